@@ -4,10 +4,17 @@ import (
 	"flag"
 	"fmt"
 	"github.com/saem/afterme/app"
+	"github.com/saem/afterme/cluster"
+	"github.com/saem/afterme/config"
+	"github.com/saem/afterme/delivery"
 	"github.com/saem/afterme/server"
+	"github.com/saem/afterme/tools"
 	"log"
+	"net/http"
 	"os"
 	"runtime"
+	"strconv"
+	"strings"
 )
 
 func main() {
@@ -18,6 +25,18 @@ func main() {
 // parameter pass to the main function was a good idea should have their head checked. Seriously, why create
 // more global state, rather than less. Now testing around main is more difficult, congrats, for what benefit?
 func notStupidMain(argv []string) {
+	// afterme <tool> [flags] runs one of the offline tools rather than the server
+	if len(argv) > 1 {
+		if tool, ok := tools.Tools[argv[1]]; ok {
+			if err := tool(argv[2:], os.Stdout); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", argv[1], err.Error())
+				os.Exit(1)
+			}
+
+			return
+		}
+	}
+
 	// Command Line Parameters/Flags
 	flags := flag.NewFlagSet(argv[0], flag.ContinueOnError)
 	var dataDir string
@@ -28,6 +47,38 @@ func notStupidMain(argv []string) {
 	flags.IntVar(&port, "port",
 		server.DefaultPort,
 		fmt.Sprintf("Sets the port, defaults to: %d", server.DefaultPort))
+	var listen string
+	flags.StringVar(&listen, "listen",
+		"",
+		"Sets the addresses HTTP is served on, a comma separated list of host:port and unix:<path>, defaults to -port's")
+	var socketMode string
+	flags.StringVar(&socketMode, "socket-mode",
+		"0660",
+		"Sets the permissions of the Unix domain sockets in -listen, in octal")
+	var h2c bool
+	flags.BoolVar(&h2c, "h2c",
+		false,
+		"Serves HTTP/2 without TLS, to clients that know to use it, as well as HTTP/1.1")
+	var tcpPort int
+	flags.IntVar(&tcpPort, "tcp-port",
+		0,
+		"Sets the port appends are taken on in the binary protocol, there's no binary protocol if it's 0")
+	var grpcPort int
+	flags.IntVar(&grpcPort, "grpc-port",
+		0,
+		"Sets the port the gRPC service is on, there's no gRPC service if it's 0")
+	var respPort int
+	flags.IntVar(&respPort, "resp-port",
+		0,
+		"Sets the port the Redis Streams front end is on, for RESP clients, there's none if it's 0")
+	var configFile string
+	flags.StringVar(&configFile, "config",
+		"",
+		"Sets the JSON config file, defaults are used for anything not in it")
+	var leader string
+	flags.StringVar(&leader, "follow",
+		"",
+		"Runs as a read only follower of the leader at this URL, like http://leader:4000")
 
 	runtime.GOMAXPROCS(runtime.NumCPU() - 1)
 
@@ -35,11 +86,67 @@ func notStupidMain(argv []string) {
 
 	logger := log.New(os.Stdout, "", log.LstdFlags)
 
-	var appServer = app.CreateAppServer(dataDir, logger)
+	var cfg = config.Default()
+	if configFile != "" {
+		var err error
+		if cfg, err = config.Load(configFile); err != nil {
+			logger.Fatalf("Could not load config: %s", err.Error())
+		}
+	}
 
-	go appServer.ProcessMessages()
+	var appServer *app.App
+	host := "localhost"
+	switch {
+	case leader != "":
+		appServer = app.CreateFollower(dataDir, strings.TrimSuffix(leader, "/"), cfg, logger)
+		go appServer.Follow(nil)
+	case cfg.Cluster.Id != "":
+		appServer = app.CreateClusterNode(dataDir, cfg, logger)
+		go appServer.ProcessMessages()
+		node, err := cluster.NewNode(cfg.Cluster.Id, cfg.Cluster.Nodes, appServer)
+		if err != nil {
+			logger.Fatalf("Could not join the cluster: %s", err.Error())
+		}
+		http.Handle("/raft/", node.Handler())
+		node.Start()
+		host = "" // The other nodes have to reach it
+	default:
+		appServer = app.CreateAppServer(dataDir, cfg, logger)
+		go appServer.ProcessMessages()
+	}
 
-	err := server.Start(fmt.Sprintf("localhost:%d", port), appServer)
+	if cfg.Retention.MaxAge != "" {
+		go appServer.Retain()
+	}
+
+	deliveries, err := delivery.Start(appServer)
+	if err != nil {
+		logger.Fatalf("Could not start delivering to webhooks and sinks: %s", err.Error())
+	}
+	admin := deliveries.Handler()
+	for _, pattern := range []string{"/admin/webhooks", "/admin/webhooks/", "/admin/sinks", "/admin/sinks/"} {
+		http.Handle(pattern, admin)
+	}
+
+	addrs := server.Addrs{HTTP: []string{fmt.Sprintf("%s:%d", host, port)}, H2C: h2c}
+	if listen != "" {
+		addrs.HTTP = strings.Split(listen, ",")
+	}
+	mode, err := strconv.ParseUint(socketMode, 8, 32)
+	if err != nil {
+		logger.Fatalf("Could not parse -socket-mode, it should be octal like 0660: %s", err.Error())
+	}
+	addrs.SocketMode = os.FileMode(mode)
+	if tcpPort != 0 {
+		addrs.TCP = fmt.Sprintf("%s:%d", host, tcpPort)
+	}
+	if grpcPort != 0 {
+		addrs.GRPC = fmt.Sprintf("%s:%d", host, grpcPort)
+	}
+	if respPort != 0 {
+		addrs.RESP = fmt.Sprintf("%s:%d", host, respPort)
+	}
+	err = server.Start(addrs, appServer)
 
 	if err != nil {
 		appServer.Logger.Fatalf("Could not start http server: %s", err.Error())
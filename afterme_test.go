@@ -1,31 +1,56 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 var appendedArgs = false
 var serverInited = false
 
-func initServer(args []string) {
+// The benchmarks share a server, served over TCP and a Unix domain socket, with h2c
+var socketPath = filepath.Join(os.TempDir(), "afterme-bench.sock")
+
+func initServer() {
 	if !serverInited {
-		go notStupidMain(args)
+		dataDir := "./test-data-dir"
+		os.RemoveAll(dataDir)
+		os.Mkdir(dataDir, 0700) // Ignore directory exist errors
+
+		go notStupidMain([]string{"afterme",
+			fmt.Sprintf("-datadir=%s", dataDir),
+			fmt.Sprintf("-listen=localhost:4001,unix:%s", socketPath),
+			"-h2c"})
 		serverInited = true
+		time.Sleep(100 * time.Millisecond) // Time to start listening
 	}
 }
 
 func BenchmarkResponseTime(b *testing.B) {
-	dataDir := "./test-data-dir"
-	args := []string{"afterme", fmt.Sprintf("-datadir=%s", dataDir), "-port=4001"}
+	benchmarkResponseTime(b, &http.Client{}, "http://localhost:4001")
+}
 
-	os.RemoveAll(dataDir)
-	os.Mkdir(dataDir, 0700) // Ignore directory exist errors
+// BenchmarkResponseTimeUnixH2C appends as co-located producers can, over a Unix domain socket, with every request
+// multiplexed on one HTTP/2 connection.
+func BenchmarkResponseTimeUnixH2C(b *testing.B) {
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+		}}}
+	benchmarkResponseTime(b, client, "http://afterme")
+}
 
-	initServer(args)
+func benchmarkResponseTime(b *testing.B, client *http.Client, url string) {
+	initServer()
 
 	payload := `[
     {
@@ -53,7 +78,6 @@ func BenchmarkResponseTime(b *testing.B) {
 ]`
 
 	successChannel := make(chan bool)
-	client := &http.Client{}
 	b.ResetTimer()
 
 	for iterations := 0; iterations < b.N; iterations++ {
@@ -62,7 +86,7 @@ func BenchmarkResponseTime(b *testing.B) {
 		failure := 0
 
 		for i := 0; i < totalRequests; i++ {
-			go post(client, payload, successChannel)
+			go post(client, url, payload, successChannel)
 		}
 
 		for success+failure < totalRequests {
@@ -75,14 +99,14 @@ func BenchmarkResponseTime(b *testing.B) {
 		}
 
 		if success != totalRequests {
-			b.Error("All requests not successful, %s/%s", success, totalRequests)
+			b.Errorf("All requests not successful, %d/%d", success, totalRequests)
 		}
 	}
 }
 
-func post(client *http.Client, payload string, successChannel chan bool) {
+func post(client *http.Client, url string, payload string, successChannel chan bool) {
 	status := false
-	resp, err := client.Post("http://localhost:4001/message", "application/json", strings.NewReader(payload))
+	resp, err := client.Post(url+"/message", "application/json", strings.NewReader(payload))
 	if err != nil {
 		fmt.Println(err.Error())
 		successChannel <- status
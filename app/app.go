@@ -1,13 +1,24 @@
 package app
 
 import (
-	"crypto/sha1"
-	"encoding/base64"
+	"crypto/ed25519"
 	"fmt"
+	"github.com/saem/afterme/config"
 	"github.com/saem/afterme/data"
-	"github.com/saem/afterme/data1"
-	"io/ioutil"
+	"github.com/saem/afterme/data2"
+	"github.com/saem/afterme/dirlock"
+	"github.com/saem/afterme/hashes"
+	"github.com/saem/afterme/hlc"
+	"github.com/saem/afterme/keystore"
+	"github.com/saem/afterme/merkle"
+	"github.com/saem/afterme/nodekey"
+	"github.com/saem/afterme/schema"
 	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -30,23 +41,69 @@ type App struct {
 	DataDir    string
 	DataWriter chan WriteRequest
 	Logger     *log.Logger
+	Config     *config.Config
+	Keys       *keystore.Store
+	Schemas    *schema.Registry   // Schemas writes to each stream are validated against
+	Key        ed25519.PrivateKey // Node key, signs tree heads
+	Leader     string             // Base URL of the leader, only set on a follower
+	lock       *dirlock.Lock      // Exclusive lock on DataDir, held for as long as the App runs
 	dataFile   data.DataFile
+	file       segmentSummary // Summary of dataFile so far
+	index      *os.File       // Time index of dataFile
+	chain      string         // Chain hash of the last message written
+	clock      *hlc.Clock     // Hybrid logical clock, timestamps messages
+	tree       *merkle.Tree   // Merkle tree over all messages written
+	treeStart  uint64         // Sequence of the tree's first leaf, accessed atomically
+	synced     uint64         // Highest sequence known to be synced, accessed atomically
+	epoch      uint64         // Writer epoch, see epoch.go, accessed atomically
+	flushes    sync.WaitGroup // Outstanding flushResponses syncs, waited on before closing a data file
+	consumers  *consumers     // Consumer offsets, see consumers.go
+	groups     *groups        // Worker groups' leases, see groups.go
+
+	manifestLock    sync.Mutex
+	followers       *followers // Followers of a leader
+	leaderCommitted uint64     // Leader's committed sequence, as last seen by a follower, accessed atomically
+	leaderErasures  string     // Leader's X-Afterme-Erasures as of the follower's last key sync
+	replica         *os.File   // Data file a follower is appending to
+	replicaVersion  data.Version
+	replicaSize     int64 // Offset just past the last message in replica
+
+	Coordinator      Coordinator      // Decides which node of a cluster takes writes, nil outside of a cluster
+	roles            chan *roleChange // Cluster role changes, carried out by ProcessMessages
+	term             uint64           // Raft term this node is leading in, zero when it's not
+	lastTerm         uint64           // Raft term of the last message in the log
+	clusterCommitted uint64           // Highest sequence a majority of the cluster has synced, accessed atomically
+
+	syncedLock    sync.Mutex
+	syncedChanged chan struct{} // Closed, and replaced, whenever synced moves forward
+
+	epochChecked bool // The epoch file's been read since the last flush, see checkEpoch
+	stale        bool // A later epoch had taken over, when it was read
+
+	holdsLock sync.Mutex
+	holds     []func() data.Sequence // Readers retention waits for, besides consumers and groups, see Hold
+
+	schemasWanted int64 // Schema versions the leader has, accessed atomically, see schemas.go
+	schemasBehind int32 // 1 while the node has fewer, accessed atomically
 }
 
 // WriteRequest is sent this to the App.DataWriter channel to request that Body is written,
 // and a notification (WriteResponse) sent via WriteRequest.Notify.
 type WriteRequest struct {
-	Body   []byte
-	Notify chan WriteResponse
-	Hash   string
+	Body       []byte
+	Attributes data2.Attributes
+	Notify     chan WriteResponse
+	Assigned   chan WriteResponse // Optional, sent the write's sequence once it's assigned one, before it's synced
+	Hash       string
 }
 
 // WriteResponse struct sent back to notify a requester of a write as to what happened.
 type WriteResponse struct {
-	Sequence data.Sequence
-	Hash     string
-	Notify   chan WriteResponse
-	Err      error
+	Sequence      data.Sequence
+	Hash          string
+	HashAlgorithm string
+	Notify        chan WriteResponse
+	Err           error
 }
 
 // WriteResponseBuffer is used to keep track of unacknowledged writes.
@@ -56,14 +113,60 @@ type WriteResponseBuffer struct {
 }
 
 // CreateAppServer creates a properly initialized App instance.
-func CreateAppServer(dataDir string, logger *log.Logger) (appServer *App) {
+func CreateAppServer(dataDir string, config *config.Config, logger *log.Logger) (appServer *App) {
+	appServer = newApp(dataDir, "", config, logger)
+	appServer.summarizeSegments()
+	appServer.takeOver()
+	appServer.createFile()
+
+	return appServer
+}
+
+// newApp does the set up common to leaders and followers, everything except catching up on the data files left by
+// the last run, and opening a data file to write to.
+func newApp(dataDir string, leader string, config *config.Config, logger *log.Logger) (appServer *App) {
 	appServer = new(App)
-	appServer.Sequence = findLatestSequence(dataDir, logger)
-	appServer.Version = 1
+	var err error
+	// Nothing else can be writing to the data dir, or the sequences worked out here would be wrong
+	if appServer.lock, err = dirlock.Exclusive(dataDir); err != nil {
+		logger.Fatalf("Could not start: %s", err.Error())
+	}
+	if !appServer.lock.Locked() {
+		logger.Printf("There's no flock here, so %s isn't locked, nothing stops a second afterme using it", dataDir)
+	}
+
+	var last *data2.Message
+	appServer.Sequence, last = findLatest(dataDir, logger)
+	appServer.clock = hlc.NewClock(hlc.Timestamp{})
+	if last != nil {
+		appServer.chain = last.Attributes[data2.AttrChain]
+		appServer.clock = hlc.NewClock(lastClock(*last))
+		appServer.lastTerm = MessageTerm(*last)
+		appServer.epoch = MessageEpoch(*last)
+	}
+	appServer.Version = 2
 	appServer.DataDir = dataDir
 	appServer.DataWriter = make(chan WriteRequest, MaxWriteBufferSize)
 	appServer.Logger = logger
-	appServer.createFile()
+	appServer.Config = config
+	appServer.Leader = leader
+	appServer.followers = newFollowers()
+	appServer.Keys = keystore.New(filepath.Join(dataDir, "keys"))
+	appServer.Schemas = schema.New(filepath.Join(dataDir, "schemas"))
+	appServer.synced = uint64(appServer.Sequence - 1)
+
+	appServer.Key, err = nodekey.LoadOrCreate(dataDir)
+	if err != nil {
+		logger.Fatalf("Could not load the node key from %s, because: %s", dataDir, err.Error())
+	}
+	if appServer.consumers, err = loadConsumers(dataDir); err != nil {
+		logger.Fatalf("Could not load the consumer offsets from %s, because: %s", dataDir, err.Error())
+	}
+	if appServer.groups, err = loadGroups(dataDir); err != nil {
+		logger.Fatalf("Could not load the worker groups' leases from %s, because: %s", dataDir, err.Error())
+	}
+
+	appServer.openTree()
 
 	return appServer
 }
@@ -72,13 +175,14 @@ func CreateAppServer(dataDir string, logger *log.Logger) (appServer *App) {
 // This should probably be put into the data1 package.
 func (app *App) createFile() {
 	if app.dataFile != nil {
-		err := app.dataFile.Close()
-		if err != nil {
-			fmt.Print("butts")
-		}
+		app.closeFile()
 	}
 
-	app.dataFile = data1.NewDataFile(app.Sequence, app.DataDir)
+	app.dataFile = data2.NewDataFile(app.Sequence, app.DataDir)
+	app.file = segmentSummary{Name: app.dataFile.Name(), First: app.Sequence, Next: app.Sequence}
+
+	// A restart right after a rotation leaves an empty file with the name we want, it's safe to reuse
+	removeIfEmpty(filepath.Join(app.DataDir, app.dataFile.Name()))
 
 	err := app.dataFile.CreateForWrite()
 	if err != nil {
@@ -87,26 +191,88 @@ func (app *App) createFile() {
 			app.dataFile.Name(),
 			err.Error())
 	}
+
+	app.index, err = createIndex(app.DataDir, app.dataFile.Name())
+	if err != nil {
+		app.Logger.Fatalf("Could not open the time index for %s/%s, because: %s",
+			app.DataDir,
+			app.dataFile.Name(),
+			err.Error())
+	}
+}
+
+// closeFile closes the file being written to, it's sealed and added to the manifest in the background.
+func (app *App) closeFile() {
+	// Outstanding syncs need to finish before the file goes away from under them
+	app.flushes.Wait()
+	err := app.dataFile.Close()
+	if err != nil {
+		app.Logger.Printf("Could not close file, %s/%s, because: %s",
+			app.DataDir,
+			app.dataFile.Name(),
+			err.Error())
+	}
+	app.index.Close()
+	app.syncTree()
+	if app.dataFile.BytesWritten() > 0 {
+		// Digesting the whole file takes a while, there's no need to hold up writes for it
+		go app.finishFile(app.file)
+	}
 }
 
 // RequestWrite lines up a piece of data to be written to the data log,
-// data not ending in a '\n' will have one added.
-func (app *App) RequestWrite(body []byte) (notifier chan WriteResponse) {
-	notifier = make(chan WriteResponse)
+// data not ending in a '\n' will have one added. Attributes are recorded in the message header, if they name a
+// subject (data2.AttrSubject) the body is sealed with the subject's data key before it's written. The body is
+// hashed with the algorithm configured for the stream (data2.AttrStream) it's written to.
+func (app *App) RequestWrite(body []byte, attributes data2.Attributes) (notifier chan WriteResponse) {
+	_, notifier = app.requestWrite(body, attributes, false)
+	return notifier
+}
+
+// RequestWriteAssigned is RequestWrite for writers that pipeline, assigned is sent the write's sequence as soon as
+// it's been assigned one, before it's synced, then notifier is sent the WriteResponse as usual. Nothing is sent to
+// assigned if the write fails before it's assigned a sequence.
+func (app *App) RequestWriteAssigned(body []byte, attributes data2.Attributes) (assigned, notifier chan WriteResponse) {
+	return app.requestWrite(body, attributes, true)
+}
+
+func (app *App) requestWrite(body []byte, attributes data2.Attributes,
+	pipelined bool) (assigned, notifier chan WriteResponse) {
+	notifier = make(chan WriteResponse, 1)
+	if pipelined {
+		assigned = make(chan WriteResponse, 1)
+	}
 
 	// We add a new line to body to ensure that the next header cleanly starts on the new line
 	if body[len(body)-1] != '\n' {
 		body = append(body, '\n')
 	}
+	attributes = attributes.Copy()
 
-	h := sha1.New()
-	h.Write(body)
-	hash := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	if subject, ok := attributes[data2.AttrSubject]; ok {
+		keyId, sealed, err := app.Keys.Seal(subject, body)
+		if err != nil {
+			notifier <- WriteResponse{Notify: notifier, Err: err}
+			return assigned, notifier
+		}
 
-	request := WriteRequest{Body: body, Notify: notifier, Hash: hash}
+		attributes[data2.AttrKey] = keyId
+		attributes[data2.AttrCipher] = keystore.Cipher
+		body = sealed
+	}
+
+	algorithm := app.Config.Stream(attributes[data2.AttrStream]).Hash
+	hash, err := hashes.Sum(algorithm, body)
+	if err != nil {
+		notifier <- WriteResponse{Notify: notifier, Err: err}
+		return assigned, notifier
+	}
+	attributes[data2.AttrHash] = algorithm
+
+	request := WriteRequest{Body: body, Attributes: attributes, Notify: notifier, Assigned: assigned, Hash: hash}
 
 	app.DataWriter <- request
-	return notifier
+	return assigned, notifier
 }
 
 // ProcessMessages is a single writer that completes all WriteRequests, flushing them, and notifying of commits
@@ -114,22 +280,46 @@ func (app *App) ProcessMessages() {
 	writeCoalesceTimeout := time.Tick(WriteCoalescingTimeout)
 	writeResponses := createResponseBuffer()
 	for {
-		if app.dataFile.BytesWritten() >= MaxBytesPerFile {
+		if app.dataFile != nil && app.dataFile.BytesWritten() >= MaxBytesPerFile {
 			app.flushResponses(writeResponses)
 			app.createFile()
 		}
 
 		select {
 		case writeRequest := <-app.DataWriter:
-			message := data1.Message{Sequence: app.Sequence,
-				TimeStamp:   time.Now().Unix(),
+			if app.dataFile == nil {
+				// A cluster node that isn't the leader
+				writeRequest.Notify <- WriteResponse{Notify: writeRequest.Notify, Err: ErrNotLeader}
+				continue
+			}
+			if err := app.checkEpoch(); err != nil {
+				writeRequest.Notify <- WriteResponse{Notify: writeRequest.Notify, Err: err}
+				continue
+			}
+
+			now := time.Now()
+			message := data2.Message{Sequence: app.Sequence,
+				TimeStamp:   now.Unix(),
 				MessageSize: uint32(len(writeRequest.Body)),
 				Hash:        writeRequest.Hash,
+				Attributes:  writeRequest.Attributes.Copy(),
 				Body:        writeRequest.Body}
+			message.Attributes[data2.AttrTime] = strconv.FormatInt(now.UnixNano(), 10)
+			message.Attributes[data2.AttrZone] = now.Format("-07:00")
+			message.Attributes[data2.AttrClock] = app.clock.Tick(now.UnixNano()).String()
+			message.Attributes[data2.AttrEpoch] = strconv.FormatUint(app.Epoch(), 10)
+			if app.term != 0 {
+				message.Attributes[data2.AttrTerm] = strconv.FormatUint(app.term, 10)
+			}
 
 			var writeResponse WriteResponse
 
-			err := app.dataFile.Write(message)
+			offset := int64(app.dataFile.BytesWritten())
+			chain, err := data2.ChainHash(app.chain, message)
+			if err == nil {
+				message.Attributes[data2.AttrChain] = chain
+				err = app.dataFile.Write(&message)
+			}
 
 			if err != nil {
 				writeResponse = WriteResponse{Sequence: message.Sequence,
@@ -140,24 +330,58 @@ func (app *App) ProcessMessages() {
 			} else {
 				// The last thing we do is append, effectively marking the end of the transaction
 				writeResponse = WriteResponse{Sequence: message.Sequence,
-					Hash:   writeRequest.Hash,
-					Notify: writeRequest.Notify,
-					Err:    nil}
+					Hash:          writeRequest.Hash,
+					HashAlgorithm: message.Attributes[data2.AttrHash],
+					Notify:        writeRequest.Notify,
+					Err:           nil}
 
+				if writeRequest.Assigned != nil {
+					writeRequest.Assigned <- writeResponse
+				}
 				err = writeResponses.buffer(writeResponse)
 				if err != nil {
 					app.flushResponses(writeResponses)
 				}
 
 				app.Sequence++
+				app.chain = chain
+				app.lastTerm = app.term
+				app.addLeaf(message)
+				app.indexMessage(message, offset)
 			}
 
+		case change := <-app.roles:
+			app.flushResponses(writeResponses)
+			app.changeRole(change)
+
 		case <-writeCoalesceTimeout:
 			app.flushResponses(writeResponses)
 		}
 	}
+}
 
-	app.dataFile.Close()
+// indexMessage keeps the summary of the data file up to date, and adds every TimeIndexInterval-th message to its
+// time index. It's only a shortcut, so failing to write to the index isn't fatal.
+func (app *App) indexMessage(message data2.Message, offset int64) {
+	t := data2.MessageTime(message)
+	if app.file.Next == app.file.First {
+		app.file.MinTime = t
+	}
+	if t > app.file.MaxTime {
+		app.file.MaxTime = t
+	}
+	app.file.Next = message.Sequence + 1
+	app.file.Chain = message.Attributes[data2.AttrChain]
+
+	if app.index != nil && (message.Sequence-app.file.First)%TimeIndexInterval == 0 {
+		entry := data2.IndexEntry{Time: t, Sequence: message.Sequence, Offset: offset}
+		if err := data2.WriteIndexEntry(app.index, entry); err != nil {
+			app.Logger.Printf("Could not add to the time index for %s/%s, because: %s",
+				app.DataDir,
+				app.file.Name,
+				err.Error())
+		}
+	}
 }
 
 // createResponseBuffer creates a properly initialized buffer, based on config parameters
@@ -183,17 +407,22 @@ func (buf *WriteResponseBuffer) buffer(res WriteResponse) (err error) {
 
 // flushResponses syncs and informs all pending requests that their data is "safe", completing WriteResponses
 func (app *App) flushResponses(writeResponses *WriteResponseBuffer) {
+	app.epochChecked = false
 	if writeResponses.outstanding > 0 {
 		oldResponses := createResponseBuffer()
 		oldResponses.outstanding = writeResponses.outstanding
 		copy(oldResponses.buf, writeResponses.buf)
 		writeResponses.outstanding = 0
 
+		dataFile := app.dataFile
+		app.flushes.Add(1)
 		go func() {
-			err := app.dataFile.Sync()
+			defer app.flushes.Done()
+			err := dataFile.Sync()
 			if err != nil {
 				app.Logger.Fatalf("butts, it broke on sync: %s", err.Error())
 			}
+			app.markSynced(oldResponses.buf[oldResponses.outstanding-1].Sequence)
 			for i := uint32(0); i < oldResponses.outstanding; i++ {
 				safeNotify(oldResponses.buf[i])
 			}
@@ -208,70 +437,108 @@ func safeNotify(wr WriteResponse) {
 	wr.Notify <- wr
 }
 
-func findLatestSequence(dataDir string, logger *log.Logger) (sequence data.Sequence) {
-	sequence = data.Sequence(1)
-	latestFile, err := findLatestFile(dataDir)
-
-	if err == nil && latestFile != nil {
-		scanner, err := latestFile.OpenForRead()
-		if err != nil {
-			logger.Fatalf("Could not open file, %s/%s, for reading. because: %s",
-				dataDir,
-				latestFile.Name(),
-				err.Error())
+// markSynced records that everything up to and including sequence has been synced, flushes can finish out of
+// order so synced only ever moves forward.
+func (app *App) markSynced(sequence data.Sequence) {
+	for {
+		current := atomic.LoadUint64(&app.synced)
+		if uint64(sequence) <= current {
+			return
 		}
-		defer latestFile.Close()
-
-		for i := 0; scanner.Scan(); i++ {
-			// Every odd row is a header
-			if i%2 == 0 {
-				sequence = data1.MessageFromHeader(scanner.Text()).Sequence
-			}
+		if atomic.CompareAndSwapUint64(&app.synced, current, uint64(sequence)) {
+			break
 		}
-		sequence++
 	}
 
-	return
+	app.syncedLock.Lock()
+	defer app.syncedLock.Unlock()
+	if app.syncedChanged != nil {
+		close(app.syncedChanged)
+		app.syncedChanged = nil
+	}
+}
+
+// SyncedChanged is closed the next time Synced moves forward.
+func (app *App) SyncedChanged() <-chan struct{} {
+	app.syncedLock.Lock()
+	defer app.syncedLock.Unlock()
+	if app.syncedChanged == nil {
+		app.syncedChanged = make(chan struct{})
+	}
+
+	return app.syncedChanged
 }
 
-// Log file management/anti-corruption layer between versioned file handling
+// Synced is the highest sequence that's been synced to this node's disk.
+func (app *App) Synced() data.Sequence {
+	return data.Sequence(atomic.LoadUint64(&app.synced))
+}
 
-func findLatestFile(dataDir string) (df data.DataFile, err error) {
-	fileInfos, err := ioutil.ReadDir(dataDir)
-	if err != nil || len(fileInfos) == 0 {
-		return nil, err
+// Committed is the highest sequence that's committed, everything up to and including it is safe to read. That's
+// everything synced, or in a cluster, everything a majority of the nodes have synced.
+func (app *App) Committed() data.Sequence {
+	synced := app.Synced()
+	if app.Coordinator == nil {
+		return synced
+	}
+	if committed := data.Sequence(atomic.LoadUint64(&app.clusterCommitted)); committed < synced {
+		return committed
 	}
-	var sequence data.Sequence = 0
-	var version data.Version = data.Version(0)
 
-	// Look for data files <version>-<sequence>.log, maybe others in the future, version must be first
-	for _, fileInfo := range fileInfos {
-		if fileInfo.IsDir() {
-			continue
-		}
+	return synced
+}
 
-		switch {
-		case data1.LogFileValidateName(fileInfo.Name()):
-			var fileStartingSequence data.Sequence
-			version, fileStartingSequence, err = data1.LogFileNameParser(fileInfo.Name())
+// findLatest works out the next sequence to write, one more than the last message in the latest data file, or the
+// file's starting sequence if it's empty, along with the last message written, if there is one.
+func findLatest(dataDir string, logger *log.Logger) (sequence data.Sequence, last *data2.Message) {
+	sequence = data.Sequence(1)
+	segments, err := ListSegments(dataDir)
+	if err != nil || len(segments) == 0 {
+		return sequence, nil
+	}
 
-			// This shouldn't be possible because we've validated the file name -- famous last words
-			if err != nil {
-				return nil, err
-			}
+	latest := len(segments) - 1
+	sequence = segments[latest].StartingSequence
 
-			if fileStartingSequence > sequence {
-				sequence = fileStartingSequence
+	// Empty files are left behind by restarts, the last message could be a few files back
+	for i := latest; i >= 0; i-- {
+		err = ReadSegment(dataDir, segments[i], 0, func(message data2.Message) error {
+			last = &message
+			return nil
+		})
+		if err != nil {
+			logger.Fatalf("Could not read file, %s/%s, because: %s",
+				dataDir,
+				segments[i].Name,
+				err.Error())
+		}
+
+		if last != nil {
+			if i == latest {
+				sequence = last.Sequence + 1
 			}
-		default:
-			continue
+			return sequence, last
 		}
 	}
 
-	switch {
-	case version == data.Version(1):
-		return data1.NewDataFile(sequence, dataDir), nil
+	return sequence, nil
+}
+
+// lastClock is the hybrid logical clock reading for the last message written, messages from before there was a
+// clock fall back to their timestamp, so the clock at least starts after them.
+func lastClock(last data2.Message) (t hlc.Timestamp) {
+	t, err := hlc.Parse(last.Attributes[data2.AttrClock])
+	if err != nil {
+		t = hlc.Timestamp{Wall: last.TimeStamp * int64(time.Second)}
 	}
 
-	return nil, data.DataFileError{Name: "", Code: data.NO_FILES_FOUND}
+	return t
+}
+
+// removeIfEmpty removes the file at path if it exists and is empty.
+func removeIfEmpty(path string) {
+	fileInfo, err := os.Stat(path)
+	if err == nil && fileInfo.Size() == 0 {
+		os.Remove(path)
+	}
 }
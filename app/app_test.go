@@ -0,0 +1,488 @@
+package app
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"github.com/saem/afterme/config"
+	"github.com/saem/afterme/data"
+	"github.com/saem/afterme/data2"
+	"github.com/saem/afterme/merkle"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testApp starts an App on dir, it gives up its lock on dir at the end of the test, or when it's restarted.
+func testApp(t *testing.T, dir string, c *config.Config) *App {
+	if c == nil {
+		c = config.Default()
+	}
+	a := CreateAppServer(dir, c, log.New(ioutil.Discard, "", 0))
+	go a.ProcessMessages()
+	t.Cleanup(func() { a.lock.Release() })
+
+	return a
+}
+
+// restart starts a new App on the same data dir, as if the server had stopped and started again.
+func restart(t *testing.T, a *App) *App {
+	a.lock.Release()
+
+	return testApp(t, a.DataDir, a.Config)
+}
+
+// write writes a message and waits for it to be synced.
+func write(t *testing.T, a *App, body string, attributes data2.Attributes) data.Sequence {
+	t.Helper()
+	response := <-a.RequestWrite([]byte(body), attributes)
+	if response.Err != nil {
+		t.Fatal(response.Err)
+	}
+
+	return response.Sequence
+}
+
+// messages reads the whole log.
+func messages(t *testing.T, dir string) (read []data2.Message) {
+	t.Helper()
+	err := ReadLog(dir, 0, func(m data2.Message) error {
+		read = append(read, m)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return read
+}
+
+func TestSealing(t *testing.T) {
+	a := testApp(t, t.TempDir(), nil)
+	for _, body := range []string{"a", "b", "c"} {
+		write(t, a, body, nil)
+	}
+
+	// The file left by the last run is sealed, and added to the manifest, on start up
+	a = restart(t, a)
+	seal, err := data2.ReadSeal(a.DataDir, "2-1.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := messages(t, a.DataDir)
+	if seal.First != 1 || seal.Last != 3 || seal.Count != 3 || seal.Chain != written[2].Attributes[data2.AttrChain] {
+		t.Fatalf("Expected the seal to cover messages 1 to 3, got %+v", seal)
+	}
+	if !seal.Verify(a.Key.Public().(ed25519.PublicKey)) {
+		t.Fatal("Expected the seal to be signed with the node key")
+	}
+	if digest, _ := data2.FileDigest(a.DataDir, "2-1.log"); digest != seal.Digest {
+		t.Fatalf("Expected the seal's digest to be the file's, %s, got %s", digest, seal.Digest)
+	}
+	root, _ := a.segmentRoot(1, 4)
+	if seal.Merkle != base64.StdEncoding.EncodeToString(root) {
+		t.Fatal("Expected the seal's Merkle root to be that of its messages")
+	}
+	manifest, _ := ReadManifest(a.DataDir)
+	if entry, ok := manifest.Entry("2-1.log"); !ok || entry.First != 1 || entry.Last != 3 || entry.Count != 3 {
+		t.Fatalf("Expected 2-1.log in the manifest, got %+v", manifest)
+	}
+
+	// The chain carries on across data files
+	write(t, a, "d", nil)
+	written = messages(t, a.DataDir)
+	chain, _ := data2.ChainHash(written[2].Attributes[data2.AttrChain], written[3])
+	if len(written) != 4 || written[3].Attributes[data2.AttrChain] != chain {
+		t.Fatalf("Expected message 4 to be chained to message 3, got %+v", written)
+	}
+}
+
+func TestTreeOnDisk(t *testing.T) {
+	a := testApp(t, t.TempDir(), nil)
+	for _, body := range []string{"a", "b", "c", "d", "e"} {
+		write(t, a, body, nil)
+	}
+	before, err := a.TreeHead(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The tree's on disk, it's picked up rather than built again, and carries on with the next message
+	a = restart(t, a)
+	if a.TreeStart() != 1 || a.TreeSize() != 5 {
+		t.Fatalf("Expected the tree to start at 1 with 5 leaves, got %d and %d", a.TreeStart(), a.TreeSize())
+	}
+	after, _ := a.TreeHead(5)
+	if !bytes.Equal(before.Root, after.Root) {
+		t.Fatal("Expected the same root after a restart")
+	}
+	sequence := write(t, a, "f", nil)
+	if index, _ := a.LeafIndex(sequence); index != 5 {
+		t.Fatalf("Expected message 6 to be leaf 5, got %d", index)
+	}
+
+	// Leaves past the end of the log, that beat their messages to disk before a crash, are cut off
+	if err = a.tree.Append(merkle.LeafHash([]byte("lost"))); err != nil {
+		t.Fatal(err)
+	}
+	a = restart(t, a)
+	if a.tree.Size() != 6 {
+		t.Fatalf("Expected 6 leaves, got %d", a.tree.Size())
+	}
+	after, _ = a.TreeHead(5)
+	if !bytes.Equal(before.Root, after.Root) {
+		t.Fatal("Expected the same root after a restart")
+	}
+
+	// Without it the tree is built from the log
+	os.RemoveAll(filepath.Join(a.DataDir, TreeDirName))
+	a = restart(t, a)
+	if after, _ = a.TreeHead(5); a.TreeSize() != 6 || !bytes.Equal(before.Root, after.Root) {
+		t.Fatal("Expected the tree built from the log to be the same")
+	}
+}
+
+// writeMany writes n messages, waiting for all of them at once rather than for each in turn.
+func writeMany(t *testing.T, a *App, n int) {
+	t.Helper()
+	var notifiers []chan WriteResponse
+	for i := 0; i < n; i++ {
+		notifiers = append(notifiers, a.RequestWrite([]byte(fmt.Sprintf("message %d", i)), nil))
+	}
+	for _, notifier := range notifiers {
+		if response := <-notifier; response.Err != nil {
+			t.Fatal(response.Err)
+		}
+	}
+}
+
+func TestTimeIndex(t *testing.T) {
+	a := testApp(t, t.TempDir(), nil)
+	writeMany(t, a, 2100)
+	a = restart(t, a)
+	writeMany(t, a, 1100)
+
+	written := messages(t, a.DataDir)
+	manifest, _ := ReadManifest(a.DataDir)
+	entry, ok := manifest.Entry("2-1.log")
+	if !ok || entry.First != 1 || entry.Last != 2100 || entry.MinTime != data2.MessageTime(written[0]) ||
+		entry.MaxTime != data2.MessageTime(written[2099]) {
+		t.Fatalf("Expected a manifest entry for 2-1.log covering its messages, got %+v", manifest)
+	}
+	if _, ok = manifest.Entry("2-2101.log"); ok {
+		t.Fatal("Expected the file being written to not to be in the manifest")
+	}
+
+	// Every TimeIndexInterval-th message is indexed, in the file being written to as well
+	for _, segment := range []Segment{{Version: 2, StartingSequence: 1, Name: "2-1.log"},
+		{Version: 2, StartingSequence: 2101, Name: "2-2101.log"}} {
+		entries, err := data2.ReadIndex(a.DataDir, segment.Name)
+		if err != nil || len(entries) < 2 {
+			t.Fatalf("Expected %s to be indexed, got %+v, %v", segment.Name, entries, err)
+		}
+		for i, entry := range entries {
+			expected := segment.StartingSequence + data.Sequence(i*TimeIndexInterval)
+			m := written[expected-1]
+			if entry.Sequence != expected || entry.Time != data2.MessageTime(m) {
+				t.Fatalf("Expected index entry %d of %s to be message %d, got %+v", i, segment.Name, expected, entry)
+			}
+			readSegment(a.DataDir, segment, entry.Offset, func(at data2.Message, offset int64) error {
+				if at.Sequence != expected {
+					t.Fatalf("Expected message %d at offset %d of %s, got %d", expected, entry.Offset, segment.Name,
+						at.Sequence)
+				}
+				return ErrStopReading
+			})
+		}
+	}
+
+	// Finding messages by time agrees with looking through every message
+	atTime := func(at int64) data.Sequence {
+		for _, m := range written {
+			if data2.MessageTime(m) >= at {
+				return m.Sequence
+			}
+		}
+		return data.Sequence(len(written) + 1)
+	}
+	for _, i := range []int{0, 1, 999, 1000, 1001, 2099, 2100, 2101, 3100, 3199} {
+		for _, at := range []int64{data2.MessageTime(written[i]) - 1, data2.MessageTime(written[i]),
+			data2.MessageTime(written[i]) + 1} {
+			sequence, err := SequenceAtTime(a.DataDir, at)
+			if err != nil || sequence != atTime(at) {
+				t.Fatalf("Expected message %d to be the first at %d, got %d, %v", atTime(at), at, sequence, err)
+			}
+		}
+	}
+
+	since := time.Unix(0, data2.MessageTime(written[1500])).Format(time.RFC3339Nano)
+	until := time.Unix(0, data2.MessageTime(written[2500])).Format(time.RFC3339Nano)
+	from, to, err := TimeRange(a.DataDir, 1, 5000, since, until)
+	if err != nil || from != atTime(data2.MessageTime(written[1500])) ||
+		to != atTime(data2.MessageTime(written[2500]))-1 {
+		t.Fatalf("Expected since and until to narrow the range, got %d to %d, %v", from, to, err)
+	}
+	if from, to, _ = TimeRange(a.DataDir, 1700, 1800, since, until); from != 1700 || to != 1800 {
+		t.Fatalf("Expected a range already inside since and until to be left alone, got %d to %d", from, to)
+	}
+	if _, _, err = TimeRange(a.DataDir, 1, 5000, "yesterday", ""); err == nil {
+		t.Fatal("Expected since that isn't an RFC3339 time to be an error")
+	}
+}
+
+func TestStaleEpoch(t *testing.T) {
+	a := testApp(t, t.TempDir(), nil)
+	write(t, a, "a", nil)
+	if epoch, _ := ReadEpoch(a.DataDir); epoch != a.Epoch() || epoch == 0 {
+		t.Fatalf("Expected the epoch file to have the App's epoch, %d, got %d", a.Epoch(), epoch)
+	}
+
+	// Another writer takes over, the next batch of writes is turned away
+	ioutil.WriteFile(filepath.Join(a.DataDir, EpochFileName), []byte(fmt.Sprintf("%d\n", a.Epoch()+1)), 0644)
+	if response := <-a.RequestWrite([]byte("b"), nil); response.Err != ErrStaleEpoch {
+		t.Fatalf("Expected %v, got %v", ErrStaleEpoch, response.Err)
+	}
+	if written := messages(t, a.DataDir); len(written) != 1 || MessageEpoch(written[0]) != a.Epoch() {
+		t.Fatalf("Expected only the first message, in the App's epoch, got %+v", written)
+	}
+
+	// Starting again takes over from the later epoch
+	epoch := a.Epoch()
+	a = restart(t, a)
+	if a.Epoch() != epoch+2 {
+		t.Fatalf("Expected epoch %d, got %d", epoch+2, a.Epoch())
+	}
+	write(t, a, "c", nil)
+}
+
+func TestReadSeeks(t *testing.T) {
+	a := testApp(t, t.TempDir(), nil)
+	writeMany(t, a, 2500)
+
+	// Reading from part way through starts at the time index entry before it, so the start of the data file isn't
+	// read at all, even when it can't be
+	path := filepath.Join(a.DataDir, "2-1.log")
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := data2.ReadIndex(a.DataDir, "2-1.log")
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 time index entries, got %+v", entries)
+	}
+	corrupt := append([]byte("x"), contents[1:]...)
+	if err = ioutil.WriteFile(path, corrupt, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var read []data.Sequence
+	err = ReadLog(a.DataDir, 2100, func(m data2.Message) error {
+		read = append(read, m.Sequence)
+		return nil
+	})
+	if err != nil || len(read) != 401 || read[0] != 2100 || read[400] != 2500 {
+		t.Fatalf("Expected messages 2100 to 2500, got %d from %v, %v", len(read), read[:1], err)
+	}
+	if err = ReadLog(a.DataDir, 5, func(m data2.Message) error { return nil }); err == nil {
+		t.Fatal("Expected reading the corrupt start of the data file to fail")
+	}
+
+	// An index that's out of date is passed over
+	ioutil.WriteFile(path, contents, 0644)
+	index := fmt.Sprintf("%d 1 0\n%d 2001 %d\n", entries[0].Time, entries[2].Time, entries[1].Offset)
+	ioutil.WriteFile(filepath.Join(a.DataDir, data2.IndexFileName("2-1.log")), []byte(index), 0644)
+	read = nil
+	err = ReadLog(a.DataDir, 2400, func(m data2.Message) error {
+		read = append(read, m.Sequence)
+		return nil
+	})
+	if err != nil || len(read) != 101 || read[0] != 2400 {
+		t.Fatalf("Expected messages 2400 to 2500, got %d, %v", len(read), err)
+	}
+}
+
+func TestReadLogBackwards(t *testing.T) {
+	a := testApp(t, t.TempDir(), nil)
+	writeMany(t, a, 10)
+	a = restart(t, a)
+	writeMany(t, a, 10)
+
+	read := func(from data.Sequence, to data.Sequence, count int) (read []data.Sequence, err error) {
+		err = ReadLogBackwards(a.DataDir, from, to, func(m data2.Message) bool { return m.Sequence%2 == 0 },
+			func(m data2.Message) error {
+				read = append(read, m.Sequence)
+				if len(read) == count {
+					return ErrStopReading
+				}
+				return nil
+			})
+		return read, err
+	}
+	for _, test := range []struct {
+		from, to data.Sequence
+		count    int
+		expected string
+	}{
+		{1, 20, -1, "[20 18 16 14 12 10 8 6 4 2]"},
+		{3, 13, -1, "[12 10 8 6 4]"},
+		{1, 100, 3, "[20 18 16]"},
+		{9, 12, 2, "[12 10]"},
+		{12, 11, -1, "[]"},
+	} {
+		if sequences, err := read(test.from, test.to, test.count); err != nil || fmt.Sprint(sequences) != test.expected {
+			t.Fatalf("Expected %s reading back from %d to %d, got %v, %v", test.expected, test.to, test.from,
+				sequences, err)
+		}
+	}
+
+	// The last messages are read without reading the data files before them
+	path := filepath.Join(a.DataDir, "2-1.log")
+	contents, _ := ioutil.ReadFile(path)
+	if err := ioutil.WriteFile(path, append([]byte("x"), contents[1:]...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if sequences, err := read(1, 20, 5); err != nil || fmt.Sprint(sequences) != "[20 18 16 14 12]" {
+		t.Fatalf("Expected the last 5 even messages, got %v, %v", sequences, err)
+	}
+	if _, err := read(1, 20, -1); err == nil {
+		t.Fatal("Expected reading the corrupt data file to fail")
+	}
+}
+
+func TestRetention(t *testing.T) {
+	c := config.Default()
+	c.Retention = config.RetentionConfig{MaxAge: "1h", KeepForConsumers: true}
+	a := testApp(t, t.TempDir(), c)
+	for _, body := range []string{"a", "b", "c"} {
+		write(t, a, body, nil)
+	}
+	a = restart(t, a)
+	write(t, a, "d", nil)
+	a = restart(t, a)
+	write(t, a, "e", nil)
+	before, _ := a.TreeHead(5)
+	later := time.Now().Add(2 * time.Hour)
+
+	// A consumer, and anything else that's held, keeps the data files it hasn't got to
+	if _, err := a.CommitOffset("reader", "", 3); err != nil {
+		t.Fatal(err)
+	}
+	held := data.Sequence(0)
+	a.Hold(func() data.Sequence { return held })
+	if deleted := a.applyRetention(later); deleted != 0 {
+		t.Fatalf("Expected nothing to be deleted while held at 0, %d were", deleted)
+	}
+	held = 3
+	if deleted := a.applyRetention(later); deleted != 1 {
+		t.Fatalf("Expected 2-1.log to be deleted, %d were", deleted)
+	}
+	if _, err := os.Stat(filepath.Join(a.DataDir, "2-1.log")); !os.IsNotExist(err) {
+		t.Fatal("Expected 2-1.log to be gone")
+	}
+	if written := messages(t, a.DataDir); len(written) != 2 || written[0].Sequence != 4 {
+		t.Fatalf("Expected messages 4 and 5 to be left, got %+v", written)
+	}
+	manifest, _ := ReadManifest(a.DataDir)
+	if _, ok := manifest.Entry("2-1.log"); ok {
+		t.Fatal("Expected 2-1.log to be gone from the manifest")
+	}
+
+	// Without keep_for_consumers only age counts, and the file still being written to is never deleted
+	c.Retention.KeepForConsumers = false
+	if deleted := a.applyRetention(later); deleted != 1 {
+		t.Fatalf("Expected 2-4.log to be deleted, %d were", deleted)
+	}
+	if deleted := a.applyRetention(time.Now()); deleted != 0 {
+		t.Fatalf("Expected nothing new enough to be deleted, %d were", deleted)
+	}
+
+	// The tree keeps the deleted messages' leaves, so its heads are the same after a restart
+	a = restart(t, a)
+	if a.TreeStart() != 1 || a.TreeSize() != 5 {
+		t.Fatalf("Expected the tree to start at 1 with 5 leaves, got %d and %d", a.TreeStart(), a.TreeSize())
+	}
+	if offset, found := a.Consumer("reader"); !found || offset.Offset != 3 {
+		t.Fatalf("Expected the consumer's offset to be kept, got %+v", offset)
+	}
+	if after, err := a.TreeHead(5); err != nil || !bytes.Equal(before.Root, after.Root) {
+		t.Fatalf("Expected the same root after retention and a restart, %v", err)
+	}
+	if _, err := a.InclusionProof(1, 5); err != nil {
+		t.Fatalf("Expected a deleted message to still be provable, got %v", err)
+	}
+}
+
+func TestLeases(t *testing.T) {
+	a := testApp(t, t.TempDir(), nil)
+	for _, body := range []string{"a", "b", "c", "d"} {
+		write(t, a, body, nil)
+	}
+
+	leased, err := a.Lease("workers", "", "w1", 2, time.Hour)
+	if err != nil || len(leased) != 2 || leased[0].Sequence != 1 || leased[1].Sequence != 2 {
+		t.Fatalf("Expected messages 1 and 2 to be leased, got %+v, %v", leased, err)
+	}
+	if _, err = a.Lease("workers", "", "w2", 1, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Ack("workers", "w1", []data.Sequence{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// In-flight leases, and where the group's got to, are kept across a restart
+	a = restart(t, a)
+	status, found := a.Group("workers")
+	if !found || status.Next != 4 || status.Leased != 2 || status.Done != 1 {
+		t.Fatalf("Expected 2 and 3 to still be leased, got %+v", status)
+	}
+	if status.Leases[0].Worker != "w1" || status.Leases[1].Worker != "w2" || status.Expired != 1 {
+		t.Fatalf("Expected 2 leased to w1 and 3's lease to have run out, got %+v", status.Leases)
+	}
+	if err = a.Ack("workers", "w2", []data.Sequence{2}); err != ErrNotLeased {
+		t.Fatalf("Expected %v acking another worker's lease, got %v", ErrNotLeased, err)
+	}
+	if a.groups.live != 3 {
+		t.Fatalf("Expected 3 live records, a group and two leases, got %d", a.groups.live)
+	}
+
+	// The lease that ran out is leased again first
+	leased, err = a.Lease("workers", "", "w3", 2, time.Hour)
+	if err != nil || len(leased) != 2 || leased[0].Sequence != 3 || leased[1].Sequence != 4 {
+		t.Fatalf("Expected messages 3 and 4 to be leased, got %+v, %v", leased, err)
+	}
+	if leased[0].Attributes[data2.AttrDeliveries] != "2" || leased[1].Attributes[data2.AttrDeliveries] != "1" {
+		t.Fatalf("Expected 3 to be on its second delivery, got %+v", leased)
+	}
+
+	// Leases going on at once never lease a message twice
+	writeMany(t, a, 200)
+	results := make(chan []data2.Message)
+	for i := 0; i < 8; i++ {
+		go func(worker string) {
+			var all []data2.Message
+			for {
+				leased, err := a.Lease("workers", "", worker, 5, time.Hour)
+				if err != nil || len(leased) == 0 {
+					results <- all
+					return
+				}
+				all = append(all, leased...)
+			}
+		}(fmt.Sprintf("worker%d", i))
+	}
+	seen := map[data.Sequence]bool{}
+	for i := 0; i < 8; i++ {
+		for _, m := range <-results {
+			if seen[m.Sequence] {
+				t.Fatalf("Expected %d to be leased once", m.Sequence)
+			}
+			seen[m.Sequence] = true
+		}
+	}
+	if len(seen) != 200 {
+		t.Fatalf("Expected all 200 new messages to be leased, got %d", len(seen))
+	}
+}
@@ -0,0 +1,235 @@
+package app
+
+import (
+	"fmt"
+	"github.com/saem/afterme/data"
+	"github.com/saem/afterme/data2"
+	"github.com/saem/afterme/merkle"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The Merkle tree over the whole log, one leaf per message, for inclusion and consistency proofs. Proofs and tree
+// heads only ever cover committed messages. The tree is kept on disk, and keeps the leaves of messages retention
+// has deleted, so a message's leaf index never changes and tree heads signed before still verify.
+
+// LeafData is what a message contributes to the Merkle tree, its header line as written. The header carries the
+// body's hash, so the body is covered too without needing it to check a proof.
+func LeafData(message data2.Message) []byte {
+	header, _, _ := message.Marshal()
+	return []byte(header)
+}
+
+// TreeDirName is the directory in the data dir the tree is kept in, see merkle.Open, along with the sequence of
+// its first leaf in a file of its own. That's message 1, unless the data dir had already lost the start of the log
+// to retention when the tree was first built, or it's a follower's that started copying part way through.
+const TreeDirName = "tree"
+
+// treeStartFileName is the file in TreeDirName with the sequence of the tree's first leaf.
+const treeStartFileName = "start"
+
+// openTree opens the Merkle tree kept in the data dir, building it from the log if there isn't one. Leaves aren't
+// synced until their data file is done with, so those of the latest data file are added again from the log, which
+// is at most a data file's worth of reading on start up.
+func (app *App) openTree() {
+	dir := filepath.Join(app.DataDir, TreeDirName)
+	start, err := readTreeStart(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			app.Logger.Printf("Could not read where the Merkle tree starts, it's built again, because: %s", err.Error())
+		}
+		// Without a start the tree never got going, it's all built from the log
+		os.RemoveAll(dir)
+		start = 0
+	}
+	if app.tree, err = merkle.Open(dir); err != nil {
+		app.Logger.Fatalf("Could not open the Merkle tree in %s, because: %s", dir, err.Error())
+	}
+
+	keep := uint64(0)
+	if latest, ok := app.latestSegment(); ok && start != 0 && latest.StartingSequence > start {
+		keep = uint64(latest.StartingSequence - start)
+		if size := app.tree.Size(); size < keep {
+			keep = size
+		}
+	}
+	from := start + data.Sequence(keep)
+	if start == 0 {
+		from = 0
+	}
+
+	gap := false
+	err = app.tree.Truncate(keep)
+	if err == nil {
+		err = ReadLog(app.DataDir, from, func(message data2.Message) error {
+			if start == 0 {
+				start = message.Sequence
+			}
+			if message.Sequence != start+data.Sequence(app.tree.Size()) {
+				gap = true
+				return ErrStopReading
+			}
+			return app.tree.Append(merkle.LeafHash(LeafData(message)))
+		})
+	}
+	if err == nil && gap {
+		// Retention deleted messages the tree never got, there's no getting them back
+		app.Logger.Printf("The Merkle tree in %s is missing messages that have been deleted, it's built again", dir)
+		app.tree.Close()
+		os.RemoveAll(dir)
+		app.openTree()
+		return
+	}
+	if start == 0 {
+		start = app.Sequence
+	}
+	if err == nil {
+		err = app.tree.Sync()
+	}
+	if err == nil {
+		err = writeTreeStart(dir, start)
+	}
+	if err != nil {
+		app.Logger.Fatalf("Could not bring the Merkle tree in %s up to date, because: %s", dir, err.Error())
+	}
+	atomic.StoreUint64(&app.treeStart, uint64(start))
+}
+
+// addLeaf adds a message just written to the tree. An empty tree starts at whatever message is first added to it,
+// a follower's first message needn't be message 1.
+func (app *App) addLeaf(message data2.Message) {
+	if app.tree.Size() == 0 && message.Sequence != app.TreeStart() {
+		if err := writeTreeStart(filepath.Join(app.DataDir, TreeDirName), message.Sequence); err != nil {
+			app.Logger.Fatalf("Could not record where the Merkle tree starts, because: %s", err.Error())
+		}
+		atomic.StoreUint64(&app.treeStart, uint64(message.Sequence))
+	}
+	if err := app.tree.Append(merkle.LeafHash(LeafData(message))); err != nil {
+		app.Logger.Fatalf("Could not add message %d to the Merkle tree, because: %s", message.Sequence, err.Error())
+	}
+}
+
+// syncTree makes sure the leaves of a data file that's done with are on disk, so they're not added again on start
+// up, and so that retention can delete the data file without the tree losing them.
+func (app *App) syncTree() {
+	if err := app.tree.Sync(); err != nil {
+		app.Logger.Printf("Could not sync the Merkle tree, because: %s", err.Error())
+	}
+}
+
+// truncateTree cuts the tree back to match the log, after messages at its end have been removed.
+func (app *App) truncateTree() error {
+	size := uint64(0)
+	if start := app.TreeStart(); app.Sequence > start {
+		size = uint64(app.Sequence - start)
+	}
+	if size > app.tree.Size() {
+		return nil
+	}
+
+	return app.tree.Truncate(size)
+}
+
+// readTreeStart reads the sequence of the tree's first leaf.
+func readTreeStart(dir string) (start data.Sequence, err error) {
+	contents, err := ioutil.ReadFile(filepath.Join(dir, treeStartFileName))
+	if err != nil {
+		return 0, err
+	}
+	parsed, err := strconv.ParseUint(strings.TrimSpace(string(contents)), 10, 64)
+	if err != nil || parsed == 0 {
+		return 0, fmt.Errorf("Malformed %s: %q", treeStartFileName, contents)
+	}
+
+	return data.Sequence(parsed), nil
+}
+
+// writeTreeStart records the sequence of the tree's first leaf, it's written to a temporary file and renamed so it's
+// never partly written.
+func writeTreeStart(dir string, start data.Sequence) (err error) {
+	path := filepath.Join(dir, treeStartFileName)
+	if err = ioutil.WriteFile(path+".tmp", []byte(fmt.Sprintf("%d\n", start)), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// TreeStart is the sequence of the tree's first leaf, the leaf index of a message is its sequence less this.
+func (app *App) TreeStart() data.Sequence {
+	return data.Sequence(atomic.LoadUint64(&app.treeStart))
+}
+
+// TreeSize is the number of committed messages in the tree.
+func (app *App) TreeSize() uint64 {
+	committed, start := app.Committed(), app.TreeStart()
+	if committed < start {
+		return 0
+	}
+
+	return uint64(committed-start) + 1
+}
+
+// LeafIndex is the index of the leaf for a message.
+func (app *App) LeafIndex(sequence data.Sequence) (index uint64, err error) {
+	start := app.TreeStart()
+	if sequence < start || sequence > app.Committed() {
+		return 0, fmt.Errorf("Sequence %d is not in the tree", sequence)
+	}
+
+	return uint64(sequence - start), nil
+}
+
+// TreeHead is the signed tree head for the first size messages.
+func (app *App) TreeHead(size uint64) (th merkle.TreeHead, err error) {
+	if size > app.TreeSize() {
+		return th, fmt.Errorf("Tree size %d is bigger than the committed tree, %d", size, app.TreeSize())
+	}
+
+	root, err := app.tree.Root(size)
+	if err != nil {
+		return th, err
+	}
+
+	th = merkle.TreeHead{TreeSize: size, Timestamp: time.Now().UnixNano() / int64(time.Millisecond), Root: root}
+	th.Sign(app.Key)
+
+	return th, nil
+}
+
+// InclusionProof is the audit path for a message in the tree of the first size messages.
+func (app *App) InclusionProof(sequence data.Sequence, size uint64) (proof [][]byte, err error) {
+	index, err := app.LeafIndex(sequence)
+	if err != nil {
+		return nil, err
+	}
+	if size > app.TreeSize() {
+		return nil, fmt.Errorf("Tree size %d is bigger than the committed tree, %d", size, app.TreeSize())
+	}
+
+	return app.tree.InclusionProof(index, size)
+}
+
+// ConsistencyProof proves the tree of the first from messages is a prefix of that of the first to messages.
+func (app *App) ConsistencyProof(from uint64, to uint64) (proof [][]byte, err error) {
+	if to > app.TreeSize() {
+		return nil, fmt.Errorf("Tree size %d is bigger than the committed tree, %d", to, app.TreeSize())
+	}
+
+	return app.tree.ConsistencyProof(from, to)
+}
+
+// segmentRoot is the Merkle root of just the messages [first, next).
+func (app *App) segmentRoot(first data.Sequence, next data.Sequence) (root []byte, err error) {
+	start := app.TreeStart()
+	if first < start {
+		return nil, fmt.Errorf("Sequence %d is before the start of the tree", first)
+	}
+
+	return app.tree.RangeRoot(uint64(first-start), uint64(next-start))
+}
@@ -0,0 +1,303 @@
+package app
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/saem/afterme/config"
+	"github.com/saem/afterme/data"
+	"github.com/saem/afterme/data2"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+)
+
+// The App's side of a cluster, the cluster package runs Raft and the log is the Raft log: a message's sequence is
+// its index and its term attribute (data2.AttrTerm) is its term. The leader writes with ProcessMessages, like a
+// single node, everyone else appends what the leader sends them exactly as it was written, like a follower.
+
+// ErrNotLeader is the error for a write to a cluster node that isn't the leader.
+var ErrNotLeader = errors.New("not the cluster leader")
+
+// Coordinator is how a cluster lets the App know who's leading.
+type Coordinator interface {
+	// Leader is the base URL of the leader, empty if there isn't one right now, and whether it's this node.
+	Leader() (url string, leading bool)
+	// Term is the current Raft term.
+	Term() uint64
+}
+
+// roleChange is sent to ProcessMessages to make this node the leader, or stop it being the leader.
+type roleChange struct {
+	term  uint64 // Zero to stop leading
+	done  chan struct{}
+	first data.Sequence // Set once done, the sequence of the first message written as leader
+}
+
+// CreateClusterNode creates an App for a node of a cluster, it takes writes only once it's made the leader (see
+// Lead), until then it's appended to by AppendEntries. ProcessMessages must be running.
+func CreateClusterNode(dataDir string, config *config.Config, logger *log.Logger) (appServer *App) {
+	appServer = newApp(dataDir, "", config, logger)
+	appServer.roles = make(chan *roleChange)
+	appServer.summarizeSegments()
+
+	return appServer
+}
+
+// Lead makes this node the leader for term, it starts a new data file and takes writes from then on, the first
+// of them being first.
+func (app *App) Lead(term uint64) (first data.Sequence) {
+	change := &roleChange{term: term, done: make(chan struct{})}
+	app.roles <- change
+	<-change.done
+
+	return change.first
+}
+
+// StepDown stops this node taking writes, the data file being written to is finished.
+func (app *App) StepDown() {
+	app.Lead(0)
+}
+
+// changeRole carries out a roleChange, it's only ever called by ProcessMessages.
+func (app *App) changeRole(change *roleChange) {
+	defer close(change.done)
+	defer func() { change.first = app.Sequence }()
+
+	app.term = change.term
+	if change.term == 0 {
+		if app.dataFile != nil {
+			app.closeFile()
+			app.dataFile = nil
+		}
+		return
+	}
+
+	// Finish the file being appended to, or left from the last run, leaders always start a new one
+	if app.replica == nil {
+		if segment, ok := app.latestSegment(); ok {
+			if err := app.openReplica(segment); err != nil {
+				app.Logger.Printf("Could not finish %s/%s, because: %s", app.DataDir, segment.Name, err.Error())
+			}
+		}
+	}
+	app.closeReplica()
+	if app.dataFile == nil {
+		app.takeOver()
+		app.createFile()
+	}
+}
+
+// latestSegment is the data file with the highest starting sequence, if there are any.
+func (app *App) latestSegment() (segment Segment, ok bool) {
+	segments, err := ListSegments(app.DataDir)
+	if err != nil || len(segments) == 0 {
+		return segment, false
+	}
+
+	return segments[len(segments)-1], true
+}
+
+// WriteLeader is where writes should go, url is empty if this node takes them (leading), or if there's no leader
+// to send them to right now.
+func (app *App) WriteLeader() (url string, leading bool) {
+	switch {
+	case app.Leader != "":
+		return app.Leader, false
+	case app.Coordinator != nil:
+		return app.Coordinator.Leader()
+	default:
+		return "", true
+	}
+}
+
+// ResetFollowers forgets every follower, for a new leader.
+func (app *App) ResetFollowers() {
+	app.followers.mu.Lock()
+	defer app.followers.mu.Unlock()
+
+	app.followers.replicated = map[string]FollowerStatus{}
+}
+
+// SetQuorum sets how many other nodes must have synced a write before it's acknowledged, a cluster's is a
+// majority.
+func (app *App) SetQuorum(quorum int) {
+	app.Config.Replication.Quorum = quorum
+}
+
+// SetCommitted moves the cluster's committed sequence forward.
+func (app *App) SetCommitted(sequence data.Sequence) {
+	for {
+		current := atomic.LoadUint64(&app.clusterCommitted)
+		if uint64(sequence) <= current || atomic.CompareAndSwapUint64(&app.clusterCommitted, current, uint64(sequence)) {
+			return
+		}
+	}
+}
+
+// LastEntry is the sequence and term of the last message in the log, zeros for an empty log. It's not to be
+// called while this node is leading, as the log is changing under it.
+func (app *App) LastEntry() (sequence data.Sequence, term uint64) {
+	return app.Sequence - 1, app.lastTerm
+}
+
+// MessageTerm is the Raft term a message was written in, zero for messages from outside of a cluster.
+func MessageTerm(message data2.Message) uint64 {
+	term, _ := strconv.ParseUint(message.Attributes[data2.AttrTerm], 10, 64)
+	return term
+}
+
+// Locate finds a synced message, the data file it's in and its offset in there.
+func (app *App) Locate(sequence data.Sequence) (message data2.Message, segment Segment, offset int64, err error) {
+	segments, err := ListSegments(app.DataDir)
+	if err != nil {
+		return message, segment, 0, err
+	}
+	found := false
+	for _, s := range segments {
+		if s.StartingSequence <= sequence {
+			segment, found = s, true
+		}
+	}
+	if !found || sequence > app.Synced() {
+		return message, segment, 0, fmt.Errorf("Sequence %d is not in the log", sequence)
+	}
+
+	// Start from the last index entry at or before it
+	offset, _ = indexedOffset(app.DataDir, segment, sequence)
+	found = false
+	_, err = readSegment(app.DataDir, segment, offset, func(m data2.Message, o int64) error {
+		if m.Sequence == sequence {
+			message, offset, found = m, o, true
+			return ErrStopReading
+		}
+		return nil
+	})
+	if err != nil && err != ErrStopReading {
+		return message, segment, 0, err
+	}
+	if !found {
+		return message, segment, 0, fmt.Errorf("Sequence %d is not in %s", sequence, segment.Name)
+	}
+
+	return message, segment, offset, nil
+}
+
+// TermAt is the term of a synced message, zero is at sequence zero.
+func (app *App) TermAt(sequence data.Sequence) (term uint64, err error) {
+	if sequence == 0 {
+		return 0, nil
+	}
+	message, _, _, err := app.Locate(sequence)
+
+	return MessageTerm(message), err
+}
+
+// ClusterEnd is how much of a data file, from offset, to send another node of the cluster: up to the end of the
+// last synced message, or MaxReplicationBytes or so, whichever is less. last is the last message to send.
+func (app *App) ClusterEnd(segment Segment, offset int64) (end int64, last data.Sequence, err error) {
+	return app.replicaEnd(segment, offset, app.Synced())
+}
+
+// AppendEntries appends the messages in entries, from the leader's data file segment, after the message at prev.
+// Any messages after prev that conflict with them (a different term) are removed first, as they were never
+// committed, while any already in the log are skipped. It's not to be called while this node is leading.
+func (app *App) AppendEntries(segment Segment, prev data.Sequence, entries []byte) (err error) {
+	if prev >= app.Sequence {
+		return fmt.Errorf("Sequence %d is past the end of the log", prev)
+	}
+
+	// Skip what's already in the log, up to the first conflict
+	skip := int64(len(entries))
+	conflict := data.Sequence(0)
+	_, err = scanMessages(segment.Version, newScanner(segment.Version, bytes.NewReader(entries)), 0,
+		func(message data2.Message, offset int64) error {
+			if message.Sequence >= app.Sequence {
+				skip = offset
+				return ErrStopReading
+			}
+			term, err := app.TermAt(message.Sequence)
+			if err != nil {
+				return err
+			}
+			if term != MessageTerm(message) {
+				skip, conflict = offset, message.Sequence
+				return ErrStopReading
+			}
+			return nil
+		})
+	if err != nil && err != ErrStopReading {
+		return err
+	}
+	if conflict != 0 {
+		if err = app.truncateAfter(conflict - 1); err != nil {
+			return err
+		}
+	}
+	entries = entries[skip:]
+	if len(entries) == 0 {
+		return nil
+	}
+
+	if app.replica == nil || app.file.Name != segment.Name {
+		if err = app.openReplica(segment); err != nil {
+			return err
+		}
+	}
+	_, err = app.appendReplica(entries)
+
+	return err
+}
+
+// truncateAfter removes every message after sequence, which must not have been committed. It's not to be called
+// while this node is leading.
+func (app *App) truncateAfter(sequence data.Sequence) (err error) {
+	app.Logger.Printf("Removing uncommitted messages after %d, they conflict with the leader's", sequence)
+
+	if app.replica != nil {
+		app.replica.Close()
+		if app.index != nil {
+			app.index.Close()
+		}
+		app.replica, app.index = nil, nil
+	}
+
+	segments, err := ListSegments(app.DataDir)
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if segment.StartingSequence <= sequence {
+			continue
+		}
+		os.Remove(filepath.Join(app.DataDir, segment.Name))
+		os.Remove(filepath.Join(app.DataDir, data2.SealFileName(segment.Name)))
+		os.Remove(filepath.Join(app.DataDir, data2.IndexFileName(segment.Name)))
+		app.removeFromManifest(segment.Name)
+	}
+	if sequence > 0 {
+		_, segment, offset, err := app.Locate(sequence + 1)
+		if err == nil {
+			// It's changing, the seal and manifest entry are redone when it's finished
+			if err = os.Truncate(filepath.Join(app.DataDir, segment.Name), offset); err != nil {
+				return err
+			}
+			os.Remove(filepath.Join(app.DataDir, data2.SealFileName(segment.Name)))
+			app.removeFromManifest(segment.Name)
+		}
+	}
+
+	// Start over from what's left
+	var last *data2.Message
+	app.Sequence, last = findLatest(app.DataDir, app.Logger)
+	app.chain, app.lastTerm = "", 0
+	if last != nil {
+		app.chain, app.lastTerm = last.Attributes[data2.AttrChain], MessageTerm(*last)
+		atomic.StoreUint64(&app.epoch, MessageEpoch(*last))
+	}
+	atomic.StoreUint64(&app.synced, uint64(app.Sequence-1))
+
+	return app.truncateTree()
+}
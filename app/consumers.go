@@ -0,0 +1,193 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/saem/afterme/data"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Consumers are named readers of the log that commit how far they've got, their offset, so they can pick up from
+// there when they next subscribe. Offsets are kept in a side log, OffsetsFileName, a record for each commit. The
+// latest record for a consumer wins, a deleted consumer has a record saying so. A consumer can be for a stream, set
+// with its first offset, so the server knows who can commit it, those who can subscribe to the stream.
+
+// OffsetsFileName is the consumer offsets side log, in the data dir.
+const OffsetsFileName = "consumers.offsets"
+
+// Errors committing an offset.
+var (
+	ErrInvalidConsumer   = errors.New("consumer names can't be empty, or have spaces or slashes in them")
+	ErrUncommittedOffset = errors.New("offset is past the last committed message")
+	ErrConsumerStream    = errors.New("the consumer is for a different stream")
+)
+
+// ConsumerOffset is how far a consumer has got.
+type ConsumerOffset struct {
+	Name      string        `json:"name"`
+	Offset    data.Sequence `json:"offset"` // Everything up to and including this has been processed
+	Lag       uint64        `json:"lag"`    // Committed messages the consumer has yet to process
+	Committed time.Time     `json:"committed_at"`
+
+	Stream string `json:"stream,omitempty"` // Every stream if it's not set
+}
+
+// offsetRecord is a line of the side log.
+type offsetRecord struct {
+	Name    string        `json:"name"`
+	Offset  data.Sequence `json:"offset,omitempty"`
+	Time    time.Time     `json:"time"`
+	Deleted bool          `json:"deleted,omitempty"`
+
+	Stream string `json:"stream,omitempty"`
+}
+
+// consumers holds every consumer's offset, and the side log they're kept in.
+type consumers struct {
+	mu      sync.Mutex
+	offsets map[string]offsetRecord
+	log     *sideLog
+}
+
+func loadConsumers(dataDir string) (c *consumers, err error) {
+	c = &consumers{offsets: map[string]offsetRecord{}}
+	c.log, err = openSideLog(filepath.Join(dataDir, OffsetsFileName), func(line []byte) error {
+		var record offsetRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return err
+		}
+		c.apply(record)
+		return nil
+	})
+	if err == nil {
+		err = c.rewrite()
+	}
+
+	return c, err
+}
+
+// CommitOffset records that a consumer has processed everything up to and including sequence, it can go back as
+// well as forward, to process messages again. A new consumer is for stream, every stream if it's empty, an empty
+// stream leaves a consumer's as it is and any other must be it.
+func (app *App) CommitOffset(name string, stream string, sequence data.Sequence) (offset ConsumerOffset, err error) {
+	if !validName(name) {
+		return offset, ErrInvalidConsumer
+	}
+	committed := app.Committed()
+	if sequence > committed {
+		return offset, ErrUncommittedOffset
+	}
+
+	record := offsetRecord{Name: name, Offset: sequence, Time: time.Now().UTC(), Stream: stream}
+	if record, err = app.consumers.append(record); err != nil {
+		return offset, err
+	}
+
+	return record.offset(committed), nil
+}
+
+// DeleteConsumer forgets a consumer, false if there's no such consumer.
+func (app *App) DeleteConsumer(name string) (found bool, err error) {
+	app.consumers.mu.Lock()
+	_, found = app.consumers.offsets[name]
+	app.consumers.mu.Unlock()
+	if !found {
+		return false, nil
+	}
+
+	_, err = app.consumers.append(offsetRecord{Name: name, Time: time.Now().UTC(), Deleted: true})
+
+	return true, err
+}
+
+// Consumer is a consumer's offset, false if there's no such consumer.
+func (app *App) Consumer(name string) (offset ConsumerOffset, found bool) {
+	app.consumers.mu.Lock()
+	defer app.consumers.mu.Unlock()
+
+	record, found := app.consumers.offsets[name]
+	return record.offset(app.Committed()), found
+}
+
+// Consumers is every consumer's offset, ordered by name.
+func (app *App) Consumers() (offsets []ConsumerOffset) {
+	committed := app.Committed()
+	offsets = []ConsumerOffset{}
+
+	app.consumers.mu.Lock()
+	defer app.consumers.mu.Unlock()
+
+	for _, record := range app.consumers.offsets {
+		offsets = append(offsets, record.offset(committed))
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i].Name < offsets[j].Name })
+
+	return offsets
+}
+
+func (record offsetRecord) offset(committed data.Sequence) (offset ConsumerOffset) {
+	offset = ConsumerOffset{Name: record.Name, Offset: record.Offset, Committed: record.Time, Stream: record.Stream}
+	if committed > record.Offset {
+		offset.Lag = uint64(committed - record.Offset)
+	}
+
+	return offset
+}
+
+// append adds a record to the side log, an offset for an existing consumer keeps its stream, and can't be for
+// another.
+func (c *consumers) append(record offsetRecord) (offsetRecord, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if existing, found := c.offsets[record.Name]; found && !record.Deleted {
+		if record.Stream != "" && record.Stream != existing.Stream {
+			return record, ErrConsumerStream
+		}
+		record.Stream = existing.Stream
+	}
+	if err := c.log.append(record); err != nil {
+		return record, err
+	}
+	c.apply(record)
+	if c.log.compact(len(c.offsets)) {
+		return record, c.rewrite()
+	}
+
+	return record, nil
+}
+
+func (c *consumers) apply(record offsetRecord) {
+	if record.Deleted {
+		delete(c.offsets, record.Name)
+	} else {
+		c.offsets[record.Name] = record
+	}
+}
+
+// rewrite rewrites the side log with just the latest offsets.
+func (c *consumers) rewrite() error {
+	var records []interface{}
+	for _, record := range c.offsets {
+		records = append(records, record)
+	}
+
+	return c.log.rewrite(records)
+}
+
+// minConsumerOffset is the lowest offset of any consumer, false if there are no consumers.
+func (app *App) minConsumerOffset() (min data.Sequence, any bool) {
+	app.consumers.mu.Lock()
+	defer app.consumers.mu.Unlock()
+
+	for _, record := range app.consumers.offsets {
+		if !any || record.Offset < min {
+			min, any = record.Offset, true
+		}
+	}
+
+	return min, any
+}
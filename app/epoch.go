@@ -0,0 +1,106 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"github.com/saem/afterme/data2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Epochs fence off writers. Every process that takes over writing to a data dir bumps the number in its epoch file and
+// records it in every message it writes (data2.AttrEpoch). Before each write the writer checks the file is still at its
+// epoch, once for each batch of writes that are synced together, if a later writer has taken over it rejects the write
+// (ErrStaleEpoch) rather than write the same sequences as the new one. The check and the write aren't atomic, so it
+// narrows the window for two writers rather than closing it, the epochs tool finds any sequences that were written
+// twice.
+
+// EpochFileName is the file in the data dir holding the latest writer epoch.
+const EpochFileName = "epoch"
+
+// ErrStaleEpoch is the error for a write to a writer that's been taken over by one with a later epoch.
+var ErrStaleEpoch = errors.New("a writer with a later epoch has taken over")
+
+// ReadEpoch reads the latest writer epoch of a data dir, zero if no writer has had one.
+func ReadEpoch(dataDir string) (epoch uint64, err error) {
+	contents, err := ioutil.ReadFile(filepath.Join(dataDir, EpochFileName))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	epoch, err = strconv.ParseUint(strings.TrimSpace(string(contents)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a valid epoch: %s", EpochFileName, err.Error())
+	}
+
+	return epoch, nil
+}
+
+// MessageEpoch is the writer epoch a message was written in, zero for messages from before epochs.
+func MessageEpoch(message data2.Message) uint64 {
+	epoch, _ := strconv.ParseUint(message.Attributes[data2.AttrEpoch], 10, 64)
+	return epoch
+}
+
+// Epoch is the epoch this node is writing in, or on a follower the epoch of the last message it has.
+func (app *App) Epoch() uint64 {
+	return atomic.LoadUint64(&app.epoch)
+}
+
+// takeOver starts a new epoch for this node to write in, one after any before it, whether in the epoch file or
+// the log.
+func (app *App) takeOver() {
+	epoch, err := ReadEpoch(app.DataDir)
+	if err != nil {
+		app.Logger.Fatalf("Could not read the epoch from %s, because: %s", app.DataDir, err.Error())
+	}
+	if current := app.Epoch(); current > epoch {
+		epoch = current
+	}
+	epoch++
+
+	path := filepath.Join(app.DataDir, EpochFileName)
+	f, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err == nil {
+		_, err = fmt.Fprintf(f, "%d\n", epoch)
+		if err == nil {
+			err = f.Sync()
+		}
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		app.Logger.Fatalf("Could not write %s, because: %s", path, err.Error())
+	}
+
+	atomic.StoreUint64(&app.epoch, epoch)
+	app.stale, app.epochChecked = false, true
+	app.Logger.Printf("Writing in epoch %d", epoch)
+}
+
+// checkEpoch checks no writer has taken over from this one since it started writing. The epoch file is read once a
+// batch, by the first write after a flush, the rest of the batch go by what it found. It's only ever called by
+// ProcessMessages.
+func (app *App) checkEpoch() error {
+	if !app.epochChecked {
+		epoch, err := ReadEpoch(app.DataDir)
+		if err != nil {
+			return err
+		}
+		app.stale, app.epochChecked = epoch > app.Epoch(), true
+	}
+	if app.stale {
+		return ErrStaleEpoch
+	}
+
+	return nil
+}
@@ -0,0 +1,407 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/saem/afterme/auth"
+	"github.com/saem/afterme/config"
+	"github.com/saem/afterme/data"
+	"github.com/saem/afterme/data2"
+	"github.com/saem/afterme/hashes"
+	"github.com/saem/afterme/hlc"
+	"github.com/saem/afterme/keystore"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A follower keeps a copy of a leader's log, see replication.go for how. It doesn't take writes itself, but it
+// serves reads, proofs and tree heads from its copy.
+
+const (
+	FollowInterval = 50 * time.Millisecond // How often a follower that's caught up pulls from its leader
+	FollowTimeout  = 30 * time.Second      // How long a pull can take
+)
+
+// CreateFollower creates an App that replicates the log from leader, the leader's base URL, rather than taking
+// writes. Follow does the replicating.
+func CreateFollower(dataDir string, leader string, config *config.Config, logger *log.Logger) (appServer *App) {
+	appServer = newApp(dataDir, leader, config, logger)
+	appServer.summarizeSegments()
+
+	return appServer
+}
+
+// Follow pulls from the leader for as long as the follower runs, it's the follower's counterpart to
+// ProcessMessages. It presents the config's auth token to the leader, if there is one, and its replication id
+// and token (config.ReplicationConfig). Without those the leader doesn't count it towards a quorum, or send it
+// data keys, so sealed bodies read as erased. It returns once stop is closed, a nil stop never is.
+func (app *App) Follow(stop <-chan struct{}) {
+	client := &http.Client{Timeout: FollowTimeout, Transport: &auth.Transport{Token: app.Config.Auth.Token}}
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		more, err := app.pull(client)
+		if err != nil {
+			app.Logger.Printf("Could not replicate from %s, because: %s", app.Leader, err.Error())
+		}
+		if !more {
+			time.Sleep(FollowInterval)
+		}
+	}
+}
+
+// LeaderCommitted is the leader's committed sequence, as of the last pull.
+func (app *App) LeaderCommitted() data.Sequence {
+	return data.Sequence(atomic.LoadUint64(&app.leaderCommitted))
+}
+
+// pull copies whatever the leader has, past what the follower has, from one data file. more is true if anything
+// was copied, so there's likely more to come.
+func (app *App) pull(client *http.Client) (more bool, err error) {
+	var segments []Segment
+	if err = app.getJSON(client, "/segments", &segments); err != nil {
+		return false, err
+	}
+
+	// The next message is in the last file starting at or before it
+	var segment *Segment
+	for i := range segments {
+		if segments[i].StartingSequence <= app.Sequence {
+			segment = &segments[i]
+		}
+	}
+	if segment == nil {
+		return false, nil
+	}
+	if app.replica == nil || app.file.Name != segment.Name {
+		if err = app.openReplica(*segment); err != nil {
+			return false, err
+		}
+	}
+
+	query := url.Values{"offset": {strconv.FormatInt(app.replicaSize, 10)},
+		"replicated": {strconv.FormatUint(uint64(app.Committed()), 10)}}
+	response, err := app.get(client, "/segments/"+url.PathEscape(segment.Name), query)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+	chunk, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return false, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("%s from the leader: %s", response.Status, bytes.TrimSpace(chunk))
+	}
+	app.sawLeaderCommitted(response)
+
+	if app.Config.Replication.Id != "" {
+		if erasures := response.Header.Get("X-Afterme-Erasures"); erasures != app.leaderErasures {
+			if err = app.eraseKeys(client); err != nil {
+				return false, err
+			}
+			app.leaderErasures = erasures
+		}
+		if err = app.fetchKeys(client, chunk); err != nil {
+			return false, err
+		}
+	}
+	if schemas, err := strconv.Atoi(response.Header.Get("X-Afterme-Schemas")); err == nil {
+		if app.WantSchemas(schemas); app.SchemasBehind() {
+			err = app.CopySchemas("/replication/schemas", func(path string) (*http.Response, error) {
+				return app.get(client, path, nil)
+			})
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+
+	return app.appendReplica(chunk)
+}
+
+// fetchKeys copies the data keys the messages in chunk were sealed with from the leader, those the follower hasn't
+// got. A key the leader doesn't have any more was erased, so it's not copied.
+func (app *App) fetchKeys(client *http.Client, chunk []byte) error {
+	missing := map[string]bool{}
+	_, err := scanMessages(app.replicaVersion, newScanner(app.replicaVersion, bytes.NewReader(chunk)), 0,
+		func(message data2.Message, offset int64) error {
+			subject, ok := message.Attributes[data2.AttrSubject]
+			if ok && !app.Keys.Has(subject, message.Attributes[data2.AttrKey]) {
+				missing[keystore.Name(subject)] = true
+			}
+			return nil
+		})
+	if err != nil {
+		// appendReplica reports what's wrong with the chunk, everything before that still needs its keys
+		app.Logger.Printf("Could not read the keys needed from %s, because: %s", app.file.Name, err.Error())
+	}
+
+	for name := range missing {
+		response, err := app.get(client, "/replication/keys/"+name, nil)
+		if err != nil {
+			return err
+		}
+		contents, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		switch {
+		case err != nil:
+			return err
+		case response.StatusCode == http.StatusNotFound:
+			continue
+		case response.StatusCode != http.StatusOK:
+			return fmt.Errorf("%s from the leader: %s", response.Status, bytes.TrimSpace(contents))
+		}
+		if err = app.Keys.Import(name, contents); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// eraseKeys erases the data keys the leader has erased, those it doesn't have, or has a different one of.
+func (app *App) eraseKeys(client *http.Client) error {
+	response, err := app.get(client, "/replication/keys", nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	contents, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s from the leader: %s", response.Status, bytes.TrimSpace(contents))
+	}
+
+	leader := map[string]string{}
+	for _, line := range strings.Split(string(contents), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			leader[fields[0]] = fields[1]
+		}
+	}
+	ids, err := app.Keys.List()
+	if err != nil {
+		return err
+	}
+	for name, id := range ids {
+		if leader[name] != id {
+			if err = app.Keys.Remove(name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// appendReplica checks the messages in chunk, read from the end of the replica, and appends those that check out.
+func (app *App) appendReplica(chunk []byte) (more bool, err error) {
+	var messages []data2.Message
+	var offsets []int64
+	sequence, chain := app.Sequence, app.chain
+	bad := int64(-1)
+	end, err := scanMessages(app.replicaVersion, newScanner(app.replicaVersion, bytes.NewReader(chunk)), app.replicaSize,
+		func(message data2.Message, offset int64) error {
+			if err := checkReplica(message, sequence, chain); err != nil {
+				bad = offset
+				return err
+			}
+			if recorded, ok := message.Attributes[data2.AttrChain]; ok {
+				chain = recorded
+			}
+			sequence++
+			messages = append(messages, message)
+			offsets = append(offsets, offset)
+			return nil
+		})
+	if len(messages) > 0 {
+		// Everything before a bad message is fine, the bad one will be tried again on the next pull
+		if bad >= 0 {
+			end = bad
+		}
+		if writeErr := app.writeReplica(chunk[:end-app.replicaSize], messages, offsets); writeErr != nil {
+			return false, writeErr
+		}
+	}
+
+	return len(messages) > 0, err
+}
+
+// writeReplica appends checked messages, as they were in the leader's data file, and syncs them.
+func (app *App) writeReplica(contents []byte, messages []data2.Message, offsets []int64) (err error) {
+	if _, err = app.replica.Write(contents); err != nil {
+		return err
+	}
+	if err = app.replica.Sync(); err != nil {
+		return err
+	}
+	app.replicaSize += int64(len(contents))
+
+	for i, message := range messages {
+		app.Sequence++
+		if recorded, ok := message.Attributes[data2.AttrChain]; ok {
+			app.chain = recorded
+		}
+		if t, err := hlc.Parse(message.Attributes[data2.AttrClock]); err == nil {
+			app.clock.Observe(t)
+		}
+		if epoch := MessageEpoch(message); epoch != 0 {
+			atomic.StoreUint64(&app.epoch, epoch)
+		}
+		app.lastTerm = MessageTerm(message)
+		app.addLeaf(message)
+		app.indexMessage(message, offsets[i])
+	}
+	app.markSynced(app.Sequence - 1)
+
+	return nil
+}
+
+// checkReplica checks a message from the leader is the next one, and that its hash and chain hash are right.
+func checkReplica(message data2.Message, next data.Sequence, chain string) error {
+	if message.Sequence != next {
+		return fmt.Errorf("Expected sequence %d from the leader, got %d", next, message.Sequence)
+	}
+
+	hash, err := hashes.Sum(message.Attributes[data2.AttrHash], message.Body)
+	if err != nil {
+		return err
+	}
+	if hash != message.Hash {
+		return fmt.Errorf("%d: body from the leader hashes to %s, not %s", message.Sequence, hash, message.Hash)
+	}
+
+	recorded, ok := message.Attributes[data2.AttrChain]
+	switch {
+	case !ok && chain != "":
+		return fmt.Errorf("%d: has no chain hash, but follows chained messages", message.Sequence)
+	case ok:
+		expected, err := data2.ChainHash(chain, message)
+		if err != nil {
+			return err
+		}
+		if recorded != expected {
+			return fmt.Errorf("%d: chain hash from the leader is %s, expected %s", message.Sequence, recorded, expected)
+		}
+	}
+
+	return nil
+}
+
+// openReplica switches to appending to a data file, finishing the one before it. Anything after the file's last
+// complete message, a write torn by a crash, is cut off.
+func (app *App) openReplica(segment Segment) (err error) {
+	app.closeReplica()
+
+	path := filepath.Join(app.DataDir, segment.Name)
+	if _, err = os.Stat(path); os.IsNotExist(err) {
+		err = ioutil.WriteFile(path, nil, 0644)
+	}
+	if err != nil {
+		return err
+	}
+
+	var index *os.File
+	if segment.Version == data.Version(2) {
+		if index, err = createIndex(app.DataDir, segment.Name); err != nil {
+			return err
+		}
+	}
+	summary, end, err := summarize(app.DataDir, segment, index)
+	if err == nil {
+		err = os.Truncate(path, end)
+	}
+	if err == nil {
+		app.replica, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	}
+	if err != nil {
+		if index != nil {
+			index.Close()
+		}
+		return err
+	}
+
+	app.file, app.index = summary, index
+	app.replicaVersion, app.replicaSize = segment.Version, end
+
+	return nil
+}
+
+// closeReplica closes the data file being appended to, if there is one, it's sealed and added to the manifest in
+// the background.
+func (app *App) closeReplica() {
+	if app.replica == nil {
+		return
+	}
+
+	app.replica.Close()
+	if app.index != nil {
+		app.index.Close()
+	}
+	app.syncTree()
+	if app.file.Next > app.file.First {
+		if app.replicaVersion == data.Version(2) {
+			go app.finishFile(app.file)
+		} else {
+			go app.addToManifest(app.file.manifestEntry())
+		}
+	}
+	app.replica, app.index = nil, nil
+}
+
+// get gets path from the leader, with the follower's replication id and token if it has them.
+func (app *App) get(client *http.Client, path string, query url.Values) (*http.Response, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	if app.Config.Replication.Id != "" {
+		query.Set("follower", app.Config.Replication.Id)
+	}
+	request, err := http.NewRequest("GET", app.Leader+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if app.Config.Replication.Token != "" {
+		request.Header.Set("X-Afterme-Replication-Token", app.Config.Replication.Token)
+	}
+
+	return client.Do(request)
+}
+
+// getJSON gets path from the leader, decoding the JSON response into v.
+func (app *App) getJSON(client *http.Client, path string, v interface{}) error {
+	response, err := app.get(client, path, nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("%s from the leader: %s", response.Status, bytes.TrimSpace(body))
+	}
+	app.sawLeaderCommitted(response)
+
+	return json.NewDecoder(response.Body).Decode(v)
+}
+
+// sawLeaderCommitted records the leader's committed sequence from a response.
+func (app *App) sawLeaderCommitted(response *http.Response) {
+	committed, err := strconv.ParseUint(response.Header.Get("X-Afterme-Committed"), 10, 64)
+	if err == nil {
+		atomic.StoreUint64(&app.leaderCommitted, committed)
+	}
+}
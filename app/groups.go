@@ -0,0 +1,496 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/saem/afterme/data"
+	"github.com/saem/afterme/data2"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Worker groups share out the messages of the log, or of one stream, between their workers, like a work queue. A
+// worker leases messages for a visibility timeout, and acks each once it's done with it. Messages whose lease runs
+// out before they're acked, or that are released, are leased again, to any worker of the group, before messages
+// that have yet to be leased. Each message is leased to one worker at a time, but delivery is at least once, a
+// worker that's slow to ack may find its messages were leased to another.
+//
+// Leases are kept in a side log, GroupsFileName, a record for each lease, ack and release, so a restart doesn't
+// lose them. A group is created by its first lease, and starts from the start of the log.
+
+// GroupsFileName is the worker groups' side log, in the data dir.
+const GroupsFileName = "groups.leases"
+
+// DefaultVisibility is how long a lease lasts if the worker doesn't say.
+const DefaultVisibility = 30 * time.Second
+
+// Errors leasing and acking.
+var (
+	ErrInvalidGroup = errors.New("group and worker names can't be empty, or have spaces or slashes in them")
+	ErrGroupStream  = errors.New("the group is for a different stream")
+	ErrNotLeased    = errors.New("message isn't leased to the worker")
+)
+
+// Lease is a message leased to a worker.
+type Lease struct {
+	Sequence   data.Sequence `json:"sequence"`
+	Worker     string        `json:"worker"`
+	Expires    time.Time     `json:"expires"`
+	Deliveries int           `json:"deliveries"` // Times it's been leased
+}
+
+// GroupStatus is how a worker group is getting on.
+type GroupStatus struct {
+	Name    string        `json:"name"`
+	Stream  string        `json:"stream,omitempty"`
+	Done    data.Sequence `json:"done"`    // Everything up to and including this has been acked
+	Next    data.Sequence `json:"next"`    // First message yet to be leased
+	Pending uint64        `json:"pending"` // Committed messages yet to be leased
+	Leased  int           `json:"leased"`  // Messages leased and not acked, including those whose lease ran out
+	Expired int           `json:"expired"` // Messages whose lease ran out, or that were released, to be leased again
+	Leases  []Lease       `json:"leases,omitempty"`
+}
+
+// groupRecord is a line of the side log.
+type groupRecord struct {
+	Group      string          `json:"group"`
+	Op         string          `json:"op"` // create, lease, ack, release or delete
+	Stream     string          `json:"stream,omitempty"`
+	Sequences  []data.Sequence `json:"sequences,omitempty"` // Leased, acked or released
+	Dropped    []data.Sequence `json:"dropped,omitempty"`   // Leases dropped, retention deleted their messages
+	Worker     string          `json:"worker,omitempty"`
+	Expires    int64           `json:"expires,omitempty"`    // Nanoseconds since the epoch
+	Deliveries int             `json:"deliveries,omitempty"` // Set when a lease is rewritten
+	Next       data.Sequence   `json:"next,omitempty"`       // First message yet to be leased, after a create or lease
+}
+
+// group is a worker group, every message before next that isn't leased has been acked, or isn't in its stream.
+type group struct {
+	name   string
+	stream string
+	next   data.Sequence
+	leases map[data.Sequence]*Lease
+}
+
+// groups holds every worker group, and the side log they're kept in.
+type groups struct {
+	mu     sync.Mutex
+	groups map[string]*group
+	log    *sideLog
+	live   int // Groups and leases, the records a rewrite would write
+}
+
+func loadGroups(dataDir string) (g *groups, err error) {
+	g = &groups{groups: map[string]*group{}}
+	g.log, err = openSideLog(filepath.Join(dataDir, GroupsFileName), func(line []byte) error {
+		var record groupRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return err
+		}
+		g.apply(record)
+		return nil
+	})
+	if err == nil {
+		err = g.rewrite()
+	}
+
+	return g, err
+}
+
+// Lease leases up to max messages to a worker of a group, those to be leased again first. It's no messages if
+// there are none to lease. stream is the group's stream, it's set when the group is created by its first lease.
+//
+// The messages are read without the lock held, so one lease reading a lot of the log doesn't hold up the others,
+// or acks. What's read is only recorded if nobody's leased it in the meantime, if another lease got to the
+// messages yet to be leased first they're read again from where it got to.
+func (app *App) Lease(name string, stream string, worker string, max int,
+	visibility time.Duration) (messages []data2.Message, err error) {
+	if !validName(name) || !validName(worker) {
+		return nil, ErrInvalidGroup
+	}
+	if max <= 0 {
+		max = 1
+	}
+	if visibility <= 0 {
+		visibility = DefaultVisibility
+	}
+
+	for {
+		g, again, next, err := app.groups.toLease(name, stream)
+		if err != nil {
+			return nil, err
+		}
+		candidates, err := app.readLeasable(g.stream, again, next, max)
+		if err != nil {
+			return nil, err
+		}
+
+		now := time.Now()
+		record := groupRecord{Group: name, Op: "lease", Worker: worker, Expires: now.Add(visibility).UnixNano(),
+			Next: candidates.next}
+		app.groups.mu.Lock()
+		if app.groups.groups[name] != g || g.next != next {
+			app.groups.mu.Unlock()
+			continue
+		}
+		messages = messages[:0]
+		for _, m := range candidates.again {
+			if lease, leased := g.leases[m.Sequence]; leased && !lease.Expires.After(now) {
+				messages = append(messages, m)
+				record.Sequences = append(record.Sequences, m.Sequence)
+			}
+		}
+		for _, sequence := range candidates.dropped {
+			if _, leased := g.leases[sequence]; leased {
+				record.Dropped = append(record.Dropped, sequence)
+			}
+		}
+		for _, m := range candidates.new {
+			messages = append(messages, m)
+			record.Sequences = append(record.Sequences, m.Sequence)
+		}
+		if len(record.Sequences) == 0 && len(record.Dropped) == 0 && record.Next == g.next {
+			app.groups.mu.Unlock()
+			return nil, nil
+		}
+		err = app.groups.append(record)
+		deliveries := make([]int, len(messages))
+		for i, m := range messages {
+			if lease, leased := g.leases[m.Sequence]; leased {
+				deliveries[i] = lease.Deliveries
+			}
+		}
+		app.groups.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+
+		for i, m := range messages {
+			if messages[i], err = Deliverable(app.Keys, m); err != nil {
+				return nil, err
+			}
+			messages[i].Attributes = messages[i].Attributes.Copy()
+			messages[i].Attributes[data2.AttrDeliveries] = strconv.Itoa(deliveries[i])
+		}
+
+		return messages, nil
+	}
+}
+
+// toLease is the group to lease from, created if it's new, with the sequences whose lease has run out, in order,
+// and where the messages yet to be leased start.
+func (g *groups) toLease(name string, stream string) (group *group, again []data.Sequence, next data.Sequence,
+	err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	group, found := g.groups[name]
+	if !found {
+		if err = g.append(groupRecord{Group: name, Op: "create", Stream: stream, Next: 1}); err != nil {
+			return nil, nil, 0, err
+		}
+		group = g.groups[name]
+	} else if stream != "" && stream != group.stream {
+		return nil, nil, 0, ErrGroupStream
+	}
+
+	now := time.Now()
+	for sequence, lease := range group.leases {
+		if !lease.Expires.After(now) {
+			again = append(again, sequence)
+		}
+	}
+	sort.Slice(again, func(i, j int) bool { return again[i] < again[j] })
+
+	return group, again, group.next, nil
+}
+
+// leasable is what a lease read, before it's recorded.
+type leasable struct {
+	again   []data2.Message // To be leased again
+	dropped []data.Sequence // Whose lease ran out, and that retention's deleted since
+	new     []data2.Message // Yet to be leased
+	next    data.Sequence   // First message yet to be leased after new
+}
+
+// readLeasable reads up to max messages to lease, those in again first, then those from next on in stream.
+func (app *App) readLeasable(stream string, again []data.Sequence, next data.Sequence,
+	max int) (l leasable, err error) {
+	l.next = next
+	for _, sequence := range again {
+		if len(l.again) == max {
+			break
+		}
+		message, found, err := app.readMessage(sequence)
+		switch {
+		case err != nil:
+			return l, err
+		case !found:
+			l.dropped = append(l.dropped, sequence)
+		default:
+			l.again = append(l.again, message)
+		}
+	}
+
+	committed := app.Committed()
+	if len(l.again) == max || next > committed {
+		return l, nil
+	}
+	err = ReadLog(app.DataDir, next, func(m data2.Message) error {
+		if m.Sequence > committed || len(l.again)+len(l.new) == max {
+			return ErrStopReading
+		}
+		l.next = m.Sequence + 1
+		if stream != "" && m.Attributes[data2.AttrStream] != stream {
+			return nil
+		}
+		l.new = append(l.new, m)
+		return nil
+	})
+
+	return l, err
+}
+
+// Ack acks messages leased to a worker of a group, they're done with and won't be leased again. A message whose
+// lease has run out can still be acked, as long as it hasn't been leased to another worker since.
+func (app *App) Ack(name string, worker string, sequences []data.Sequence) error {
+	return app.groups.update(groupRecord{Group: name, Op: "ack", Worker: worker, Sequences: sequences})
+}
+
+// Release gives up the leases on messages, they're leased again straight away.
+func (app *App) Release(name string, worker string, sequences []data.Sequence) error {
+	return app.groups.update(groupRecord{Group: name, Op: "release", Worker: worker, Sequences: sequences})
+}
+
+// GroupStream is the stream a worker group is for, empty for every stream, false if there's no such group.
+func (app *App) GroupStream(name string) (stream string, found bool) {
+	app.groups.mu.Lock()
+	defer app.groups.mu.Unlock()
+
+	g, found := app.groups.groups[name]
+	if found {
+		stream = g.stream
+	}
+
+	return stream, found
+}
+
+// DeleteGroup forgets a worker group and its leases, false if there's no such group.
+func (app *App) DeleteGroup(name string) (found bool, err error) {
+	app.groups.mu.Lock()
+	defer app.groups.mu.Unlock()
+
+	if _, found = app.groups.groups[name]; !found {
+		return false, nil
+	}
+
+	return true, app.groups.append(groupRecord{Group: name, Op: "delete"})
+}
+
+// Group is how a worker group is getting on, with its leases, false if there's no such group.
+func (app *App) Group(name string) (status GroupStatus, found bool) {
+	committed := app.Committed()
+
+	app.groups.mu.Lock()
+	defer app.groups.mu.Unlock()
+
+	g, found := app.groups.groups[name]
+	if !found {
+		return status, false
+	}
+	status = g.status(committed)
+	for _, lease := range g.leases {
+		status.Leases = append(status.Leases, *lease)
+	}
+	sort.Slice(status.Leases, func(i, j int) bool { return status.Leases[i].Sequence < status.Leases[j].Sequence })
+
+	return status, true
+}
+
+// Groups is how every worker group is getting on, ordered by name.
+func (app *App) Groups() (statuses []GroupStatus) {
+	committed := app.Committed()
+	statuses = []GroupStatus{}
+
+	app.groups.mu.Lock()
+	defer app.groups.mu.Unlock()
+
+	for _, g := range app.groups.groups {
+		statuses = append(statuses, g.status(committed))
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+
+	return statuses
+}
+
+func (g *group) status(committed data.Sequence) (status GroupStatus) {
+	status = GroupStatus{Name: g.name, Stream: g.stream, Done: g.done(), Next: g.next, Leased: len(g.leases)}
+	if committed >= g.next {
+		status.Pending = uint64(committed-g.next) + 1
+	}
+	now := time.Now()
+	for _, lease := range g.leases {
+		if !lease.Expires.After(now) {
+			status.Expired++
+		}
+	}
+
+	return status
+}
+
+// done is the last message the group is done with, everything up to and including it has been acked.
+func (g *group) done() data.Sequence {
+	done := g.next - 1
+	for sequence := range g.leases {
+		if sequence <= done {
+			done = sequence - 1
+		}
+	}
+
+	return done
+}
+
+// readMessage reads a single message, false if it's not in the log.
+func (app *App) readMessage(sequence data.Sequence) (message data2.Message, found bool, err error) {
+	err = ReadLog(app.DataDir, sequence, func(m data2.Message) error {
+		message, found = m, m.Sequence == sequence
+		return ErrStopReading
+	})
+
+	return message, found, err
+}
+
+// update checks every message of an ack or release is leased to its worker, then records it.
+func (g *groups) update(record groupRecord) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	group, found := g.groups[record.Group]
+	if !found {
+		return ErrNotLeased
+	}
+	for _, sequence := range record.Sequences {
+		if lease, leased := group.leases[sequence]; !leased || lease.Worker != record.Worker {
+			return ErrNotLeased
+		}
+	}
+	if record.Op == "release" {
+		record.Expires = time.Now().UnixNano()
+	}
+
+	return g.append(record)
+}
+
+// append adds a record to the side log, with the lock held.
+func (g *groups) append(record groupRecord) (err error) {
+	if err = g.log.append(record); err != nil {
+		return err
+	}
+	g.apply(record)
+	if g.log.compact(g.live) {
+		return g.rewrite()
+	}
+
+	return nil
+}
+
+func (g *groups) apply(record groupRecord) {
+	if record.Op == "create" {
+		if existing, found := g.groups[record.Group]; found {
+			g.live -= 1 + len(existing.leases)
+		}
+		g.live++
+		g.groups[record.Group] = &group{name: record.Group,
+			stream: record.Stream,
+			next:   record.Next,
+			leases: map[data.Sequence]*Lease{}}
+	}
+	group, found := g.groups[record.Group]
+	if !found {
+		return
+	}
+
+	switch record.Op {
+	case "lease":
+		for _, sequence := range record.Sequences {
+			lease, leased := group.leases[sequence]
+			if !leased {
+				lease = &Lease{Sequence: sequence}
+				group.leases[sequence] = lease
+				g.live++
+			}
+			lease.Worker, lease.Expires = record.Worker, time.Unix(0, record.Expires)
+			lease.Deliveries++
+			if record.Deliveries > 0 {
+				lease.Deliveries = record.Deliveries
+			}
+		}
+		for _, sequence := range record.Dropped {
+			g.drop(group, sequence)
+		}
+		if record.Next > group.next {
+			group.next = record.Next
+		}
+	case "ack":
+		for _, sequence := range record.Sequences {
+			g.drop(group, sequence)
+		}
+	case "release":
+		for _, sequence := range record.Sequences {
+			if lease, leased := group.leases[sequence]; leased {
+				lease.Expires = time.Unix(0, record.Expires)
+			}
+		}
+	case "delete":
+		g.live -= 1 + len(group.leases)
+		delete(g.groups, record.Group)
+	}
+}
+
+// drop removes a lease, if it's there.
+func (g *groups) drop(group *group, sequence data.Sequence) {
+	if _, leased := group.leases[sequence]; leased {
+		delete(group.leases, sequence)
+		g.live--
+	}
+}
+
+// rewrite rewrites the side log with a create for each group, and its leases.
+func (g *groups) rewrite() error {
+	var records []interface{}
+	for _, group := range g.groups {
+		records = append(records, groupRecord{Group: group.name, Op: "create", Stream: group.stream, Next: group.next})
+		for _, lease := range group.leases {
+			records = append(records, groupRecord{Group: group.name,
+				Op:         "lease",
+				Sequences:  []data.Sequence{lease.Sequence},
+				Worker:     lease.Worker,
+				Expires:    lease.Expires.UnixNano(),
+				Deliveries: lease.Deliveries})
+		}
+	}
+
+	return g.log.rewrite(records)
+}
+
+// minGroupDone is the last message every worker group has acked, false if there are no groups.
+func (app *App) minGroupDone() (min data.Sequence, any bool) {
+	app.groups.mu.Lock()
+	defer app.groups.mu.Unlock()
+
+	for _, group := range app.groups.groups {
+		if done := group.done(); !any || done < min {
+			min, any = done, true
+		}
+	}
+
+	return min, any
+}
+
+func validName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, " \t\r\n/")
+}
@@ -0,0 +1,294 @@
+package app
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/saem/afterme/data"
+	"github.com/saem/afterme/data1"
+	"github.com/saem/afterme/data2"
+	"io"
+	"io/ioutil"
+	"sort"
+)
+
+// Log file management/anti-corruption layer between versioned file handling, everything outside of this file
+// deals in the current version's messages regardless of what version is on disk.
+
+// scannerMaxTokenSize is how big a header or body is allowed to get when reading, the scanner defaults to 64KB
+// which is much smaller than MaxMessageSize.
+const scannerMaxTokenSize = 2 * MaxMessageSize
+
+// ErrStopReading can be returned by a ReadLog callback to stop reading without ReadLog returning an error.
+var ErrStopReading = errors.New("stop reading")
+
+// Segment is a data file, of any version, within a data dir.
+type Segment struct {
+	Version          data.Version  `json:"version"`
+	StartingSequence data.Sequence `json:"first"`
+	Name             string        `json:"name"`
+}
+
+// ListSegments finds all the data files in dataDir, ordered by their starting sequence.
+func ListSegments(dataDir string) (segments []Segment, err error) {
+	fileInfos, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Look for data files <version>-<sequence>.log, maybe others in the future, version must be first
+	for _, fileInfo := range fileInfos {
+		if fileInfo.IsDir() {
+			continue
+		}
+
+		var segment = Segment{Name: fileInfo.Name()}
+		switch {
+		case data1.LogFileValidateName(fileInfo.Name()):
+			segment.Version, segment.StartingSequence, err = data1.LogFileNameParser(fileInfo.Name())
+		case data2.LogFileValidateName(fileInfo.Name()):
+			segment.Version, segment.StartingSequence, err = data2.LogFileNameParser(fileInfo.Name())
+		default:
+			continue
+		}
+
+		// This shouldn't be possible because we've validated the file name -- famous last words
+		if err != nil {
+			return nil, err
+		}
+
+		segments = append(segments, segment)
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		if segments[i].StartingSequence == segments[j].StartingSequence {
+			return segments[i].Version < segments[j].Version
+		}
+		return segments[i].StartingSequence < segments[j].StartingSequence
+	})
+
+	return segments, nil
+}
+
+// DataFile creates the versioned data.DataFile for the segment.
+func (s Segment) DataFile(dataDir string) data.DataFile {
+	switch s.Version {
+	case data.Version(1):
+		return data1.NewDataFile(s.StartingSequence, dataDir)
+	default:
+		return data2.NewDataFile(s.StartingSequence, dataDir)
+	}
+}
+
+// ReadLog calls fn, in order, for every message in dataDir with a sequence of at least from. Should fn return
+// ErrStopReading, reading stops and nil is returned, any other error is passed along.
+func ReadLog(dataDir string, from data.Sequence, fn func(message data2.Message) error) (err error) {
+	segments, err := ListSegments(dataDir)
+	if err != nil {
+		return err
+	}
+
+	for i, segment := range segments {
+		// Skip over segments that end before from
+		if i+1 < len(segments) && segments[i+1].StartingSequence <= from {
+			continue
+		}
+
+		err = ReadSegment(dataDir, segment, from, fn)
+		if err == ErrStopReading {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReadLogBackwards calls fn, last first, for every message in dataDir with a sequence from from up to to that keep
+// wants. It reads a segment at a time, starting with the last, holding on to what keep wants of each until it's been
+// read, so reading the last few messages only means reading the last segment or two. Should fn return
+// ErrStopReading, reading stops and nil is returned, any other error is passed along.
+func ReadLogBackwards(dataDir string, from data.Sequence, to data.Sequence, keep func(message data2.Message) bool,
+	fn func(message data2.Message) error) (err error) {
+	segments, err := ListSegments(dataDir)
+	if err != nil {
+		return err
+	}
+
+	for i := len(segments) - 1; i >= 0; i-- {
+		// Skip over segments that start after to, and stop at the first that ends before from
+		if segments[i].StartingSequence > to {
+			continue
+		}
+		if i+1 < len(segments) && segments[i+1].StartingSequence <= from {
+			break
+		}
+
+		var kept []data2.Message
+		err = ReadSegment(dataDir, segments[i], from, func(message data2.Message) error {
+			if message.Sequence > to {
+				return ErrStopReading
+			}
+			if keep(message) {
+				kept = append(kept, message)
+			}
+			return nil
+		})
+		if err != nil && err != ErrStopReading {
+			return err
+		}
+		for j := len(kept) - 1; j >= 0; j-- {
+			if err = fn(kept[j]); err == ErrStopReading {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ReadSegment calls fn, in order, for every message in a segment with a sequence of at least from, upgrading older
+// versions to data2.Message. Reading starts from the segment's time index entry for from, if there is one, so
+// reading from the end of a segment doesn't mean reading all of it.
+func ReadSegment(dataDir string, segment Segment, from data.Sequence, fn func(message data2.Message) error) error {
+	offset, indexed := indexedOffset(dataDir, segment, from)
+	read := false
+	_, err := readSegment(dataDir, segment, offset, func(message data2.Message, messageOffset int64) error {
+		if !read && offset > 0 && message.Sequence != indexed {
+			return errStaleIndex
+		}
+		read = true
+		if message.Sequence < from {
+			return nil
+		}
+		return fn(message)
+	})
+	if err != nil && !read && offset > 0 {
+		// The index is only a shortcut, if it's out of date the segment's read from the start
+		return readSegmentFrom(dataDir, segment, from, fn)
+	}
+
+	return err
+}
+
+// readSegmentFrom is ReadSegment without the time index.
+func readSegmentFrom(dataDir string, segment Segment, from data.Sequence, fn func(message data2.Message) error) error {
+	_, err := readSegment(dataDir, segment, 0, func(message data2.Message, offset int64) error {
+		if message.Sequence < from {
+			return nil
+		}
+		return fn(message)
+	})
+
+	return err
+}
+
+// errStaleIndex is returned when a time index entry doesn't point at the message it's for.
+var errStaleIndex = errors.New("time index entry doesn't match the data file")
+
+// indexedOffset is where to start reading a segment for the message from, the offset of the last time index entry
+// at or before it, along with the sequence of the message there. It's the start of the segment if there's no such
+// entry, or the segment can't be read part way through.
+func indexedOffset(dataDir string, segment Segment, from data.Sequence) (offset int64, sequence data.Sequence) {
+	sequence = segment.StartingSequence
+	if segment.Version == data.Version(1) {
+		return 0, sequence
+	}
+	entries, _ := data2.ReadIndex(dataDir, segment.Name)
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].Sequence > from })
+	if i == 0 {
+		return 0, sequence
+	}
+
+	return entries[i-1].Offset, entries[i-1].Sequence
+}
+
+// seekableDataFile is a data file that can be read from part way through, version 2 onwards
+type seekableDataFile interface {
+	OpenForReadAt(offset int64) (scanner *bufio.Scanner, err error)
+}
+
+// readSegment calls fn, in order, for every message in a segment starting with the one at offset, which must be
+// the start of a header, along with the offset of each message. end is the offset just past the last complete
+// message read, anything after it is a partial write.
+func readSegment(dataDir string, segment Segment, offset int64,
+	fn func(message data2.Message, offset int64) error) (end int64, err error) {
+	df := segment.DataFile(dataDir)
+
+	var scanner *bufio.Scanner
+	if seekable, ok := df.(seekableDataFile); ok {
+		scanner, err = seekable.OpenForReadAt(offset)
+	} else if offset == 0 {
+		scanner, err = df.OpenForRead()
+	} else {
+		err = fmt.Errorf("Version %d data files can only be read from the start", segment.Version)
+	}
+	if err != nil {
+		return offset, err
+	}
+	defer df.Close()
+	scanner.Buffer(make([]byte, 64*1024), scannerMaxTokenSize)
+
+	return scanMessages(segment.Version, scanner, offset, fn)
+}
+
+// newScanner returns a scanner for messages in the given version's format, read from r.
+func newScanner(version data.Version, r io.Reader) (scanner *bufio.Scanner) {
+	switch version {
+	case data.Version(1):
+		scanner = data1.NewScanner(r)
+	default:
+		scanner = data2.NewScanner(r)
+	}
+	scanner.Buffer(make([]byte, 64*1024), scannerMaxTokenSize)
+
+	return scanner
+}
+
+// scanMessages calls fn for every message a scanner produces, offset is where the scanner starts, in the file or
+// stream being read, and is used to work out the offset of each message. end is the offset just past the last
+// complete message, anything after it is a partial write.
+func scanMessages(version data.Version, scanner *bufio.Scanner, offset int64,
+	fn func(message data2.Message, offset int64) error) (end int64, err error) {
+	end = offset
+	for scanner.Scan() {
+		message, err := messageFromHeader(version, scanner.Text())
+		if err != nil {
+			return end, err
+		}
+		headerSize := int64(len(scanner.Bytes())) + 1 // The header's newline isn't part of the token
+		if !scanner.Scan() {
+			break // A header without a body, partial write
+		}
+
+		message.Body = make([]byte, len(scanner.Bytes()))
+		copy(message.Body, scanner.Bytes())
+
+		messageOffset := end
+		end += headerSize + int64(len(message.Body))
+		if err = fn(message, messageOffset); err != nil {
+			return end, err
+		}
+	}
+
+	return end, scanner.Err()
+}
+
+// messageFromHeader parses a header from a file of the given version.
+func messageFromHeader(version data.Version, header string) (message data2.Message, err error) {
+	switch version {
+	case data.Version(1):
+		m := data1.MessageFromHeader(header)
+		return data2.Message{Sequence: m.Sequence,
+			TimeStamp:   m.TimeStamp,
+			MessageSize: m.MessageSize,
+			Hash:        m.Hash}, nil
+	default:
+		return data2.MessageFromHeader(header)
+	}
+}
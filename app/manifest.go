@@ -0,0 +1,217 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/saem/afterme/data"
+	"github.com/saem/afterme/data2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// The manifest (<datadir>/manifest.json) summarises each data file that's done with, its sequences and the span of
+// time its messages cover (see data2.MessageTime). Together with each data file's sparse time index it means
+// finding the messages from a point in time only needs to scan a small part of one data file.
+
+const (
+	ManifestFileName  = "manifest.json"
+	TimeIndexInterval = 1000 // Messages between time index entries
+)
+
+// ManifestEntry summarises a data file.
+type ManifestEntry struct {
+	Segment string        `json:"segment"`
+	First   data.Sequence `json:"first"`
+	Last    data.Sequence `json:"last"`
+	Count   uint64        `json:"count"`
+	MinTime int64         `json:"min_time"` // Nanoseconds since the epoch
+	MaxTime int64         `json:"max_time"`
+}
+
+// Manifest is the contents of the manifest file.
+type Manifest struct {
+	Segments []ManifestEntry `json:"segments"`
+}
+
+// ReadManifest reads the manifest in dataDir, a missing manifest is an empty one.
+func ReadManifest(dataDir string) (manifest *Manifest, err error) {
+	manifest = new(Manifest)
+	contents, err := ioutil.ReadFile(filepath.Join(dataDir, ManifestFileName))
+	if os.IsNotExist(err) {
+		return manifest, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(contents, manifest)
+
+	return manifest, err
+}
+
+// Entry looks up the entry for a data file.
+func (manifest *Manifest) Entry(segment string) (entry ManifestEntry, ok bool) {
+	for _, entry = range manifest.Segments {
+		if entry.Segment == segment {
+			return entry, true
+		}
+	}
+
+	return entry, false
+}
+
+// addToManifest adds, or replaces, the entry for a data file.
+func (app *App) addToManifest(entry ManifestEntry) {
+	app.manifestLock.Lock()
+	defer app.manifestLock.Unlock()
+
+	manifest, err := ReadManifest(app.DataDir)
+	if err == nil {
+		segments := []ManifestEntry{entry}
+		for _, existing := range manifest.Segments {
+			if existing.Segment != entry.Segment {
+				segments = append(segments, existing)
+			}
+		}
+		sort.Slice(segments, func(i, j int) bool { return segments[i].First < segments[j].First })
+		manifest.Segments = segments
+
+		err = writeManifest(app.DataDir, manifest)
+	}
+	if err != nil {
+		app.Logger.Printf("Could not add %s to the manifest, because: %s", entry.Segment, err.Error())
+	}
+}
+
+// removeFromManifest removes the entry for a data file, if there is one.
+func (app *App) removeFromManifest(segment string) {
+	app.manifestLock.Lock()
+	defer app.manifestLock.Unlock()
+
+	manifest, err := ReadManifest(app.DataDir)
+	if err == nil {
+		if _, ok := manifest.Entry(segment); !ok {
+			return
+		}
+		var segments []ManifestEntry
+		for _, existing := range manifest.Segments {
+			if existing.Segment != segment {
+				segments = append(segments, existing)
+			}
+		}
+		manifest.Segments = segments
+
+		err = writeManifest(app.DataDir, manifest)
+	}
+	if err != nil {
+		app.Logger.Printf("Could not remove %s from the manifest, because: %s", segment, err.Error())
+	}
+}
+
+// writeManifest writes to a temporary file then renames it, so the manifest is never partially written.
+func writeManifest(dataDir string, manifest *Manifest) (err error) {
+	contents, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dataDir, ManifestFileName)
+	if err = ioutil.WriteFile(path+".tmp", contents, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// createIndex creates an empty time index for a data file, replacing any that's there.
+func createIndex(dataDir string, segment string) (index *os.File, err error) {
+	os.Remove(filepath.Join(dataDir, data2.IndexFileName(segment)))
+
+	return data2.OpenIndexForAppend(dataDir, segment)
+}
+
+// SequenceAtTime finds the first message at or after t (nanoseconds since the epoch, see data2.MessageTime). If
+// every message is before t, it's the sequence after the last message.
+func SequenceAtTime(dataDir string, t int64) (sequence data.Sequence, err error) {
+	segments, err := ListSegments(dataDir)
+	if err != nil {
+		return 0, err
+	}
+	manifest, err := ReadManifest(dataDir)
+	if err != nil {
+		return 0, err
+	}
+
+	sequence = data.Sequence(1)
+	for _, segment := range segments {
+		if entry, ok := manifest.Entry(segment.Name); ok && entry.MaxTime < t {
+			sequence = entry.Last + 1
+			continue
+		}
+
+		// Start from the last index entry before t, without an index it's the whole file
+		var offset int64
+		entries, _ := data2.ReadIndex(dataDir, segment.Name)
+		for _, entry := range entries {
+			if entry.Time >= t {
+				break
+			}
+			offset = entry.Offset
+		}
+
+		found := false
+		_, err = readSegment(dataDir, segment, offset, func(message data2.Message, offset int64) error {
+			sequence = message.Sequence + 1
+			if data2.MessageTime(message) >= t {
+				sequence, found = message.Sequence, true
+				return ErrStopReading
+			}
+			return nil
+		})
+		if err != nil && err != ErrStopReading {
+			return 0, err
+		}
+		if found {
+			return sequence, nil
+		}
+	}
+
+	return sequence, nil
+}
+
+// TimeRange narrows the sequences [from, to] to the messages at or after since, and before until, both RFC3339
+// times that are ignored if they're empty.
+func TimeRange(dataDir string, from data.Sequence, to data.Sequence, since string,
+	until string) (data.Sequence, data.Sequence, error) {
+	if since != "" {
+		t, err := time.Parse(time.RFC3339Nano, since)
+		if err != nil {
+			return 0, 0, fmt.Errorf("Invalid since, expected an RFC3339 time: %s", since)
+		}
+		sequence, err := SequenceAtTime(dataDir, t.UnixNano())
+		if err != nil {
+			return 0, 0, err
+		}
+		if sequence > from {
+			from = sequence
+		}
+	}
+	if until != "" {
+		t, err := time.Parse(time.RFC3339Nano, until)
+		if err != nil {
+			return 0, 0, fmt.Errorf("Invalid until, expected an RFC3339 time: %s", until)
+		}
+		sequence, err := SequenceAtTime(dataDir, t.UnixNano())
+		if err != nil {
+			return 0, 0, err
+		}
+		if sequence-1 < to {
+			to = sequence - 1
+		}
+	}
+
+	return from, to, nil
+}
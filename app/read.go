@@ -0,0 +1,35 @@
+package app
+
+import (
+	"github.com/saem/afterme/data2"
+	"github.com/saem/afterme/keystore"
+)
+
+// Deliverable turns a message, as read from the log, into what should be handed to a reader. Sealed bodies are
+// opened, if the subject has been erased the body is replaced by a bare newline and data2.AttrErased is set, so
+// readers get a clear marker rather than cipher text.
+func Deliverable(keys *keystore.Store, message data2.Message) (data2.Message, error) {
+	if _, sealed := message.Attributes[data2.AttrCipher]; !sealed {
+		return message, nil
+	}
+
+	body, err := keys.Open(message.Attributes[data2.AttrSubject], message.Attributes[data2.AttrKey], message.Body)
+	switch {
+	case err == keystore.ErrErased:
+		message.Attributes = message.Attributes.Copy()
+		message.Attributes[data2.AttrErased] = "true"
+		message.Body = []byte("\n")
+	case err != nil:
+		return message, err
+	default:
+		message.Body = body
+	}
+	message.MessageSize = uint32(len(message.Body))
+
+	return message, nil
+}
+
+// Erased reports whether a message returned by Deliverable had its body erased.
+func Erased(message data2.Message) bool {
+	return message.Attributes[data2.AttrErased] == "true"
+}
@@ -0,0 +1,139 @@
+package app
+
+import (
+	"fmt"
+	"github.com/saem/afterme/data"
+	"github.com/saem/afterme/data2"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Replication is pull based. Followers ask a leader for its data files (GET /segments), then for the bytes of each
+// one from where their copy ends (GET /segments/<name>?offset=). A follower checks the messages and appends them as
+// they are, so its data files are byte for byte the same as the leader's. Every pull also reports how far the
+// follower has got, which is what a leader waiting for a quorum (config.ReplicationConfig) waits on.
+
+// MaxReplicationBytes is roughly the most a follower is sent per pull, a pull always gets at least one message.
+const MaxReplicationBytes = 16 * 1024 * 1024
+
+// FollowerStatus is what a leader knows about a follower.
+type FollowerStatus struct {
+	Id         string        `json:"id"`
+	Replicated data.Sequence `json:"replicated"` // Everything up to and including this is synced on the follower
+	Lag        uint64        `json:"lag"`        // Committed messages the follower is yet to sync
+	LastSeen   time.Time     `json:"last_seen"`
+}
+
+// followers tracks how far each follower of a leader has got.
+type followers struct {
+	mu         sync.Mutex
+	replicated map[string]FollowerStatus
+	changed    chan struct{} // Closed, and replaced, whenever a follower gets further
+}
+
+func newFollowers() *followers {
+	return &followers{replicated: map[string]FollowerStatus{}, changed: make(chan struct{})}
+}
+
+// ReplicaEnd works out how much of a data file, from offset, to send a follower: up to the end of the last
+// committed message, or MaxReplicationBytes or so, whichever is less.
+func (app *App) ReplicaEnd(segment Segment, offset int64) (end int64, err error) {
+	end, _, err = app.replicaEnd(segment, offset, app.Committed())
+	return end, err
+}
+
+// replicaEnd is ReplicaEnd, sending messages up to and including upTo. last is the last message to be sent, or
+// zero if there aren't any.
+func (app *App) replicaEnd(segment Segment, offset int64, upTo data.Sequence) (end int64, last data.Sequence,
+	err error) {
+	start := offset
+	if segment.Version == data.Version(1) {
+		start = 0 // Version 1 files can only be read from the start
+	}
+
+	stop := int64(-1)
+	end, err = readSegment(app.DataDir, segment, start, func(message data2.Message, messageOffset int64) error {
+		if messageOffset < offset {
+			return nil
+		}
+		if message.Sequence > upTo || messageOffset-offset >= MaxReplicationBytes {
+			stop = messageOffset
+			return ErrStopReading
+		}
+		last = message.Sequence
+		return nil
+	})
+	if stop >= 0 {
+		return stop, last, nil
+	}
+	if end < offset {
+		return offset, 0, fmt.Errorf("Offset %d is past the end of %s", offset, segment.Name)
+	}
+
+	return end, last, err
+}
+
+// Replicated records that a follower has synced everything up to and including sequence.
+func (app *App) Replicated(id string, sequence data.Sequence) {
+	app.followers.mu.Lock()
+	defer app.followers.mu.Unlock()
+
+	previous := app.followers.replicated[id]
+	app.followers.replicated[id] = FollowerStatus{Id: id, Replicated: sequence, LastSeen: time.Now()}
+	if sequence > previous.Replicated {
+		close(app.followers.changed)
+		app.followers.changed = make(chan struct{})
+	}
+}
+
+// WaitForQuorum waits until the configured quorum of followers have synced sequence, or the replication timeout
+// passes, in which case an error is returned. There's nothing to wait for without a quorum.
+func (app *App) WaitForQuorum(sequence data.Sequence) error {
+	quorum := app.Config.Replication.Quorum
+	if quorum == 0 {
+		return nil
+	}
+
+	timeout := time.NewTimer(app.Config.Replication.Wait())
+	defer timeout.Stop()
+	for {
+		app.followers.mu.Lock()
+		replicas := 0
+		for _, follower := range app.followers.replicated {
+			if follower.Replicated >= sequence {
+				replicas++
+			}
+		}
+		changed := app.followers.changed
+		app.followers.mu.Unlock()
+
+		if replicas >= quorum {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-timeout.C:
+			return fmt.Errorf("Only %d of the %d followers needed have sequence %d", replicas, quorum, sequence)
+		}
+	}
+}
+
+// Followers is the status of every follower that's pulled from this leader, ordered by id.
+func (app *App) Followers() (statuses []FollowerStatus) {
+	committed := app.Committed()
+
+	app.followers.mu.Lock()
+	defer app.followers.mu.Unlock()
+
+	for _, follower := range app.followers.replicated {
+		if committed > follower.Replicated {
+			follower.Lag = uint64(committed - follower.Replicated)
+		}
+		statuses = append(statuses, follower)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Id < statuses[j].Id })
+
+	return statuses
+}
@@ -0,0 +1,92 @@
+package app
+
+import (
+	"github.com/saem/afterme/data"
+	"github.com/saem/afterme/data2"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Retention deletes the oldest data files, along with their seals, time indexes and manifest entries, once their
+// newest message is older than the configured max age. Only files that are done with, those in the manifest, are
+// ever deleted, and only from the start of the log, so what's left is always contiguous. With keep_for_consumers
+// a file isn't deleted until every consumer's offset, every worker group's acks, and everything else that's asked
+// to be waited for (see Hold), are at or past its last message.
+
+// RetentionInterval is how often data files are checked against the retention settings.
+const RetentionInterval = time.Minute
+
+// Retain deletes data files as the retention settings say, every RetentionInterval, it never returns.
+func (app *App) Retain() {
+	for {
+		app.applyRetention(time.Now())
+		time.Sleep(RetentionInterval)
+	}
+}
+
+// Hold has retention wait for a reader the App doesn't keep track of itself, such as a delivery target, as it does
+// for consumers when keep_for_consumers is set. done is the last sequence the reader is done with.
+func (app *App) Hold(done func() data.Sequence) {
+	app.holdsLock.Lock()
+	defer app.holdsLock.Unlock()
+	app.holds = append(app.holds, done)
+}
+
+// minHeld is the lowest sequence of the readers retention's been asked to wait for.
+func (app *App) minHeld() (min data.Sequence, any bool) {
+	app.holdsLock.Lock()
+	defer app.holdsLock.Unlock()
+
+	for _, done := range app.holds {
+		if held := done(); !any || held < min {
+			min, any = held, true
+		}
+	}
+
+	return min, any
+}
+
+// applyRetention deletes the data files that are too old at now, it returns how many were deleted.
+func (app *App) applyRetention(now time.Time) (deleted int) {
+	retention := app.Config.Retention
+	age := retention.Age()
+	if age == 0 {
+		return 0
+	}
+
+	manifest, err := ReadManifest(app.DataDir)
+	if err != nil {
+		app.Logger.Printf("Could not read the manifest to apply retention, because: %s", err.Error())
+		return 0
+	}
+	committed := app.Committed()
+	keep, anyConsumers := app.minConsumerOffset()
+	if done, anyGroups := app.minGroupDone(); anyGroups && (!anyConsumers || done < keep) {
+		keep, anyConsumers = done, true
+	}
+	if held, anyHeld := app.minHeld(); anyHeld && (!anyConsumers || held < keep) {
+		keep, anyConsumers = held, true
+	}
+
+	for _, entry := range manifest.Segments {
+		switch {
+		case entry.MaxTime > now.Add(-age).UnixNano(), entry.Last > committed:
+			return deleted
+		case retention.KeepForConsumers && anyConsumers && entry.Last > keep:
+			return deleted
+		}
+
+		app.Logger.Printf("Retention: deleting %s, sequences %d to %d", entry.Segment, entry.First, entry.Last)
+		if err = os.Remove(filepath.Join(app.DataDir, entry.Segment)); err != nil && !os.IsNotExist(err) {
+			app.Logger.Printf("Could not delete %s, because: %s", entry.Segment, err.Error())
+			return deleted
+		}
+		os.Remove(filepath.Join(app.DataDir, data2.SealFileName(entry.Segment)))
+		os.Remove(filepath.Join(app.DataDir, data2.IndexFileName(entry.Segment)))
+		app.removeFromManifest(entry.Segment)
+		deleted++
+	}
+
+	return deleted
+}
@@ -0,0 +1,108 @@
+package app
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// The schema registry (see the schema package) isn't in the log, so it's copied to the other nodes alongside it.
+// The leader says how many schema versions it has with everything it sends, a follower in the X-Afterme-Schemas
+// header of each pull and a cluster node in each AppendRequest. A node that has fewer copies the ones it's missing,
+// from /replication/schemas on a follower's leader, /raft/schemas on a cluster's: GET of it for every stream's
+// versions, a line of each stream and version (see ListSchemas), and GET of <stream>/<version> under it for one.
+//
+// Until it's copied them a node is behind, and if it takes over writes in the meantime it turns away writes to
+// named streams, and schemas being registered, rather than validate against schemas it hasn't got or give a new
+// one a version number the old leader already gave another.
+
+// ErrSchemasBehind is the error for a write, or registering a schema, on a node missing schemas the leader had.
+var ErrSchemasBehind = errors.New("this node is yet to copy every schema from the last leader, try again shortly")
+
+// WantSchemas records how many schema versions the leader has, the node's behind until it has as many.
+func (app *App) WantSchemas(count int) {
+	atomic.StoreInt64(&app.schemasWanted, int64(count))
+	app.checkSchemas()
+}
+
+// SchemasBehind is whether the node has fewer schema versions than the leader had, as of the last it heard.
+func (app *App) SchemasBehind() bool {
+	return atomic.LoadInt32(&app.schemasBehind) == 1
+}
+
+// checkSchemas works out whether the node is behind.
+func (app *App) checkSchemas() {
+	behind := int32(0)
+	if count, err := app.Schemas.Count(); err != nil || int64(count) < atomic.LoadInt64(&app.schemasWanted) {
+		behind = 1
+	}
+	atomic.StoreInt32(&app.schemasBehind, behind)
+}
+
+// ListSchemas is every schema version, a line of each one's stream and version.
+func (app *App) ListSchemas() (list []byte, err error) {
+	streams, err := app.Schemas.Streams()
+	var b bytes.Buffer
+	for stream, versions := range streams {
+		for _, version := range versions {
+			fmt.Fprintln(&b, stream, version)
+		}
+	}
+
+	return b.Bytes(), err
+}
+
+// CopySchemas copies the schema versions the node is missing from the leader, get gets a path from it, under
+// base.
+func (app *App) CopySchemas(base string, get func(path string) (*http.Response, error)) error {
+	defer app.checkSchemas()
+
+	listed, err := getBody(get, base)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(listed), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		stream, version := fields[0], fields[1]
+		number, err := strconv.Atoi(version)
+		if err != nil {
+			return fmt.Errorf("The leader listed schema %s version %s", stream, version)
+		}
+		if _, err = app.Schemas.Document(stream, number); err == nil {
+			continue
+		}
+		document, err := getBody(get, base+"/"+url.PathEscape(stream)+"/"+version)
+		if err != nil {
+			return err
+		}
+		if err = app.Schemas.Import(stream, number, document); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getBody gets a path with get, the body of a 200 or an error.
+func getBody(get func(path string) (*http.Response, error), path string) ([]byte, error) {
+	response, err := get(path)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	contents, err := ioutil.ReadAll(response.Body)
+	if err == nil && response.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%s from the leader: %s", response.Status, bytes.TrimSpace(contents))
+	}
+
+	return contents, err
+}
@@ -0,0 +1,147 @@
+package app
+
+import (
+	"encoding/base64"
+	"github.com/saem/afterme/data"
+	"github.com/saem/afterme/data2"
+	"os"
+)
+
+// segmentSummary describes a data file that's no longer being written to, holding messages [First, Next).
+type segmentSummary struct {
+	Name    string
+	First   data.Sequence
+	Next    data.Sequence
+	Chain   string // Chain hash of the last message
+	MinTime int64  // See data2.MessageTime
+	MaxTime int64
+}
+
+// summarizeSegments catches up on data files left behind by the last run: any version 2 files left unsealed, or
+// without a time index, and any file missing from the manifest. That's normally just the one being written to when
+// the server last stopped.
+func (app *App) summarizeSegments() {
+	segments, err := ListSegments(app.DataDir)
+	if err != nil {
+		app.Logger.Fatalf("Could not list data files in %s, because: %s", app.DataDir, err.Error())
+	}
+	manifest, err := ReadManifest(app.DataDir)
+	if err != nil {
+		app.Logger.Fatalf("Could not read the manifest in %s, because: %s", app.DataDir, err.Error())
+	}
+
+	for i, segment := range segments {
+		if (app.Leader != "" || app.roles != nil) && i == len(segments)-1 {
+			continue // Followers, and cluster nodes, can carry on appending to their latest file
+		}
+
+		_, inManifest := manifest.Entry(segment.Name)
+		unsealed, unindexed := false, false
+		if segment.Version == data.Version(2) {
+			_, err = data2.ReadSeal(app.DataDir, segment.Name)
+			unsealed = os.IsNotExist(err)
+			_, err = data2.ReadIndex(app.DataDir, segment.Name)
+			unindexed = os.IsNotExist(err)
+		}
+		if inManifest && !unsealed && !unindexed {
+			continue
+		}
+
+		// An unsealed file was being written to, its index wasn't synced so it's rebuilt as well
+		var index *os.File
+		if unsealed || unindexed {
+			index, err = createIndex(app.DataDir, segment.Name)
+			if err != nil {
+				app.Logger.Fatalf("Could not create time index for %s/%s, because: %s",
+					app.DataDir,
+					segment.Name,
+					err.Error())
+			}
+		}
+
+		summary, _, err := summarize(app.DataDir, segment, index)
+		if index != nil {
+			index.Close()
+		}
+		if err != nil {
+			app.Logger.Fatalf("Could not read file, %s/%s, because: %s",
+				app.DataDir,
+				segment.Name,
+				err.Error())
+		}
+
+		if summary.Next == summary.First {
+			continue // Empty
+		}
+		if unsealed {
+			app.sealFile(summary)
+		}
+		if !inManifest {
+			app.addToManifest(summary.manifestEntry())
+		}
+	}
+}
+
+// summarize reads a data file to summarize it, adding to its time index if index isn't nil. end is the offset just
+// past its last complete message.
+func summarize(dataDir string, segment Segment, index *os.File) (summary segmentSummary, end int64, err error) {
+	summary = segmentSummary{Name: segment.Name, First: segment.StartingSequence, Next: segment.StartingSequence}
+	end, err = readSegment(dataDir, segment, 0, func(message data2.Message, offset int64) error {
+		t := data2.MessageTime(message)
+		if index != nil && (message.Sequence-summary.First)%TimeIndexInterval == 0 {
+			entry := data2.IndexEntry{Time: t, Sequence: message.Sequence, Offset: offset}
+			if err := data2.WriteIndexEntry(index, entry); err != nil {
+				return err
+			}
+		}
+		if summary.Next == summary.First || t < summary.MinTime {
+			summary.MinTime = t
+		}
+		if t > summary.MaxTime {
+			summary.MaxTime = t
+		}
+		summary.Next = message.Sequence + 1
+		summary.Chain = message.Attributes[data2.AttrChain]
+		return nil
+	})
+
+	return summary, end, err
+}
+
+// finishFile seals, and adds to the manifest, a data file that's no longer being written to.
+func (app *App) finishFile(summary segmentSummary) {
+	app.sealFile(summary)
+	app.addToManifest(summary.manifestEntry())
+}
+
+// sealFile writes the signed seal for a data file that's no longer being written to.
+func (app *App) sealFile(summary segmentSummary) {
+	seal := data2.Seal{Segment: summary.Name,
+		First: summary.First,
+		Last:  summary.Next - 1,
+		Count: uint64(summary.Next - summary.First),
+		Chain: summary.Chain}
+
+	root, err := app.segmentRoot(summary.First, summary.Next)
+	if err == nil {
+		seal.Merkle = base64.StdEncoding.EncodeToString(root)
+		seal.Digest, err = data2.FileDigest(app.DataDir, summary.Name)
+	}
+	if err == nil {
+		seal.Sign(app.Key)
+		err = data2.WriteSeal(app.DataDir, seal)
+	}
+	if err != nil {
+		app.Logger.Printf("Could not seal file, %s/%s, because: %s", app.DataDir, summary.Name, err.Error())
+	}
+}
+
+// manifestEntry is the summary as it's recorded in the manifest.
+func (summary segmentSummary) manifestEntry() ManifestEntry {
+	return ManifestEntry{Segment: summary.Name,
+		First:   summary.First,
+		Last:    summary.Next - 1,
+		Count:   uint64(summary.Next - summary.First),
+		MinTime: summary.MinTime,
+		MaxTime: summary.MaxTime}
+}
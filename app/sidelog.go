@@ -0,0 +1,97 @@
+package app
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+)
+
+// A side log is a small append only file of JSON records, one a line, kept in the data dir next to the data files
+// for state that changes too often to rewrite the whole of each time, like consumer offsets and leases. Each append
+// is synced. Once it's mostly records that have been superseded it's rewritten with just what's needed to rebuild
+// the current state.
+
+// compactSideLogAfter is how many records a side log gets to before it's rewritten, at the least.
+const compactSideLogAfter = 10000
+
+type sideLog struct {
+	path    string
+	file    *os.File
+	records int
+}
+
+// openSideLog replays a side log, calling fn with each record, then opens it for appending. Records that can't be
+// read, like a torn last one from a crash part way through an append, are skipped. fn must rewrite it, with
+// sideLog.rewrite, once it's rebuilt the state, so appends start on a fresh line.
+func openSideLog(path string, fn func(record []byte) error) (log *sideLog, err error) {
+	log = &sideLog{path: path}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return log, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		if fn(scanner.Bytes()) == nil {
+			log.records++
+		}
+	}
+
+	return log, scanner.Err()
+}
+
+// append adds a record and syncs it.
+func (log *sideLog) append(record interface{}) (err error) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err = log.file.Write(append(line, '\n')); err == nil {
+		err = log.file.Sync()
+	}
+	log.records++
+
+	return err
+}
+
+// compact reports whether the side log should be rewritten, given it only needs live records to rebuild the state.
+func (log *sideLog) compact(live int) bool {
+	return log.records > compactSideLogAfter && log.records > 2*live
+}
+
+// rewrite replaces the side log with records, and opens it for appending.
+func (log *sideLog) rewrite(records []interface{}) (err error) {
+	f, err := os.OpenFile(log.path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, record := range records {
+		line, _ := json.Marshal(record)
+		w.Write(append(line, '\n'))
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(log.path+".tmp", log.path)
+	}
+	if err != nil {
+		return err
+	}
+
+	if log.file != nil {
+		log.file.Close()
+	}
+	log.file, err = os.OpenFile(log.path, os.O_APPEND|os.O_WRONLY, 0644)
+	log.records = len(records)
+
+	return err
+}
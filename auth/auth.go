@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+)
+
+// Token authentication, and per stream authorization. Principals are read from a local credentials file, a JSON
+// object of principals by name, each with the SHA-256 hashes of its tokens (hex) and the operations it can do on
+// each stream, * being every stream:
+//
+//	{
+//	    "billing": {"tokens": ["9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"],
+//	                "permissions": {"invoices": ["append", "read", "subscribe"], "orders": ["read"]}},
+//	    "ops":     {"tokens": ["..."], "permissions": {"*": ["admin", "read", "status"]}}
+//	}
+//
+// Only hashes are kept, so the file doesn't give away the tokens, printf %s "$TOKEN" | sha256sum makes one.
+
+// Operations
+const (
+	Append    = "append"    // Write messages to the stream
+	Read      = "read"      // Read messages in the stream
+	Subscribe = "subscribe" // Follow the stream as a consumer, or as one of a group
+	Admin     = "admin"     // Register the stream's schemas, and with * everything else that's administration
+	Status    = "status"    // With *, /status, /health and /metrics
+)
+
+// AllStreams is the stream in permissions that means every stream. Messages not in a stream are only covered by it.
+const AllStreams = "*"
+
+var operations = map[string]bool{Append: true, Read: true, Subscribe: true, Admin: true, Status: true}
+
+// Principal is who a token belongs to, and what it can do.
+type Principal struct {
+	Name        string              `json:"-"`
+	Tokens      []string            `json:"tokens"`      // SHA-256 hashes of its tokens, hex
+	Permissions map[string][]string `json:"permissions"` // Operations it can do, by stream
+}
+
+// Can reports whether the principal can do operation on stream, "" for messages not in a stream. Nil can do nothing.
+func (p *Principal) Can(operation string, stream string) bool {
+	if p == nil {
+		return false
+	}
+	for _, s := range []string{stream, AllStreams} {
+		for _, op := range p.Permissions[s] {
+			if op == operation {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// CanAny reports whether the principal can do operation on any stream at all.
+func (p *Principal) CanAny(operation string) bool {
+	if p == nil {
+		return false
+	}
+	for stream := range p.Permissions {
+		if p.Can(operation, stream) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Credentials are the principals in a credentials file, by their tokens.
+type Credentials struct {
+	principals map[[sha256.Size]byte]*Principal
+}
+
+// Load reads a credentials file, checking its principals make sense.
+func Load(path string) (credentials *Credentials, err error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var principals map[string]*Principal
+	if err = json.Unmarshal(contents, &principals); err != nil {
+		return nil, fmt.Errorf("Could not parse credentials file %s: %s", path, err.Error())
+	}
+
+	credentials = &Credentials{principals: map[[sha256.Size]byte]*Principal{}}
+	names := make([]string, 0, len(principals))
+	for name := range principals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := principals[name]
+		if p == nil || len(p.Tokens) == 0 {
+			return nil, fmt.Errorf("Principal %s has no tokens", name)
+		}
+		p.Name = name
+		for stream, ops := range p.Permissions {
+			for _, op := range ops {
+				if !operations[op] {
+					return nil, fmt.Errorf("Principal %s: unknown operation %q for stream %q", name, op, stream)
+				}
+			}
+		}
+		for _, token := range p.Tokens {
+			var hash [sha256.Size]byte
+			if n, err := hex.Decode(hash[:], []byte(token)); err != nil || n != sha256.Size || len(token) != 2*n {
+				return nil, fmt.Errorf("Principal %s: tokens are SHA-256 hashes, in hex", name)
+			}
+			if other, ok := credentials.principals[hash]; ok {
+				return nil, fmt.Errorf("Principals %s and %s have the same token", other.Name, name)
+			}
+			credentials.principals[hash] = p
+		}
+	}
+
+	return credentials, nil
+}
+
+// Authenticate finds the principal a token belongs to.
+func (c *Credentials) Authenticate(token string) (principal *Principal, ok bool) {
+	if token == "" {
+		return nil, false
+	}
+	principal, ok = c.principals[sha256.Sum256([]byte(token))]
+
+	return principal, ok
+}
+
+// Transport adds a bearer token to the requests it makes, it's how a node authenticates to its leader, or to the
+// other nodes of its cluster. Without a Token it's Base as is, Base is http.DefaultTransport if it's nil.
+type Transport struct {
+	Token string
+	Base  http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if t.Token == "" {
+		return base.RoundTrip(r)
+	}
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+t.Token)
+
+	return base.RoundTrip(r)
+}
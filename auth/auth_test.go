@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func writeCredentials(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestCredentials(t *testing.T) {
+	path := writeCredentials(t, `{
+		"billing": {"tokens": ["`+hash("b1")+`", "`+hash("b2")+`"],
+			"permissions": {"invoices": ["append", "read"], "orders": ["read"]}},
+		"ops": {"tokens": ["`+hash("o1")+`"], "permissions": {"*": ["admin", "read"]}}
+	}`)
+	credentials, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	billing, ok := credentials.Authenticate("b2")
+	if !ok || billing.Name != "billing" {
+		t.Fatalf("Expected b2 to be billing's, got %v", billing)
+	}
+	for _, token := range []string{"", "b3", hash("b1")} {
+		if p, ok := credentials.Authenticate(token); ok {
+			t.Fatalf("Expected %q not to authenticate, got %s", token, p.Name)
+		}
+	}
+
+	ops, _ := credentials.Authenticate("o1")
+	tests := []struct {
+		principal *Principal
+		operation string
+		stream    string
+		can       bool
+	}{
+		{billing, Append, "invoices", true},
+		{billing, Append, "orders", false},
+		{billing, Read, "orders", true},
+		{billing, Read, "", false},
+		{billing, Read, AllStreams, false},
+		{ops, Read, "orders", true},
+		{ops, Read, "", true},
+		{ops, Append, "orders", false},
+		{nil, Read, "orders", false},
+	}
+	for _, test := range tests {
+		if can := test.principal.Can(test.operation, test.stream); can != test.can {
+			t.Fatalf("Expected %v can %s %q to be %t", test.principal, test.operation, test.stream, test.can)
+		}
+	}
+	if !billing.CanAny(Append) || billing.CanAny(Subscribe) || !ops.CanAny(Admin) {
+		t.Fatal("Expected CanAny to be whether there's any stream")
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := map[string]string{
+		`{"a": {"permissions": {"*": ["read"]}}}`:                                          "has no tokens",
+		`{"a": {"tokens": ["b1"]}}`:                                                        "SHA-256 hashes",
+		`{"a": {"tokens": ["` + hash("b") + `"], "permissions": {"x": ["writ"]}}}`:         "unknown operation",
+		`{"a": {"tokens": ["` + hash("b") + `"]}, "c": {"tokens": ["` + hash("b") + `"]}}`: "same token",
+		`[]`: "Could not parse",
+	}
+	for contents, expected := range tests {
+		if _, err := Load(writeCredentials(t, contents)); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("Expected %s to fail with %q, got %v", contents, expected, err)
+		}
+	}
+}
+
+func TestTransport(t *testing.T) {
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+
+	for token, expected := range map[string]string{"n1": "Bearer n1", "": ""} {
+		client := &http.Client{Transport: &Transport{Token: token}}
+		response, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if authorization != expected {
+			t.Fatalf("Expected Authorization %q, got %q", expected, authorization)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package client
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/saem/afterme/wire"
+	"net"
+	"sync"
+)
+
+// The Go client for the binary append protocol (see the wire package), for producers writing more than HTTP keeps
+// up with. A Client is a connection, safe to use from many goroutines at once. Appends are pipelined, AppendAsync
+// sends one without waiting and what it returns is told the sequence once it's assigned, then that it's durable:
+//
+//	c, err := client.Dial("localhost:4001")
+//	result, err := c.AppendAsync([]byte(`{"total": 12}`), map[string]string{"stream": "orders"})
+//	sequence, err := result.Durable()
+//
+// Append sends one and waits until it's durable.
+
+// ErrClosed is the error for appends after the client's been closed, or that were waiting on acks when it was.
+var ErrClosed = errors.New("client closed")
+
+// Error is an append the server refused, or failed to write.
+type Error struct {
+	Code    int // An HTTP status code, as a write to POST /message would have got
+	Message string
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("%d %s", err.Code, err.Message)
+}
+
+// Client is a connection to a server's binary protocol port.
+type Client struct {
+	Token string // Sent with every append, for a server that wants one
+
+	conn    net.Conn
+	flushes chan struct{} // Has something in it when there are appends waiting to be flushed
+
+	mu      sync.Mutex // Guards everything after it
+	writer  *bufio.Writer
+	next    uint64
+	pending map[uint64]*Result
+	err     error // Why the connection's no good, every append fails with it from then on
+}
+
+// Result is what happens to an append, Assigned and Durable wait for it.
+type Result struct {
+	assigned   chan struct{} // Closed once assigned a sequence, or failed
+	durable    chan struct{} // Closed once durable, or failed
+	isAssigned bool
+	sequence   uint64
+	err        error // Why it wasn't assigned a sequence
+	durableErr error // Why it's not durable
+}
+
+// Assigned waits until the append's been assigned a sequence, it's not durable yet, and returns it.
+func (result *Result) Assigned() (sequence uint64, err error) {
+	<-result.assigned
+	return result.sequence, result.err
+}
+
+// Durable waits until the append's durable, synced and on a quorum of followers if the server has one, as a write
+// to POST /message is when it's acknowledged.
+func (result *Result) Durable() (sequence uint64, err error) {
+	<-result.durable
+	return result.sequence, result.durableErr
+}
+
+// settle records what's become of an append, and wakes whatever's waiting on it, done is whether that's all.
+func (result *Result) settle(sequence uint64, err error, done bool) {
+	if !result.isAssigned {
+		result.isAssigned = true
+		result.sequence, result.err = sequence, err
+		close(result.assigned)
+	}
+	if done {
+		result.durableErr = err
+		close(result.durable)
+	}
+}
+
+// Dial connects to a server's binary protocol port.
+func Dial(addr string) (c *Client, err error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return start(conn)
+}
+
+// DialTLS connects to a server's binary protocol port when it's served over TLS, config has the client certificate
+// if the server wants one.
+func DialTLS(addr string, config *tls.Config) (c *Client, err error) {
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return start(conn)
+}
+
+// start says hello on a new connection, and starts reading acks from it.
+func start(conn net.Conn) (c *Client, err error) {
+	if _, err = conn.Write([]byte(wire.Hello)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c = &Client{conn: conn,
+		flushes: make(chan struct{}, 1),
+		writer:  bufio.NewWriterSize(conn, 64*1024),
+		next:    1, // 0 is for errors that aren't any append's
+		pending: map[uint64]*Result{}}
+	go c.readAcks()
+	go c.flush()
+
+	return c, nil
+}
+
+// Append appends a message, and waits until it's durable.
+func (c *Client) Append(body []byte, attributes map[string]string) (sequence uint64, err error) {
+	result, err := c.AppendAsync(body, attributes)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.Durable()
+}
+
+// AppendAsync sends an append without waiting for it to be acked. Attributes are those the headers of a write to
+// POST /message would set, see the wire package.
+func (c *Client) AppendAsync(body []byte, attributes map[string]string) (result *Result, err error) {
+	result = &Result{assigned: make(chan struct{}), durable: make(chan struct{})}
+	if c.Token != "" {
+		withToken := make(map[string]string, len(attributes)+1)
+		for name, value := range attributes {
+			withToken[name] = value
+		}
+		withToken[wire.TokenAttribute] = c.Token
+		attributes = withToken
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return nil, c.err
+	}
+	id := c.next
+	if err = wire.WriteAppend(c.writer, wire.Append{Id: id, Attributes: attributes, Body: body}); err != nil {
+		if err != wire.ErrFrameTooBig {
+			c.fail(err)
+		}
+		return nil, err
+	}
+	c.next++
+	c.pending[id] = result
+
+	select {
+	case c.flushes <- struct{}{}:
+	default: // There's a flush coming already
+	}
+
+	return result, nil
+}
+
+// Close closes the connection, appends still waiting on acks fail with ErrClosed.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.writer.Flush()
+		c.fail(ErrClosed)
+	}
+
+	return nil
+}
+
+// flush flushes appends to the connection, those sent while it's flushing go out together next time round.
+func (c *Client) flush() {
+	for range c.flushes {
+		c.mu.Lock()
+		if c.err == nil {
+			if err := c.writer.Flush(); err != nil {
+				c.fail(err)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (c *Client) readAcks() {
+	reader := bufio.NewReaderSize(c.conn, 64*1024)
+	for {
+		ack, err := wire.ReadAck(reader)
+
+		c.mu.Lock()
+		if err == nil && ack.Kind == wire.FrameError && ack.Id == 0 {
+			err = &Error{Code: int(ack.Code), Message: ack.Message}
+		}
+		if err != nil {
+			if c.err == nil {
+				c.fail(err)
+			}
+			c.mu.Unlock()
+			return
+		}
+		if result, ok := c.pending[ack.Id]; ok {
+			c.acked(result, ack)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// acked records an ack for an append, c.mu must be held.
+func (c *Client) acked(result *Result, ack wire.Ack) {
+	var err error
+	if ack.Kind == wire.FrameError {
+		err = &Error{Code: int(ack.Code), Message: ack.Message}
+	}
+	result.settle(ack.Sequence, err, ack.Kind != wire.FrameAssigned)
+	if ack.Kind != wire.FrameAssigned {
+		delete(c.pending, ack.Id)
+	}
+}
+
+// fail fails every append waiting on acks, and every one after, with err, c.mu must be held.
+func (c *Client) fail(err error) {
+	c.err = err
+	c.conn.Close()
+	for id, result := range c.pending {
+		result.settle(0, err, true)
+		delete(c.pending, id)
+	}
+	close(c.flushes)
+}
@@ -0,0 +1,94 @@
+package client
+
+import (
+	"bufio"
+	"github.com/saem/afterme/wire"
+	"io"
+	"net"
+	"testing"
+)
+
+// fakeServer acks appends as the server does, refusing those with a body of "bad".
+func fakeServer(t *testing.T) (addr string) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader, writer := bufio.NewReader(conn), bufio.NewWriter(conn)
+		hello := make([]byte, len(wire.Hello))
+		if _, err := io.ReadFull(reader, hello); err != nil || string(hello) != wire.Hello {
+			t.Errorf("Expected hello, got %q", hello)
+			return
+		}
+
+		sequence := uint64(0)
+		for {
+			a, err := wire.ReadAppend(reader)
+			if err != nil {
+				return
+			}
+			if string(a.Body) == "bad" {
+				wire.WriteAck(writer, wire.Ack{Kind: wire.FrameError, Id: a.Id, Code: 422, Message: "bad body"})
+			} else {
+				sequence++
+				wire.WriteAck(writer, wire.Ack{Kind: wire.FrameAssigned, Id: a.Id, Sequence: sequence})
+				wire.WriteAck(writer, wire.Ack{Kind: wire.FrameDurable, Id: a.Id, Sequence: sequence})
+			}
+			if reader.Buffered() == 0 {
+				writer.Flush()
+			}
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestClient(t *testing.T) {
+	c, err := Dial(fakeServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sequence, err := c.Append([]byte("first"), map[string]string{"stream": "orders"}); sequence != 1 || err != nil {
+		t.Fatalf("Expected sequence 1, got %d, %v", sequence, err)
+	}
+
+	results := make([]*Result, 100)
+	for i := range results {
+		body := []byte("pipelined")
+		if i == 50 {
+			body = []byte("bad")
+		}
+		if results[i], err = c.AppendAsync(body, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := uint64(2)
+	for i, result := range results {
+		assigned, assignedErr := result.Assigned()
+		durable, err := result.Durable()
+		if i == 50 {
+			if e, ok := err.(*Error); !ok || e.Code != 422 || assignedErr == nil {
+				t.Errorf("Expected a 422, got %v", err)
+			}
+			continue
+		}
+		if assigned != expected || durable != expected || err != nil || assignedErr != nil {
+			t.Errorf("Expected sequence %d, got %d then %d, %v", expected, assigned, durable, err)
+		}
+		expected++
+	}
+
+	c.Close()
+	if _, err := c.Append([]byte("after"), nil); err != ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+}
@@ -0,0 +1,261 @@
+package cloudevents
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/saem/afterme/data2"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// The CloudEvents 1.0 HTTP binding, both ways. An event written to afterme is stored as a message whose body is
+// the event's data, and whose attributes are its envelope: type as the type attribute, datacontenttype as
+// content-type, time as the event time, and every other event attribute, extensions included, as ce.<name>.
+//
+// Any message can be read back out as an event, messages that weren't written as one get an id and source made up
+// from afterme's own: the sequence, and /afterme or /afterme/streams/<stream>. Every event read out has the
+// aftermesequence extension, its message's sequence.
+
+const (
+	SpecVersion = "1.0"
+
+	ContentType      = "application/cloudevents+json"
+	BatchContentType = "application/cloudevents-batch+json"
+
+	// DefaultType is the type of an event read out of a message that was written without one.
+	DefaultType = "afterme.message"
+	// SequenceExtension is the extension every event read out has, its message's sequence.
+	SequenceExtension = "aftermesequence"
+)
+
+// Structured and binary are the two ways an event goes over HTTP: as a JSON document, or as its data with the
+// attributes in ce-* headers.
+const (
+	Structured = "structured"
+	Binary     = "binary"
+)
+
+// Attributes with a place of their own in the envelope, the rest are kept as ce.<name>.
+const (
+	attrType        = "type"
+	attrContentType = "datacontenttype"
+	attrTime        = "time"
+)
+
+// IsEvent reports whether a request is a CloudEvent, in either mode.
+func IsEvent(header http.Header) bool {
+	return header.Get("ce-specversion") != "" || mediaType(header.Get("Content-Type")) == ContentType
+}
+
+// Decode reads the CloudEvent in a request, returning its data, which is the message body, and the message
+// attributes for its envelope.
+func Decode(header http.Header, body []byte) (data []byte, attributes data2.Attributes, err error) {
+	event := map[string]interface{}{}
+	switch mediaType(header.Get("Content-Type")) {
+	case BatchContentType:
+		return nil, nil, fmt.Errorf("CloudEvents batches can't be written, write each event on its own")
+	case ContentType:
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		if err = decoder.Decode(&event); err != nil {
+			return nil, nil, fmt.Errorf("Invalid structured CloudEvent: %s", err.Error())
+		}
+		if data, err = structuredData(event); err != nil {
+			return nil, nil, err
+		}
+	default:
+		for name, values := range header {
+			if lower := strings.ToLower(name); strings.HasPrefix(lower, "ce-") {
+				value, err := url.PathUnescape(values[0])
+				if err != nil {
+					value = values[0]
+				}
+				event[strings.TrimPrefix(lower, "ce-")] = value
+			}
+		}
+		if contentType := header.Get("Content-Type"); contentType != "" {
+			event[attrContentType] = contentType
+		}
+		data = body
+	}
+
+	return data, attributesOf(event), validate(event)
+}
+
+// structuredData is a structured event's data, as the message body.
+func structuredData(event map[string]interface{}) (data []byte, err error) {
+	defer delete(event, "data")
+	defer delete(event, "data_base64")
+
+	if encoded, ok := event["data_base64"].(string); ok {
+		if data, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			return nil, fmt.Errorf("Invalid data_base64 in CloudEvent")
+		}
+		return data, nil
+	}
+	value, ok := event["data"]
+	if !ok {
+		return nil, nil
+	}
+	contentType, _ := event[attrContentType].(string)
+	if s, isString := value.(string); isString && !isJSON(contentType) {
+		return []byte(s), nil
+	}
+	if contentType == "" {
+		event[attrContentType] = "application/json"
+	}
+
+	return json.Marshal(value)
+}
+
+func validate(event map[string]interface{}) error {
+	if version, _ := event["specversion"].(string); version != SpecVersion {
+		return fmt.Errorf("Only CloudEvents specversion %s is supported, not %v", SpecVersion, event["specversion"])
+	}
+	for _, required := range []string{"id", "source", "type"} {
+		if value, _ := event[required].(string); value == "" {
+			return fmt.Errorf("CloudEvent has no %s", required)
+		}
+	}
+	if t, ok := event[attrTime].(string); ok {
+		if _, err := time.Parse(time.RFC3339Nano, t); err != nil {
+			return fmt.Errorf("CloudEvent time must be an RFC 3339 time")
+		}
+	}
+
+	return nil
+}
+
+// attributesOf is the message envelope for an event's attributes.
+func attributesOf(event map[string]interface{}) (attributes data2.Attributes) {
+	attributes = data2.Attributes{}
+	for name, value := range event {
+		s, isString := value.(string)
+		if !isString {
+			encoded, _ := json.Marshal(value)
+			s = string(encoded)
+		}
+
+		switch name {
+		case attrType:
+			attributes[data2.AttrType] = s
+		case attrContentType:
+			attributes[data2.AttrContentType] = s
+		case attrTime:
+			if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+				attributes[data2.AttrEvent] = strconv.FormatInt(t.UnixNano(), 10)
+			}
+		default:
+			attributes[data2.AttrCloudEvent+name] = s
+		}
+	}
+
+	return attributes
+}
+
+// Attributes are a message's event attributes, everything but its data.
+func Attributes(m data2.Message) (event map[string]string) {
+	event = map[string]string{"specversion": SpecVersion,
+		"id":              strconv.FormatUint(uint64(m.Sequence), 10),
+		"source":          "/afterme",
+		"type":            DefaultType,
+		SequenceExtension: strconv.FormatUint(uint64(m.Sequence), 10)}
+	if stream := m.Attributes[data2.AttrStream]; stream != "" {
+		event["source"] = "/afterme/streams/" + stream
+	}
+	if eventType := m.Attributes[data2.AttrType]; eventType != "" {
+		event["type"] = eventType
+	}
+	if contentType := m.Attributes[data2.AttrContentType]; contentType != "" {
+		event[attrContentType] = contentType
+	}
+	t := data2.MessageTime(m)
+	if eventTime, err := strconv.ParseInt(m.Attributes[data2.AttrEvent], 10, 64); err == nil {
+		t = eventTime
+	}
+	event[attrTime] = time.Unix(0, t).UTC().Format(time.RFC3339Nano)
+	for attribute, value := range m.Attributes {
+		if strings.HasPrefix(attribute, data2.AttrCloudEvent) {
+			event[strings.TrimPrefix(attribute, data2.AttrCloudEvent)] = value
+		}
+	}
+	if m.Attributes[data2.AttrErased] == "true" {
+		event["aftermeerased"] = "true"
+	}
+
+	return event
+}
+
+// SetHeaders sets the ce-* headers, and Content-Type, that carry a message's event attributes in binary mode, the
+// body is the message body.
+func SetHeaders(header http.Header, m data2.Message) {
+	for name, value := range Attributes(m) {
+		if name == attrContentType {
+			header.Set("Content-Type", value)
+		} else {
+			header.Set("ce-"+name, headerValue(value))
+		}
+	}
+}
+
+// Event is a message as a structured mode event. JSON data is inlined, other text is a string and anything else is
+// data_base64.
+func Event(m data2.Message) (event map[string]interface{}) {
+	event = map[string]interface{}{}
+	for name, value := range Attributes(m) {
+		event[name] = value
+	}
+	if m.Attributes[data2.AttrErased] == "true" {
+		return event
+	}
+
+	contentType := m.Attributes[data2.AttrContentType]
+	trimmed := bytes.TrimSpace(m.Body)
+	switch {
+	case len(trimmed) == 0 && contentType == "":
+		// No data, an event written without any is stored with an empty line
+	case (isJSON(contentType) || contentType == "") && json.Valid(trimmed) && len(trimmed) > 0:
+		event["data"] = json.RawMessage(trimmed)
+	case strings.HasPrefix(contentType, "text/") && utf8.Valid(m.Body):
+		event["data"] = string(m.Body)
+	default:
+		event["data_base64"] = base64.StdEncoding.EncodeToString(m.Body)
+	}
+
+	return event
+}
+
+func isJSON(contentType string) bool {
+	t := mediaType(contentType)
+	return t == "application/json" || strings.HasSuffix(t, "+json")
+}
+
+func mediaType(contentType string) string {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(contentType))
+	}
+
+	return t
+}
+
+// headerValue percent encodes what can't go in a header as it is, as the HTTP binding says.
+func headerValue(value string) string {
+	var b strings.Builder
+	for _, c := range []byte(value) {
+		if c < 0x21 && c != ' ' || c > 0x7e || c == '"' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
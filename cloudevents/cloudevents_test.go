@@ -0,0 +1,110 @@
+package cloudevents
+
+import (
+	"encoding/json"
+	"github.com/saem/afterme/data2"
+	"net/http"
+	"testing"
+)
+
+func TestDecodeBinary(t *testing.T) {
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain")
+	header.Set("ce-specversion", "1.0")
+	header.Set("ce-id", "a-1")
+	header.Set("ce-source", "/orders")
+	header.Set("ce-type", "order.created")
+	header.Set("ce-time", "2024-01-02T03:04:05.5Z")
+	header.Set("ce-tenant", "acme%20corp")
+
+	data, attributes, err := Decode(header, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("Expected the body as data, got %q", data)
+	}
+	for attribute, expected := range map[string]string{
+		data2.AttrType:        "order.created",
+		data2.AttrContentType: "text/plain",
+		data2.AttrEvent:       "1704164645500000000",
+		"ce.id":               "a-1",
+		"ce.source":           "/orders",
+		"ce.specversion":      "1.0",
+		"ce.tenant":           "acme corp",
+	} {
+		if attributes[attribute] != expected {
+			t.Errorf("Expected %s to be %q, got %q", attribute, expected, attributes[attribute])
+		}
+	}
+}
+
+func TestDecodeStructured(t *testing.T) {
+	header := http.Header{"Content-Type": {ContentType + "; charset=utf-8"}}
+	data, attributes, err := Decode(header,
+		[]byte(`{"specversion": "1.0", "id": "1", "source": "/s", "type": "t", "data": {"total": 12.5}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"total":12.5}` || attributes[data2.AttrContentType] != "application/json" {
+		t.Errorf("Expected JSON data, got %q as %q", data, attributes[data2.AttrContentType])
+	}
+	if _, ok := attributes["ce.data"]; ok {
+		t.Errorf("Expected data not to be an attribute")
+	}
+
+	data, _, err = Decode(header,
+		[]byte(`{"specversion": "1.0", "id": "1", "source": "/s", "type": "t", "data_base64": "AAEC"}`))
+	if err != nil || string(data) != "\x00\x01\x02" {
+		t.Errorf("Expected data_base64 decoded, got %q, %v", data, err)
+	}
+
+	for _, invalid := range []string{
+		`{"specversion": "0.3", "id": "1", "source": "/s", "type": "t"}`,
+		`{"specversion": "1.0", "source": "/s", "type": "t"}`,
+		`{"specversion": "1.0", "id": "1", "source": "/s", "type": "t", "time": "yesterday"}`,
+		`not json`,
+	} {
+		if _, _, err := Decode(header, []byte(invalid)); err == nil {
+			t.Errorf("Expected %s not to decode", invalid)
+		}
+	}
+	if _, _, err := Decode(http.Header{"Content-Type": {BatchContentType}}, []byte("[]")); err == nil {
+		t.Errorf("Expected a batch not to decode")
+	}
+}
+
+func TestEvent(t *testing.T) {
+	m := data2.Message{Sequence: 7, TimeStamp: 1,
+		Attributes: data2.Attributes{data2.AttrStream: "orders", data2.AttrContentType: "application/json",
+			"ce.id": "a-1", "ce.tenant": "acme"},
+		Body: []byte(`{"total": 1}` + "\n")}
+	event := Event(m)
+	for name, expected := range map[string]interface{}{
+		"id":              "a-1",
+		"source":          "/afterme/streams/orders",
+		"type":            DefaultType,
+		"tenant":          "acme",
+		SequenceExtension: "7",
+	} {
+		if event[name] != expected {
+			t.Errorf("Expected %s to be %v, got %v", name, expected, event[name])
+		}
+	}
+	if data, _ := json.Marshal(event["data"]); string(data) != `{"total":1}` {
+		t.Errorf("Expected the JSON body inlined, got %s", data)
+	}
+
+	m.Attributes = data2.Attributes{}
+	m.Body = []byte{0xff, 0x00}
+	if event = Event(m); event["data_base64"] != "/wA=" || event["id"] != "7" || event["source"] != "/afterme" {
+		t.Errorf("Expected binary data as data_base64, got %v", event)
+	}
+
+	header := http.Header{}
+	m.Attributes = data2.Attributes{"ce.subject": "a b%"}
+	SetHeaders(header, m)
+	if header.Get("ce-subject") != "a b%25" || header.Get("ce-aftermesequence") != "7" {
+		t.Errorf("Expected percent encoded headers, got %v", header)
+	}
+}
@@ -0,0 +1,699 @@
+package cluster
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/saem/afterme/app"
+	"github.com/saem/afterme/auth"
+	"github.com/saem/afterme/data"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Raft (https://raft.github.io/raft.pdf) over HTTP, so three or five nodes agree on the order of the log. The log
+// is the Raft log, a message's sequence is its index and its term attribute its term (see app/cluster.go). The
+// leader writes as a single node does, then sends what it's written to the others as it is in its data files, so
+// every node's data files are byte for byte the same. A write is acknowledged once a majority have synced it.
+//
+// There's no membership change, the nodes are fixed by the config, and no snapshots, the log is never compacted.
+// A new leader doesn't write a no-op, messages left from an earlier term are committed along with its first write.
+//
+// The nodes share a token (config.ClusterConfig), sent with every RPC in an X-Afterme-Cluster-Token header, an RPC
+// without it is turned away, so nothing but the nodes can vote or append.
+
+const (
+	DefaultElectionTimeout = 300 * time.Millisecond // A random amount up to as much again is added
+	DefaultHeartbeat       = 50 * time.Millisecond
+	RPCTimeout             = 2 * time.Second
+	StateFileName          = "raft.json"
+)
+
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+// state is what has to survive a restart, written to StateFileName in the data dir.
+type state struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for"`
+}
+
+// Node is one node of a cluster.
+type Node struct {
+	Id              string
+	ElectionTimeout time.Duration
+	Heartbeat       time.Duration
+
+	app    *app.App
+	nodes  map[string]string // Base URLs, by id, this node included
+	token  string
+	client *http.Client
+	logger *log.Logger
+
+	mu          sync.Mutex
+	role        role
+	state       state
+	leader      string    // Id of the leader, as far as this node knows
+	deadline    time.Time // When an election is started, unless the leader's heard from first
+	leaderStart data.Sequence
+	peers       map[string]*peer // Only once the App's leading, while this node leads
+	appTerm     uint64           // Term the App's to lead in, zero if it's not to lead, see applyRoles
+	roleChanged chan struct{}
+	stop        chan struct{}
+
+	copyingSchemas int32 // 1 while schemas are being copied from the leader, accessed atomically
+}
+
+// peer is what a leader knows about another node.
+type peer struct {
+	next  data.Sequence // Next message to send it
+	match data.Sequence // Last message it's known to have
+}
+
+// VoteRequest is the RequestVote RPC, POST /raft/vote
+type VoteRequest struct {
+	Term      uint64        `json:"term"`
+	Candidate string        `json:"candidate"`
+	LastIndex data.Sequence `json:"last_index"`
+	LastTerm  uint64        `json:"last_term"`
+}
+
+// VoteResponse is the response to a VoteRequest
+type VoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+// AppendRequest is the AppendEntries RPC, POST /raft/append. Entries are messages, as they are in the leader's data
+// file Segment, following Prev, up to and including Last.
+type AppendRequest struct {
+	Term     uint64        `json:"term"`
+	Leader   string        `json:"leader"`
+	Prev     data.Sequence `json:"prev"`
+	PrevTerm uint64        `json:"prev_term"`
+	Segment  app.Segment   `json:"segment"`
+	Entries  []byte        `json:"entries"`
+	Last     data.Sequence `json:"last"`
+	Commit   data.Sequence `json:"commit"`
+	Schemas  int           `json:"schemas"` // Schema versions the leader has, see app/schemas.go
+}
+
+// AppendResponse is the response to an AppendRequest, Last is the end of the node's log when it's unsuccessful, so
+// the leader knows where to go back to.
+type AppendResponse struct {
+	Term    uint64        `json:"term"`
+	Success bool          `json:"success"`
+	Last    data.Sequence `json:"last"`
+}
+
+// NewNode makes a cluster node of an App created with app.CreateClusterNode, id is this node's id and nodes the
+// base URL of every node, by id. The token the nodes share is the App's config's. Start gets it going.
+func NewNode(id string, nodes map[string]string, a *app.App) (node *Node, err error) {
+	if a.Config.Cluster.Token == "" {
+		return nil, fmt.Errorf("A cluster needs a token, its nodes only take Raft RPCs from those that have it")
+	}
+	node = &Node{Id: id,
+		ElectionTimeout: DefaultElectionTimeout,
+		Heartbeat:       DefaultHeartbeat,
+		app:             a,
+		nodes:           nodes,
+		token:           a.Config.Cluster.Token,
+		client:          &http.Client{Timeout: RPCTimeout, Transport: &auth.Transport{Token: a.Config.Auth.Token}},
+		logger:          a.Logger,
+		roleChanged:     make(chan struct{}, 1),
+		stop:            make(chan struct{})}
+
+	contents, err := ioutil.ReadFile(filepath.Join(a.DataDir, StateFileName))
+	if err == nil {
+		err = json.Unmarshal(contents, &node.state)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Could not read %s: %s", StateFileName, err.Error())
+	}
+
+	a.Coordinator = node
+	a.SetQuorum(len(nodes) / 2) // Along with this node, that's a majority
+
+	return node, nil
+}
+
+// Start has the node take part in elections, a leader is elected soon after a majority of the nodes are started.
+func (node *Node) Start() {
+	node.mu.Lock()
+	node.resetDeadline()
+	node.mu.Unlock()
+
+	go node.run()
+	go node.applyRoles()
+}
+
+// Stop has the node stop taking part in the cluster, as if it had been switched off.
+func (node *Node) Stop() {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	select {
+	case <-node.stop:
+	default:
+		close(node.stop)
+	}
+}
+
+// Leader is the base URL of the leader, empty if there isn't one, and whether it's this node. This node isn't
+// leading until the App is.
+func (node *Node) Leader() (url string, leading bool) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	return node.nodes[node.leader], node.role == leader && node.peers != nil
+}
+
+// Term is the current term.
+func (node *Node) Term() uint64 {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	return node.state.Term
+}
+
+// Handler serves the Raft RPCs, under /raft/, to those with the cluster token.
+func (node *Node) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/raft/vote", func(w http.ResponseWriter, r *http.Request) {
+		var request VoteRequest
+		if decodeRequest(w, r, &request) {
+			encodeResponse(w, node.vote(request))
+		}
+	})
+	mux.HandleFunc("/raft/append", func(w http.ResponseWriter, r *http.Request) {
+		var request AppendRequest
+		if decodeRequest(w, r, &request) {
+			encodeResponse(w, node.appendEntries(request))
+		}
+	})
+	mux.HandleFunc("/raft/schemas", func(w http.ResponseWriter, r *http.Request) {
+		list, err := node.app.ListSchemas()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(list)
+	})
+	mux.HandleFunc("/raft/schemas/", func(w http.ResponseWriter, r *http.Request) {
+		path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/raft/schemas/"), "/", 2)
+		version, err := strconv.Atoi(path[len(path)-1])
+		if err != nil || len(path) != 2 || version <= 0 {
+			http.Error(w, "GET /raft/schemas/<stream>/<version>", http.StatusBadRequest)
+			return
+		}
+		document, err := node.app.Schemas.Document(path[0], version)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Write(document)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get("X-Afterme-Cluster-Token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(node.token)) != 1 {
+			http.Error(w, "Only the cluster's nodes can make Raft RPCs", http.StatusForbidden)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// run starts an election whenever the leader's not been heard from for too long.
+func (node *Node) run() {
+	for {
+		select {
+		case <-node.stop:
+			return
+		case <-time.After(node.ElectionTimeout / 10):
+		}
+
+		node.mu.Lock()
+		if node.role != leader && time.Now().After(node.deadline) {
+			node.startElection()
+		}
+		node.mu.Unlock()
+	}
+}
+
+// resetDeadline puts off the next election by the election timeout, plus a random amount so nodes don't all
+// start one at once.
+func (node *Node) resetDeadline() {
+	node.deadline = time.Now().Add(node.ElectionTimeout + time.Duration(rand.Int63n(int64(node.ElectionTimeout))))
+}
+
+// persist writes the state that has to survive a restart, it's synced before anyone's told about it.
+func (node *Node) persist() {
+	contents, _ := json.Marshal(node.state)
+	path := filepath.Join(node.app.DataDir, StateFileName)
+
+	f, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err == nil {
+		_, err = f.Write(contents)
+		if err == nil {
+			err = f.Sync()
+		}
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		node.logger.Fatalf("Could not write %s, because: %s", path, err.Error())
+	}
+}
+
+// startElection has this node stand for leader in the next term.
+func (node *Node) startElection() {
+	node.role = candidate
+	node.leader = ""
+	node.state.Term++
+	node.state.VotedFor = node.Id
+	node.persist()
+	node.resetDeadline()
+
+	term := node.state.Term
+	lastIndex, lastTerm := node.app.LastEntry()
+	request := VoteRequest{Term: term, Candidate: node.Id, LastIndex: lastIndex, LastTerm: lastTerm}
+	node.logger.Printf("Standing for leader in term %d", term)
+
+	votes := 1
+	if votes > len(node.nodes)/2 {
+		node.becomeLeader()
+		return
+	}
+	for id := range node.nodes {
+		if id == node.Id {
+			continue
+		}
+		go func(id string) {
+			var response VoteResponse
+			if err := node.call(id, "/raft/vote", request, &response); err != nil {
+				return
+			}
+
+			node.mu.Lock()
+			defer node.mu.Unlock()
+			if response.Term > node.state.Term {
+				node.follow(response.Term)
+				return
+			}
+			if !response.Granted || node.role != candidate || node.state.Term != term {
+				return
+			}
+			votes++
+			if votes > len(node.nodes)/2 {
+				node.becomeLeader()
+			}
+		}(id)
+	}
+}
+
+// becomeLeader has this node, a candidate that's won its election, take over as leader. It leads once the App
+// does, see applyRoles.
+func (node *Node) becomeLeader() {
+	node.logger.Printf("Leading in term %d", node.state.Term)
+	node.role = leader
+	node.leader = node.Id
+	node.app.ResetFollowers()
+	node.setAppTerm(node.state.Term)
+}
+
+// startLeading starts sending the other nodes what the App writes, from first, the first message it writes as
+// leader in term.
+func (node *Node) startLeading(term uint64, first data.Sequence) {
+	node.leaderStart = first
+	node.peers = map[string]*peer{}
+	for id := range node.nodes {
+		if id == node.Id {
+			continue
+		}
+		node.peers[id] = &peer{next: node.leaderStart}
+		go node.replicate(id, node.peers[id], term)
+	}
+	go node.commitLocally(term)
+}
+
+// setAppTerm has applyRoles make the App lead in term, or stop leading if it's zero.
+func (node *Node) setAppTerm(term uint64) {
+	node.appTerm = term
+	select {
+	case node.roleChanged <- struct{}{}:
+	default:
+	}
+}
+
+// applyRoles has the App lead, or stop leading, as this node's role changes. The App finishes a data file when it
+// changes role, which isn't to be done with mu held, holding up the RPCs, so it's done here, in the order the
+// changes were made. A leader always starts a new data file, so the App stops leading before it leads again.
+func (node *Node) applyRoles() {
+	applied := uint64(0)
+	for {
+		select {
+		case <-node.stop:
+			return
+		case <-node.roleChanged:
+		}
+
+		node.mu.Lock()
+		term := node.appTerm
+		node.mu.Unlock()
+		if term == applied {
+			continue
+		}
+		if applied != 0 {
+			node.app.StepDown()
+			applied = 0
+		}
+		if term == 0 {
+			continue
+		}
+		first := node.app.Lead(term)
+		applied = term
+
+		node.mu.Lock()
+		if node.leading(term) && node.peers == nil {
+			node.startLeading(term, first)
+		}
+		node.mu.Unlock()
+	}
+}
+
+// follow has this node go back to following, in term if it's a later one.
+func (node *Node) follow(term uint64) {
+	if node.role == leader {
+		node.logger.Printf("No longer leading, term %d has started", term)
+		node.setAppTerm(0)
+		node.app.ResetFollowers()
+		node.peers = nil
+	}
+	node.role = follower
+	if term > node.state.Term {
+		node.state.Term = term
+		node.state.VotedFor = ""
+		node.leader = ""
+		node.persist()
+	}
+}
+
+// leading is whether this node is still leading in term.
+func (node *Node) leading(term uint64) bool {
+	select {
+	case <-node.stop:
+		return false
+	default:
+	}
+
+	return node.role == leader && node.state.Term == term
+}
+
+// replicate sends a peer what it's missing, or a heartbeat if it's not missing anything, for as long as this node
+// leads in term.
+func (node *Node) replicate(id string, p *peer, term uint64) {
+	for {
+		synced := node.app.SyncedChanged()
+
+		node.mu.Lock()
+		if !node.leading(term) {
+			node.mu.Unlock()
+			return
+		}
+		next := p.next
+		node.mu.Unlock()
+
+		request, err := node.appendRequest(term, next)
+		if err != nil {
+			node.logger.Printf("Could not send messages from %d to %s, because: %s", next, id, err.Error())
+			time.Sleep(node.Heartbeat)
+			continue
+		}
+
+		var response AppendResponse
+		if err = node.call(id, "/raft/append", request, &response); err != nil {
+			time.Sleep(node.Heartbeat)
+			continue
+		}
+
+		node.mu.Lock()
+		if response.Term > node.state.Term {
+			node.follow(response.Term)
+		}
+		if !node.leading(term) {
+			node.mu.Unlock()
+			return
+		}
+		if response.Success {
+			p.match, p.next = request.Last, request.Last+1
+			node.app.Replicated(id, p.match)
+			node.advanceCommit()
+		} else {
+			p.next = response.Last + 1
+			if p.next >= next && next > 1 {
+				p.next = next - 1
+			}
+		}
+		caughtUp := response.Success && p.next > node.app.Synced()
+		node.mu.Unlock()
+
+		if caughtUp {
+			select {
+			case <-synced:
+			case <-time.After(node.Heartbeat):
+			case <-node.stop:
+			}
+		}
+	}
+}
+
+// commitLocally moves the commit on as this node syncs, it's what commits in a cluster of one.
+func (node *Node) commitLocally(term uint64) {
+	for {
+		synced := node.app.SyncedChanged()
+
+		node.mu.Lock()
+		if !node.leading(term) {
+			node.mu.Unlock()
+			return
+		}
+		node.advanceCommit()
+		node.mu.Unlock()
+
+		select {
+		case <-synced:
+		case <-time.After(node.Heartbeat):
+		case <-node.stop:
+		}
+	}
+}
+
+// appendRequest puts together an AppendRequest with the messages from next on, there's only ever messages from one
+// data file in a request.
+func (node *Node) appendRequest(term uint64, next data.Sequence) (request AppendRequest, err error) {
+	request = AppendRequest{Term: term, Leader: node.Id, Prev: next - 1, Last: next - 1, Commit: node.app.Committed()}
+	request.Schemas, _ = node.app.Schemas.Count()
+	if request.PrevTerm, err = node.app.TermAt(request.Prev); err != nil {
+		return request, err
+	}
+	if next > node.app.Synced() {
+		return request, nil
+	}
+
+	_, segment, offset, err := node.app.Locate(next)
+	if err != nil {
+		return request, err
+	}
+	end, last, err := node.app.ClusterEnd(segment, offset)
+	if err != nil {
+		return request, err
+	}
+
+	f, err := os.Open(filepath.Join(node.app.DataDir, segment.Name))
+	if err != nil {
+		return request, err
+	}
+	defer f.Close()
+	request.Entries = make([]byte, end-offset)
+	if _, err = io.ReadFull(io.NewSectionReader(f, offset, end-offset), request.Entries); err != nil {
+		return request, err
+	}
+	request.Segment, request.Last = segment, last
+
+	return request, nil
+}
+
+// advanceCommit moves the commit on to the last message a majority have, as long as it's from this term.
+func (node *Node) advanceCommit() {
+	matches := []data.Sequence{node.app.Synced()}
+	for _, p := range node.peers {
+		matches = append(matches, p.match)
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i] > matches[j] })
+
+	if majority := matches[len(node.nodes)/2]; majority >= node.leaderStart {
+		node.app.SetCommitted(majority)
+	}
+}
+
+// vote handles a VoteRequest.
+func (node *Node) vote(request VoteRequest) (response VoteResponse) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	if request.Term > node.state.Term {
+		node.follow(request.Term)
+	}
+	response.Term = node.state.Term
+	if request.Term < node.state.Term {
+		return response
+	}
+
+	// Only a candidate with a log at least as up to date as this one gets the vote
+	lastIndex, lastTerm := node.app.LastEntry()
+	upToDate := request.LastTerm > lastTerm || (request.LastTerm == lastTerm && request.LastIndex >= lastIndex)
+	if upToDate && (node.state.VotedFor == "" || node.state.VotedFor == request.Candidate) {
+		node.state.VotedFor = request.Candidate
+		node.persist()
+		node.resetDeadline()
+		response.Granted = true
+	}
+
+	return response
+}
+
+// appendEntries handles an AppendRequest.
+func (node *Node) appendEntries(request AppendRequest) (response AppendResponse) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	if request.Term > node.state.Term || (request.Term == node.state.Term && node.role == candidate) {
+		node.follow(request.Term)
+	}
+	response.Term = node.state.Term
+	response.Last, _ = node.app.LastEntry()
+	if request.Term < node.state.Term {
+		return response
+	}
+	node.leader = request.Leader
+	node.resetDeadline()
+	node.wantSchemas(request.Leader, request.Schemas)
+
+	if request.Prev > response.Last {
+		return response
+	}
+	prevTerm, err := node.app.TermAt(request.Prev)
+	if err != nil {
+		node.logger.Printf("Could not check sequence %d against the leader's, because: %s", request.Prev, err.Error())
+		return response
+	}
+	if prevTerm != request.PrevTerm {
+		// The leader goes back a message, this one will conflict and be removed
+		response.Last = request.Prev - 1
+		return response
+	}
+
+	if len(request.Entries) > 0 {
+		err = node.app.AppendEntries(request.Segment, request.Prev, request.Entries)
+		if err != nil {
+			node.logger.Printf("Could not append messages from the leader, because: %s", err.Error())
+			response.Last, _ = node.app.LastEntry()
+			return response
+		}
+	}
+
+	commit := request.Commit
+	if commit > request.Last {
+		commit = request.Last
+	}
+	node.app.SetCommitted(commit)
+	response.Success = true
+	response.Last, _ = node.app.LastEntry()
+
+	return response
+}
+
+// wantSchemas copies the schemas from the leader, in the background, if it has some this node hasn't.
+func (node *Node) wantSchemas(leader string, count int) {
+	node.app.WantSchemas(count)
+	if !node.app.SchemasBehind() || !atomic.CompareAndSwapInt32(&node.copyingSchemas, 0, 1) {
+		return
+	}
+
+	go func() {
+		defer atomic.StoreInt32(&node.copyingSchemas, 0)
+		err := node.app.CopySchemas("/raft/schemas", func(path string) (*http.Response, error) {
+			get, err := http.NewRequest("GET", node.nodes[leader]+path, nil)
+			if err != nil {
+				return nil, err
+			}
+			get.Header.Set("X-Afterme-Cluster-Token", node.token)
+			return node.client.Do(get)
+		})
+		if err != nil {
+			node.logger.Printf("Could not copy schemas from %s, because: %s", leader, err.Error())
+		}
+	}()
+}
+
+// call makes an RPC to another node.
+func (node *Node) call(id string, path string, request interface{}, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	post, err := http.NewRequest("POST", node.nodes[id]+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	post.Header.Set("Content-Type", "application/json")
+	post.Header.Set("X-Afterme-Cluster-Token", node.token)
+	r, err := node.client.Do(post)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s from %s", r.Status, id)
+	}
+
+	return json.NewDecoder(r.Body).Decode(response)
+}
+
+func decodeRequest(w http.ResponseWriter, r *http.Request, request interface{}) bool {
+	if r.Method != "POST" {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+func encodeResponse(w http.ResponseWriter, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,439 @@
+package cluster
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/saem/afterme/app"
+	"github.com/saem/afterme/config"
+	"github.com/saem/afterme/data"
+	"github.com/saem/afterme/data2"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testNode is a node running in process, on a loopback port.
+type testNode struct {
+	node   *Node
+	app    *app.App
+	server *http.Server
+}
+
+// newTestNode makes a node of a cluster of nodes, the base URLs of each, in a data dir of its own. It's not started.
+func newTestNode(t *testing.T, id string, nodes map[string]string, logger *log.Logger) *Node {
+	c := config.Default()
+	c.Cluster = config.ClusterConfig{Id: id, Nodes: nodes, Token: "cluster-token"}
+	a := app.CreateClusterNode(t.TempDir(), c, logger)
+	go a.ProcessMessages()
+
+	node, err := NewNode(id, nodes, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return node
+}
+
+// startCluster starts size nodes, each with its own data dir.
+func startCluster(t *testing.T, size int) (nodes map[string]*testNode) {
+	listeners := map[string]net.Listener{}
+	urls := map[string]string{}
+	for i := 0; i < size; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := string(rune('a' + i))
+		listeners[id], urls[id] = listener, "http://"+listener.Addr().String()
+	}
+
+	nodes = map[string]*testNode{}
+	for id, listener := range listeners {
+		logger := log.New(ioutil.Discard, "", 0)
+		if testing.Verbose() {
+			logger = log.New(log.Writer(), id+" ", log.Lmicroseconds)
+		}
+		node := newTestNode(t, id, urls, logger)
+		a := node.app
+		node.ElectionTimeout, node.Heartbeat = 150*time.Millisecond, 20*time.Millisecond
+		server := &http.Server{Handler: node.Handler()}
+		go server.Serve(listener)
+		node.Start()
+
+		nodes[id] = &testNode{node: node, app: a, server: server}
+	}
+	t.Cleanup(func() {
+		for _, n := range nodes {
+			n.node.Stop()
+			n.server.Close()
+		}
+	})
+
+	return nodes
+}
+
+// waitForLeader waits for one of nodes to be elected leader.
+func waitForLeader(t *testing.T, nodes map[string]*testNode) *testNode {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, n := range nodes {
+			if _, leading := n.node.Leader(); leading {
+				return n
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("No leader was elected")
+
+	return nil
+}
+
+// write writes to the leader, waiting until a majority have it.
+func write(t *testing.T, leader *testNode, body string) data.Sequence {
+	response := <-leader.app.RequestWrite([]byte(body), data2.Attributes{})
+	if response.Err != nil {
+		t.Fatalf("Could not write: %s", response.Err.Error())
+	}
+	if err := leader.app.WaitForQuorum(response.Sequence); err != nil {
+		t.Fatal(err)
+	}
+
+	return response.Sequence
+}
+
+// waitForCommitted waits for every one of nodes to have committed sequence.
+func waitForCommitted(t *testing.T, nodes map[string]*testNode, sequence data.Sequence) {
+	deadline := time.Now().Add(5 * time.Second)
+	for id, n := range nodes {
+		for n.app.Committed() < sequence {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s has only committed %d, not %d", id, n.app.Committed(), sequence)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// dataFiles is the contents of every data file in a node's data dir, by name.
+func dataFiles(t *testing.T, n *testNode) map[string][]byte {
+	names, err := filepath.Glob(filepath.Join(n.app.DataDir, "*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{}
+	for _, name := range names {
+		if files[filepath.Base(name)], err = ioutil.ReadFile(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return files
+}
+
+func TestClusterElectsReplicatesAndFailsOver(t *testing.T) {
+	nodes := startCluster(t, 3)
+
+	leader := waitForLeader(t, nodes)
+	var last data.Sequence
+	for i := 0; i < 10; i++ {
+		last = write(t, leader, fmt.Sprintf("first leader %d", i))
+	}
+	waitForCommitted(t, nodes, last)
+
+	// Writes to anyone else are turned away
+	for _, n := range nodes {
+		if n != leader {
+			if response := <-n.app.RequestWrite([]byte("not the leader"), data2.Attributes{}); response.Err != app.ErrNotLeader {
+				t.Fatalf("Expected %s writing to %s, got %v", app.ErrNotLeader, n.node.Id, response.Err)
+			}
+		}
+	}
+
+	// Take the leader away, the other two carry on
+	leader.node.Stop()
+	leader.server.Close()
+	delete(nodes, leader.node.Id)
+
+	newLeader := waitForLeader(t, nodes)
+	if newLeader.node.Term() <= leader.node.Term() {
+		t.Fatalf("New leader's term %d is not after %d", newLeader.node.Term(), leader.node.Term())
+	}
+	for i := 0; i < 10; i++ {
+		last = write(t, newLeader, fmt.Sprintf("second leader %d", i))
+	}
+	waitForCommitted(t, nodes, last)
+	if last != 20 {
+		t.Fatalf("Expected the last sequence to be 20, got %d", last)
+	}
+
+	// The data files are byte for byte the same
+	var expected map[string][]byte
+	for id, n := range nodes {
+		files := dataFiles(t, n)
+		if expected == nil {
+			expected = files
+			continue
+		}
+		if len(files) != len(expected) {
+			t.Fatalf("%s has %d data files, expected %d", id, len(files), len(expected))
+		}
+		for name, contents := range expected {
+			if !bytes.Equal(files[name], contents) {
+				t.Fatalf("%s's %s differs", id, name)
+			}
+		}
+	}
+
+	// Every message records the term it was written in
+	for _, contents := range expected {
+		if !strings.Contains(string(contents), data2.AttrTerm+"=") {
+			t.Fatal("Expected messages to have a term")
+		}
+	}
+}
+
+// unreachable is a cluster of three whose nodes can't be reached, for testing one of them on its own.
+var unreachable = map[string]string{"a": "http://127.0.0.1:1", "b": "http://127.0.0.1:1", "c": "http://127.0.0.1:1"}
+
+// writeTo writes to a node's App, which must be leading.
+func writeTo(t *testing.T, node *Node, body string) data.Sequence {
+	t.Helper()
+	response := <-node.app.RequestWrite([]byte(body), data2.Attributes{})
+	if response.Err != nil {
+		t.Fatalf("Could not write: %s", response.Err.Error())
+	}
+
+	return response.Sequence
+}
+
+func TestClusterToken(t *testing.T) {
+	node := newTestNode(t, "a", unreachable, log.New(ioutil.Discard, "", 0))
+	server := httptest.NewServer(node.Handler())
+	defer server.Close()
+
+	vote := `{"term": 7, "candidate": "b"}`
+	for _, token := range []string{"", "wrong", "cluster-token"} {
+		r, _ := http.NewRequest("POST", server.URL+"/raft/vote", strings.NewReader(vote))
+		if token != "" {
+			r.Header.Set("X-Afterme-Cluster-Token", token)
+		}
+		response, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+
+		expected := http.StatusForbidden
+		if token == "cluster-token" {
+			expected = http.StatusOK
+		}
+		if response.StatusCode != expected {
+			t.Fatalf("Expected a vote with token %q to be a %d, got %d", token, expected, response.StatusCode)
+		}
+		if token != "cluster-token" && node.Term() != 0 {
+			t.Fatal("Expected a vote without the token to be ignored")
+		}
+	}
+	if node.Term() != 7 {
+		t.Fatalf("Expected the vote with the token to move the term to 7, got %d", node.Term())
+	}
+
+	// There's no cluster without a token
+	a := app.CreateClusterNode(t.TempDir(), config.Default(), log.New(ioutil.Discard, "", 0))
+	if _, err := NewNode("a", unreachable, a); err == nil {
+		t.Fatal("Expected a node without a cluster token to be refused")
+	}
+}
+
+func TestVoteRejection(t *testing.T) {
+	node := newTestNode(t, "a", unreachable, log.New(ioutil.Discard, "", 0))
+	node.app.Lead(2)
+	writeTo(t, node, "a")
+	writeTo(t, node, "b")
+	node.app.StepDown()
+	node.state.Term = 3
+
+	rejected := map[string]VoteRequest{
+		"an earlier term":              {Term: 2, Candidate: "b", LastIndex: 5, LastTerm: 2},
+		"a log from an earlier term":   {Term: 4, Candidate: "b", LastIndex: 5, LastTerm: 1},
+		"a shorter log, the same term": {Term: 4, Candidate: "b", LastIndex: 1, LastTerm: 2},
+	}
+	for what, request := range rejected {
+		if response := node.vote(request); response.Granted || response.Term < 3 {
+			t.Fatalf("Expected a candidate with %s not to get the vote, got %+v", what, response)
+		}
+	}
+	if node.Term() != 4 || node.state.VotedFor != "" {
+		t.Fatalf("Expected a later term to be taken up, without a vote, got %+v", node.state)
+	}
+
+	if response := node.vote(VoteRequest{Term: 4, Candidate: "b", LastIndex: 2, LastTerm: 2}); !response.Granted {
+		t.Fatal("Expected a candidate with as up to date a log to get the vote")
+	}
+	if response := node.vote(VoteRequest{Term: 4, Candidate: "c", LastIndex: 9, LastTerm: 3}); response.Granted {
+		t.Fatal("Expected only one vote in a term")
+	}
+	if response := node.vote(VoteRequest{Term: 4, Candidate: "b", LastIndex: 2, LastTerm: 2}); !response.Granted {
+		t.Fatal("Expected the same candidate to get the vote again")
+	}
+
+	// The vote survives a restart
+	restarted, err := NewNode("a", unreachable, node.app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restarted.state != (state{Term: 4, VotedFor: "b"}) {
+		t.Fatalf("Expected the term and vote to be read back, got %+v", restarted.state)
+	}
+	if response := restarted.vote(VoteRequest{Term: 4, Candidate: "c", LastIndex: 9, LastTerm: 3}); response.Granted {
+		t.Fatal("Expected no second vote in the term after a restart")
+	}
+}
+
+func TestTerms(t *testing.T) {
+	node := newTestNode(t, "a", unreachable, log.New(ioutil.Discard, "", 0))
+	go node.applyRoles()
+	defer node.Stop()
+
+	node.mu.Lock()
+	node.state.Term = 2
+	node.becomeLeader()
+	node.mu.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for _, leading := node.Leader(); !leading; _, leading = node.Leader() {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the node to lead once its App does")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	writeTo(t, node, "a")
+
+	// A leader from an earlier term is turned away
+	response := node.appendEntries(AppendRequest{Term: 1, Leader: "b"})
+	if response.Success || response.Term != 2 {
+		t.Fatalf("Expected an append from term 1 to be refused, got %+v", response)
+	}
+	if _, leading := node.Leader(); !leading {
+		t.Fatal("Expected the node to carry on leading")
+	}
+
+	// One from a later term takes over, and the App stops taking writes
+	response = node.appendEntries(AppendRequest{Term: 3, Leader: "b", Prev: 1, PrevTerm: 2, Last: 1})
+	if !response.Success || response.Term != 3 || response.Last != 1 {
+		t.Fatalf("Expected an append from term 3 to be taken, got %+v", response)
+	}
+	if url, leading := node.Leader(); leading || url != unreachable["b"] || node.state.VotedFor != "" {
+		t.Fatalf("Expected b to be leading, got %s, %v, %+v", url, leading, node.state)
+	}
+	for deadline = time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if (<-node.app.RequestWrite([]byte("b"), data2.Attributes{})).Err == app.ErrNotLeader {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the App to stop taking writes")
+		}
+	}
+}
+
+func TestLogConflict(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	a, b := newTestNode(t, "a", unreachable, logger), newTestNode(t, "b", unreachable, logger)
+
+	// a leads in term 1, b gets its first message, but not the two after
+	a.app.Lead(1)
+	writeTo(t, a, "x")
+	request, err := a.appendRequest(1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response := b.appendEntries(request); !response.Success || response.Last != 1 {
+		t.Fatalf("Expected b to append message 1, got %+v", response)
+	}
+	writeTo(t, a, "y")
+	writeTo(t, a, "z")
+	a.app.StepDown()
+
+	// b leads in term 2, its messages 2 and 3 conflict with a's
+	b.mu.Lock()
+	b.state.Term = 2
+	b.mu.Unlock()
+	b.app.Lead(2)
+	writeTo(t, b, "p")
+	writeTo(t, b, "q")
+
+	// It goes back a message at a time until a's log matches, a's messages from term 1 are replaced
+	for next, expected := range map[data.Sequence]data.Sequence{4: 2, 3: 1} {
+		request, err = b.appendRequest(2, next)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response := a.appendEntries(request); response.Success || response.Last != expected {
+			t.Fatalf("Expected a to go back to %d from %d, got %+v", expected, next, response)
+		}
+	}
+	if request, err = b.appendRequest(2, 2); err != nil {
+		t.Fatal(err)
+	}
+	if response := a.appendEntries(request); !response.Success || response.Last != 3 {
+		t.Fatalf("Expected a to take b's messages, got %+v", response)
+	}
+	if last, term := a.app.LastEntry(); last != 3 || term != 2 {
+		t.Fatalf("Expected a's last message to be 3, from term 2, got %d from %d", last, term)
+	}
+	aFiles, bFiles := dataFiles(t, &testNode{app: a.app}), dataFiles(t, &testNode{app: b.app})
+	if len(aFiles) != len(bFiles) {
+		t.Fatalf("Expected a to have b's data files, got %d not %d", len(aFiles), len(bFiles))
+	}
+	for name, contents := range bFiles {
+		if !bytes.Equal(aFiles[name], contents) {
+			t.Fatalf("a's %s differs from b's", name)
+		}
+	}
+}
+
+func TestClusterSchemas(t *testing.T) {
+	nodes := startCluster(t, 3)
+	leader := waitForLeader(t, nodes)
+	for _, document := range []string{`{"type": "object"}`, `{"type": "array"}`} {
+		if _, _, err := leader.app.Schemas.Register("orders", []byte(document)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The others copy them from the leader with its next heartbeat
+	for id, n := range nodes {
+		deadline := time.Now().Add(5 * time.Second)
+		for count, _ := n.app.Schemas.Count(); count != 2 || n.app.SchemasBehind(); count, _ = n.app.Schemas.Count() {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %s to have both versions of orders' schema, it has %d", id, count)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if document, _ := n.app.Schemas.Document("orders", 2); string(document) != `{"type": "array"}` {
+			t.Fatalf("Expected %s's version 2 to be the leader's, got %s", id, document)
+		}
+	}
+
+	// A node that's heard of more than it has is behind until it's copied them, which it can't from a stand-in
+	n := newTestNode(t, "d", map[string]string{"d": "http://127.0.0.1:1"}, log.New(ioutil.Discard, "", 0))
+	n.wantSchemas("d", 3)
+	if !n.app.SchemasBehind() {
+		t.Fatal("Expected a node missing schemas to be behind")
+	}
+	for atomic.LoadInt32(&n.copyingSchemas) == 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	n.app.Schemas.Register("orders", []byte(`{"type": "object"}`))
+	n.app.Schemas.Register("orders", []byte(`{"type": "array"}`))
+	n.app.Schemas.Register("invoices", []byte(`{"type": "object"}`))
+	if n.wantSchemas("d", 3); n.app.SchemasBehind() {
+		t.Fatal("Expected a node with every schema not to be behind")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"fmt"
 	"github.com/saem/afterme/data"
+	"io"
 	"os"
 	"regexp"
 	"strconv"
@@ -68,7 +69,7 @@ func (message Message) Unmarshal(header string, body []byte) (err error) {
 // is already open, or if the file exists.
 func (df *dataFile) CreateForWrite() (err error) {
 	if df.file != nil {
-		return data.DataFileError{df.Name(), data.ALREADY_OPEN}
+		return data.DataFileError{Name: df.Name(), Code: data.ALREADY_OPEN}
 	}
 	df.file, err = os.OpenFile(df.fullName(), os.O_APPEND|os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
 
@@ -103,21 +104,17 @@ func (df dataFile) Write(message data.Message) (err error) {
 // not exist.
 func (df *dataFile) OpenForRead() (scanner *bufio.Scanner, err error) {
 	if df.file != nil {
-		return nil, data.DataFileError{df.Name(), data.ALREADY_OPEN}
+		return nil, data.DataFileError{Name: df.Name(), Code: data.ALREADY_OPEN}
 	}
 	df.file, err = os.OpenFile(df.fullName(), os.O_RDONLY, 0644)
 
-	return df.scanner(), err
+	return NewScanner(df.file), err
 }
 
-// scanner returns a scanner which allows for reading a file sequentially, returning alternating lines between
-// header and body
-func (df dataFile) scanner() (scanner *bufio.Scanner) {
-	if df.file == nil {
-		fmt.Errorf("For some reason the file pointer is nil")
-	}
-
-	scanner = bufio.NewScanner(df.file)
+// NewScanner returns a scanner which allows for reading messages sequentially, returning alternating lines
+// between header and body. It reads from a data file, or anything else in the same format.
+func NewScanner(r io.Reader) (scanner *bufio.Scanner) {
+	scanner = bufio.NewScanner(r)
 	parseHeader := true
 	var header string
 	split := func(data []byte, atEOF bool) (advance int, token []byte, err error) {
@@ -0,0 +1,320 @@
+package data2
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/saem/afterme/data"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+)
+
+// Version 2 of the file format, it's version 1 with an optional set of attributes trailing the header, so that
+// new pieces of metadata can be recorded without needing yet another format version:
+//
+//	<sequence>-<timestamp>-<size>-<hash>[ <attributes>]\n
+//	<body>
+//
+// Attributes are URL query encoded (key=value&key=value) with the keys sorted, an empty set is left off.
+
+// Well known attribute keys
+const (
+	AttrSubject     = "subject"      // Subject (erasure key) that the body was sealed for
+	AttrKey         = "key"          // Id of the subject's data key used to seal the body
+	AttrCipher      = "cipher"       // Cipher used to seal the body, absent means plain text
+	AttrErased      = "erased"       // Never written, only set on delivery when a sealed body's key is gone
+	AttrDeliveries  = "deliveries"   // Never written, only set on messages leased to a worker group, times leased
+	AttrHash        = "hash"         // Algorithm the body was hashed with, absent means SHA1
+	AttrStream      = "stream"       // Stream the message was written to, absent means none
+	AttrTime        = "time"         // Wall clock time it was written, nanoseconds since the epoch
+	AttrZone        = "zone"         // The server's time zone offset when it was written, like -07:00
+	AttrClock       = "hlc"          // Hybrid logical clock timestamp, never goes backwards, see hlc.Timestamp
+	AttrEvent       = "event"        // Client supplied time the event happened, nanoseconds since the epoch
+	AttrTerm        = "term"         // Raft term of the cluster leader that wrote it, absent outside of a cluster
+	AttrEpoch       = "epoch"        // Writer epoch it was written in, see the epoch file in the data dir
+	AttrType        = "type"         // Client supplied event type
+	AttrCorrelation = "correlation"  // Client supplied id correlating the messages of a conversation or workflow
+	AttrCausation   = "causation"    // Client supplied id of what caused it, often the id of another message
+	AttrContentType = "content-type" // MIME type of the body, as the client gave it
+	AttrSchema      = "schema"       // Version of the stream's schema the body was validated against
+	AttrProducer    = "producer"     // Subject of the TLS client certificate it was written with
+	AttrPrincipal   = "principal"    // Name of the principal whose token it was written with, see the auth package
+)
+
+// Prefixes of attributes with client supplied names
+const (
+	AttrMeta       = "meta." // Metadata, arbitrary key/value pairs, meta.<key> with the key in lower case
+	AttrCloudEvent = "ce."   // CloudEvents attributes without an attribute of their own, see the cloudevents package
+)
+
+// maxTokenSize is the biggest header or body the scanner will produce, this is above app.MaxMessageSize to
+// allow for sealing overhead.
+const maxTokenSize = 64 * 1024 * 1024
+
+// dataFile is an *os.File and associated metadata for a given data file.
+type dataFile struct {
+	version          data.Version
+	startingSequence data.Sequence
+	dataDir          string
+	file             *os.File
+	bytesWritten     uint32
+}
+
+// Attributes are the optional key/value pairs recorded in a message header.
+type Attributes map[string]string
+
+// Message represents an entry in the dataFile, consisting of metadata (header) and the data (body).
+type Message struct {
+	Sequence    data.Sequence
+	TimeStamp   int64
+	MessageSize uint32
+	Hash        string
+	Attributes  Attributes
+	Body        []byte
+}
+
+// NewDataFile is how you create a valid instance of a version 2 dataFile, nothing on disk will be created
+// that's taken care of by CreateForWrite and OpenForRead.
+func NewDataFile(startingSequence data.Sequence, dataDir string) (df *dataFile) {
+	df = new(dataFile)
+	df.version = data.Version(2)
+	df.startingSequence = startingSequence
+	df.dataDir = dataDir
+
+	return df
+}
+
+// Encode produces the header representation of the attributes, keys are sorted so the output is stable.
+func (attributes Attributes) Encode() string {
+	values := url.Values{}
+	for k, v := range attributes {
+		values.Set(k, v)
+	}
+
+	return values.Encode()
+}
+
+// Copy returns a copy that can be modified without affecting the original.
+func (attributes Attributes) Copy() (c Attributes) {
+	c = make(Attributes, len(attributes))
+	for k, v := range attributes {
+		c[k] = v
+	}
+
+	return c
+}
+
+// ParseAttributes is the inverse of Attributes.Encode
+func ParseAttributes(encoded string) (attributes Attributes, err error) {
+	values, err := url.ParseQuery(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse attributes, %s: %s", encoded, err.Error())
+	}
+
+	attributes = make(Attributes, len(values))
+	for k, v := range values {
+		attributes[k] = v[0]
+	}
+
+	return attributes, nil
+}
+
+// Marshal creates a header string, and a []byte to be written to disk.
+func (message Message) Marshal() (header string, body []byte, err error) {
+	header = fmt.Sprintf("%d-%d-%d-%s", message.Sequence, message.TimeStamp, message.MessageSize, message.Hash)
+	if len(message.Attributes) > 0 {
+		header += " " + message.Attributes.Encode()
+	}
+
+	return header + "\n", message.Body, nil
+}
+
+// Unmarshal takes a header and a body and sets the values to the data therein, this is an inverse of Marshal
+func (message *Message) Unmarshal(header string, body []byte) (err error) {
+	m, err := MessageFromHeader(header)
+	if err != nil {
+		return err
+	}
+
+	*message = m
+	message.Body = body
+
+	return nil
+}
+
+// CreateForWrite creates the actual on disk file, and opens it for writing. An error is produced if a file
+// is already open, or if the file exists.
+func (df *dataFile) CreateForWrite() (err error) {
+	if df.file != nil {
+		return data.DataFileError{Name: df.Name(), Code: data.ALREADY_OPEN}
+	}
+	df.file, err = os.OpenFile(df.fullName(), os.O_APPEND|os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+
+	return err
+}
+
+// Write takes a Marshal()'d Message to disk and writes it to a file, errors are thrown if the file write fails.
+func (df *dataFile) Write(message data.Message) (err error) {
+	header, body, err := message.Marshal()
+	if err != nil {
+		return err
+	}
+
+	bytesWritten, err := df.file.Write([]byte(header))
+	df.bytesWritten += uint32(bytesWritten)
+	if err != nil {
+		return err
+	}
+
+	bytesWritten, err = df.file.Write(body)
+	df.bytesWritten += uint32(bytesWritten)
+
+	return err
+}
+
+// OpenForRead opens a file for reading. An error is produced if a file is already open, or if the file does
+// not exist.
+func (df *dataFile) OpenForRead() (scanner *bufio.Scanner, err error) {
+	if df.file != nil {
+		return nil, data.DataFileError{Name: df.Name(), Code: data.ALREADY_OPEN}
+	}
+	df.file, err = os.OpenFile(df.fullName(), os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewScanner(df.file), nil
+}
+
+// NewScanner returns a scanner which allows for reading messages sequentially, returning alternating tokens
+// between header and body. It reads from a data file, or anything else in the same format.
+func NewScanner(r io.Reader) (scanner *bufio.Scanner) {
+	scanner = bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxTokenSize)
+	parseHeader := true
+	var messageSize int
+	split := func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		if parseHeader {
+			// Unlike bufio.ScanLines a header without a trailing newline isn't a token, at the end of a file
+			// that's a partial write, either in progress or torn by a crash.
+			i := bytes.IndexByte(data, '\n')
+			if i < 0 {
+				return 0, nil, nil
+			}
+
+			var m Message
+			m, err = MessageFromHeader(string(data[:i]))
+			if err != nil {
+				return
+			}
+			messageSize = int(m.MessageSize)
+			advance, token = i+1, data[:i]
+			parseHeader = false // alternate parsing logic
+		} else {
+			if len(data) < messageSize {
+				advance = 0
+				token = nil
+			} else {
+				token = data[:messageSize]
+				advance = messageSize
+				parseHeader = true // alternate parsing logic
+			}
+		}
+
+		return
+	}
+	scanner.Split(split)
+
+	return
+}
+
+// MessageFromHeader produces a Message based on a header string, an error is returned if it's not valid
+func MessageFromHeader(header string) (message Message, err error) {
+	matches := validMessageHeader.FindStringSubmatch(header)
+	if matches == nil {
+		return message, fmt.Errorf("Malformed header: %s", header)
+	}
+
+	sequence, err := strconv.ParseUint(matches[1], 10, 64)
+	if err != nil {
+		return message, fmt.Errorf("Malformed sequence in header: %s", header)
+	}
+	timeStamp, err := strconv.ParseInt(matches[2], 10, 64)
+	if err != nil {
+		return message, fmt.Errorf("Malformed timestamp in header: %s", header)
+	}
+	messageSize, err := strconv.ParseUint(matches[3], 10, 32)
+	if err != nil {
+		return message, fmt.Errorf("Malformed message size in header: %s", header)
+	}
+
+	var attributes Attributes
+	if matches[5] != "" {
+		attributes, err = ParseAttributes(matches[5])
+		if err != nil {
+			return message, err
+		}
+	}
+
+	message = Message{Sequence: data.Sequence(sequence),
+		TimeStamp:   timeStamp,
+		MessageSize: uint32(messageSize),
+		Hash:        matches[4],
+		Attributes:  attributes}
+
+	return message, nil
+}
+
+// validMessageHeader is a regexp that can be used to validate a message header
+var validMessageHeader = regexp.MustCompile(`^(\d+)-(\d+)-(\d+)-([a-zA-Z0-9=+/]+)(?: ([^ ]+))?$`)
+
+func (df *dataFile) BytesWritten() (bytes uint32) {
+	return df.bytesWritten
+}
+
+func (df *dataFile) Sync() (err error) {
+	return df.file.Sync()
+}
+
+func (df *dataFile) Close() (err error) {
+	if df.file != nil {
+		err = df.file.Close()
+	}
+
+	df.file = nil //we only allow reading XOR writing
+
+	return err
+}
+
+func (df *dataFile) Name() string {
+	return fmt.Sprintf("%d-%d.log", df.version, df.startingSequence)
+}
+
+func (df *dataFile) fullName() string {
+	return fmt.Sprintf("%s/%s", df.dataDir, df.Name())
+}
+
+var validFileName = regexp.MustCompile(`^2-(\d+)\.log$`)
+
+func LogFileValidateName(fileName string) (valid bool) {
+	return validFileName.MatchString(fileName)
+}
+
+// LogFileNameParser parses out the version and sequence from a log file name, returning an error if the name
+// is invalid.
+func LogFileNameParser(fileName string) (version data.Version, sequence data.Sequence, err error) {
+	matches := validFileName.FindStringSubmatch(fileName)
+	if matches == nil {
+		return data.Version(0), data.Sequence(0), fmt.Errorf("Could not parse filename, %s", fileName)
+	}
+	currentSequence, err := strconv.ParseUint(matches[1], 10, 64)
+
+	if err != nil {
+		return data.Version(0), data.Sequence(0), fmt.Errorf("Could not parse filename, %s", fileName)
+	}
+
+	return data.Version(2), data.Sequence(currentSequence), nil
+}
@@ -0,0 +1,82 @@
+package data2
+
+import (
+	"bytes"
+	"github.com/saem/afterme/data"
+	"reflect"
+	"testing"
+)
+
+func TestHeaderRoundTrip(t *testing.T) {
+	messages := []Message{
+		{Sequence: 1, TimeStamp: 1700000000000000000, MessageSize: 6, Hash: "qUqP5cyxm6YcTAhz05Hph5gvu9M=",
+			Body: []byte("hello\n")},
+		{Sequence: 2, TimeStamp: 1700000000000000001, MessageSize: 3, Hash: "abc+/=",
+			Attributes: Attributes{AttrStream: "orders", AttrHash: "sha256", AttrMeta + "note": "a b&c=d%\n",
+				AttrSubject: "alice@example.com"},
+			Body: []byte("{}\n")},
+	}
+
+	var file bytes.Buffer
+	for _, m := range messages {
+		header, body, err := m.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Count([]byte(header), []byte("\n")) != 1 {
+			t.Fatalf("Expected a one line header, got %q", header)
+		}
+		file.WriteString(header)
+		file.Write(body)
+	}
+
+	scanner := NewScanner(&file)
+	for _, expected := range messages {
+		if !scanner.Scan() {
+			t.Fatalf("Expected message %d's header, got %v", expected.Sequence, scanner.Err())
+		}
+		header := scanner.Text()
+		if !scanner.Scan() {
+			t.Fatalf("Expected message %d's body, got %v", expected.Sequence, scanner.Err())
+		}
+		var m Message
+		if err := m.Unmarshal(header, append([]byte(nil), scanner.Bytes()...)); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(m, expected) {
+			t.Fatalf("Expected %+v, got %+v", expected, m)
+		}
+	}
+	if scanner.Scan() {
+		t.Fatal("Expected nothing after the last message")
+	}
+}
+
+func TestMalformedHeaders(t *testing.T) {
+	for _, header := range []string{"", "1-2-3", "x-2-3-abc", "1-2-3-abc k=v extra", "1-2-99999999999-abc",
+		"1-2-3-ab!c"} {
+		if _, err := MessageFromHeader(header); err == nil {
+			t.Fatalf("Expected %q to be malformed", header)
+		}
+	}
+}
+
+func TestTornWrite(t *testing.T) {
+	// A header without its newline, or a body cut short, is a partial write and isn't a message
+	for _, contents := range []string{"1-2-6-abc", "1-2-6-abc\nhel"} {
+		scanner := NewScanner(bytes.NewBufferString(contents))
+		if scanner.Scan() && scanner.Scan() {
+			t.Fatalf("Expected %q not to be a message", contents)
+		}
+	}
+}
+
+func TestLogFileNames(t *testing.T) {
+	version, sequence, err := LogFileNameParser(NewDataFile(42, "").Name())
+	if err != nil || version != data.Version(2) || sequence != 42 {
+		t.Fatalf("Expected 2-42.log to parse, got %d, %d, %v", version, sequence, err)
+	}
+	if LogFileValidateName("1-42.log") || LogFileValidateName("2-x.log") {
+		t.Fatal("Expected only version 2 names to be valid")
+	}
+}
@@ -0,0 +1,92 @@
+package data2
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/saem/afterme/data"
+	"github.com/saem/afterme/hlc"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A sparse time index for a data file, a sidecar file (<name>.tidx) with a line for every so many messages:
+//
+//	<time> <sequence> <offset>\n
+//
+// time is the message's time (see MessageTime) and offset is where its header starts in the data file. Finding the
+// messages at a given time means seeking to the last entry before it, then scanning forward. The index is only a
+// shortcut, it isn't synced and can always be rebuilt from the data file.
+
+// IndexEntry is a line in a time index.
+type IndexEntry struct {
+	Time     int64
+	Sequence data.Sequence
+	Offset   int64
+}
+
+// IndexFileName is the name of the time index file for a data file.
+func IndexFileName(segment string) string {
+	return segment + ".tidx"
+}
+
+// MessageTime is the time a message is indexed by, its hybrid logical clock wall time as that never goes
+// backwards. Older messages without a clock fall back to their time attribute, or failing that, their timestamp.
+func MessageTime(message Message) int64 {
+	if t, err := hlc.Parse(message.Attributes[AttrClock]); err == nil {
+		return t.Wall
+	}
+	if wall, err := strconv.ParseInt(message.Attributes[AttrTime], 10, 64); err == nil {
+		return wall
+	}
+
+	return message.TimeStamp * 1e9
+}
+
+// OpenIndexForAppend opens a data file's time index for adding entries to.
+func OpenIndexForAppend(dataDir string, segment string) (f *os.File, err error) {
+	return os.OpenFile(filepath.Join(dataDir, IndexFileName(segment)), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+}
+
+// WriteIndexEntry appends an entry to an index opened with OpenIndexForAppend.
+func WriteIndexEntry(f *os.File, entry IndexEntry) (err error) {
+	_, err = fmt.Fprintf(f, "%d %d %d\n", entry.Time, entry.Sequence, entry.Offset)
+	return err
+}
+
+// ReadIndex reads a data file's time index, os.IsNotExist(err) is true if there isn't one. A partially written
+// last line is ignored.
+func ReadIndex(dataDir string, segment string) (entries []IndexEntry, err error) {
+	contents, err := ioutil.ReadFile(filepath.Join(dataDir, IndexFileName(segment)))
+	if err != nil {
+		return nil, err
+	}
+
+	lines := strings.Split(string(contents), "\n")
+	// The last element is either empty, or a line without a newline that was cut short
+	for _, line := range lines[:len(lines)-1] {
+		var entry IndexEntry
+		if _, err := fmt.Sscanf(line, "%d %d %d", &entry.Time, &entry.Sequence, &entry.Offset); err != nil {
+			return nil, fmt.Errorf("Malformed time index line: %s", line)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// OpenForReadAt opens a file for reading starting at offset, which must be the start of a header.
+func (df *dataFile) OpenForReadAt(offset int64) (scanner *bufio.Scanner, err error) {
+	scanner, err = df.OpenForRead()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = df.file.Seek(offset, 0); err != nil {
+		df.Close()
+		return nil, err
+	}
+
+	return scanner, nil
+}
@@ -0,0 +1,82 @@
+package data2
+
+import (
+	"github.com/saem/afterme/data"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestIndex(t *testing.T) {
+	dir := t.TempDir()
+	index, err := OpenIndexForAppend(dir, "2-1.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []IndexEntry{{Time: 100, Sequence: 1, Offset: 0}, {Time: 250, Sequence: 1001, Offset: 78000}}
+	for _, entry := range entries {
+		if err = WriteIndexEntry(index, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A crash can cut the last line short
+	index.WriteString("300 20")
+	index.Close()
+
+	read, err := ReadIndex(dir, "2-1.log")
+	if err != nil || !reflect.DeepEqual(read, entries) {
+		t.Fatalf("Expected %+v, got %+v, %v", entries, read, err)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, IndexFileName("2-9.log")), []byte("100 1 0\nnot an entry\n"), 0644)
+	if _, err = ReadIndex(dir, "2-9.log"); err == nil {
+		t.Fatal("Expected a malformed index to be an error")
+	}
+}
+
+func TestMessageTime(t *testing.T) {
+	tests := []struct {
+		message Message
+		time    int64
+	}{
+		{Message{TimeStamp: 7, Attributes: Attributes{AttrClock: "7000000005.2", AttrTime: "7000000009"}}, 7000000005},
+		{Message{TimeStamp: 7, Attributes: Attributes{AttrTime: "7000000009"}}, 7000000009},
+		{Message{TimeStamp: 7, Attributes: Attributes{AttrClock: "garbage"}}, 7000000000},
+		{Message{TimeStamp: 7}, 7000000000},
+	}
+	for _, test := range tests {
+		if actual := MessageTime(test.message); actual != test.time {
+			t.Fatalf("Expected %+v to be at %d, got %d", test.message, test.time, actual)
+		}
+	}
+}
+
+func TestOpenForReadAt(t *testing.T) {
+	dir := t.TempDir()
+	df := NewDataFile(data.Sequence(1), dir)
+	if err := df.CreateForWrite(); err != nil {
+		t.Fatal(err)
+	}
+	var offsets []int64
+	for i, body := range []string{"a\n", "bb\n", "ccc\n"} {
+		offsets = append(offsets, int64(df.BytesWritten()))
+		df.Write(&Message{Sequence: data.Sequence(i + 1), TimeStamp: 1, MessageSize: uint32(len(body)), Hash: "h",
+			Body: []byte(body)})
+	}
+	df.Close()
+
+	for i, offset := range offsets {
+		scanner, err := NewDataFile(data.Sequence(1), dir).OpenForReadAt(offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !scanner.Scan() {
+			t.Fatalf("Expected a header at %d", offset)
+		}
+		m, err := MessageFromHeader(scanner.Text())
+		if err != nil || m.Sequence != data.Sequence(i+1) {
+			t.Fatalf("Expected message %d at %d, got %+v, %v", i+1, offset, m, err)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package data2
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"github.com/saem/afterme/data"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Hash chaining and seals, tamper evidence for the log.
+//
+// Each message carries a chain hash (AttrChain), the SHA256 of the previous message's chain hash, this message's
+// header (sans chain attribute) and body. Altering, removing or reordering any message breaks the chain from that
+// point on. The chain starts, with an empty previous hash, at the first message that has a chain attribute.
+//
+// Once a data file is done with, rotated or found left over on start up, it's sealed with a sidecar file
+// (<name>.seal) that records the messages in the file, a digest of the whole file, the chain head at the end of
+// the file and the Merkle root of its messages. The seal is signed with the node key, so a copy of a data file
+// (say in cold storage) can be shown to be byte for byte what the server wrote.
+
+const AttrChain = "chain" // Chain hash up to and including this message
+
+// ChainHash computes the chain hash for message given the previous message's chain hash, which is empty for the
+// first message of the chain.
+func ChainHash(previous string, message Message) (chain string, err error) {
+	prev, err := base64.StdEncoding.DecodeString(previous)
+	if err != nil {
+		return "", fmt.Errorf("Invalid previous chain hash, %s: %s", previous, err.Error())
+	}
+
+	unchained := message
+	if _, ok := message.Attributes[AttrChain]; ok {
+		unchained.Attributes = message.Attributes.Copy()
+		delete(unchained.Attributes, AttrChain)
+	}
+	header, body, err := unchained.Marshal()
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write(prev)
+	h.Write([]byte(header))
+	h.Write(body)
+
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// Seal is the contents of a seal file, written as "field: value" lines.
+type Seal struct {
+	Segment   string        // Name of the data file that's sealed
+	First     data.Sequence // First message in the data file
+	Last      data.Sequence // Last message in the data file
+	Count     uint64        // Number of messages in the data file
+	Digest    string        // SHA256 of the whole data file
+	Chain     string        // Chain hash of the last message in the data file
+	Merkle    string        // Merkle tree root hash of the messages in the data file
+	Signature string        // Ed25519 signature, by the node key, of all the above
+}
+
+// SignedBytes is what the signature covers, every line of the seal file but the signature.
+func (seal Seal) SignedBytes() []byte {
+	return []byte(fmt.Sprintf("segment: %s\nfirst: %d\nlast: %d\ncount: %d\ndigest: %s\nchain: %s\nmerkle: %s\n",
+		seal.Segment,
+		seal.First,
+		seal.Last,
+		seal.Count,
+		seal.Digest,
+		seal.Chain,
+		seal.Merkle))
+}
+
+// Marshal produces the seal file contents.
+func (seal Seal) Marshal() []byte {
+	return append(seal.SignedBytes(), []byte(fmt.Sprintf("signature: %s\n", seal.Signature))...)
+}
+
+// Sign sets the signature using the node's key.
+func (seal *Seal) Sign(key ed25519.PrivateKey) {
+	seal.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, seal.SignedBytes()))
+}
+
+// Verify checks the signature against the node's public key.
+func (seal Seal) Verify(key ed25519.PublicKey) bool {
+	signature, err := base64.StdEncoding.DecodeString(seal.Signature)
+	return err == nil && ed25519.Verify(key, seal.SignedBytes(), signature)
+}
+
+// Unmarshal is the inverse of Marshal, unknown fields are ignored.
+func (seal *Seal) Unmarshal(contents []byte) (err error) {
+	scanner := bufio.NewScanner(strings.NewReader(string(contents)))
+	for scanner.Scan() {
+		field := strings.SplitN(scanner.Text(), ": ", 2)
+		if len(field) != 2 {
+			return fmt.Errorf("Malformed seal line: %s", scanner.Text())
+		}
+
+		switch field[0] {
+		case "segment":
+			seal.Segment = field[1]
+		case "first":
+			var first uint64
+			first, err = strconv.ParseUint(field[1], 10, 64)
+			seal.First = data.Sequence(first)
+		case "last":
+			var last uint64
+			last, err = strconv.ParseUint(field[1], 10, 64)
+			seal.Last = data.Sequence(last)
+		case "count":
+			seal.Count, err = strconv.ParseUint(field[1], 10, 64)
+		case "digest":
+			seal.Digest = field[1]
+		case "chain":
+			seal.Chain = field[1]
+		case "merkle":
+			seal.Merkle = field[1]
+		case "signature":
+			seal.Signature = field[1]
+		}
+		if err != nil {
+			return fmt.Errorf("Malformed seal line: %s", scanner.Text())
+		}
+	}
+
+	return scanner.Err()
+}
+
+// FileDigest is the SHA256, base64, of a whole data file.
+func FileDigest(dataDir string, segment string) (digest string, err error) {
+	f, err := os.Open(filepath.Join(dataDir, segment))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// SealFileName is the name of the seal file for a data file
+func SealFileName(segment string) string {
+	return segment + ".seal"
+}
+
+// WriteSeal writes, and syncs, the seal file for seal.Segment. It's written to a temporary file first and then
+// renamed, so a seal file is either complete or absent.
+func WriteSeal(dataDir string, seal Seal) (err error) {
+	path := filepath.Join(dataDir, SealFileName(seal.Segment))
+	tmp := path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(seal.Marshal()); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+
+	return err
+}
+
+// ReadSeal reads the seal file for a data file, os.IsNotExist(err) is true if the data file isn't sealed.
+func ReadSeal(dataDir string, segment string) (seal Seal, err error) {
+	contents, err := ioutil.ReadFile(filepath.Join(dataDir, SealFileName(segment)))
+	if err != nil {
+		return seal, err
+	}
+
+	err = seal.Unmarshal(contents)
+
+	return seal, err
+}
@@ -0,0 +1,95 @@
+package data2
+
+import (
+	"crypto/ed25519"
+	"os"
+	"testing"
+)
+
+func TestChainHash(t *testing.T) {
+	first := Message{Sequence: 1, TimeStamp: 1, MessageSize: 2, Hash: "h1", Body: []byte("a\n")}
+	second := Message{Sequence: 2, TimeStamp: 2, MessageSize: 2, Hash: "h2", Body: []byte("b\n")}
+
+	c1, err := ChainHash("", first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := ChainHash(c1, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c1 == c2 {
+		t.Fatal("Expected each message to have its own chain hash")
+	}
+
+	// The chain attribute itself isn't covered, it's what's being worked out
+	second.Attributes = Attributes{AttrChain: c2}
+	if again, _ := ChainHash(c1, second); again != c2 {
+		t.Fatalf("Expected the chain attribute to be left out, got %s not %s", again, c2)
+	}
+	if second.Attributes[AttrChain] != c2 {
+		t.Fatal("Expected the message's attributes to be left as they were")
+	}
+
+	changes := map[string]func(m *Message){
+		"body":       func(m *Message) { m.Body = []byte("c\n") },
+		"hash":       func(m *Message) { m.Hash = "h3" },
+		"sequence":   func(m *Message) { m.Sequence = 3 },
+		"attributes": func(m *Message) { m.Attributes = Attributes{AttrChain: c2, AttrStream: "orders"} },
+	}
+	for what, change := range changes {
+		m := second
+		change(&m)
+		if chain, _ := ChainHash(c1, m); chain == c2 {
+			t.Fatalf("Expected changing the %s to change the chain hash", what)
+		}
+	}
+	if chain, _ := ChainHash("", second); chain == c2 {
+		t.Fatal("Expected the previous chain hash to change the chain hash")
+	}
+	if _, err = ChainHash("not base64!", second); err == nil {
+		t.Fatal("Expected an invalid previous chain hash to be an error")
+	}
+}
+
+func TestSeal(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+
+	seal := Seal{Segment: "2-1.log", First: 1, Last: 3, Count: 3, Digest: "ZA==", Chain: "Yw==", Merkle: "bQ=="}
+	seal.Sign(private)
+	if !seal.Verify(public) {
+		t.Fatal("Expected the seal to verify")
+	}
+	if err = WriteSeal(dir, seal); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadSeal(dir, "2-1.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read != seal {
+		t.Fatalf("Expected %+v, got %+v", seal, read)
+	}
+	if _, err = os.Stat(dir + "/" + SealFileName("2-1.log") + ".tmp"); !os.IsNotExist(err) {
+		t.Fatal("Expected the temporary file to be gone")
+	}
+
+	read.Count = 4
+	if read.Verify(public) {
+		t.Fatal("Expected a changed seal not to verify")
+	}
+	other, _, _ := ed25519.GenerateKey(nil)
+	if seal.Verify(other) {
+		t.Fatal("Expected the seal not to verify with another key")
+	}
+	if _, err = ReadSeal(dir, "2-4.log"); !os.IsNotExist(err) {
+		t.Fatalf("Expected a missing seal to be IsNotExist, got %v", err)
+	}
+	if err = read.Unmarshal([]byte("segment 2-1.log\n")); err == nil {
+		t.Fatal("Expected a malformed seal to be an error")
+	}
+}
@@ -0,0 +1,102 @@
+package delivery
+
+import (
+	"context"
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/saem/afterme/data2"
+	"strconv"
+	"time"
+)
+
+// amqpSink publishes to an AMQP 0-9-1 broker (RabbitMQ), with publisher confirms, so a batch is only delivered once
+// the broker has acknowledged every message in it. Messages are persistent, with their sequence as the message id.
+type amqpSink struct {
+	url        string
+	exchange   string
+	routingKey string // The message's stream if empty
+
+	conn    *amqp.Connection
+	channel *amqp.Channel
+}
+
+func (sink *amqpSink) Send(batch []data2.Message) (err error) {
+	if sink.channel == nil {
+		if err = sink.connect(); err != nil {
+			return err
+		}
+	}
+	defer func() {
+		if err != nil {
+			sink.close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), DeliveryTimeout)
+	defer cancel()
+
+	confirms := make([]*amqp.DeferredConfirmation, 0, len(batch))
+	for _, m := range batch {
+		key := sink.routingKey
+		if key == "" {
+			key = m.Attributes[data2.AttrStream]
+		}
+		headers := amqp.Table{}
+		for _, header := range Headers(m) {
+			headers[header.Key] = header.Value
+		}
+
+		contentType := m.Attributes[data2.AttrContentType]
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+
+		confirm, err := sink.channel.PublishWithDeferredConfirmWithContext(ctx, sink.exchange, key, false, false,
+			amqp.Publishing{Headers: headers,
+				ContentType:   contentType,
+				CorrelationId: m.Attributes[data2.AttrCorrelation],
+				Type:          m.Attributes[data2.AttrType],
+				DeliveryMode:  amqp.Persistent,
+				MessageId:     strconv.FormatUint(uint64(m.Sequence), 10),
+				Timestamp:     time.Unix(0, data2.MessageTime(m)),
+				Body:          m.Body})
+		if err != nil {
+			return err
+		}
+		confirms = append(confirms, confirm)
+	}
+
+	for i, confirm := range confirms {
+		acked, err := confirm.WaitContext(ctx)
+		if err != nil {
+			return err
+		}
+		if !acked {
+			return fmt.Errorf("The broker didn't take sequence %d", batch[i].Sequence)
+		}
+	}
+
+	return nil
+}
+
+func (sink *amqpSink) connect() (err error) {
+	sink.conn, err = amqp.DialConfig(sink.url, amqp.Config{Dial: amqp.DefaultDial(DeliveryTimeout)})
+	if err != nil {
+		return err
+	}
+	if sink.channel, err = sink.conn.Channel(); err == nil {
+		err = sink.channel.Confirm(false)
+	}
+	if err != nil {
+		sink.close()
+	}
+
+	return err
+}
+
+func (sink *amqpSink) close() {
+	if sink.conn != nil {
+		sink.conn.Close()
+	}
+	sink.conn, sink.channel = nil, nil
+}
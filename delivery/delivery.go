@@ -0,0 +1,425 @@
+package delivery
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/saem/afterme/app"
+	"github.com/saem/afterme/config"
+	"github.com/saem/afterme/data"
+	"github.com/saem/afterme/data2"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Delivery pushes committed messages out to targets, webhooks and sinks (brokers, files and commands), in order, so
+// integrations don't need their own daemon tailing the log. Each target has a cursor, the last sequence it's been
+// sent, kept in the data dir so delivery carries on where it left off after a restart. A batch that fails is
+// retried with exponential backoff, after enough failures it's recorded as a dead letter and delivery moves on.
+// Delivery is at least once, a crash between a target taking a batch and the cursor being written sends that batch
+// again.
+//
+// Targets are fed from the data files, once a message is synced (see App.SyncedChanged) and committed, each at its
+// own pace. A slow or unreachable target falls behind, its lag is in its Status, without holding up writes or any
+// other target. With keep_for_consumers retention waits for every target, without it messages deleted before a
+// target got to them are recorded as a dead letter.
+//
+// Only the node taking writes delivers: a single node, a leader, or a cluster's leader. Cursors aren't replicated,
+// a new cluster leader carries on from its own.
+
+const (
+	DirName         = "delivery" // In the data dir, holding <target>.cursor and <target>.dead
+	PollInterval    = 100 * time.Millisecond
+	DeliveryTimeout = 30 * time.Second
+)
+
+// Sink is a target committed messages are delivered to.
+type Sink interface {
+	// Send delivers a batch of messages, in order, an error unless the target has taken every one of them. A
+	// Sink with a connection reconnects on the next Send after one fails.
+	Send(batch []data2.Message) error
+}
+
+// DeadLetter records a batch that couldn't be delivered.
+type DeadLetter struct {
+	First    data.Sequence `json:"first"`
+	Last     data.Sequence `json:"last"`
+	Attempts int           `json:"attempts"`
+	Error    string        `json:"error"`
+	Time     time.Time     `json:"time"`
+}
+
+// Status is how delivery to a target is going.
+type Status struct {
+	Name        string        `json:"name"`
+	Type        string        `json:"type"` // webhook, or the sink's type
+	Target      string        `json:"target"`
+	Delivered   data.Sequence `json:"delivered"` // Everything up to and including this has been delivered
+	Lag         uint64        `json:"lag"`       // Committed messages yet to be delivered
+	Failures    int           `json:"failures"`  // Failed attempts in a row
+	LastError   string        `json:"last_error,omitempty"`
+	NextAttempt *time.Time    `json:"next_attempt,omitempty"`
+	DeadLetters int           `json:"dead_letters"`
+}
+
+// Manager delivers to every configured target.
+type Manager struct {
+	app     *app.App
+	targets map[string]*target
+}
+
+// target is a target being delivered to.
+type target struct {
+	name     string
+	kind     string // Type, for Status
+	url      string // Where it's delivered, for Status
+	settings config.DeliveryConfig
+	sink     Sink
+	dir      string
+
+	mu          sync.Mutex
+	cursor      data.Sequence
+	failures    int
+	lastError   string
+	nextAttempt time.Time
+	deadLetters int
+}
+
+// Start starts delivering to the webhooks and sinks in the App's config.
+func Start(a *app.App) (manager *Manager, err error) {
+	manager = &Manager{app: a, targets: map[string]*target{}}
+	dir := filepath.Join(a.DataDir, DirName)
+	if len(a.Config.Webhooks)+len(a.Config.Sinks) > 0 {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	for name, settings := range a.Config.Webhooks {
+		manager.targets[name] = &target{name: name,
+			kind:     "webhook",
+			url:      settings.URL,
+			settings: settings.DeliveryConfig,
+			sink:     newWebhook(name, settings),
+			dir:      dir}
+	}
+	for name, settings := range a.Config.Sinks {
+		sink, err := NewSink(settings)
+		if err != nil {
+			return nil, fmt.Errorf("Could not set up sink %s: %s", name, err.Error())
+		}
+		manager.targets[name] = &target{name: name,
+			kind:     settings.Type,
+			url:      settings.Target(),
+			settings: settings.DeliveryConfig,
+			sink:     sink,
+			dir:      dir}
+	}
+	for name, t := range manager.targets {
+		if err = t.load(); err != nil {
+			return nil, fmt.Errorf("Could not load the delivery state of %s: %s", name, err.Error())
+		}
+	}
+	if len(manager.targets) > 0 {
+		a.Hold(manager.delivered)
+	}
+	for _, t := range manager.targets {
+		go manager.deliver(t)
+	}
+
+	return manager, nil
+}
+
+// delivered is the lowest of the targets' cursors, retention keeps what's after it with keep_for_consumers.
+func (manager *Manager) delivered() (min data.Sequence) {
+	first := true
+	for _, t := range manager.targets {
+		t.mu.Lock()
+		if first || t.cursor < min {
+			min, first = t.cursor, false
+		}
+		t.mu.Unlock()
+	}
+
+	return min
+}
+
+// Statuses is the status of every target, or if webhooks only the webhooks, ordered by name.
+func (manager *Manager) Statuses(webhooks bool) (statuses []Status) {
+	for _, t := range manager.targets {
+		if !webhooks || t.kind == "webhook" {
+			statuses = append(statuses, t.status(manager.app.Committed()))
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+
+	return statuses
+}
+
+// Handler serves the admin endpoints, GET /admin/sinks for every target's status and GET /admin/sinks/<name> for
+// one target's, along with its dead letters. /admin/webhooks is the same, for webhooks only.
+func (manager *Manager) Handler() http.Handler {
+	mux := http.NewServeMux()
+	for _, prefix := range []string{"/admin/sinks", "/admin/webhooks"} {
+		prefix := prefix
+		webhooks := prefix == "/admin/webhooks"
+		mux.HandleFunc(prefix, func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, manager.Statuses(webhooks))
+		})
+		mux.HandleFunc(prefix+"/", func(w http.ResponseWriter, r *http.Request) {
+			manager.targetHandler(w, r, strings.TrimPrefix(r.URL.Path, prefix+"/"), webhooks)
+		})
+	}
+
+	return mux
+}
+
+// targetHandler serves a target's status and dead letters.
+func (manager *Manager) targetHandler(w http.ResponseWriter, r *http.Request, name string, webhooks bool) {
+	t, ok := manager.targets[name]
+	if !ok || (webhooks && t.kind != "webhook") {
+		http.NotFound(w, r)
+		return
+	}
+	deadLetters, err := t.readDeadLetters()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, struct {
+		Status
+		DeadLetters []DeadLetter `json:"dead_letter_records"`
+	}{t.status(manager.app.Committed()), deadLetters})
+}
+
+// deliver delivers to a target for as long as the server runs.
+func (manager *Manager) deliver(t *target) {
+	for {
+		synced := manager.app.SyncedChanged()
+		if _, leading := manager.app.WriteLeader(); !leading || t.caughtUp(manager.app.Committed()) {
+			select {
+			case <-synced:
+			case <-time.After(PollInterval):
+			}
+			continue
+		}
+
+		batch, last, err := t.nextBatch(manager.app)
+		if err != nil {
+			manager.app.Logger.Printf("Could not read messages for %s, because: %s", t.name, err.Error())
+			time.Sleep(PollInterval)
+			continue
+		}
+		if len(batch) > 0 {
+			err = t.sink.Send(batch)
+		}
+		if err = t.attempted(batch, last, err); err != nil {
+			manager.app.Logger.Printf("Could not record delivery to %s, because: %s", t.name, err.Error())
+		}
+
+		t.mu.Lock()
+		wait := time.Until(t.nextAttempt)
+		t.mu.Unlock()
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+}
+
+// caughtUp is whether everything committed has been delivered.
+func (t *target) caughtUp(committed data.Sequence) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.cursor >= committed
+}
+
+// nextBatch reads the next batch of committed messages for a target, last is the last message read, which is
+// past the end of the batch when messages from other streams follow it. Messages retention deleted before they
+// were delivered are recorded as a dead letter, and passed over in an empty batch.
+func (t *target) nextBatch(a *app.App) (batch []data2.Message, last data.Sequence, err error) {
+	t.mu.Lock()
+	from := t.cursor + 1
+	t.mu.Unlock()
+	committed, size := a.Committed(), t.settings.BatchSize()
+
+	last = from - 1
+	err = app.ReadLog(a.DataDir, from, func(m data2.Message) error {
+		if m.Sequence > committed || len(batch) == size {
+			return app.ErrStopReading
+		}
+		if last == from-1 && m.Sequence > from {
+			last = m.Sequence - 1
+			return t.deleted(from, last)
+		}
+		last = m.Sequence
+		if t.settings.Stream != "" && m.Attributes[data2.AttrStream] != t.settings.Stream {
+			return nil
+		}
+		m, err := app.Deliverable(a.Keys, m)
+		if err != nil {
+			return err
+		}
+		batch = append(batch, m)
+		return nil
+	})
+
+	return batch, last, err
+}
+
+// attempted records the outcome of an attempt to deliver a batch, ending with last. A batch that's failed too
+// many times is dead lettered, either way the cursor moves past it.
+func (t *target) attempted(batch []data2.Message, last data.Sequence, err error) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err == nil {
+		t.failures, t.lastError, t.nextAttempt = 0, "", time.Time{}
+		return t.setCursor(last)
+	}
+
+	t.failures++
+	t.lastError = err.Error()
+	if t.failures < t.settings.Attempts() {
+		t.nextAttempt = time.Now().Add(t.settings.Wait(t.failures))
+		return nil
+	}
+
+	deadLetter := DeadLetter{First: batch[0].Sequence,
+		Last:     batch[len(batch)-1].Sequence,
+		Attempts: t.failures,
+		Error:    t.lastError,
+		Time:     time.Now()}
+	t.failures, t.nextAttempt = 0, time.Time{}
+	if err = t.writeDeadLetter(deadLetter); err != nil {
+		// Not moving on, or the batch would be lost without a trace
+		t.nextAttempt = time.Now().Add(t.settings.Wait(t.settings.Attempts()))
+		return err
+	}
+
+	return t.setCursor(last)
+}
+
+// deleted records a dead letter for messages retention deleted before they were delivered.
+func (t *target) deleted(first data.Sequence, last data.Sequence) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	deadLetter := DeadLetter{First: first, Last: last, Error: "Deleted by retention before being delivered",
+		Time: time.Now()}
+	if err := t.writeDeadLetter(deadLetter); err != nil {
+		return err
+	}
+
+	return app.ErrStopReading
+}
+
+func (t *target) status(committed data.Sequence) (status Status) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	status = Status{Name: t.name,
+		Type:        t.kind,
+		Target:      t.url,
+		Delivered:   t.cursor,
+		Failures:    t.failures,
+		LastError:   t.lastError,
+		DeadLetters: t.deadLetters}
+	if committed > t.cursor {
+		status.Lag = uint64(committed - t.cursor)
+	}
+	if !t.nextAttempt.IsZero() {
+		nextAttempt := t.nextAttempt
+		status.NextAttempt = &nextAttempt
+	}
+
+	return status
+}
+
+// load reads the cursor and counts the dead letters from a previous run.
+func (t *target) load() error {
+	contents, err := ioutil.ReadFile(t.path(".cursor"))
+	if err == nil {
+		var cursor uint64
+		cursor, err = strconv.ParseUint(strings.TrimSpace(string(contents)), 10, 64)
+		t.cursor = data.Sequence(cursor)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	deadLetters, err := t.readDeadLetters()
+	t.deadLetters = len(deadLetters)
+
+	return err
+}
+
+// setCursor records that everything up to and including sequence has been delivered.
+func (t *target) setCursor(sequence data.Sequence) (err error) {
+	path := t.path(".cursor")
+	f, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%d\n", sequence)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err == nil {
+		t.cursor = sequence
+	}
+
+	return err
+}
+
+// writeDeadLetter appends a dead letter to the target's dead letter file, a JSON object a line.
+func (t *target) writeDeadLetter(deadLetter DeadLetter) (err error) {
+	line, _ := json.Marshal(deadLetter)
+	f, err := os.OpenFile(t.path(".dead"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = f.Write(append(line, '\n')); err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		t.deadLetters++
+	}
+
+	return err
+}
+
+func (t *target) readDeadLetters() (deadLetters []DeadLetter, err error) {
+	contents, err := ioutil.ReadFile(t.path(".dead"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	for _, line := range strings.Split(string(contents), "\n") {
+		var deadLetter DeadLetter
+		if line != "" && json.Unmarshal([]byte(line), &deadLetter) == nil {
+			deadLetters = append(deadLetters, deadLetter)
+		}
+	}
+
+	return deadLetters, err
+}
+
+func (t *target) path(suffix string) string {
+	return filepath.Join(t.dir, t.name+suffix)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,266 @@
+package delivery
+
+import (
+	"fmt"
+	"github.com/saem/afterme/app"
+	"github.com/saem/afterme/config"
+	"github.com/saem/afterme/data"
+	"github.com/saem/afterme/data2"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testBatch is messages 1 to 3 of the orders stream.
+func testBatch() (batch []data2.Message) {
+	now := time.Now()
+	for i := 1; i <= 3; i++ {
+		body := []byte(fmt.Sprintf("order %d\n", i))
+		batch = append(batch, data2.Message{Sequence: data.Sequence(i),
+			TimeStamp:   now.Unix(),
+			MessageSize: uint32(len(body)),
+			Hash:        "hash" + strconv.Itoa(i),
+			Attributes: data2.Attributes{data2.AttrStream: "orders",
+				data2.AttrTime: strconv.FormatInt(now.UnixNano(), 10)},
+			Body: body})
+	}
+
+	return batch
+}
+
+// checkPublished checks a stand-in got batch, in order, to destination.
+func checkPublished(t *testing.T, got []published, batch []data2.Message, destination string) {
+	if len(got) != len(batch) {
+		t.Fatalf("Expected %d messages, got %d: %v", len(batch), len(got), got)
+	}
+	for i, p := range got {
+		if p.Destination != destination {
+			t.Errorf("Expected %d to go to %s, went to %s", i, destination, p.Destination)
+		}
+		if p.Body != string(batch[i].Body) {
+			t.Errorf("Expected body %q, got %q", batch[i].Body, p.Body)
+		}
+		if sequence := p.Headers["afterme-sequence"]; sequence != strconv.Itoa(int(batch[i].Sequence)) {
+			t.Errorf("Expected afterme-sequence %d, got %q", batch[i].Sequence, sequence)
+		}
+		if stream := p.Headers["afterme-stream"]; stream != "orders" {
+			t.Errorf("Expected afterme-stream orders, got %q", stream)
+		}
+	}
+}
+
+// sendTwice sends the batch, then sends it again to check the sink carries on with the connection it has.
+func sendTwice(t *testing.T, sink Sink, batch []data2.Message) {
+	for _, b := range [][]data2.Message{batch[:1], batch[1:]} {
+		if err := sink.Send(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestNATSSink(t *testing.T) {
+	server := newStandIn(t, serveNATS)
+	sink, _ := NewSink(config.SinkConfig{Type: config.SinkNATS, URL: "nats://" + server.addr(), Subject: "afterme.orders"})
+
+	batch := testBatch()
+	sendTwice(t, sink, batch)
+	checkPublished(t, server.published(), batch, "afterme.orders")
+}
+
+func TestAMQPSink(t *testing.T) {
+	broker := newStandIn(t, serveAMQP)
+	sink, _ := NewSink(config.SinkConfig{Type: config.SinkAMQP, URL: "amqp://guest:guest@" + broker.addr() + "/",
+		Exchange: "events"})
+
+	batch := testBatch()
+	sendTwice(t, sink, batch)
+	checkPublished(t, broker.published(), batch, "events/orders")
+}
+
+func TestKafkaSink(t *testing.T) {
+	bootstrap, leader := newKafkaStandIn(t, "orders")
+	sink, _ := NewSink(config.SinkConfig{Type: config.SinkKafka, Brokers: []string{bootstrap.addr()}, Topic: "orders"})
+
+	batch := testBatch()
+	sendTwice(t, sink, batch)
+	checkPublished(t, leader.published(), batch, "orders")
+
+	// A broker whose leader can't be reached is passed over for the next
+	unreachable, gone := newKafkaStandIn(t, "orders")
+	gone.listener.Close()
+	bootstrap, leader = newKafkaStandIn(t, "orders")
+	sink, _ = NewSink(config.SinkConfig{Type: config.SinkKafka, Brokers: []string{unreachable.addr(), bootstrap.addr()},
+		Topic: "orders"})
+	sendTwice(t, sink, batch)
+	checkPublished(t, leader.published(), batch, "orders")
+}
+
+func TestFileAndExecSinks(t *testing.T) {
+	dir := t.TempDir()
+	batch := testBatch()
+	expected := string(logFormat(batch))
+
+	sink, _ := NewSink(config.SinkConfig{Type: config.SinkFile, Path: filepath.Join(dir, "file.log")})
+	sendTwice(t, sink, batch)
+	if contents, _ := ioutil.ReadFile(filepath.Join(dir, "file.log")); string(contents) != expected {
+		t.Fatalf("Expected the file sink to write:\n%s\ngot:\n%s", expected, contents)
+	}
+
+	sink, _ = NewSink(config.SinkConfig{Type: config.SinkExec,
+		Command: []string{"sh", "-c", "cat > " + filepath.Join(dir, "exec.log")}})
+	sendTwice(t, sink, batch)
+	sink.(*execSink).stdin.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		contents, _ := ioutil.ReadFile(filepath.Join(dir, "exec.log"))
+		if string(contents) == expected {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the exec sink's command to get:\n%s\ngot:\n%s", expected, contents)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestExecSinkAcks(t *testing.T) {
+	dir := t.TempDir()
+	batch := testBatch()
+
+	// Each message is a header line and, for these, a body of one line, it's acked once it's in the file
+	script := `while read -r header && read -r body; do echo "$body" >> ` + filepath.Join(dir, "acked.log") +
+		`; echo ok; done`
+	sink, _ := NewSink(config.SinkConfig{Type: config.SinkExec, Command: []string{"sh", "-c", script}, Ack: true})
+	sendTwice(t, sink, batch)
+	if contents, _ := ioutil.ReadFile(filepath.Join(dir, "acked.log")); string(contents) != "order 1\norder 2\norder 3\n" {
+		t.Fatalf("Expected every message to be in the file once Send returned, got:\n%s", contents)
+	}
+	sink.(*execSink).stop()
+
+	// A command that exits without acking fails the batch, and is run again for the next try
+	script = `read -r header; echo x >> ` + filepath.Join(dir, "runs.log") + `; exit 1`
+	sink, _ = NewSink(config.SinkConfig{Type: config.SinkExec, Command: []string{"sh", "-c", script}, Ack: true})
+	for i := 0; i < 2; i++ {
+		if err := sink.Send(batch); err == nil {
+			t.Fatal("Expected a batch that wasn't acked to fail")
+		}
+	}
+	if contents, _ := ioutil.ReadFile(filepath.Join(dir, "runs.log")); string(contents) != "x\nx\n" {
+		t.Fatalf("Expected the command to be run for each try, got %q", contents)
+	}
+}
+
+// TestManager delivers from a running App, to a file sink and to a webhook that always fails.
+func TestManager(t *testing.T) {
+	dir := t.TempDir()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	cfg := config.Default()
+	cfg.Sinks = map[string]config.SinkConfig{"orders": {Type: config.SinkFile,
+		Path:           filepath.Join(dir, "orders.log"),
+		DeliveryConfig: config.DeliveryConfig{Stream: "orders", Batch: 2}}}
+	cfg.Webhooks = map[string]config.WebhookConfig{"down": {URL: failing.URL,
+		DeliveryConfig: config.DeliveryConfig{MaxAttempts: 2, Backoff: "1ms"}}}
+	os.Mkdir(filepath.Join(dir, "data"), 0755)
+	a := app.CreateAppServer(filepath.Join(dir, "data"), cfg, log.New(ioutil.Discard, "", 0))
+	go a.ProcessMessages()
+
+	manager, err := Start(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		stream := "orders"
+		if i%2 == 0 {
+			stream = "other"
+		}
+		response := <-a.RequestWrite([]byte(fmt.Sprintf("message %d\n", i)), data2.Attributes{data2.AttrStream: stream})
+		if response.Err != nil {
+			t.Fatal(response.Err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		statuses := manager.Statuses(false)
+		if statuses[0].Delivered == 5 && statuses[1].Delivered == 5 {
+			if statuses[0].Name != "down" || statuses[0].DeadLetters != 5 || statuses[1].DeadLetters != 0 {
+				t.Fatalf("Unexpected statuses: %+v", statuses)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Delivery didn't finish: %+v", statuses)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	contents, _ := ioutil.ReadFile(filepath.Join(dir, "orders.log"))
+	for i, body := range []string{"message 1", "message 3", "message 5"} {
+		if !strings.Contains(string(contents), body) || strings.Contains(string(contents), fmt.Sprintf("message %d", 2*i+2)) {
+			t.Fatalf("Expected only the orders stream in the file sink, got:\n%s", contents)
+		}
+	}
+	cursor, _ := ioutil.ReadFile(filepath.Join(dir, "data", DirName, "orders.cursor"))
+	if strings.TrimSpace(string(cursor)) != "5" {
+		t.Fatalf("Expected the cursor to be 5, got %q", cursor)
+	}
+	deadLetters, _ := ioutil.ReadFile(filepath.Join(dir, "data", DirName, "down.dead"))
+	if lines := strings.Count(string(deadLetters), "\n"); lines != 5 {
+		t.Fatalf("Expected 5 dead letters, got %d", lines)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "data", DirName, "down.cursor")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestDeletedBeforeDelivery delivers from a log retention has already deleted the start of.
+func TestDeletedBeforeDelivery(t *testing.T) {
+	dir := t.TempDir()
+	df := data2.NewDataFile(4, dir)
+	if err := df.CreateForWrite(); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range testBatch() {
+		m.Sequence += 3
+		if err := df.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	df.Close()
+
+	cfg := config.Default()
+	cfg.Sinks = map[string]config.SinkConfig{"copy": {Type: config.SinkFile, Path: filepath.Join(dir, "copy.log")}}
+	a := app.CreateAppServer(dir, cfg, log.New(ioutil.Discard, "", 0))
+	go a.ProcessMessages()
+	manager, err := Start(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The messages that are gone are dead lettered, rather than passed over without a trace
+	deadline := time.Now().Add(5 * time.Second)
+	for statuses := manager.Statuses(false); statuses[0].Delivered != 6; statuses = manager.Statuses(false) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Delivery didn't finish: %+v", statuses)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	deadLetters, _ := manager.targets["copy"].readDeadLetters()
+	if len(deadLetters) != 1 || deadLetters[0].First != 1 || deadLetters[0].Last != 3 {
+		t.Fatalf("Expected messages 1 to 3 to be dead lettered, got %+v", deadLetters)
+	}
+	if contents, _ := ioutil.ReadFile(filepath.Join(dir, "copy.log")); strings.Count(string(contents), "order ") != 3 {
+		t.Fatalf("Expected messages 4 to 6 to be delivered, got:\n%s", contents)
+	}
+}
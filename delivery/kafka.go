@@ -0,0 +1,191 @@
+package delivery
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/saem/afterme/data2"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// kafkaSink produces to one partition of a Kafka topic. It's a producer of just what's needed, the wire format
+// comes from kmsg: it asks a broker for the partition's leader (Metadata v4), then sends the leader each batch as
+// one record batch (Produce v3, Kafka 0.11 and later), with acks from all in-sync replicas. A batch is delivered
+// once the leader has acknowledged it. Records have no key, the message header is in the record headers.
+type kafkaSink struct {
+	brokers   []string
+	topic     string
+	partition int32
+
+	conn        net.Conn // To the partition's leader
+	correlation int32
+}
+
+const (
+	kafkaMetadataVersion = 4
+	kafkaProduceVersion  = 3
+)
+
+var (
+	kafkaFormatter = kmsg.NewRequestFormatter(kmsg.FormatterClientID("afterme"))
+	castagnoli     = crc32.MakeTable(crc32.Castagnoli)
+)
+
+func (sink *kafkaSink) Send(batch []data2.Message) (err error) {
+	if sink.conn == nil {
+		if err = sink.connect(); err != nil {
+			return err
+		}
+	}
+	defer func() {
+		if err != nil {
+			sink.conn.Close()
+			sink.conn = nil
+		}
+	}()
+
+	request := kmsg.NewPtrProduceRequest()
+	request.Version = kafkaProduceVersion
+	request.Acks = -1
+	request.TimeoutMillis = int32(DeliveryTimeout / time.Millisecond)
+	request.Topics = []kmsg.ProduceRequestTopic{{Topic: sink.topic,
+		Partitions: []kmsg.ProduceRequestTopicPartition{{Partition: sink.partition, Records: RecordBatch(batch)}}}}
+
+	response := kmsg.NewPtrProduceResponse()
+	if err = sink.roundTrip(sink.conn, request, response); err != nil {
+		return err
+	}
+	for _, topic := range response.Topics {
+		for _, partition := range topic.Partitions {
+			if partition.ErrorCode != 0 {
+				return fmt.Errorf("Kafka error %d producing to %s/%d", partition.ErrorCode, topic.Topic, partition.Partition)
+			}
+			return nil
+		}
+	}
+
+	return fmt.Errorf("No response for %s/%d from Kafka", sink.topic, sink.partition)
+}
+
+// connect connects to the partition's leader, found from the first broker that answers.
+func (sink *kafkaSink) connect() (err error) {
+	for _, broker := range sink.brokers {
+		var conn net.Conn
+		if conn, err = net.DialTimeout("tcp", broker, DeliveryTimeout); err != nil {
+			continue
+		}
+		var leader string
+		if leader, err = sink.leader(conn); err != nil {
+			conn.Close()
+			continue
+		}
+
+		if leader != broker {
+			conn.Close()
+			if conn, err = net.DialTimeout("tcp", leader, DeliveryTimeout); err != nil {
+				continue // Another broker may know of a leader that can be reached
+			}
+		}
+		sink.conn = conn
+		return nil
+	}
+
+	return fmt.Errorf("Could not find the leader of %s/%d: %s", sink.topic, sink.partition, err.Error())
+}
+
+// leader asks a broker for the address of the partition's leader.
+func (sink *kafkaSink) leader(conn net.Conn) (address string, err error) {
+	request := kmsg.NewPtrMetadataRequest()
+	request.Version = kafkaMetadataVersion
+	request.Topics = []kmsg.MetadataRequestTopic{{Topic: kmsg.StringPtr(sink.topic)}}
+
+	response := kmsg.NewPtrMetadataResponse()
+	if err = sink.roundTrip(conn, request, response); err != nil {
+		return "", err
+	}
+
+	leader := int32(-1)
+	for _, topic := range response.Topics {
+		if topic.ErrorCode != 0 {
+			return "", fmt.Errorf("Kafka error %d for topic %s", topic.ErrorCode, sink.topic)
+		}
+		for _, partition := range topic.Partitions {
+			if partition.Partition == sink.partition {
+				leader = partition.Leader
+			}
+		}
+	}
+	for _, broker := range response.Brokers {
+		if broker.NodeID == leader {
+			return net.JoinHostPort(broker.Host, strconv.Itoa(int(broker.Port))), nil
+		}
+	}
+
+	return "", fmt.Errorf("No leader for %s/%d", sink.topic, sink.partition)
+}
+
+// roundTrip sends a request and reads its response.
+func (sink *kafkaSink) roundTrip(conn net.Conn, request kmsg.Request, response kmsg.Response) (err error) {
+	conn.SetDeadline(time.Now().Add(DeliveryTimeout + 5*time.Second))
+	sink.correlation++
+	if _, err = conn.Write(kafkaFormatter.AppendRequest(nil, request, sink.correlation)); err != nil {
+		return err
+	}
+
+	var size [4]byte
+	if _, err = io.ReadFull(conn, size[:]); err != nil {
+		return err
+	}
+	body := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err = io.ReadFull(conn, body); err != nil {
+		return err
+	}
+	if len(body) < 4 || int32(binary.BigEndian.Uint32(body)) != sink.correlation {
+		return fmt.Errorf("Response from Kafka is not for the request sent")
+	}
+
+	response.SetVersion(request.GetVersion())
+	return response.ReadFrom(body[4:])
+}
+
+// RecordBatch encodes messages as an uncompressed Kafka record batch (magic 2), not from an idempotent producer.
+func RecordBatch(batch []data2.Message) []byte {
+	first := data2.MessageTime(batch[0]) / int64(time.Millisecond)
+	max := first
+	var records []byte
+	for i, m := range batch {
+		timestamp := data2.MessageTime(m) / int64(time.Millisecond)
+		if timestamp > max {
+			max = timestamp
+		}
+		record := kmsg.Record{TimestampDelta64: timestamp - first, OffsetDelta: int32(i), Value: m.Body}
+		for _, header := range Headers(m) {
+			record.Headers = append(record.Headers, kmsg.Header{Key: header.Key, Value: []byte(header.Value)})
+		}
+		// Length is everything after it, a zero length encodes to one byte
+		record.Length = int32(len(record.AppendTo(nil)) - 1)
+		records = record.AppendTo(records)
+	}
+
+	recordBatch := kmsg.RecordBatch{PartitionLeaderEpoch: -1,
+		Magic:           2,
+		LastOffsetDelta: int32(len(batch) - 1),
+		FirstTimestamp:  first,
+		MaxTimestamp:    max,
+		ProducerID:      -1,
+		ProducerEpoch:   -1,
+		FirstSequence:   -1,
+		NumRecords:      int32(len(batch)),
+		Records:         records}
+	encoded := recordBatch.AppendTo(nil)
+
+	// Length is everything after it, and the CRC everything after the CRC
+	binary.BigEndian.PutUint32(encoded[8:12], uint32(len(encoded)-12))
+	binary.BigEndian.PutUint32(encoded[17:21], crc32.Checksum(encoded[21:], castagnoli))
+
+	return encoded
+}
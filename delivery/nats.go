@@ -0,0 +1,44 @@
+package delivery
+
+import (
+	"github.com/nats-io/nats.go"
+	"github.com/saem/afterme/data2"
+)
+
+// natsSink publishes to a NATS subject. Core NATS has no acknowledgements, a batch is delivered once the server
+// has answered a ping sent after it, so it has everything before the ping.
+type natsSink struct {
+	url     string
+	subject string
+
+	conn *nats.Conn
+}
+
+func (sink *natsSink) Send(batch []data2.Message) (err error) {
+	if sink.conn == nil {
+		// Reconnecting is left to the next Send, so failures aren't hidden in a buffer
+		sink.conn, err = nats.Connect(sink.url, nats.Name("afterme"), nats.Timeout(DeliveryTimeout), nats.NoReconnect())
+		if err != nil {
+			return err
+		}
+	}
+	defer func() {
+		if err != nil {
+			sink.conn.Close()
+			sink.conn = nil
+		}
+	}()
+
+	for _, m := range batch {
+		msg := nats.NewMsg(sink.subject)
+		for _, header := range Headers(m) {
+			msg.Header.Set(header.Key, header.Value)
+		}
+		msg.Data = m.Body
+		if err = sink.conn.PublishMsg(msg); err != nil {
+			return err
+		}
+	}
+
+	return sink.conn.FlushTimeout(DeliveryTimeout)
+}
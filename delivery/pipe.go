@@ -0,0 +1,128 @@
+package delivery
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/saem/afterme/data2"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// fileSink appends to a local file, in the log file format, a batch is delivered once it's synced.
+type fileSink struct {
+	path string
+	file *os.File
+}
+
+func (sink *fileSink) Send(batch []data2.Message) (err error) {
+	if sink.file == nil {
+		if sink.file, err = os.OpenFile(sink.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644); err != nil {
+			return err
+		}
+	}
+
+	if _, err = sink.file.Write(logFormat(batch)); err == nil {
+		err = sink.file.Sync()
+	}
+	if err != nil {
+		sink.file.Close()
+		sink.file = nil
+	}
+
+	return err
+}
+
+// execSink runs a command and writes to its stdin, in the log file format. The command's output goes to afterme's
+// stderr, if it exits it's run again on the next Send. Without ack a batch is delivered once it's written to the
+// pipe, so whatever's in the pipe when the command dies is lost, it's at most once. With ack the command writes a
+// line to its stdout for each message once it's done with it, and a batch isn't delivered until every message in it
+// has been acked, a batch the command dies with is sent again, as with the other sinks.
+type execSink struct {
+	command []string
+	ack     bool
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	acks    chan error // Each line the command writes, or why it stopped writing them
+}
+
+func (sink *execSink) Send(batch []data2.Message) (err error) {
+	if sink.stdin == nil {
+		if err = sink.start(); err != nil {
+			return err
+		}
+	}
+
+	if _, err = sink.stdin.Write(logFormat(batch)); err == nil && sink.ack {
+		timeout := time.After(DeliveryTimeout)
+		for acked := 0; acked < len(batch) && err == nil; acked++ {
+			select {
+			case err = <-sink.acks:
+			case <-timeout:
+				err = fmt.Errorf("%s didn't ack the batch within %s", sink.command[0], DeliveryTimeout)
+			}
+		}
+	}
+	if err != nil {
+		sink.stop()
+	}
+
+	return err
+}
+
+// start runs the command.
+func (sink *execSink) start() (err error) {
+	cmd := exec.Command(sink.command[0], sink.command[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	var stdout io.ReadCloser
+	if sink.ack {
+		cmd.Stdout = nil
+		if stdout, err = cmd.StdoutPipe(); err != nil {
+			return err
+		}
+	}
+	if sink.stdin, err = cmd.StdinPipe(); err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		sink.stdin = nil
+		return err
+	}
+	sink.cmd = cmd
+
+	if !sink.ack {
+		go cmd.Wait()
+		return nil
+	}
+	acks := make(chan error, 1)
+	sink.acks = acks
+	go func() {
+		lines := bufio.NewScanner(stdout)
+		for lines.Scan() {
+			acks <- nil
+		}
+		err := lines.Err()
+		if err == nil {
+			err = fmt.Errorf("%s exited", sink.command[0])
+		}
+		cmd.Wait()
+		acks <- err
+		close(acks)
+	}()
+
+	return nil
+}
+
+// stop stops the command, it's run again on the next Send.
+func (sink *execSink) stop() {
+	sink.stdin.Close()
+	if sink.ack {
+		sink.cmd.Process.Kill()
+		go func(acks chan error) {
+			for range acks {
+			}
+		}(sink.acks)
+	}
+	sink.cmd, sink.stdin, sink.acks = nil, nil, nil
+}
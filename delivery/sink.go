@@ -0,0 +1,62 @@
+package delivery
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/saem/afterme/config"
+	"github.com/saem/afterme/data2"
+	"sort"
+	"strconv"
+)
+
+// Sinks deliver each message as a message of their own, brokers with headers get the message header in them (see
+// Headers), files and commands get the log file format.
+
+// NewSink makes a sink from its config, it doesn't connect to anything until the first Send.
+func NewSink(settings config.SinkConfig) (Sink, error) {
+	switch settings.Type {
+	case config.SinkAMQP:
+		return &amqpSink{url: settings.URL, exchange: settings.Exchange, routingKey: settings.RoutingKey}, nil
+	case config.SinkNATS:
+		return &natsSink{url: settings.URL, subject: settings.Subject}, nil
+	case config.SinkKafka:
+		return &kafkaSink{brokers: settings.Brokers, topic: settings.Topic, partition: settings.Partition}, nil
+	case config.SinkFile:
+		return &fileSink{path: settings.Path}, nil
+	case config.SinkExec:
+		return &execSink{command: settings.Command, ack: settings.Ack}, nil
+	default:
+		return nil, fmt.Errorf("Unknown sink type: %s", settings.Type)
+	}
+}
+
+// Header is a header a broker message is given, from the message header.
+type Header struct {
+	Key   string
+	Value string
+}
+
+// Headers are a message's header as broker message headers: afterme-sequence, afterme-hash-value (the body's
+// hash) and afterme-<attribute> for each attribute, ordered by key.
+func Headers(message data2.Message) (headers []Header) {
+	headers = []Header{{"afterme-sequence", strconv.FormatUint(uint64(message.Sequence), 10)},
+		{"afterme-hash-value", message.Hash}}
+	for key, value := range message.Attributes {
+		headers = append(headers, Header{"afterme-" + key, value})
+	}
+	sort.Slice(headers, func(i, j int) bool { return headers[i].Key < headers[j].Key })
+
+	return headers
+}
+
+// logFormat is a batch in the log file format, as GET /messages has it.
+func logFormat(batch []data2.Message) []byte {
+	var contents bytes.Buffer
+	for _, m := range batch {
+		header, body, _ := m.Marshal()
+		contents.WriteString(header)
+		contents.Write(body)
+	}
+
+	return contents.Bytes()
+}
@@ -0,0 +1,355 @@
+package delivery
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Stand-ins for the brokers, just enough of each protocol to take what the sinks publish and record it.
+
+// published is a message as a stand-in broker got it.
+type published struct {
+	Destination string // Routing key, subject or topic
+	Headers     map[string]string
+	Body        string
+}
+
+type standIn struct {
+	listener net.Listener
+	mu       sync.Mutex
+	got      []published
+}
+
+func newStandIn(t *testing.T, serve func(s *standIn, conn net.Conn)) *standIn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &standIn{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(s, conn)
+			}()
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+
+	return s
+}
+
+func (s *standIn) record(p published) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.got = append(s.got, p)
+}
+
+func (s *standIn) published() []published {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]published(nil), s.got...)
+}
+
+func (s *standIn) addr() string {
+	return s.listener.Addr().String()
+}
+
+// serveNATS is a NATS server, it takes PUB and HPUB and answers PINGs.
+func serveNATS(s *standIn, conn net.Conn) {
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"stand-in\",\"version\":\"2.10.0\",\"proto\":1,\"headers\":true,"+
+		"\"max_payload\":1048576}\r\n")
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "PING":
+			io.WriteString(conn, "PONG\r\n")
+		case "PUB", "HPUB":
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			payload := make([]byte, size+2)
+			if _, err = io.ReadFull(r, payload); err != nil {
+				return
+			}
+			p := published{Destination: fields[1], Headers: map[string]string{}}
+			if fields[0] == "HPUB" {
+				headerSize, _ := strconv.Atoi(fields[len(fields)-2])
+				for _, header := range strings.Split(string(payload[:headerSize]), "\r\n")[1:] {
+					if kv := strings.SplitN(header, ": ", 2); len(kv) == 2 {
+						p.Headers[kv[0]] = kv[1]
+					}
+				}
+				payload = payload[headerSize:]
+			}
+			p.Body = string(payload[:len(payload)-2])
+			s.record(p)
+		}
+	}
+}
+
+// AMQP 0-9-1 frames and methods the stand-in uses
+const (
+	amqpMethodFrame = 1
+	amqpHeaderFrame = 2
+	amqpBodyFrame   = 3
+	amqpFrameEnd    = 0xCE
+)
+
+type amqpFrame struct {
+	kind    byte
+	channel uint16
+	payload []byte
+}
+
+func readAMQPFrame(r io.Reader) (frame amqpFrame, err error) {
+	var header [7]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return frame, err
+	}
+	frame.kind, frame.channel = header[0], binary.BigEndian.Uint16(header[1:3])
+	frame.payload = make([]byte, binary.BigEndian.Uint32(header[3:7])+1)
+	if _, err = io.ReadFull(r, frame.payload); err != nil {
+		return frame, err
+	}
+	if frame.payload[len(frame.payload)-1] != amqpFrameEnd {
+		return frame, fmt.Errorf("bad frame end")
+	}
+	frame.payload = frame.payload[:len(frame.payload)-1]
+
+	return frame, nil
+}
+
+func writeAMQPMethod(w io.Writer, channel uint16, class, method uint16, args []byte) error {
+	payload := binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(nil, class), method)
+	payload = append(payload, args...)
+	frame := []byte{amqpMethodFrame}
+	frame = binary.BigEndian.AppendUint16(frame, channel)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(payload)))
+	frame = append(append(frame, payload...), amqpFrameEnd)
+	_, err := w.Write(frame)
+	return err
+}
+
+func amqpShortString(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+func amqpLongString(s string) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(s))), s...)
+}
+
+// readShortString reads a short string from the front of b, returning what follows it.
+func readShortString(b []byte) (string, []byte) {
+	n := int(b[0])
+	return string(b[1 : 1+n]), b[1+n:]
+}
+
+// readStringTable reads a field table holding only long strings.
+func readStringTable(b []byte) (table map[string]string, rest []byte) {
+	size := binary.BigEndian.Uint32(b)
+	fields, rest := b[4:4+size], b[4+size:]
+	table = map[string]string{}
+	for len(fields) > 0 {
+		var key string
+		key, fields = readShortString(fields)
+		if fields[0] != 'S' {
+			return table, rest
+		}
+		n := binary.BigEndian.Uint32(fields[1:])
+		table[key] = string(fields[5 : 5+n])
+		fields = fields[5+n:]
+	}
+
+	return table, rest
+}
+
+// serveAMQP is an AMQP 0-9-1 broker, it takes publishes on a channel in confirm mode and acks each one.
+func serveAMQP(s *standIn, conn net.Conn) {
+	protocol := make([]byte, 8)
+	if _, err := io.ReadFull(conn, protocol); err != nil {
+		return
+	}
+	start := append([]byte{0, 9}, binary.BigEndian.AppendUint32(nil, 0)...) // Version, no server properties
+	start = append(append(start, amqpLongString("PLAIN")...), amqpLongString("en_US")...)
+	writeAMQPMethod(conn, 0, 10, 10, start)
+
+	var tag uint64
+	var publishing *published
+	var remaining uint64
+	for {
+		frame, err := readAMQPFrame(conn)
+		if err != nil {
+			return
+		}
+		switch frame.kind {
+		case amqpMethodFrame:
+			class, method := binary.BigEndian.Uint16(frame.payload), binary.BigEndian.Uint16(frame.payload[2:])
+			args := frame.payload[4:]
+			switch {
+			case class == 10 && method == 11: // Connection.StartOk
+				tune := binary.BigEndian.AppendUint32([]byte{0, 0}, 131072)
+				writeAMQPMethod(conn, 0, 10, 30, append(tune, 0, 0))
+			case class == 10 && method == 40: // Connection.Open
+				writeAMQPMethod(conn, 0, 10, 41, amqpShortString(""))
+			case class == 10 && method == 50: // Connection.Close
+				writeAMQPMethod(conn, 0, 10, 51, nil)
+				return
+			case class == 20 && method == 10: // Channel.Open
+				writeAMQPMethod(conn, frame.channel, 20, 11, amqpLongString(""))
+			case class == 20 && method == 40: // Channel.Close
+				writeAMQPMethod(conn, frame.channel, 20, 41, nil)
+			case class == 85 && method == 10: // Confirm.Select
+				writeAMQPMethod(conn, frame.channel, 85, 11, nil)
+			case class == 60 && method == 40: // Basic.Publish
+				exchange, rest := readShortString(args[2:])
+				key, _ := readShortString(rest)
+				publishing = &published{Destination: exchange + "/" + key}
+			}
+		case amqpHeaderFrame:
+			remaining = binary.BigEndian.Uint64(frame.payload[4:])
+			flags, properties := binary.BigEndian.Uint16(frame.payload[12:]), frame.payload[14:]
+			if flags&(1<<15) != 0 { // Content type comes before the headers
+				_, properties = readShortString(properties)
+			}
+			if flags&(1<<13) != 0 {
+				publishing.Headers, _ = readStringTable(properties)
+			}
+		case amqpBodyFrame:
+			publishing.Body += string(frame.payload)
+			remaining -= uint64(len(frame.payload))
+		}
+
+		if publishing != nil && remaining == 0 && publishing.Headers != nil {
+			s.record(*publishing)
+			publishing = nil
+			tag++
+			writeAMQPMethod(conn, 1, 60, 80, append(binary.BigEndian.AppendUint64(nil, tag), 0)) // Basic.Ack
+		}
+	}
+}
+
+// kafkaStandIn is a Kafka cluster of two brokers, node 1 is only asked for metadata and sends the producer to node
+// 2, the partition's leader.
+func newKafkaStandIn(t *testing.T, topic string) (bootstrap *standIn, leader *standIn) {
+	leader = newStandIn(t, func(s *standIn, conn net.Conn) { serveKafka(t, s, conn, topic, nil) })
+	bootstrap = newStandIn(t, func(s *standIn, conn net.Conn) { serveKafka(t, s, conn, topic, leader) })
+
+	return bootstrap, leader
+}
+
+func serveKafka(t *testing.T, s *standIn, conn net.Conn, topic string, leader *standIn) {
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		request := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return
+		}
+		key, version := int16(binary.BigEndian.Uint16(request)), int16(binary.BigEndian.Uint16(request[2:]))
+		correlation := request[4:8]
+		clientId := int16(binary.BigEndian.Uint16(request[8:]))
+		body := request[10:]
+		if clientId > 0 {
+			body = body[clientId:]
+		}
+
+		req := kmsg.RequestForKey(key)
+		req.SetVersion(version)
+		if err := req.ReadFrom(body); err != nil {
+			t.Errorf("Kafka stand-in could not read request %d v%d: %s", key, version, err.Error())
+			return
+		}
+
+		var response kmsg.Response
+		switch req := req.(type) {
+		case *kmsg.MetadataRequest:
+			metadata := req.ResponseKind().(*kmsg.MetadataResponse)
+			node := s
+			if leader != nil {
+				node = leader
+			}
+			host, port, _ := net.SplitHostPort(node.addr())
+			portNumber, _ := strconv.Atoi(port)
+			metadata.Brokers = []kmsg.MetadataResponseBroker{{NodeID: 2, Host: host, Port: int32(portNumber)}}
+			metadata.Topics = []kmsg.MetadataResponseTopic{{Topic: kmsg.StringPtr(topic),
+				Partitions: []kmsg.MetadataResponseTopicPartition{{Partition: 0, Leader: 2}}}}
+			response = metadata
+		case *kmsg.ProduceRequest:
+			produce := req.ResponseKind().(*kmsg.ProduceResponse)
+			for _, requestTopic := range req.Topics {
+				responseTopic := kmsg.ProduceResponseTopic{Topic: requestTopic.Topic}
+				for _, partition := range requestTopic.Partitions {
+					code := int16(0)
+					if err := readRecordBatch(s, requestTopic.Topic, partition.Records); err != nil || leader != nil {
+						t.Errorf("Kafka stand-in got a bad produce request: %v", err)
+						code = 2 // CORRUPT_MESSAGE
+					}
+					responseTopic.Partitions = append(responseTopic.Partitions,
+						kmsg.ProduceResponseTopicPartition{Partition: partition.Partition, ErrorCode: code})
+				}
+				produce.Topics = append(produce.Topics, responseTopic)
+			}
+			response = produce
+		default:
+			t.Errorf("Kafka stand-in got an unexpected request: %d", key)
+			return
+		}
+
+		encoded := response.AppendTo(append([]byte(nil), correlation...))
+		conn.Write(append(binary.BigEndian.AppendUint32(nil, uint32(len(encoded))), encoded...))
+	}
+}
+
+// readRecordBatch checks a record batch's length and CRC and records each record in it.
+func readRecordBatch(s *standIn, topic string, encoded []byte) error {
+	var batch kmsg.RecordBatch
+	if err := batch.ReadFrom(encoded); err != nil {
+		return err
+	}
+	if int(batch.Length) != len(encoded)-12 {
+		return fmt.Errorf("length %d, expected %d", batch.Length, len(encoded)-12)
+	}
+	if uint32(batch.CRC) != crc32.Checksum(encoded[21:], crc32.MakeTable(crc32.Castagnoli)) {
+		return fmt.Errorf("bad CRC")
+	}
+
+	records := batch.Records
+	for i := int32(0); i < batch.NumRecords; i++ {
+		length, n := binary.Varint(records)
+		var record kmsg.Record
+		if err := record.ReadFrom(records[:n+int(length)]); err != nil {
+			return err
+		}
+		records = records[n+int(length):]
+
+		p := published{Destination: topic, Headers: map[string]string{}, Body: string(record.Value)}
+		for _, header := range record.Headers {
+			p.Headers[header.Key] = string(header.Value)
+		}
+		s.record(p)
+	}
+
+	return nil
+}
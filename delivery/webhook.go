@@ -0,0 +1,115 @@
+package delivery
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/saem/afterme/cloudevents"
+	"github.com/saem/afterme/config"
+	"github.com/saem/afterme/data2"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+// A webhook is POSTed each batch, the messages in the log file format (as GET /messages has them), with:
+//
+//	X-Afterme-Webhook:   the webhook's name
+//	X-Afterme-First:     sequence of the first message in the batch
+//	X-Afterme-Last:      sequence of the last message in the batch
+//	X-Afterme-Signature: sha256=<hex HMAC-SHA256 of the body, keyed with the webhook's secret>
+//
+// Any 2xx response is taken as delivered.
+//
+// A webhook with cloudevents set is POSTed CloudEvents instead, with the same headers. In structured mode a batch of
+// one is an event and a bigger one a CloudEvents batch, in binary mode each message is POSTed on its own.
+
+type webhook struct {
+	name   string
+	url    string
+	secret []byte
+	events string
+	client *http.Client
+}
+
+func newWebhook(name string, settings config.WebhookConfig) *webhook {
+	return &webhook{name: name,
+		url:    settings.URL,
+		secret: []byte(settings.Secret),
+		events: settings.CloudEvents,
+		client: &http.Client{Timeout: DeliveryTimeout}}
+}
+
+// Signature is the X-Afterme-Signature header for a body, for receivers to check against.
+func Signature(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (hook *webhook) Send(batch []data2.Message) error {
+	if hook.events == cloudevents.Binary {
+		for _, m := range batch {
+			header := http.Header{}
+			cloudevents.SetHeaders(header, m)
+			if err := hook.post(header, []data2.Message{m}, m.Body); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	body := logFormat(batch)
+	if hook.events == cloudevents.Structured {
+		var err error
+		if len(batch) == 1 {
+			header.Set("Content-Type", cloudevents.ContentType)
+			body, err = json.Marshal(cloudevents.Event(batch[0]))
+		} else {
+			events := make([]map[string]interface{}, len(batch))
+			for i, m := range batch {
+				events[i] = cloudevents.Event(m)
+			}
+			header.Set("Content-Type", cloudevents.BatchContentType)
+			body, err = json.Marshal(events)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return hook.post(header, batch, body)
+}
+
+func (hook *webhook) post(header http.Header, batch []data2.Message, body []byte) error {
+	request, err := http.NewRequest("POST", hook.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header = header
+	request.Header.Set("X-Afterme-Webhook", hook.name)
+	request.Header.Set("X-Afterme-First", strconv.FormatUint(uint64(batch[0].Sequence), 10))
+	request.Header.Set("X-Afterme-Last", strconv.FormatUint(uint64(batch[len(batch)-1].Sequence), 10))
+	if len(hook.secret) > 0 {
+		request.Header.Set("X-Afterme-Signature", Signature(hook.secret, body))
+	}
+
+	response, err := hook.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		reason, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("%s from %s: %s", response.Status, hook.url, bytes.TrimSpace(reason))
+	}
+	io.Copy(ioutil.Discard, response.Body)
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package dirlock
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A data dir has one writer, the server holds an exclusive lock on the lock file in it for as long as it runs, and
+// records who it is (pid and host) in there. Tools that only read take a shared lock, so they can't run alongside
+// a server, nor a server start under them. The lock is an flock, it goes away with the process holding it, and the
+// lock file is left behind, stale contents and all.
+//
+// A read only copy of a data dir, in cold storage say, can't have a lock file made in it, so readers go unlocked
+// there, nothing can be writing to it. Where there's no flock (Supported is false) nothing is locked at all.
+
+// FileName is the lock file in the data dir.
+const FileName = "lock"
+
+// Lock is a held lock on a data dir.
+type Lock struct {
+	f *os.File // Nil if the data dir isn't locked, see Shared
+}
+
+// Exclusive locks a data dir for writing, an error says who holds it if it's already locked.
+func Exclusive(dataDir string) (lock *Lock, err error) {
+	f, err := os.OpenFile(filepath.Join(dataDir, FileName), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = flock(f, true); err != nil {
+		f.Close()
+		return nil, lockedError(dataDir, err)
+	}
+
+	hostname, _ := os.Hostname()
+	record := fmt.Sprintf("pid %d on %s since %s\n", os.Getpid(), hostname, time.Now().Format(time.RFC3339))
+	if err = f.Truncate(0); err == nil {
+		_, err = f.WriteAt([]byte(record), 0)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &Lock{f: f}, nil
+}
+
+// Shared locks a data dir for reading, any number of readers can hold it at once, but not alongside a writer. If
+// there's no lock file and one can't be made, as the data dir is read only, it's not locked, there's no writer.
+func Shared(dataDir string) (lock *Lock, err error) {
+	path := filepath.Join(dataDir, FileName)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		f, err = os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0644)
+		if os.IsPermission(err) || errors.Is(err, syscall.EROFS) {
+			return &Lock{}, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = flock(f, false); err != nil {
+		f.Close()
+		return nil, lockedError(dataDir, err)
+	}
+
+	return &Lock{f: f}, nil
+}
+
+// Locked reports whether the data dir is locked, it's not if it's read only, or flock isn't Supported.
+func (lock *Lock) Locked() bool {
+	return lock.f != nil && Supported
+}
+
+// Release gives up the lock.
+func (lock *Lock) Release() error {
+	if lock.f == nil {
+		return nil
+	}
+
+	return lock.f.Close()
+}
+
+// lockedError explains why a lock couldn't be taken, with who holds it if that's why.
+func lockedError(dataDir string, err error) error {
+	if err != errLocked {
+		return fmt.Errorf("Could not lock %s: %s", dataDir, err.Error())
+	}
+
+	holder, _ := ioutil.ReadFile(filepath.Join(dataDir, FileName))
+	if len(holder) == 0 {
+		return fmt.Errorf("%s is in use by another afterme", dataDir)
+	}
+
+	return fmt.Errorf("%s is in use by another afterme, %s", dataDir, strings.TrimSpace(string(holder)))
+}
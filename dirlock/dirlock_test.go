@@ -0,0 +1,67 @@
+package dirlock
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocks(t *testing.T) {
+	dir := t.TempDir()
+	writer, err := Exclusive(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !writer.Locked() {
+		t.Fatal("Expected the data dir to be locked")
+	}
+	if _, err = Exclusive(dir); err == nil || !strings.Contains(err.Error(), "in use by another afterme, pid") {
+		t.Fatalf("Expected a second writer to be told who has the lock, got %v", err)
+	}
+	if _, err = Shared(dir); err == nil {
+		t.Fatal("Expected a reader not to lock alongside a writer")
+	}
+	writer.Release()
+
+	// Any number of readers, but no writer alongside them
+	first, err := Shared(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := Shared(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Exclusive(dir); err == nil {
+		t.Fatal("Expected a writer not to lock alongside readers")
+	}
+	first.Release()
+	second.Release()
+	if writer, err = Exclusive(dir); err != nil {
+		t.Fatalf("Expected the writer to lock once the readers are done, got %v", err)
+	}
+	writer.Release()
+}
+
+func TestSharedReadOnly(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("Permissions don't stop root making the lock file")
+	}
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(dir, 0755)
+
+	lock, err := Shared(dir)
+	if err != nil {
+		t.Fatalf("Expected a read only data dir to be read unlocked, got %v", err)
+	}
+	if lock.Locked() || lock.Release() != nil {
+		t.Fatal("Expected the lock not to be held")
+	}
+	if _, err = os.Stat(filepath.Join(dir, FileName)); !os.IsNotExist(err) {
+		t.Fatal("Expected no lock file to be made")
+	}
+}
@@ -0,0 +1,29 @@
+//go:build unix
+
+package dirlock
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Supported is whether data dirs are locked, they are here.
+const Supported = true
+
+var errLocked = errors.New("locked")
+
+// flock takes an exclusive or shared lock on f, without waiting, errLocked if someone else has it.
+func flock(f *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return errLocked
+	}
+
+	return err
+}
@@ -0,0 +1,387 @@
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/saem/afterme/data2"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Filters pick out messages by what's in their JSON body and their attributes, so readers only get what they want.
+// A filter is comparisons joined with and, or and not, and grouped with parentheses:
+//
+//	$.type == "order.created" and attr.stream == "orders"
+//	$.type ^= "order." and not ($.customer.tier == "free" or $.items[0].sku == null)
+//
+// The left of a comparison is a JSONPath into the body, $ then .name, ['name'] or [index] steps, or attr.<name>
+// for an attribute. The right is a string, in double or single quotes, a number, true, false or null. == and != are
+// equality and ^= is a string prefix. A path that's not there, or a body that's not JSON, doesn't equal anything,
+// so == and ^= are false and != is true.
+
+// Filter is a parsed filter expression.
+type Filter struct {
+	root node
+}
+
+// Parse parses a filter expression.
+func Parse(expression string) (filter *Filter, err error) {
+	p := new(parser)
+	if p.tokens, err = lex(expression); err != nil {
+		return nil, err
+	}
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokenEnd {
+		return nil, fmt.Errorf("Unexpected %q in filter", p.peek().text)
+	}
+
+	return &Filter{root: root}, nil
+}
+
+// Match reports whether a message matches the filter, the body is only parsed if the filter looks into it.
+func (filter *Filter) Match(message data2.Message) bool {
+	m := &candidate{message: message}
+	return filter.root.eval(m)
+}
+
+// candidate is a message being matched, with its body parsed the first time it's needed.
+type candidate struct {
+	message data2.Message
+	parsed  bool
+	body    interface{}
+	isJSON  bool
+}
+
+func (c *candidate) json() (interface{}, bool) {
+	if !c.parsed {
+		c.parsed = true
+		c.isJSON = json.Unmarshal(c.message.Body, &c.body) == nil
+	}
+
+	return c.body, c.isJSON
+}
+
+type node interface {
+	eval(c *candidate) bool
+}
+
+type and struct{ left, right node }
+type or struct{ left, right node }
+type not struct{ operand node }
+
+func (n and) eval(c *candidate) bool { return n.left.eval(c) && n.right.eval(c) }
+func (n or) eval(c *candidate) bool  { return n.left.eval(c) || n.right.eval(c) }
+func (n not) eval(c *candidate) bool { return !n.operand.eval(c) }
+
+// step is a step of a JSONPath, a name or an index.
+type step struct {
+	name  string
+	index int // When name is empty
+}
+
+// comparison compares a JSONPath, or an attribute, with a value.
+type comparison struct {
+	attribute string // Compare this attribute if there's no path
+	path      []step
+	op        string
+	value     interface{} // string, float64, bool or nil, as encoding/json has them
+}
+
+func (n comparison) eval(c *candidate) bool {
+	var actual interface{}
+	found := false
+	if n.path == nil {
+		actual, found = c.message.Attributes[n.attribute]
+	} else if body, ok := c.json(); ok {
+		actual, found = lookup(body, n.path)
+	}
+
+	switch n.op {
+	case "==":
+		return found && actual == n.value
+	case "!=":
+		return !found || actual != n.value
+	default: // ^=
+		s, isString := actual.(string)
+		return found && isString && strings.HasPrefix(s, n.value.(string))
+	}
+}
+
+func lookup(value interface{}, path []step) (interface{}, bool) {
+	for _, s := range path {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if value, ok = v[s.name]; !ok || s.name == "" {
+				return nil, false
+			}
+		case []interface{}:
+			if s.name != "" || s.index < 0 || s.index >= len(v) {
+				return nil, false
+			}
+			value = v[s.index]
+		default:
+			return nil, false
+		}
+	}
+
+	return value, true
+}
+
+// The parser, recursive descent, or binds loosest then and then not.
+
+type parser struct {
+	tokens []token
+	next   int
+}
+
+func (p *parser) peek() token { return p.tokens[p.next] }
+
+// take takes the next token, the end token is never taken, so there's always one to peek at.
+func (p *parser) take() (t token) {
+	if t = p.tokens[p.next]; t.kind != tokenEnd {
+		p.next++
+	}
+
+	return t
+}
+
+func (p *parser) or() (n node, err error) {
+	if n, err = p.and(); err != nil {
+		return nil, err
+	}
+	for p.peek().is("or") {
+		p.take()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		n = or{n, right}
+	}
+
+	return n, nil
+}
+
+func (p *parser) and() (n node, err error) {
+	if n, err = p.unary(); err != nil {
+		return nil, err
+	}
+	for p.peek().is("and") {
+		p.take()
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		n = and{n, right}
+	}
+
+	return n, nil
+}
+
+func (p *parser) unary() (n node, err error) {
+	t := p.take()
+	switch {
+	case t.is("not"):
+		if n, err = p.unary(); err != nil {
+			return nil, err
+		}
+		return not{n}, nil
+	case t.kind == tokenOpen:
+		if n, err = p.or(); err != nil {
+			return nil, err
+		}
+		if p.take().kind != tokenClose {
+			return nil, fmt.Errorf("Missing ) in filter")
+		}
+		return n, nil
+	case t.kind == tokenPath || t.kind == tokenWord && strings.HasPrefix(t.text, "attr."):
+		return p.comparison(t)
+	case t.kind == tokenEnd:
+		return nil, fmt.Errorf("Filter ends too soon")
+	default:
+		return nil, fmt.Errorf("Expected $.path or attr.name in filter, got %q", t.text)
+	}
+}
+
+func (p *parser) comparison(left token) (n node, err error) {
+	c := comparison{path: left.path, attribute: strings.TrimPrefix(left.text, "attr.")}
+	if op := p.take(); op.kind == tokenOp {
+		c.op = op.text
+	} else {
+		return nil, fmt.Errorf("Expected ==, != or ^= after %s in filter", left.text)
+	}
+
+	value := p.take()
+	switch {
+	case value.kind == tokenString:
+		c.value = value.text
+	case value.kind == tokenNumber && c.path != nil:
+		c.value, _ = strconv.ParseFloat(value.text, 64)
+	case value.kind == tokenNumber:
+		c.value = value.text // Attributes are strings
+	case value.is("true") || value.is("false"):
+		c.value = value.text == "true"
+	case value.is("null"):
+		c.value = nil
+	default:
+		return nil, fmt.Errorf("Expected a value after %s %s in filter, got %q", left.text, c.op, value.text)
+	}
+	if _, isString := c.value.(string); c.op == "^=" && !isString {
+		return nil, fmt.Errorf("^= needs a string, in filter")
+	}
+	if c.path == nil && c.value == nil {
+		return nil, fmt.Errorf("Attributes are never null, in filter")
+	}
+
+	return c, nil
+}
+
+// The lexer.
+
+const (
+	tokenEnd = iota
+	tokenWord
+	tokenPath
+	tokenString
+	tokenNumber
+	tokenOp
+	tokenOpen
+	tokenClose
+)
+
+type token struct {
+	kind int
+	text string
+	path []step // For a tokenPath
+}
+
+func (t token) is(word string) bool {
+	return t.kind == tokenWord && t.text == word
+}
+
+func lex(s string) (tokens []token, err error) {
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')':
+			kind := tokenOpen
+			if c == ')' {
+				kind = tokenClose
+			}
+			tokens = append(tokens, token{kind: kind, text: string(c)})
+			i++
+		case strings.HasPrefix(s[i:], "==") || strings.HasPrefix(s[i:], "!=") || strings.HasPrefix(s[i:], "^="):
+			tokens = append(tokens, token{kind: tokenOp, text: s[i : i+2]})
+			i += 2
+		case c == '"' || c == '\'':
+			text, n, err := quoted(s[i:])
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokenString, text: text})
+			i += n
+		case c == '$':
+			path, n, err := jsonPath(s[i:])
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokenPath, text: s[i : i+n], path: path})
+			i += n
+		case c == '-' || c >= '0' && c <= '9':
+			n := 1
+			for n < len(s[i:]) && strings.IndexByte("0123456789.eE+-", s[i+n]) >= 0 {
+				n++
+			}
+			if _, err := strconv.ParseFloat(s[i:i+n], 64); err != nil {
+				return nil, fmt.Errorf("Invalid number in filter: %s", s[i:i+n])
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: s[i : i+n]})
+			i += n
+		case isWordChar(rune(c)):
+			n := 1
+			for n < len(s[i:]) && (isWordChar(rune(s[i+n])) || s[i+n] == '.' || s[i+n] == '-') {
+				n++
+			}
+			tokens = append(tokens, token{kind: tokenWord, text: s[i : i+n]})
+			i += n
+		default:
+			return nil, fmt.Errorf("Unexpected %q in filter", c)
+		}
+	}
+
+	return append(tokens, token{kind: tokenEnd}), nil
+}
+
+func isWordChar(c rune) bool {
+	return c == '_' || unicode.IsLetter(c) || unicode.IsDigit(c)
+}
+
+// quoted reads a quoted string off the start of s, double quoted strings have Go escapes, single quoted ones none.
+func quoted(s string) (text string, n int, err error) {
+	for n = 1; n < len(s); n++ {
+		if s[n] == '\\' && s[0] == '"' {
+			n++
+			continue
+		}
+		if s[n] == s[0] {
+			break
+		}
+	}
+	if n >= len(s) {
+		return "", 0, fmt.Errorf("Unterminated string in filter")
+	}
+	if s[0] == '\'' {
+		return s[1:n], n + 1, nil
+	}
+	text, err = strconv.Unquote(s[:n+1])
+	if err != nil {
+		return "", 0, fmt.Errorf("Invalid string in filter: %s", s[:n+1])
+	}
+
+	return text, n + 1, nil
+}
+
+// jsonPath reads a JSONPath off the start of s.
+func jsonPath(s string) (path []step, n int, err error) {
+	path = []step{}
+	for n = 1; n < len(s); {
+		switch s[n] {
+		case '.':
+			start := n + 1
+			for n = start; n < len(s) && (isWordChar(rune(s[n])) || s[n] == '-'); n++ {
+			}
+			if n == start {
+				return nil, 0, fmt.Errorf("Expected a name after . in %s", s[:n])
+			}
+			path = append(path, step{name: s[start:n]})
+		case '[':
+			end := strings.IndexByte(s[n:], ']')
+			if end < 0 {
+				return nil, 0, fmt.Errorf("Missing ] in filter")
+			}
+			inside := s[n+1 : n+end]
+			if len(inside) > 0 && (inside[0] == '\'' || inside[0] == '"') {
+				name, m, err := quoted(inside)
+				if err != nil || m != len(inside) {
+					return nil, 0, fmt.Errorf("Invalid [%s] in filter", inside)
+				}
+				path = append(path, step{name: name})
+			} else if index, err := strconv.Atoi(inside); err == nil && index >= 0 {
+				path = append(path, step{index: index})
+			} else {
+				return nil, 0, fmt.Errorf("Invalid [%s] in filter", inside)
+			}
+			n += end + 1
+		default:
+			return path, n, nil
+		}
+	}
+
+	return path, n, nil
+}
@@ -0,0 +1,75 @@
+package filter
+
+import (
+	"github.com/saem/afterme/data2"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	order := data2.Message{Sequence: 1,
+		Attributes: data2.Attributes{data2.AttrStream: "orders", "retries": "3"},
+		Body: []byte(`{"type": "order.created", "total": 12.5, "paid": true, "coupon": null, ` +
+			`"customer": {"tier": "gold", "first-name": "Ada"}, "items": [{"sku": "A-1"}]}` + "\n")}
+	notJSON := data2.Message{Sequence: 2, Attributes: data2.Attributes{data2.AttrStream: "logs"},
+		Body: []byte("GET /index.html 200\n")}
+
+	for expression, expected := range map[string][2]bool{
+		`$.type == "order.created"`:                             {true, false},
+		`$.type == 'order.created'`:                             {true, false},
+		`$.type ^= "order."`:                                    {true, false},
+		`$.type ^= "invoice."`:                                  {false, false},
+		`$.type != "order.created"`:                             {false, true},
+		`$.total == 12.5`:                                       {true, false},
+		`$.total == "12.5"`:                                     {false, false},
+		`$.paid == true`:                                        {true, false},
+		`$.coupon == null`:                                      {true, false},
+		`$.missing == null`:                                     {false, false},
+		`$.customer.tier == "gold"`:                             {true, false},
+		`$['customer']['first-name'] == "Ada"`:                  {true, false},
+		`$.customer.first-name == "Ada"`:                        {true, false},
+		`$.items[0].sku == "A-1"`:                               {true, false},
+		`$.items[1].sku == "A-1"`:                               {false, false},
+		`$.items.sku == "A-1"`:                                  {false, false},
+		`attr.stream == "orders"`:                               {true, false},
+		`attr.retries == 3`:                                     {true, false},
+		`attr.stream ^= "log"`:                                  {false, true},
+		`attr.missing != "x"`:                                   {true, true},
+		`$.type == "order.created" and attr.stream == "orders"`: {true, false},
+		`$.type == "nope" or attr.stream == "logs"`:             {false, true},
+		`not attr.stream == "orders"`:                           {false, true},
+		`not ($.paid == true or attr.stream == "logs")`:         {false, false},
+		`attr.stream == "logs" or attr.stream == "orders" and $.paid == false`: {false, true},
+	} {
+		filter, err := Parse(expression)
+		if err != nil {
+			t.Fatalf("%s: %s", expression, err.Error())
+		}
+		for i, m := range []data2.Message{order, notJSON} {
+			if matched := filter.Match(m); matched != expected[i] {
+				t.Errorf("%s: expected %v for message %d, got %v", expression, expected[i], m.Sequence, matched)
+			}
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expression := range []string{
+		``,
+		`$.type`,
+		`$.type ==`,
+		`$.type = "a"`,
+		`$.type == "a`,
+		`type == "a"`,
+		`$.type == "a" and`,
+		`($.type == "a"`,
+		`$.type == "a")`,
+		`$.items[x] == 1`,
+		`$.total ^= 1`,
+		`attr.stream == null`,
+		`$. == 1`,
+	} {
+		if _, err := Parse(expression); err == nil {
+			t.Errorf("Expected %q not to parse", expression)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package hashes
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"github.com/cespare/xxhash/v2"
+	"github.com/zeebo/blake3"
+	"hash"
+)
+
+// Content hash algorithms a message body can be hashed with, the one used is recorded in the message header
+// (data2.AttrHash). Messages without one were hashed with SHA1, the only option before it was selectable. SHA1 is
+// still there to read them, and for anyone who configures it, but new writes default to SHA256 as security tooling
+// rightly flags SHA1.
+
+const (
+	SHA1    = "sha1"
+	SHA256  = "sha256"
+	BLAKE3  = "blake3"
+	XXHASH  = "xxh64" // Fast, but not cryptographic, it catches corruption not tampering
+	Default = SHA256
+)
+
+// New creates a hash.Hash for an algorithm, an empty algorithm is SHA1, as it's what messages without one used.
+func New(algorithm string) (h hash.Hash, err error) {
+	switch algorithm {
+	case SHA1, "":
+		return sha1.New(), nil
+	case SHA256:
+		return sha256.New(), nil
+	case BLAKE3:
+		return blake3.New(), nil
+	case XXHASH:
+		return xxhash.New(), nil
+	}
+
+	return nil, fmt.Errorf("Unknown hash algorithm: %s", algorithm)
+}
+
+// Valid reports whether an algorithm is known.
+func Valid(algorithm string) bool {
+	_, err := New(algorithm)
+	return err == nil
+}
+
+// Sum hashes body with algorithm, returning the hash as it's written in a message header (base64).
+func Sum(algorithm string, body []byte) (sum string, err error) {
+	h, err := New(algorithm)
+	if err != nil {
+		return "", err
+	}
+	h.Write(body)
+
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,48 @@
+package hashes
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+)
+
+func TestSum(t *testing.T) {
+	// Hashes of "abc"
+	tests := map[string]string{
+		SHA1:   "a9993e364706816aba3e25717850c26c9cd0d89d",
+		"":     "a9993e364706816aba3e25717850c26c9cd0d89d",
+		SHA256: "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+		BLAKE3: "6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85",
+		XXHASH: "44bc2cf5ad770999",
+	}
+	for algorithm, expected := range tests {
+		sum, err := Sum(algorithm, []byte("abc"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(sum)
+		if err != nil {
+			t.Fatalf("Expected %s's sum to be base64, got %s", algorithm, sum)
+		}
+		if hex.EncodeToString(decoded) != expected {
+			t.Fatalf("Expected %q to hash abc to %s, got %x", algorithm, expected, decoded)
+		}
+	}
+}
+
+func TestValid(t *testing.T) {
+	for _, algorithm := range []string{SHA1, SHA256, BLAKE3, XXHASH, Default, ""} {
+		if !Valid(algorithm) {
+			t.Fatalf("Expected %q to be valid", algorithm)
+		}
+	}
+	if Valid("md5") {
+		t.Fatal("Expected md5 not to be valid")
+	}
+	if _, err := Sum("md5", []byte("abc")); err == nil {
+		t.Fatal("Expected an unknown algorithm to be an error")
+	}
+	if Default != SHA256 {
+		t.Fatalf("Expected new writes to default to SHA256, not %s", Default)
+	}
+}
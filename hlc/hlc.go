@@ -0,0 +1,84 @@
+package hlc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A hybrid logical clock, it follows wall time as closely as it can but never goes backwards. When the wall clock
+// stalls, or jumps backwards, the logical counter is incremented instead, so every reading is strictly greater than
+// the one before it.
+
+// Timestamp is a clock reading, wall time in nanoseconds since the epoch, plus a logical counter.
+type Timestamp struct {
+	Wall    int64
+	Logical uint32
+}
+
+// Clock hands out increasing timestamps, the zero value starts from the wall clock.
+type Clock struct {
+	mu   sync.Mutex
+	last Timestamp
+}
+
+// NewClock creates a clock that will only ever hand out timestamps after last, the last reading from a previous
+// run, so it doesn't go backwards across restarts either.
+func NewClock(last Timestamp) *Clock {
+	return &Clock{last: last}
+}
+
+// Tick produces the next timestamp given the current wall time in nanoseconds.
+func (c *Clock) Tick(wall int64) Timestamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if wall > c.last.Wall {
+		c.last = Timestamp{Wall: wall}
+	} else {
+		c.last.Logical++
+	}
+
+	return c.last
+}
+
+// Observe moves the clock past a timestamp seen elsewhere, like from another node.
+func (c *Clock) Observe(t Timestamp) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.last.Less(t) {
+		c.last = t
+	}
+}
+
+// Less reports whether t happened before o.
+func (t Timestamp) Less(o Timestamp) bool {
+	return t.Wall < o.Wall || (t.Wall == o.Wall && t.Logical < o.Logical)
+}
+
+// String is <wall>.<logical>, this is how it's recorded in a message header.
+func (t Timestamp) String() string {
+	return fmt.Sprintf("%d.%d", t.Wall, t.Logical)
+}
+
+// Parse is the inverse of Timestamp.String
+func Parse(s string) (t Timestamp, err error) {
+	parts := strings.SplitN(s, ".", 2)
+	if len(parts) != 2 {
+		return t, fmt.Errorf("Malformed hybrid logical clock timestamp: %s", s)
+	}
+
+	t.Wall, err = strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return t, fmt.Errorf("Malformed hybrid logical clock timestamp: %s", s)
+	}
+	logical, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return t, fmt.Errorf("Malformed hybrid logical clock timestamp: %s", s)
+	}
+	t.Logical = uint32(logical)
+
+	return t, nil
+}
@@ -0,0 +1,65 @@
+package hlc
+
+import (
+	"testing"
+)
+
+func TestTickBackwards(t *testing.T) {
+	c := NewClock(Timestamp{})
+	walls := []int64{100, 200, 200, 150, 50, 199, 201, 201, 300}
+	expected := []Timestamp{{100, 0}, {200, 0}, {200, 1}, {200, 2}, {200, 3}, {200, 4}, {201, 0}, {201, 1}, {300, 0}}
+
+	var last Timestamp
+	for i, wall := range walls {
+		tick := c.Tick(wall)
+		if tick != expected[i] {
+			t.Fatalf("Expected tick %d, at wall time %d, to be %s, got %s", i, wall, expected[i], tick)
+		}
+		if i > 0 && !last.Less(tick) {
+			t.Fatalf("Expected %s to be after %s", tick, last)
+		}
+		last = tick
+	}
+}
+
+func TestRestartAndObserve(t *testing.T) {
+	// A clock picking up from a previous run's last reading doesn't go backwards, even if the wall clock has
+	c := NewClock(Timestamp{Wall: 500, Logical: 3})
+	if tick := c.Tick(400); tick != (Timestamp{500, 4}) {
+		t.Fatalf("Expected 500.4, got %s", tick)
+	}
+
+	c.Observe(Timestamp{Wall: 700, Logical: 1})
+	if tick := c.Tick(600); tick != (Timestamp{700, 2}) {
+		t.Fatalf("Expected to carry on from an observed timestamp, got %s", tick)
+	}
+	c.Observe(Timestamp{Wall: 10})
+	if tick := c.Tick(800); tick != (Timestamp{800, 0}) {
+		t.Fatalf("Expected an older timestamp to be ignored, and the wall clock followed, got %s", tick)
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, ts := range []Timestamp{{}, {Wall: 1700000000123456789, Logical: 7}, {Wall: -5, Logical: 4294967295}} {
+		parsed, err := Parse(ts.String())
+		if err != nil || parsed != ts {
+			t.Fatalf("Expected %s to parse back to itself, got %s, %v", ts, parsed, err)
+		}
+	}
+	if ts := (Timestamp{Wall: 12, Logical: 3}).String(); ts != "12.3" {
+		t.Fatalf("Expected 12.3, got %s", ts)
+	}
+
+	for _, s := range []string{"", "12", "12.", ".3", "a.3", "12.b", "12.3.4", "12.4294967296", "1.-1"} {
+		if _, err := Parse(s); err == nil {
+			t.Fatalf("Expected %q not to parse", s)
+		}
+	}
+}
+
+func TestLess(t *testing.T) {
+	if !(Timestamp{1, 5}).Less(Timestamp{2, 0}) || !(Timestamp{2, 0}).Less(Timestamp{2, 1}) ||
+		(Timestamp{2, 1}).Less(Timestamp{2, 1}) || (Timestamp{3, 0}).Less(Timestamp{2, 9}) {
+		t.Fatal("Expected timestamps to be ordered by wall time, then the logical counter")
+	}
+}
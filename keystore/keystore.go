@@ -0,0 +1,316 @@
+package keystore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The key store holds a data key per subject, bodies written for a subject are sealed with its key. The log is
+// append only, so erasing a subject's data is done by deleting its key (crypto-shredding), every body sealed
+// with it is unreadable from then on.
+//
+// Keys live in a directory, one file per subject, named after the SHA256 of the subject so the subject itself
+// isn't sitting around in a directory listing. A key file is the 8 byte key id followed by the 32 byte key, both raw
+// bytes, the id is hex encoded where it's recorded with a sealed body.
+
+const (
+	Cipher  = "aes-256-gcm"
+	keySize = 32
+	idSize  = 8
+)
+
+// ErrErased is returned when opening a body whose key has been deleted.
+var ErrErased = errors.New("subject erased")
+
+// Store is a directory of per subject data keys.
+type Store struct {
+	dir      string
+	mu       sync.Mutex
+	started  int64  // When the Store was created, in Unix nanoseconds
+	erasures uint64 // Subjects erased since then
+}
+
+// key is a subject's data key along with its id, the id is recorded with each sealed body so that a key
+// created for a subject after an erasure can't be confused for the erased one.
+type key struct {
+	id  string
+	key []byte
+}
+
+// New creates a Store backed by dir, the directory is created on the first write.
+func New(dir string) *Store {
+	return &Store{dir: dir, started: time.Now().UnixNano()}
+}
+
+// Seal encrypts plaintext with subject's data key, creating the key if there isn't one, returning the id of the
+// key used and the sealed body (base64, newline terminated, so the log stays line oriented).
+func (s *Store) Seal(subject string, plaintext []byte) (keyId string, sealed []byte, err error) {
+	s.mu.Lock()
+	k, err := s.load(subject)
+	if os.IsNotExist(err) {
+		k, err = s.create(subject)
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return "", nil, err
+	}
+
+	aead, err := newAEAD(k.key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", nil, err
+	}
+
+	box := aead.Seal(nonce, nonce, plaintext, []byte(subject))
+	sealed = make([]byte, base64.StdEncoding.EncodedLen(len(box))+1)
+	base64.StdEncoding.Encode(sealed, box)
+	sealed[len(sealed)-1] = '\n'
+
+	return k.id, sealed, nil
+}
+
+// Open decrypts a body produced by Seal, ErrErased is returned if the key has since been deleted.
+func (s *Store) Open(subject string, keyId string, sealed []byte) (plaintext []byte, err error) {
+	s.mu.Lock()
+	k, err := s.load(subject)
+	s.mu.Unlock()
+	if os.IsNotExist(err) || (err == nil && k.id != keyId) {
+		return nil, ErrErased
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	box := make([]byte, base64.StdEncoding.DecodedLen(len(sealed)))
+	n, err := base64.StdEncoding.Decode(box, trimNewline(sealed))
+	if err != nil {
+		return nil, fmt.Errorf("Sealed body is not valid base64: %s", err.Error())
+	}
+	box = box[:n]
+
+	aead, err := newAEAD(k.key)
+	if err != nil {
+		return nil, err
+	}
+	if len(box) < aead.NonceSize() {
+		return nil, fmt.Errorf("Sealed body is too short")
+	}
+
+	return aead.Open(nil, box[:aead.NonceSize()], box[aead.NonceSize():], []byte(subject))
+}
+
+// Erase deletes subject's data key, making every body sealed with it unreadable. Erasing a subject without a
+// key is not an error.
+func (s *Store) Erase(subject string) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err = os.Remove(s.fileName(subject))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err == nil {
+		s.erasures++
+	}
+
+	return err
+}
+
+// Erasures changes whenever a subject is erased, it's how a follower knows to look for keys to erase too. It's
+// only comparable to earlier values from the same Store, erasing with the erase tool shows as a new Store.
+func (s *Store) Erasures() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return fmt.Sprintf("%d.%d", s.started, s.erasures)
+}
+
+// Name is the name a subject's key goes by in List, Export, Import and Remove, it doesn't give the subject away.
+func Name(subject string) string {
+	sum := sha256.Sum256([]byte(subject))
+	return hex.EncodeToString(sum[:])
+}
+
+// Has reports whether there's a key for subject with the id keyId.
+func (s *Store) Has(subject string, keyId string) bool {
+	s.mu.Lock()
+	k, err := s.load(subject)
+	s.mu.Unlock()
+
+	return err == nil && k.id == keyId
+}
+
+// List is the ids of the keys in the store, by name.
+func (s *Store) List() (ids map[string]string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	ids = map[string]string{}
+	for _, file := range files {
+		name := strings.TrimSuffix(file.Name(), ".key")
+		if name == file.Name() || !validName(name) {
+			continue
+		}
+		contents, err := ioutil.ReadFile(filepath.Join(s.dir, file.Name()))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(contents) == idSize+keySize {
+			ids[name] = hex.EncodeToString(contents[:idSize])
+		}
+	}
+
+	return ids, nil
+}
+
+// Export reads a key file as it is, for copying to another store with Import. A key that isn't there is
+// os.IsNotExist.
+func (s *Store) Export(name string) (contents []byte, err error) {
+	if !validName(name) {
+		return nil, fmt.Errorf("%q is not the name of a key", name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	contents, err = ioutil.ReadFile(filepath.Join(s.dir, name+".key"))
+	if err == nil && len(contents) != idSize+keySize {
+		return nil, fmt.Errorf("Key file %s is corrupt, expected %d bytes got %d", name, idSize+keySize, len(contents))
+	}
+
+	return contents, err
+}
+
+// Import writes a key file exported from another store, replacing the key there is for the subject, if any.
+func (s *Store) Import(name string, contents []byte) (err error) {
+	if !validName(name) || len(contents) != idSize+keySize {
+		return fmt.Errorf("%q is not a key, or the name of one", name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.write(filepath.Join(s.dir, name+".key"), contents)
+}
+
+// Remove deletes a key by its name, like Erase.
+func (s *Store) Remove(name string) (err error) {
+	if !validName(name) {
+		return fmt.Errorf("%q is not the name of a key", name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err = os.Remove(filepath.Join(s.dir, name+".key"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err == nil {
+		s.erasures++
+	}
+
+	return err
+}
+
+func (s *Store) load(subject string) (k key, err error) {
+	contents, err := ioutil.ReadFile(s.fileName(subject))
+	if err != nil {
+		return k, err
+	}
+	if len(contents) != idSize+keySize {
+		return k, fmt.Errorf("Key file for subject is corrupt, expected %d bytes got %d",
+			idSize+keySize,
+			len(contents))
+	}
+
+	return key{id: hex.EncodeToString(contents[:idSize]), key: contents[idSize:]}, nil
+}
+
+func (s *Store) create(subject string) (k key, err error) {
+	contents := make([]byte, idSize+keySize)
+	if _, err = io.ReadFull(rand.Reader, contents); err != nil {
+		return k, err
+	}
+
+	if err = s.write(s.fileName(subject), contents); err != nil {
+		return k, err
+	}
+
+	return key{id: hex.EncodeToString(contents[:idSize]), key: contents[idSize:]}, nil
+}
+
+// write writes a key file, then renames it into place, so a crash never leaves a partial key behind.
+func (s *Store) write(path string, contents []byte) (err error) {
+	if err = os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(contents); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+
+	return err
+}
+
+func (s *Store) fileName(subject string) string {
+	return filepath.Join(s.dir, Name(subject)+".key")
+}
+
+// validName reports whether name is a key's name, so it can't be used to reach outside the store's directory.
+func validName(name string) bool {
+	decoded, err := hex.DecodeString(name)
+	return err == nil && len(decoded) == sha256.Size && name == strings.ToLower(name)
+}
+
+func newAEAD(k []byte) (aead cipher.AEAD, err error) {
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func trimNewline(b []byte) []byte {
+	if len(b) > 0 && b[len(b)-1] == '\n' {
+		return b[:len(b)-1]
+	}
+
+	return b
+}
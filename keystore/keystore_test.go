@@ -0,0 +1,120 @@
+package keystore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSealOpenErase(t *testing.T) {
+	s := New(filepath.Join(t.TempDir(), "keys"))
+
+	keyId, sealed, err := s.Seal("alice", []byte("hello alice\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keyId) != 2*idSize || sealed[len(sealed)-1] != '\n' || bytes.Contains(sealed, []byte("hello")) {
+		t.Fatalf("Expected a hex key id and a sealed line, got %s and %q", keyId, sealed)
+	}
+	plaintext, err := s.Open("alice", keyId, sealed)
+	if err != nil || string(plaintext) != "hello alice\n" {
+		t.Fatalf("Expected the body back, got %q, %v", plaintext, err)
+	}
+	if _, err = s.Open("bob", keyId, sealed); err != ErrErased {
+		t.Fatalf("Expected a subject without a key to be erased, got %v", err)
+	}
+
+	// The subject is authenticated, a body can't be moved to another subject with a key
+	bobKey, _, err := s.Seal("bob", []byte("bob\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Open("bob", bobKey, sealed); err == nil {
+		t.Fatal("Expected alice's body not to open as bob's")
+	}
+
+	if err = s.Erase("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Open("alice", keyId, sealed); err != ErrErased {
+		t.Fatalf("Expected an erased subject, got %v", err)
+	}
+	if err = s.Erase("alice"); err != nil {
+		t.Fatalf("Expected erasing again to be fine, got %v", err)
+	}
+
+	// A new key for the subject doesn't open what was sealed with the erased one
+	newKey, _, err := s.Seal("alice", []byte("again\n"))
+	if err != nil || newKey == keyId {
+		t.Fatalf("Expected a new key, got %s, %v", newKey, err)
+	}
+	if _, err = s.Open("alice", keyId, sealed); err != ErrErased {
+		t.Fatalf("Expected the old body to stay erased, got %v", err)
+	}
+}
+
+func TestKeyFile(t *testing.T) {
+	s := New(t.TempDir())
+	keyId, _, err := s.Seal("alice", []byte("a\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadFile(s.fileName("alice"))
+	if err != nil || len(contents) != idSize+keySize {
+		t.Fatalf("Expected a %d byte key file, got %d bytes, %v", idSize+keySize, len(contents), err)
+	}
+	if k, _ := s.load("alice"); k.id != keyId {
+		t.Fatalf("Expected the file to start with the raw key id %s, got %s", keyId, k.id)
+	}
+
+	ioutil.WriteFile(s.fileName("alice"), contents[:10], 0600)
+	if _, _, err = s.Seal("alice", []byte("a\n")); err == nil {
+		t.Fatal("Expected a corrupt key file to be an error")
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	leader, follower := New(filepath.Join(t.TempDir(), "keys")), New(filepath.Join(t.TempDir(), "keys"))
+	keyId, sealed, err := leader.Seal("alice", []byte("hello alice\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids, _ := leader.List(); len(ids) != 1 || ids[Name("alice")] != keyId {
+		t.Fatalf("Expected alice's key to be listed, got %v", ids)
+	}
+
+	contents, err := leader.Export(Name("alice"))
+	if err == nil {
+		err = follower.Import(Name("alice"), contents)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := follower.Open("alice", keyId, sealed); err != nil || string(plaintext) != "hello alice\n" {
+		t.Fatalf("Expected the imported key to open the body, got %q, %v", plaintext, err)
+	}
+
+	before := follower.Erasures()
+	if err = follower.Remove(Name("alice")); err != nil {
+		t.Fatal(err)
+	}
+	if follower.Has("alice", keyId) || follower.Erasures() == before {
+		t.Fatal("Expected the key to be removed, and counted as an erasure")
+	}
+	if _, err = follower.Export(Name("alice")); !os.IsNotExist(err) {
+		t.Fatalf("Expected a removed key to be IsNotExist, got %v", err)
+	}
+
+	// Names are checked, they can't reach outside the directory
+	for _, name := range []string{"", "../keys", strings.ToUpper(Name("alice"))} {
+		if _, err = leader.Export(name); err == nil || os.IsNotExist(err) {
+			t.Fatalf("Expected %q not to be a key's name", name)
+		}
+	}
+	if err = follower.Import(Name("bob"), []byte("short")); err == nil {
+		t.Fatal("Expected a key of the wrong size not to be imported")
+	}
+}
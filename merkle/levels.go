@@ -0,0 +1,223 @@
+package merkle
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// levels holds a tree's leaf hashes (level 0) and the hashes of its complete subtrees, level k having those of
+// 2^k leaves. Only the ends of levels change, they're appended to or truncated.
+type levels interface {
+	node(k int, i uint64) ([]byte, error)
+	count(k int) uint64
+	append(k int, hash []byte) error
+	truncate(k int, n uint64) error
+	sync() error
+	close() error
+}
+
+// memoryLevels keeps every hash in memory, it's for trees that are built to be thrown away, like the verify tool's.
+type memoryLevels struct {
+	levels [][][]byte
+}
+
+func (m *memoryLevels) node(k int, i uint64) ([]byte, error) {
+	return m.levels[k][i], nil
+}
+
+func (m *memoryLevels) count(k int) uint64 {
+	if k >= len(m.levels) {
+		return 0
+	}
+
+	return uint64(len(m.levels[k]))
+}
+
+func (m *memoryLevels) append(k int, hash []byte) error {
+	if k == len(m.levels) {
+		m.levels = append(m.levels, nil)
+	}
+	m.levels[k] = append(m.levels[k], hash)
+
+	return nil
+}
+
+func (m *memoryLevels) truncate(k int, n uint64) error {
+	if k < len(m.levels) {
+		m.levels[k] = m.levels[k][:n]
+	}
+
+	return nil
+}
+
+func (m *memoryLevels) sync() error  { return nil }
+func (m *memoryLevels) close() error { return nil }
+
+// fileLevels keeps each level in a file of its own in a directory, named for the level, of hashes one after the
+// other. Nodes are read as they're needed, a root or proof only needs O(log n) of them, so nothing but the
+// files' sizes is kept in memory.
+type fileLevels struct {
+	dir    string
+	files  []*os.File
+	counts []uint64
+}
+
+// Open opens a tree kept on disk in dir, creating it if it's not there. Appends aren't synced, so after a crash
+// the end of the tree may be missing or, if they beat the data they're hashes of to disk, ahead of it. What's
+// left is made whole again, complete subtrees missing their hash are hashed, but it's up to the caller to check
+// the last few leaves against the data, and Truncate or Append to match.
+func Open(dir string) (t *Tree, err error) {
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f := &fileLevels{dir: dir}
+	t = &Tree{levels: f}
+	for k := 0; ; k++ {
+		path := filepath.Join(dir, strconv.Itoa(k))
+		if _, err = os.Stat(path); k > 0 && os.IsNotExist(err) {
+			break
+		}
+		if err = f.open(k); err != nil {
+			f.close()
+			return nil, err
+		}
+	}
+
+	if err = f.repair(); err != nil {
+		f.close()
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// repair makes each level the right size for the one below it, torn writes having been cut off when the level
+// was opened. Those above that are too short are made up from the level below, and those too long cut back.
+func (f *fileLevels) repair() (err error) {
+	for k := 1; k < len(f.files) || f.count(k-1) >= 2; k++ {
+		below := f.count(k - 1)
+		if f.count(k) > below/2 {
+			if err = f.truncate(k, below/2); err != nil {
+				return err
+			}
+		}
+		for n := f.count(k); n < below/2; n++ {
+			left, err := f.node(k-1, 2*n)
+			if err != nil {
+				return err
+			}
+			right, err := f.node(k-1, 2*n+1)
+			if err != nil {
+				return err
+			}
+			if err = f.append(k, NodeHash(left, right)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// open opens the file for level k, cutting off any partly written hash at its end.
+func (f *fileLevels) open(k int) error {
+	file, err := os.OpenFile(filepath.Join(f.dir, strconv.Itoa(k)), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err == nil && info.Size()%sha256.Size != 0 {
+		err = file.Truncate(info.Size() - info.Size()%sha256.Size)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.files = append(f.files, file)
+	f.counts = append(f.counts, uint64(info.Size()/sha256.Size))
+
+	return nil
+}
+
+func (f *fileLevels) node(k int, i uint64) ([]byte, error) {
+	if k >= len(f.files) || i >= f.counts[k] {
+		return nil, fmt.Errorf("There's no node %d at level %d of the tree in %s", i, k, f.dir)
+	}
+	hash := make([]byte, sha256.Size)
+	if _, err := f.files[k].ReadAt(hash, int64(i)*sha256.Size); err != nil {
+		return nil, err
+	}
+
+	return hash, nil
+}
+
+func (f *fileLevels) count(k int) uint64 {
+	if k >= len(f.counts) {
+		return 0
+	}
+
+	return f.counts[k]
+}
+
+func (f *fileLevels) append(k int, hash []byte) error {
+	if k == len(f.files) {
+		if err := f.open(k); err != nil {
+			return err
+		}
+	}
+	if _, err := f.files[k].WriteAt(hash, int64(f.counts[k])*sha256.Size); err != nil {
+		return err
+	}
+	f.counts[k]++
+
+	return nil
+}
+
+func (f *fileLevels) truncate(k int, n uint64) error {
+	if k >= len(f.files) {
+		return nil
+	}
+	if err := f.files[k].Truncate(int64(n) * sha256.Size); err != nil {
+		return err
+	}
+	f.counts[k] = n
+
+	return nil
+}
+
+func (f *fileLevels) sync() (err error) {
+	for _, file := range f.files {
+		if syncErr := file.Sync(); err == nil {
+			err = syncErr
+		}
+	}
+	if err == nil {
+		err = syncDir(f.dir)
+	}
+
+	return err
+}
+
+func (f *fileLevels) close() (err error) {
+	for _, file := range f.files {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+// syncDir syncs a directory, so files created in it are there after a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,340 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"sync"
+)
+
+// A Merkle tree, as in certificate transparency logs (RFC 6962), so that someone can be shown a message is in the
+// log (an inclusion proof), or that a later version of the log contains an earlier one (a consistency proof),
+// without needing the whole log.
+
+// LeafHash is the hash of a leaf's data, prefixed so that a leaf can't be passed off as an interior node.
+func LeafHash(leaf []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(leaf)
+	return h.Sum(nil)
+}
+
+// NodeHash is the hash of an interior node given its children's hashes.
+func NodeHash(left []byte, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// Tree is an append only Merkle tree of leaf hashes. Along with the leaves it keeps the hash of every complete
+// (power of two sized and aligned) subtree, so that roots and proofs, for any size, take O(log n) hashing. They're
+// kept in memory (NewTree) or on disk (Open).
+type Tree struct {
+	mu     sync.RWMutex
+	levels levels // levels.node(k, i) is the hash of leaves [i*2^k, (i+1)*2^k)
+}
+
+// NewTree creates an empty tree, kept in memory.
+func NewTree() *Tree {
+	return &Tree{levels: &memoryLevels{levels: make([][][]byte, 1)}}
+}
+
+// Append adds a leaf hash (see LeafHash) to the tree.
+func (t *Tree) Append(leafHash []byte) (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err = t.levels.append(0, leafHash); err != nil {
+		return err
+	}
+	for k := 0; t.levels.count(k)%2 == 0; k++ {
+		n := t.levels.count(k)
+		left, err := t.levels.node(k, n-2)
+		if err != nil {
+			return err
+		}
+		right, err := t.levels.node(k, n-1)
+		if err != nil {
+			return err
+		}
+		if err = t.levels.append(k+1, NodeHash(left, right)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Truncate cuts the tree back to its first size leaves, it's an error for it to have fewer.
+func (t *Tree) Truncate(size uint64) (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if size > t.levels.count(0) {
+		return fmt.Errorf("Can't truncate a tree of size %d to %d", t.levels.count(0), size)
+	}
+	for k := 0; size>>k > 0 || t.levels.count(k) > 0; k++ {
+		if err = t.levels.truncate(k, size>>k); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Size is the number of leaves in the tree.
+func (t *Tree) Size() uint64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.levels.count(0)
+}
+
+// Sync makes sure everything appended is on disk, it does nothing for a tree in memory.
+func (t *Tree) Sync() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.levels.sync()
+}
+
+// Close closes the files of a tree kept on disk, it's not to be used after.
+func (t *Tree) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.levels.close()
+}
+
+// Root is the root hash of the tree made up of the first size leaves.
+func (t *Tree) Root(size uint64) (root []byte, err error) {
+	return t.RangeRoot(0, size)
+}
+
+// RangeRoot is the root hash of a tree made up of just the leaves [begin, end).
+func (t *Tree) RangeRoot(begin uint64, end uint64) (root []byte, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if begin > end || end > t.levels.count(0) {
+		return nil, fmt.Errorf("Leaves %d to %d are outside of the tree, size %d", begin, end, t.levels.count(0))
+	}
+	if begin == end {
+		empty := sha256.Sum256(nil)
+		return empty[:], nil
+	}
+
+	return t.subtree(begin, end)
+}
+
+// InclusionProof is the audit path for the leaf at index, in the tree of the first size leaves.
+func (t *Tree) InclusionProof(index uint64, size uint64) (proof [][]byte, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if index >= size || size > t.levels.count(0) {
+		return nil, fmt.Errorf("Leaf %d is outside of a tree of size %d (of %d)", index, size, t.levels.count(0))
+	}
+
+	return t.path(index, 0, size)
+}
+
+// ConsistencyProof proves that the tree of the first from leaves is a prefix of the tree of the first to leaves.
+func (t *Tree) ConsistencyProof(from uint64, to uint64) (proof [][]byte, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if from > to || to > t.levels.count(0) {
+		return nil, fmt.Errorf("Can't prove %d consistent with %d, the tree is size %d", from, to, t.levels.count(0))
+	}
+	if from == 0 || from == to {
+		return [][]byte{}, nil
+	}
+
+	return t.subproof(from, 0, to, true)
+}
+
+// subtree is MTH(D[begin:end]), begin < end
+func (t *Tree) subtree(begin uint64, end uint64) ([]byte, error) {
+	n := end - begin
+	if n&(n-1) == 0 && begin%n == 0 {
+		return t.levels.node(log2(n), begin/n)
+	}
+
+	k := largestPowerOfTwoBelow(n)
+	left, err := t.subtree(begin, begin+k)
+	if err != nil {
+		return nil, err
+	}
+	right, err := t.subtree(begin+k, end)
+	if err != nil {
+		return nil, err
+	}
+
+	return NodeHash(left, right), nil
+}
+
+// path is PATH(m, D[begin:end]), m is relative to begin
+func (t *Tree) path(m uint64, begin uint64, end uint64) ([][]byte, error) {
+	n := end - begin
+	if n == 1 {
+		return [][]byte{}, nil
+	}
+
+	k := largestPowerOfTwoBelow(n)
+	if m < k {
+		return t.extend(t.path(m, begin, begin+k))(begin+k, end)
+	}
+	return t.extend(t.path(m-k, begin+k, end))(begin, begin+k)
+}
+
+// subproof is SUBPROOF(m, D[begin:end], b), m is relative to begin
+func (t *Tree) subproof(m uint64, begin uint64, end uint64, b bool) ([][]byte, error) {
+	n := end - begin
+	if m == n {
+		if b {
+			return [][]byte{}, nil
+		}
+		return t.extend([][]byte{}, nil)(begin, end)
+	}
+
+	k := largestPowerOfTwoBelow(n)
+	if m <= k {
+		return t.extend(t.subproof(m, begin, begin+k, b))(begin+k, end)
+	}
+	return t.extend(t.subproof(m-k, begin+k, end, false))(begin, begin+k)
+}
+
+// extend appends MTH(D[begin:end]) to a proof, unless there was an error working the proof out.
+func (t *Tree) extend(proof [][]byte, err error) func(begin uint64, end uint64) ([][]byte, error) {
+	return func(begin uint64, end uint64) ([][]byte, error) {
+		if err != nil {
+			return nil, err
+		}
+		hash, err := t.subtree(begin, end)
+		if err != nil {
+			return nil, err
+		}
+
+		return append(proof, hash), nil
+	}
+}
+
+// VerifyInclusion checks an audit path for the leaf at index, in a tree of size leaves, against the tree's root.
+func VerifyInclusion(index uint64, size uint64, leafHash []byte, proof [][]byte, root []byte) bool {
+	if index >= size {
+		return false
+	}
+
+	fn, sn := index, size-1
+	r := leafHash
+	for _, p := range proof {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			r = NodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = NodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	return sn == 0 && bytes.Equal(r, root)
+}
+
+// VerifyConsistency checks a consistency proof between a tree of from leaves and one of to leaves.
+func VerifyConsistency(from uint64, to uint64, fromRoot []byte, toRoot []byte, proof [][]byte) bool {
+	switch {
+	case from > to:
+		return false
+	case from == to:
+		return len(proof) == 0 && bytes.Equal(fromRoot, toRoot)
+	case from == 0:
+		return len(proof) == 0
+	case len(proof) == 0:
+		return false
+	}
+
+	if from&(from-1) == 0 {
+		proof = append([][]byte{fromRoot}, proof...)
+	}
+
+	fn, sn := from-1, to-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+
+	fr, sr := proof[0], proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = NodeHash(c, fr)
+			sr = NodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = NodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	return sn == 0 && bytes.Equal(fr, fromRoot) && bytes.Equal(sr, toRoot)
+}
+
+// TreeHead is a root hash at a given size, signed by the node that produced it.
+type TreeHead struct {
+	TreeSize  uint64 `json:"tree_size"`
+	Timestamp int64  `json:"timestamp"` // Milliseconds since the epoch
+	Root      []byte `json:"root"`
+	Signature []byte `json:"signature"`
+}
+
+// SignedBytes is what the signature covers.
+func (th TreeHead) SignedBytes() []byte {
+	return []byte(fmt.Sprintf("afterme tree head\n%d\n%d\n%s\n",
+		th.TreeSize,
+		th.Timestamp,
+		base64.StdEncoding.EncodeToString(th.Root)))
+}
+
+// Sign sets the signature using the node's key.
+func (th *TreeHead) Sign(key ed25519.PrivateKey) {
+	th.Signature = ed25519.Sign(key, th.SignedBytes())
+}
+
+// Verify checks the signature against the node's public key.
+func (th TreeHead) Verify(key ed25519.PublicKey) bool {
+	return ed25519.Verify(key, th.SignedBytes(), th.Signature)
+}
+
+func largestPowerOfTwoBelow(n uint64) uint64 {
+	k := uint64(1)
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+func log2(n uint64) (k int) {
+	for n > 1 {
+		n >>= 1
+		k++
+	}
+	return k
+}
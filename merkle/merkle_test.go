@@ -0,0 +1,202 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// naiveRoot is MTH straight out of RFC 6962, to check the tree's cached subtrees against.
+func naiveRoot(leaves [][]byte) []byte {
+	if len(leaves) == 1 {
+		return leaves[0]
+	}
+	k := largestPowerOfTwoBelow(uint64(len(leaves)))
+	return NodeHash(naiveRoot(leaves[:k]), naiveRoot(leaves[k:]))
+}
+
+func buildTree(size int) (tree *Tree, leaves [][]byte) {
+	tree = NewTree()
+	for i := 0; i < size; i++ {
+		leaf := LeafHash([]byte(fmt.Sprintf("leaf %d", i)))
+		leaves = append(leaves, leaf)
+		tree.Append(leaf)
+	}
+	return tree, leaves
+}
+
+func TestEmptyRoot(t *testing.T) {
+	root, err := NewTree().Root(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(root) != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Errorf("Empty root is %x", root)
+	}
+}
+
+func TestRoots(t *testing.T) {
+	tree, leaves := buildTree(70)
+	for size := 1; size <= len(leaves); size++ {
+		root, err := tree.Root(uint64(size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(root, naiveRoot(leaves[:size])) {
+			t.Errorf("Root for size %d doesn't match", size)
+		}
+	}
+}
+
+func TestInclusionProofs(t *testing.T) {
+	tree, leaves := buildTree(40)
+	for size := uint64(1); size <= 40; size++ {
+		root, _ := tree.Root(size)
+		for index := uint64(0); index < size; index++ {
+			proof, err := tree.InclusionProof(index, size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			leaf := leaves[index]
+			if !VerifyInclusion(index, size, leaf, proof, root) {
+				t.Errorf("Inclusion of %d in %d did not verify", index, size)
+			}
+			if size > 1 && VerifyInclusion((index+1)%size, size, leaf, proof, root) {
+				t.Errorf("Inclusion of %d in %d verified for the wrong index", index, size)
+			}
+		}
+	}
+}
+
+func TestConsistencyProofs(t *testing.T) {
+	tree, _ := buildTree(40)
+	for to := uint64(1); to <= 40; to++ {
+		toRoot, _ := tree.Root(to)
+		for from := uint64(1); from <= to; from++ {
+			fromRoot, _ := tree.Root(from)
+			proof, err := tree.ConsistencyProof(from, to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !VerifyConsistency(from, to, fromRoot, toRoot, proof) {
+				t.Errorf("Consistency of %d with %d did not verify", from, to)
+			}
+			if from < to && VerifyConsistency(from, to, toRoot, toRoot, proof) {
+				t.Errorf("Consistency of %d with %d verified with the wrong root", from, to)
+			}
+		}
+	}
+}
+
+func TestTreeHeadSignature(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+	tree, _ := buildTree(5)
+	root, _ := tree.Root(5)
+
+	th := TreeHead{TreeSize: 5, Timestamp: 1, Root: root}
+	th.Sign(private)
+	if !th.Verify(public) {
+		t.Error("Tree head signature did not verify")
+	}
+
+	th.TreeSize = 4
+	if th.Verify(public) {
+		t.Error("Altered tree head signature verified")
+	}
+}
+
+// sameRoots checks a tree has the roots of the first size leaves.
+func sameRoots(t *testing.T, tree *Tree, leaves [][]byte) {
+	t.Helper()
+	if tree.Size() != uint64(len(leaves)) {
+		t.Fatalf("Expected a tree of size %d, got %d", len(leaves), tree.Size())
+	}
+	for size := 1; size <= len(leaves); size++ {
+		root, err := tree.Root(uint64(size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(root, naiveRoot(leaves[:size])) {
+			t.Fatalf("Root for size %d doesn't match", size)
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+	tree, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, leaves := buildTree(70)
+	for _, leaf := range leaves[:37] {
+		if err = tree.Append(leaf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tree.Close()
+
+	// It carries on from where it was left
+	if tree, err = Open(dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, leaf := range leaves[37:] {
+		tree.Append(leaf)
+	}
+	sameRoots(t, tree, leaves)
+	proof, err := tree.InclusionProof(12, 70)
+	root, _ := tree.Root(70)
+	if err != nil || !VerifyInclusion(12, 70, leaves[12], proof, root) {
+		t.Fatalf("Expected an inclusion proof that verifies, got %v", err)
+	}
+	from, _ := tree.Root(21)
+	if proof, err = tree.ConsistencyProof(21, 70); err != nil || !VerifyConsistency(21, 70, from, root, proof) {
+		t.Fatalf("Expected a consistency proof that verifies, got %v", err)
+	}
+
+	if err = tree.Truncate(71); err == nil {
+		t.Fatal("Expected truncating to more leaves than there are to fail")
+	}
+	if err = tree.Truncate(33); err != nil {
+		t.Fatal(err)
+	}
+	sameRoots(t, tree, leaves[:33])
+	tree.Close()
+	if tree, err = Open(dir); err != nil {
+		t.Fatal(err)
+	}
+	sameRoots(t, tree, leaves[:33])
+	tree.Close()
+}
+
+func TestOpenRepair(t *testing.T) {
+	dir := t.TempDir()
+	tree, _ := Open(dir)
+	_, leaves := buildTree(45)
+	for _, leaf := range leaves {
+		tree.Append(leaf)
+	}
+	tree.Close()
+
+	// A crash can leave a torn hash at the end of a level, and levels that are behind or ahead of those below
+	torn, _ := os.OpenFile(filepath.Join(dir, "0"), os.O_APPEND|os.O_WRONLY, 0644)
+	torn.Write([]byte("torn"))
+	torn.Close()
+	os.Truncate(filepath.Join(dir, "2"), 3*32)
+	os.Remove(filepath.Join(dir, "3"))
+	os.Remove(filepath.Join(dir, "4"))
+	os.Remove(filepath.Join(dir, "5"))
+	os.Truncate(filepath.Join(dir, "1"), 24*32) // 22 is right for 45 leaves
+
+	tree, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	sameRoots(t, tree, leaves)
+}
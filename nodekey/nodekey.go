@@ -0,0 +1,106 @@
+package nodekey
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The node key is an Ed25519 key that the server signs things with (tree heads, seals), so that anyone holding
+// the public key can check they came from this node. It's kept in the data dir, the private key (seed) in
+// node.key and the public key, to hand out, in node.pub, both base64.
+
+const (
+	PrivateFileName = "node.key"
+	PublicFileName  = "node.pub"
+)
+
+// LoadOrCreate loads the node key from dataDir, creating one if there isn't one yet.
+func LoadOrCreate(dataDir string) (key ed25519.PrivateKey, err error) {
+	seed, err := readBase64(filepath.Join(dataDir, PrivateFileName))
+	if os.IsNotExist(err) {
+		return create(dataDir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s is not a valid key, expected %d bytes got %d",
+			PrivateFileName,
+			ed25519.SeedSize,
+			len(seed))
+	}
+
+	key = ed25519.NewKeyFromSeed(seed)
+
+	return key, writePublic(dataDir, key)
+}
+
+// LoadPublic loads a public key written by LoadOrCreate, path is normally <datadir>/node.pub.
+func LoadPublic(path string) (key ed25519.PublicKey, err error) {
+	contents, err := readBase64(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(contents) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%s is not a valid public key, expected %d bytes got %d",
+			path,
+			ed25519.PublicKeySize,
+			len(contents))
+	}
+
+	return ed25519.PublicKey(contents), nil
+}
+
+func create(dataDir string) (key ed25519.PrivateKey, err error) {
+	_, key, err = ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeBase64(filepath.Join(dataDir, PrivateFileName), key.Seed(), 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, writePublic(dataDir, key)
+}
+
+// writePublic writes out node.pub if it's missing, it can always be recreated from the private key.
+func writePublic(dataDir string, key ed25519.PrivateKey) (err error) {
+	err = writeBase64(filepath.Join(dataDir, PublicFileName), key.Public().(ed25519.PublicKey), 0644)
+	if os.IsExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+func readBase64(path string) (contents []byte, err error) {
+	encoded, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+}
+
+func writeBase64(path string, contents []byte, perm os.FileMode) (err error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write([]byte(base64.StdEncoding.EncodeToString(contents) + "\n")); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
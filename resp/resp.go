@@ -0,0 +1,240 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// RESP, the Redis serialization protocol, version 2, for the Redis Streams front end and clients of it. A command is
+// an array of bulk strings, or an inline command, a line of words as typed into telnet. A reply is one of:
+//
+//	Simple string: +OK\r\n
+//	Error:         -ERR message\r\n
+//	Integer:       :12\r\n
+//	Bulk string:   $5\r\nhello\r\n, or $-1\r\n for a null
+//	Array:         *2\r\n then its 2 elements, or *-1\r\n for a null
+//
+// ReadReply reads these as a string, an Error, an int64, a string or nil, and an []interface{} or nil.
+
+// MaxBulkSize is the biggest bulk string there can be, a body of the most a message can be with room to spare.
+const MaxBulkSize = 64 * 1024 * 1024
+
+// MaxArrayLength is the most elements an array can have.
+const MaxArrayLength = 1024 * 1024
+
+// ErrTooBig is returned reading a bulk string or an array bigger than the maximum, the connection can't carry on
+// after it.
+var ErrTooBig = errors.New("bulk string or array is bigger than the maximum")
+
+// Error is an error reply.
+type Error string
+
+func (err Error) Error() string {
+	return string(err)
+}
+
+// ReadCommand reads a command, an array of bulk strings or an inline command.
+func ReadCommand(r *bufio.Reader) (args []string, err error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+
+	count, err := length(line, MaxArrayLength)
+	if err != nil {
+		return nil, err
+	}
+	args = make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		if line, err = readLine(r); err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("Expected a bulk string, got %.20q", line)
+		}
+		arg, null, err := readBulk(r, line)
+		if err != nil {
+			return nil, err
+		}
+		if null {
+			return nil, fmt.Errorf("Null bulk string in a command")
+		}
+		args = append(args, arg)
+	}
+
+	return args, nil
+}
+
+// ReadReply reads a reply, an error reply is returned as an Error value rather than as err.
+func ReadReply(r *bufio.Reader) (reply interface{}, err error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, fmt.Errorf("Empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return Error(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		bulk, null, err := readBulk(r, line)
+		if err != nil || null {
+			return nil, err
+		}
+		return bulk, nil
+	case '*':
+		if line == "*-1" {
+			return nil, nil
+		}
+		count, err := length(line, MaxArrayLength)
+		if err != nil {
+			return nil, err
+		}
+		array := make([]interface{}, count)
+		for i := range array {
+			if array[i], err = ReadReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return array, nil
+	default:
+		return nil, fmt.Errorf("Unknown reply type %q", line[0])
+	}
+}
+
+// WriteCommand writes a command, as an array of bulk strings.
+func WriteCommand(w *bufio.Writer, args ...string) (err error) {
+	err = WriteArray(w, len(args))
+	for _, arg := range args {
+		err = WriteBulk(w, arg) // A bufio.Writer's errors stick, so the last is all there is to check
+	}
+
+	return err
+}
+
+// WriteSimple writes a simple string, it mustn't have a \r or \n in it.
+func WriteSimple(w *bufio.Writer, s string) error {
+	w.WriteByte('+')
+	w.WriteString(s)
+	_, err := w.WriteString("\r\n")
+
+	return err
+}
+
+// WriteError writes an error reply, message starts with the error's code, ERR unless there's a better one. Line
+// breaks in it are replaced with spaces.
+func WriteError(w *bufio.Writer, message string) error {
+	w.WriteByte('-')
+	w.WriteString(strings.NewReplacer("\r", " ", "\n", " ").Replace(message))
+	_, err := w.WriteString("\r\n")
+
+	return err
+}
+
+// WriteInteger writes an integer.
+func WriteInteger(w *bufio.Writer, n int64) error {
+	w.WriteByte(':')
+	w.WriteString(strconv.FormatInt(n, 10))
+	_, err := w.WriteString("\r\n")
+
+	return err
+}
+
+// WriteBulk writes a bulk string.
+func WriteBulk(w *bufio.Writer, s string) error {
+	w.WriteByte('$')
+	w.WriteString(strconv.Itoa(len(s)))
+	w.WriteString("\r\n")
+	w.WriteString(s)
+	_, err := w.WriteString("\r\n")
+
+	return err
+}
+
+// WriteNull writes a null bulk string.
+func WriteNull(w *bufio.Writer) error {
+	_, err := w.WriteString("$-1\r\n")
+
+	return err
+}
+
+// WriteArray writes the start of an array of n elements, they're written after it.
+func WriteArray(w *bufio.Writer, n int) error {
+	w.WriteByte('*')
+	w.WriteString(strconv.Itoa(n))
+	_, err := w.WriteString("\r\n")
+
+	return err
+}
+
+// WriteNullArray writes a null array.
+func WriteNullArray(w *bufio.Writer) error {
+	_, err := w.WriteString("*-1\r\n")
+
+	return err
+}
+
+// readLine reads a line without its \r\n, an inline command's can end with only \n.
+func readLine(r *bufio.Reader) (line string, err error) {
+	line, err = r.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(line) > 64*1024 {
+		return "", ErrTooBig
+	}
+
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+// readBulk reads the bulk string that line, its $<length>, starts.
+func readBulk(r *bufio.Reader, line string) (bulk string, null bool, err error) {
+	if line == "$-1" {
+		return "", true, nil
+	}
+	size, err := length(line, MaxBulkSize)
+	if err != nil {
+		return "", false, err
+	}
+	b := make([]byte, size+2)
+	if _, err = io.ReadFull(r, b); err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if b[size] != '\r' || b[size+1] != '\n' {
+		return "", false, fmt.Errorf("Bulk string isn't followed by \\r\\n")
+	}
+
+	return string(b[:size]), false, nil
+}
+
+// length parses the length after an array's * or a bulk string's $.
+func length(line string, max int) (n int, err error) {
+	n, err = strconv.Atoi(line[1:])
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid length %.20q", line)
+	}
+	if n > max {
+		return 0, ErrTooBig
+	}
+
+	return n, nil
+}
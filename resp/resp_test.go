@@ -0,0 +1,57 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCommands(t *testing.T) {
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	WriteCommand(w, "XADD", "orders", "*", "total", "12\r\n")
+	w.Flush()
+	if b.String() != "*5\r\n$4\r\nXADD\r\n$6\r\norders\r\n$1\r\n*\r\n$5\r\ntotal\r\n$4\r\n12\r\n\r\n" {
+		t.Fatalf("Unexpected command %q", b.String())
+	}
+
+	r := bufio.NewReader(strings.NewReader(b.String() + "PING  hello\r\nXLEN orders\n"))
+	commands := [][]string{{"XADD", "orders", "*", "total", "12\r\n"}, {"PING", "hello"}, {"XLEN", "orders"}}
+	for _, expected := range commands {
+		args, err := ReadCommand(r)
+		if err != nil || !reflect.DeepEqual(args, expected) {
+			t.Fatalf("Expected %q, got %q, %v", expected, args, err)
+		}
+	}
+	if _, err := ReadCommand(r); err == nil {
+		t.Fatal("Expected an error at the end")
+	}
+
+	bad := []string{"*1\r\n:1\r\n", "*1\r\n$5\r\nabc\r\n", "*1\r\n$3\r\nabc", "*x\r\n", "*1\r\n$99999999999\r\n"}
+	for _, command := range bad {
+		if _, err := ReadCommand(bufio.NewReader(strings.NewReader(command))); err == nil {
+			t.Fatalf("Expected %q to be an error", command)
+		}
+	}
+}
+
+func TestReplies(t *testing.T) {
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	WriteArray(w, 6)
+	WriteSimple(w, "OK")
+	WriteError(w, "ERR no\r\ngood")
+	WriteInteger(w, -3)
+	WriteBulk(w, "12-0")
+	WriteNull(w)
+	WriteNullArray(w)
+	w.Flush()
+
+	reply, err := ReadReply(bufio.NewReader(&b))
+	expected := []interface{}{"OK", Error("ERR no  good"), int64(-3), "12-0", nil, nil}
+	if err != nil || !reflect.DeepEqual(reply, expected) {
+		t.Fatalf("Expected %#v, got %#v, %v", expected, reply, err)
+	}
+}
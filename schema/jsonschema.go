@@ -0,0 +1,613 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The JSON Schema validator, the parts of draft 2020-12 that say what a valid body is:
+//
+//	type, enum, const
+//	properties, required, additionalProperties, patternProperties, minProperties, maxProperties
+//	items, minItems, maxItems, uniqueItems
+//	minLength, maxLength, pattern
+//	minimum, maximum, exclusiveMinimum, exclusiveMaximum, multipleOf
+//	allOf, anyOf, oneOf, not
+//	$ref, to somewhere in the same document (#/$defs/name)
+//
+// Anything else, format and the annotations included, is ignored. Patterns are Go regular expressions (RE2), which
+// is most of what ECMA 262 ones are used for.
+
+// Schema is a compiled JSON Schema.
+type Schema struct {
+	root *node
+}
+
+// node is a compiled schema, or subschema.
+type node struct {
+	always *bool // For a boolean schema, true or false whatever the value
+	ref    *node // $ref'd schema, checked as well as the rest
+
+	types    []string
+	enum     []interface{}
+	constant interface{}
+	hasConst bool
+
+	properties    map[string]*node
+	patterns      map[*regexp.Regexp]*node
+	additional    *node // Schema for properties not in properties or matched by a pattern, nil allows any
+	required      []string
+	minProperties int
+	maxProperties int // -1 for no limit
+
+	items       *node
+	minItems    int
+	maxItems    int // -1 for no limit
+	uniqueItems bool
+
+	minLength int
+	maxLength int // -1 for no limit
+	pattern   *regexp.Regexp
+
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+	multipleOf       *float64
+
+	allOf []*node
+	anyOf []*node
+	oneOf []*node
+	not   *node
+}
+
+var jsonTypes = map[string]bool{"null": true, "boolean": true, "object": true, "array": true, "number": true,
+	"integer": true, "string": true}
+
+// Compile compiles a JSON Schema document.
+func Compile(document []byte) (schema *Schema, err error) {
+	var root interface{}
+	if err = json.Unmarshal(document, &root); err != nil {
+		return nil, fmt.Errorf("Schema is not JSON: %s", err.Error())
+	}
+
+	c := &compiler{document: root, refs: map[string]*node{}}
+	n, err := c.compile(root, "#")
+	if err == nil {
+		err = c.checkCycles(n)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Schema{root: n}, nil
+}
+
+// Validate checks a body against the schema, returning what's wrong with it, nothing if it's valid.
+func (schema *Schema) Validate(body []byte) (problems []string) {
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return []string{fmt.Sprintf("$: body is not JSON: %s", err.Error())}
+	}
+
+	return schema.root.validate(value, "$", nil)
+}
+
+// compiler compiles a document, $refs are compiled once each, so a schema can refer to itself.
+type compiler struct {
+	document interface{}
+	refs     map[string]*node
+}
+
+func (c *compiler) compile(value interface{}, at string) (n *node, err error) {
+	n = new(node)
+	return n, c.compileInto(n, value, at)
+}
+
+func (c *compiler) compileInto(n *node, value interface{}, at string) (err error) {
+	if b, ok := value.(bool); ok {
+		n.always = &b
+		return nil
+	}
+	keywords, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s: a schema must be an object or a boolean", at)
+	}
+	n.maxProperties, n.maxItems, n.maxLength = -1, -1, -1
+
+	for keyword, v := range keywords {
+		here := at + "/" + keyword
+		switch keyword {
+		case "$ref":
+			pointer, _ := v.(string)
+			if n.ref, err = c.ref(pointer, here); err != nil {
+				return err
+			}
+		case "type":
+			if n.types, err = typesOf(v, here); err != nil {
+				return err
+			}
+		case "enum":
+			if n.enum, ok = v.([]interface{}); !ok {
+				return fmt.Errorf("%s must be an array", here)
+			}
+		case "const":
+			n.constant, n.hasConst = v, true
+		case "properties", "patternProperties":
+			properties, ok := v.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%s must be an object", here)
+			}
+			for name, property := range properties {
+				compiled, err := c.compile(property, here+"/"+name)
+				if err != nil {
+					return err
+				}
+				if keyword == "properties" {
+					if n.properties == nil {
+						n.properties = map[string]*node{}
+					}
+					n.properties[name] = compiled
+					continue
+				}
+				pattern, err := regexp.Compile(name)
+				if err != nil {
+					return fmt.Errorf("%s: invalid pattern %q", here, name)
+				}
+				if n.patterns == nil {
+					n.patterns = map[*regexp.Regexp]*node{}
+				}
+				n.patterns[pattern] = compiled
+			}
+		case "additionalProperties":
+			n.additional, err = c.compile(v, here)
+		case "required":
+			if n.required, err = stringsOf(v, here); err != nil {
+				return err
+			}
+		case "items":
+			n.items, err = c.compile(v, here)
+		case "uniqueItems":
+			n.uniqueItems, _ = v.(bool)
+		case "minProperties", "maxProperties", "minItems", "maxItems", "minLength", "maxLength":
+			f, isNumber := v.(float64)
+			if !isNumber || f < 0 || f != math.Trunc(f) {
+				return fmt.Errorf("%s must be a non-negative integer", here)
+			}
+			*n.limit(keyword) = int(f)
+		case "pattern":
+			pattern, _ := v.(string)
+			if n.pattern, err = regexp.Compile(pattern); err != nil {
+				return fmt.Errorf("%s: invalid pattern %q", here, pattern)
+			}
+		case "minimum", "maximum", "exclusiveMinimum", "exclusiveMaximum", "multipleOf":
+			f, isNumber := v.(float64)
+			if !isNumber || keyword == "multipleOf" && f <= 0 {
+				return fmt.Errorf("%s must be a number", here)
+			}
+			*n.bound(keyword) = &f
+		case "allOf", "anyOf", "oneOf":
+			schemas, ok := v.([]interface{})
+			if !ok || len(schemas) == 0 {
+				return fmt.Errorf("%s must be a non-empty array", here)
+			}
+			compiled := make([]*node, len(schemas))
+			for i, s := range schemas {
+				if compiled[i], err = c.compile(s, here+"/"+strconv.Itoa(i)); err != nil {
+					return err
+				}
+			}
+			switch keyword {
+			case "allOf":
+				n.allOf = compiled
+			case "anyOf":
+				n.anyOf = compiled
+			default:
+				n.oneOf = compiled
+			}
+		case "not":
+			n.not, err = c.compile(v, here)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// limit is the field for a size keyword.
+func (n *node) limit(keyword string) *int {
+	switch keyword {
+	case "minProperties":
+		return &n.minProperties
+	case "maxProperties":
+		return &n.maxProperties
+	case "minItems":
+		return &n.minItems
+	case "maxItems":
+		return &n.maxItems
+	case "minLength":
+		return &n.minLength
+	default:
+		return &n.maxLength
+	}
+}
+
+// bound is the field for a numeric keyword.
+func (n *node) bound(keyword string) **float64 {
+	switch keyword {
+	case "minimum":
+		return &n.minimum
+	case "maximum":
+		return &n.maximum
+	case "exclusiveMinimum":
+		return &n.exclusiveMinimum
+	case "exclusiveMaximum":
+		return &n.exclusiveMaximum
+	default:
+		return &n.multipleOf
+	}
+}
+
+// ref compiles the schema a $ref points to, only references within the document are supported.
+func (c *compiler) ref(pointer string, at string) (n *node, err error) {
+	if n, ok := c.refs[pointer]; ok {
+		return n, nil
+	}
+	if pointer != "#" && !strings.HasPrefix(pointer, "#/") {
+		return nil, fmt.Errorf("%s: only references within the schema, #/..., are supported", at)
+	}
+
+	target := c.document
+	for _, token := range strings.Split(strings.TrimPrefix(pointer, "#"), "/")[1:] {
+		token = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+		switch v := target.(type) {
+		case map[string]interface{}:
+			target = v[token]
+		case []interface{}:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, fmt.Errorf("%s: %s is not in the schema", at, pointer)
+			}
+			target = v[i]
+		default:
+			target = nil
+		}
+		if target == nil {
+			return nil, fmt.Errorf("%s: %s is not in the schema", at, pointer)
+		}
+	}
+
+	// Registered before it's compiled, for schemas that refer to themselves
+	n = &node{}
+	c.refs[pointer] = n
+
+	return n, c.compileInto(n, target, pointer)
+}
+
+// checkCycles turns away $refs that lead back to themselves without going into the value, through properties,
+// items and the like, as validating would follow them forever.
+func (c *compiler) checkCycles(root *node) error {
+	// Every node, then each one's nodes that check the same value followed, looking for one that's already being
+	// followed
+	var nodes []*node
+	seen := map[*node]bool{}
+	var collect func(n *node)
+	collect = func(n *node) {
+		if n == nil || seen[n] {
+			return
+		}
+		seen[n] = true
+		nodes = append(nodes, n)
+		for _, s := range append(n.sameValue(), n.additional, n.items) {
+			collect(s)
+		}
+		for _, s := range n.properties {
+			collect(s)
+		}
+		for _, s := range n.patterns {
+			collect(s)
+		}
+	}
+	collect(root)
+
+	following, followed := map[*node]bool{}, map[*node]bool{}
+	var follow func(n *node) error
+	follow = func(n *node) error {
+		if n == nil || followed[n] {
+			return nil
+		}
+		if following[n] {
+			for pointer, ref := range c.refs {
+				if ref == n {
+					return fmt.Errorf("%s: $ref leads back to itself without going into the value", pointer)
+				}
+			}
+			return fmt.Errorf("#: $ref leads back to itself without going into the value")
+		}
+		following[n] = true
+		for _, s := range n.sameValue() {
+			if err := follow(s); err != nil {
+				return err
+			}
+		}
+		following[n], followed[n] = false, true
+		return nil
+	}
+	for _, n := range nodes {
+		if err := follow(n); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sameValue is the schemas that check the value n does, rather than something in it.
+func (n *node) sameValue() (schemas []*node) {
+	schemas = append([]*node{n.ref, n.not}, n.allOf...)
+	return append(append(schemas, n.anyOf...), n.oneOf...)
+}
+
+func typesOf(v interface{}, at string) (types []string, err error) {
+	if s, ok := v.(string); ok {
+		types = []string{s}
+	} else if types, err = stringsOf(v, at); err != nil {
+		return nil, err
+	}
+	for _, t := range types {
+		if !jsonTypes[t] {
+			return nil, fmt.Errorf("%s: unknown type %q", at, t)
+		}
+	}
+
+	return types, nil
+}
+
+func stringsOf(v interface{}, at string) (strs []string, err error) {
+	values, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must be an array of strings", at)
+	}
+	for _, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s must be an array of strings", at)
+		}
+		strs = append(strs, s)
+	}
+
+	return strs, nil
+}
+
+// validate appends what's wrong with value, at path, to problems.
+func (n *node) validate(value interface{}, path string, problems []string) []string {
+	if n.always != nil {
+		if !*n.always {
+			problems = append(problems, path+": is not allowed")
+		}
+		return problems
+	}
+	if n.ref != nil {
+		problems = n.ref.validate(value, path, problems)
+	}
+
+	if len(n.types) > 0 && !n.typed(value) {
+		return append(problems, fmt.Sprintf("%s: must be %s, not %s", path, strings.Join(n.types, " or "), typeOf(value)))
+	}
+	if len(n.enum) > 0 && !contains(n.enum, value) {
+		problems = append(problems, path+": must be one of the enum values")
+	}
+	if n.hasConst && !equal(n.constant, value) {
+		problems = append(problems, fmt.Sprintf("%s: must be %s", path, compact(n.constant)))
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		problems = n.validateObject(v, path, problems)
+	case []interface{}:
+		problems = n.validateArray(v, path, problems)
+	case string:
+		problems = n.validateString(v, path, problems)
+	case float64:
+		problems = n.validateNumber(v, path, problems)
+	}
+
+	for _, s := range n.allOf {
+		problems = s.validate(value, path, problems)
+	}
+	if len(n.anyOf) > 0 && n.matching(n.anyOf, value) == 0 {
+		problems = append(problems, path+": must match at least one of anyOf")
+	}
+	if matched := n.matching(n.oneOf, value); len(n.oneOf) > 0 && matched != 1 {
+		problems = append(problems, fmt.Sprintf("%s: must match exactly one of oneOf, matches %d", path, matched))
+	}
+	if n.not != nil && len(n.not.validate(value, path, nil)) == 0 {
+		problems = append(problems, path+": must not match not")
+	}
+
+	return problems
+}
+
+func (n *node) validateObject(object map[string]interface{}, path string, problems []string) []string {
+	for _, name := range n.required {
+		if _, ok := object[name]; !ok {
+			problems = append(problems, pathTo(path, name)+": is required")
+		}
+	}
+	if len(object) < n.minProperties {
+		problems = append(problems, fmt.Sprintf("%s: must have at least %d properties", path, n.minProperties))
+	}
+	if n.maxProperties >= 0 && len(object) > n.maxProperties {
+		problems = append(problems, fmt.Sprintf("%s: must have at most %d properties", path, n.maxProperties))
+	}
+
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names) // So problems are always in the same order
+	for _, name := range names {
+		at := pathTo(path, name)
+		matched := false
+		if property, ok := n.properties[name]; ok {
+			problems = property.validate(object[name], at, problems)
+			matched = true
+		}
+		for pattern, property := range n.patterns {
+			if pattern.MatchString(name) {
+				problems = property.validate(object[name], at, problems)
+				matched = true
+			}
+		}
+		if !matched && n.additional != nil {
+			problems = n.additional.validate(object[name], at, problems)
+		}
+	}
+
+	return problems
+}
+
+func (n *node) validateArray(array []interface{}, path string, problems []string) []string {
+	if len(array) < n.minItems {
+		problems = append(problems, fmt.Sprintf("%s: must have at least %d items", path, n.minItems))
+	}
+	if n.maxItems >= 0 && len(array) > n.maxItems {
+		problems = append(problems, fmt.Sprintf("%s: must have at most %d items", path, n.maxItems))
+	}
+	if n.uniqueItems {
+		for i := range array {
+			if contains(array[:i], array[i]) {
+				problems = append(problems, fmt.Sprintf("%s[%d]: must be unique", path, i))
+			}
+		}
+	}
+	if n.items != nil {
+		for i, item := range array {
+			problems = n.items.validate(item, fmt.Sprintf("%s[%d]", path, i), problems)
+		}
+	}
+
+	return problems
+}
+
+func (n *node) validateString(s string, path string, problems []string) []string {
+	length := utf8.RuneCountInString(s)
+	if length < n.minLength {
+		problems = append(problems, fmt.Sprintf("%s: must be at least %d characters", path, n.minLength))
+	}
+	if n.maxLength >= 0 && length > n.maxLength {
+		problems = append(problems, fmt.Sprintf("%s: must be at most %d characters", path, n.maxLength))
+	}
+	if n.pattern != nil && !n.pattern.MatchString(s) {
+		problems = append(problems, fmt.Sprintf("%s: must match %s", path, n.pattern.String()))
+	}
+
+	return problems
+}
+
+func (n *node) validateNumber(f float64, path string, problems []string) []string {
+	if n.minimum != nil && f < *n.minimum {
+		problems = append(problems, fmt.Sprintf("%s: must be at least %v", path, *n.minimum))
+	}
+	if n.maximum != nil && f > *n.maximum {
+		problems = append(problems, fmt.Sprintf("%s: must be at most %v", path, *n.maximum))
+	}
+	if n.exclusiveMinimum != nil && f <= *n.exclusiveMinimum {
+		problems = append(problems, fmt.Sprintf("%s: must be more than %v", path, *n.exclusiveMinimum))
+	}
+	if n.exclusiveMaximum != nil && f >= *n.exclusiveMaximum {
+		problems = append(problems, fmt.Sprintf("%s: must be less than %v", path, *n.exclusiveMaximum))
+	}
+	if n.multipleOf != nil {
+		if q := f / *n.multipleOf; math.Abs(q-math.Round(q)) > 1e-9 {
+			problems = append(problems, fmt.Sprintf("%s: must be a multiple of %v", path, *n.multipleOf))
+		}
+	}
+
+	return problems
+}
+
+// matching is how many of schemas value matches.
+func (n *node) matching(schemas []*node, value interface{}) (matched int) {
+	for _, s := range schemas {
+		if len(s.validate(value, "", nil)) == 0 {
+			matched++
+		}
+	}
+
+	return matched
+}
+
+func (n *node) typed(value interface{}) bool {
+	actual := typeOf(value)
+	for _, t := range n.types {
+		if t == actual || t == "number" && actual == "integer" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func typeOf(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case float64:
+		if v == math.Trunc(v) && !math.IsInf(v, 0) {
+			return "integer"
+		}
+		return "number"
+	default:
+		return "string"
+	}
+}
+
+func contains(values []interface{}, value interface{}) bool {
+	for _, v := range values {
+		if equal(v, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func equal(a, b interface{}) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+func compact(value interface{}) string {
+	encoded, _ := json.Marshal(value)
+	return string(bytes.TrimSpace(encoded))
+}
+
+// pathTo is the JSONPath of a property, as the filter package has them.
+func pathTo(path string, name string) string {
+	for i, c := range name {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			return path + "[" + strconv.Quote(name) + "]"
+		}
+	}
+	if name == "" {
+		return path + `[""]`
+	}
+
+	return path + "." + name
+}
@@ -0,0 +1,290 @@
+package schema
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The registry holds the schemas writes to each stream are validated against. A stream's schemas are versioned,
+// registering one adds a version, and versions are never changed or removed, messages record the version they were
+// validated against and it has to stay what it was. Writes are validated against the latest version unless they ask
+// for another, a stream without any schemas isn't validated.
+//
+// Schemas live in a directory, a directory per stream holding a file per version, <stream>/<version>.json.
+
+// Errors from the registry.
+var (
+	ErrInvalidStream  = errors.New("schemas are for named streams, without slashes, or dots at the start")
+	ErrUnknownVersion = errors.New("no such schema version")
+)
+
+// Registry is a directory of versioned schemas, by stream.
+type Registry struct {
+	dir      string
+	mu       sync.Mutex
+	versions map[string][]int           // Each stream's versions, oldest first, loaded the first time it's used
+	compiled map[string]map[int]*Schema // Compiled versions, by stream
+}
+
+// New creates a Registry backed by dir, the directory is created when the first schema is registered.
+func New(dir string) *Registry {
+	return &Registry{dir: dir, versions: map[string][]int{}, compiled: map[string]map[int]*Schema{}}
+}
+
+// Register adds a schema for a stream as its next version, returning the version. A schema the same as the latest
+// version is that version, nothing is added.
+func (r *Registry) Register(stream string, document []byte) (version int, added bool, err error) {
+	if !validStream(stream) {
+		return 0, false, ErrInvalidStream
+	}
+	schema, err := Compile(document)
+	if err != nil {
+		return 0, false, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	versions, err := r.load(stream)
+	if err != nil {
+		return 0, false, err
+	}
+	if len(versions) > 0 {
+		latest := versions[len(versions)-1]
+		current, err := ioutil.ReadFile(r.fileName(stream, latest))
+		if err != nil {
+			return 0, false, err
+		}
+		if bytes.Equal(bytes.TrimSpace(current), bytes.TrimSpace(document)) {
+			return latest, false, nil
+		}
+		version = latest
+	}
+	version++
+
+	if err = writeFile(r.fileName(stream, version), document); err != nil {
+		return 0, false, err
+	}
+	r.versions[stream] = append(versions, version)
+	r.compiledFor(stream)[version] = schema
+
+	return version, true, nil
+}
+
+// Import adds a version of a stream's schema as it is on another node, so replicas validate as it does. A version
+// that's already there is left as it is.
+func (r *Registry) Import(stream string, version int, document []byte) (err error) {
+	if !validStream(stream) {
+		return ErrInvalidStream
+	}
+	if version <= 0 {
+		return ErrUnknownVersion
+	}
+	schema, err := Compile(document)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	versions, err := r.load(stream)
+	if err != nil {
+		return err
+	}
+	i := sort.SearchInts(versions, version)
+	if i < len(versions) && versions[i] == version {
+		return nil
+	}
+	if err = writeFile(r.fileName(stream, version), document); err != nil {
+		return err
+	}
+	versions = append(versions[:i:i], append([]int{version}, versions[i:]...)...)
+	r.versions[stream] = versions
+	r.compiledFor(stream)[version] = schema
+
+	return nil
+}
+
+// Count is how many versions there are, of every stream's schemas. Versions are only ever added, so two registries
+// with the same count, one a copy of the other, have the same schemas.
+func (r *Registry) Count() (count int, err error) {
+	streams, err := r.Streams()
+	for _, versions := range streams {
+		count += len(versions)
+	}
+
+	return count, err
+}
+
+// Versions are a stream's versions, oldest first, none if it has no schemas.
+func (r *Registry) Versions(stream string) (versions []int, err error) {
+	if !validStream(stream) {
+		return nil, ErrInvalidStream
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	versions, err = r.load(stream)
+	return append([]int{}, versions...), err
+}
+
+// Streams are the streams with schemas, with their versions.
+func (r *Registry) Streams() (streams map[string][]int, err error) {
+	streams = map[string][]int{}
+	entries, err := ioutil.ReadDir(r.dir)
+	if os.IsNotExist(err) {
+		return streams, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !validStream(entry.Name()) {
+			continue
+		}
+		versions, err := r.Versions(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		if len(versions) > 0 {
+			streams[entry.Name()] = versions
+		}
+	}
+
+	return streams, nil
+}
+
+// Document is a version of a stream's schema as it was registered, 0 for the latest version.
+func (r *Registry) Document(stream string, version int) (document []byte, err error) {
+	r.mu.Lock()
+	version, err = r.version(stream, version)
+	r.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadFile(r.fileName(stream, version))
+}
+
+// Validate checks a body written to a stream against a version of its schema, 0 for the latest. It returns the
+// version it was checked against, 0 if the stream has no schemas, and what's wrong with the body, nothing if it's
+// valid.
+func (r *Registry) Validate(stream string, version int, body []byte) (checked int, problems []string, err error) {
+	if !validStream(stream) && version == 0 {
+		return 0, nil, nil // A stream that can't have schemas
+	}
+	if !validStream(stream) {
+		return 0, nil, ErrInvalidStream
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if versions, err := r.load(stream); err != nil || len(versions) == 0 && version == 0 {
+		return 0, nil, err
+	}
+	if checked, err = r.version(stream, version); err != nil {
+		return 0, nil, err
+	}
+	schema, ok := r.compiledFor(stream)[checked]
+	if !ok {
+		document, err := ioutil.ReadFile(r.fileName(stream, checked))
+		if err != nil {
+			return 0, nil, err
+		}
+		if schema, err = Compile(document); err != nil {
+			return 0, nil, fmt.Errorf("Schema %s version %d no longer compiles: %s", stream, checked, err.Error())
+		}
+		r.compiledFor(stream)[checked] = schema
+	}
+
+	return checked, schema.Validate(body), nil
+}
+
+// version is a version of a stream's schema that's there, the latest for 0.
+func (r *Registry) version(stream string, version int) (int, error) {
+	if !validStream(stream) {
+		return 0, ErrInvalidStream
+	}
+	versions, err := r.load(stream)
+	if err != nil {
+		return 0, err
+	}
+	if version == 0 && len(versions) > 0 {
+		return versions[len(versions)-1], nil
+	}
+	if i := sort.SearchInts(versions, version); i < len(versions) && versions[i] == version {
+		return version, nil
+	}
+
+	return 0, ErrUnknownVersion
+}
+
+// load is a stream's versions, read from its directory the first time they're needed.
+func (r *Registry) load(stream string) (versions []int, err error) {
+	if versions, ok := r.versions[stream]; ok {
+		return versions, nil
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(r.dir, stream))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		version, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), ".json"))
+		if err == nil && version > 0 && strings.HasSuffix(entry.Name(), ".json") {
+			versions = append(versions, version)
+		}
+	}
+	sort.Ints(versions)
+	r.versions[stream] = versions
+
+	return versions, nil
+}
+
+func (r *Registry) compiledFor(stream string) map[int]*Schema {
+	if r.compiled[stream] == nil {
+		r.compiled[stream] = map[int]*Schema{}
+	}
+
+	return r.compiled[stream]
+}
+
+func (r *Registry) fileName(stream string, version int) string {
+	return filepath.Join(r.dir, stream, strconv.Itoa(version)+".json")
+}
+
+func validStream(stream string) bool {
+	return stream != "" && !strings.ContainsAny(stream, `/\`) && !strings.HasPrefix(stream, ".")
+}
+
+// writeFile writes then renames, so a crash never leaves a partial schema behind.
+func writeFile(name string, contents []byte) (err error) {
+	if err = os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return err
+	}
+	tmp := name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(contents); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+
+	return err
+}
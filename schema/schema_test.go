@@ -0,0 +1,169 @@
+package schema
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+const orderSchema = `{
+	"type": "object",
+	"required": ["id", "total", "items"],
+	"additionalProperties": false,
+	"properties": {
+		"id": {"type": "string", "pattern": "^o-[0-9]+$"},
+		"total": {"type": "number", "minimum": 0, "multipleOf": 0.01},
+		"status": {"enum": ["new", "paid"]},
+		"items": {"type": "array", "minItems": 1, "items": {"$ref": "#/$defs/item"}},
+		"first-name": {"type": "string", "maxLength": 3},
+		"note": {"anyOf": [{"type": "null"}, {"type": "string"}]}
+	},
+	"$defs": {
+		"item": {"type": "object", "required": ["sku"], "properties": {"sku": {"type": "string"},
+			"quantity": {"type": "integer", "exclusiveMinimum": 0}}}
+	}
+}`
+
+func TestValidate(t *testing.T) {
+	schema, err := Compile([]byte(orderSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for body, expected := range map[string][]string{
+		`{"id": "o-1", "total": 12.5, "items": [{"sku": "A", "quantity": 2}], "note": null}`: nil,
+		`{"id": "x", "total": -1, "items": []}`: {
+			"$.id: must match ^o-[0-9]+$",
+			"$.items: must have at least 1 items",
+			"$.total: must be at least 0"},
+		`{"total": 1.005, "items": [{"quantity": 1.5}], "status": "lost", "extra": 1}`: {
+			"$.id: is required",
+			"$.extra: is not allowed",
+			"$.items[0].sku: is required",
+			"$.items[0].quantity: must be integer, not number",
+			"$.status: must be one of the enum values",
+			"$.total: must be a multiple of 0.01"},
+		`{"id": "o-1", "total": 1, "items": [{"sku": 1}], "first-name": "Ada Lovelace", "note": 3}`: {
+			`$["first-name"]: must be at most 3 characters`,
+			"$.items[0].sku: must be string, not integer",
+			"$.note: must match at least one of anyOf"},
+		`[1, 2]`:   {"$: must be object, not array"},
+		`not json`: {"$: body is not JSON: invalid character 'o' in literal null (expecting 'u')"},
+	} {
+		if problems := schema.Validate([]byte(body)); !reflect.DeepEqual(problems, expected) {
+			t.Errorf("%s: expected %q, got %q", body, expected, problems)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, document := range []string{
+		`not json`,
+		`3`,
+		`{"type": "decimal"}`,
+		`{"required": "id"}`,
+		`{"minLength": -1}`,
+		`{"pattern": "("}`,
+		`{"$ref": "other.json#/a"}`,
+		`{"$ref": "#/$defs/missing"}`,
+		`{"anyOf": []}`,
+		// $refs back to themselves without going into the value, validating would follow them forever
+		`{"$ref": "#"}`,
+		`{"$defs": {"a": {"$ref": "#/$defs/a"}}, "$ref": "#/$defs/a"}`,
+		`{"$defs": {"a": {"allOf": [{"$ref": "#/$defs/b"}]}, "b": {"not": {"$ref": "#/$defs/a"}}},
+			"properties": {"x": {"$ref": "#/$defs/a"}}}`,
+		`{"anyOf": [{"type": "null"}, {"$ref": "#"}]}`,
+	} {
+		if _, err := Compile([]byte(document)); err == nil {
+			t.Errorf("Expected %s not to compile", document)
+		}
+	}
+
+	recursive := `{"type": "object", "properties": {"children": {"type": "array", "items": {"$ref": "#"}}}}`
+	schema, err := Compile([]byte(recursive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems := schema.Validate([]byte(`{"children": [{"children": [{"children": 1}]}]}`)); len(problems) != 1 {
+		t.Errorf("Expected one problem with the nested children, got %q", problems)
+	}
+	list := `{"$defs": {"list": {"anyOf": [{"type": "null"},
+		{"type": "object", "properties": {"next": {"$ref": "#/$defs/list"}}}]}}, "$ref": "#/$defs/list"}`
+	if schema, err = Compile([]byte(list)); err != nil {
+		t.Fatal(err)
+	}
+	if problems := schema.Validate([]byte(`{"next": {"next": {"next": null}}}`)); problems != nil {
+		t.Errorf("Expected the list to be valid, got %q", problems)
+	}
+	if problems := schema.Validate([]byte(`{"next": {"next": {"next": 1}}}`)); problems == nil {
+		t.Error("Expected a problem with the end of the list")
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schemas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	registry := New(dir)
+
+	version, problems, err := registry.Validate("orders", 0, []byte("anything"))
+	if version != 0 || problems != nil || err != nil {
+		t.Errorf("Expected a stream without schemas not to be validated, got %d %q %v", version, problems, err)
+	}
+	if _, _, err := registry.Register("../orders", []byte(`true`)); err != ErrInvalidStream {
+		t.Errorf("Expected an invalid stream, got %v", err)
+	}
+	for i, document := range []string{`{"type": "object"}`, `{"type": "object"}` + "\n", `{"type": "array"}`} {
+		version, added, err := registry.Register("orders", []byte(document))
+		if err != nil || version != []int{1, 1, 2}[i] || added != (i != 1) {
+			t.Errorf("Registering %d: got version %d, added %v, %v", i, version, added, err)
+		}
+	}
+
+	// A fresh registry reads them back from the directory
+	registry = New(dir)
+	if version, problems, _ := registry.Validate("orders", 0, []byte(`{}`)); version != 2 || len(problems) != 1 {
+		t.Errorf("Expected {} not to match the latest version, got %d %q", version, problems)
+	}
+	if version, problems, _ := registry.Validate("orders", 1, []byte(`{}`)); version != 1 || len(problems) != 0 {
+		t.Errorf("Expected {} to match version 1, got %d %q", version, problems)
+	}
+	if _, _, err := registry.Validate("orders", 3, []byte(`{}`)); err != ErrUnknownVersion {
+		t.Errorf("Expected an unknown version, got %v", err)
+	}
+	if _, _, err := registry.Validate("", 1, []byte(`{}`)); err != ErrInvalidStream {
+		t.Errorf("Expected no schemas without a stream, got %v", err)
+	}
+	if streams, err := registry.Streams(); err != nil || !reflect.DeepEqual(streams, map[string][]int{"orders": {1, 2}}) {
+		t.Errorf("Expected orders' versions, got %v %v", streams, err)
+	}
+	if document, err := registry.Document("orders", 1); err != nil || string(document) != `{"type": "object"}` {
+		t.Errorf("Expected version 1 as it was registered, got %s %v", document, err)
+	}
+
+	// A copy made by importing each version validates the same
+	copyDir, err := ioutil.TempDir("", "schemas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(copyDir)
+	copied := New(copyDir)
+	for _, version := range []int{2, 1, 2} {
+		document, _ := registry.Document("orders", version)
+		if err := copied.Import("orders", version, document); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count, err := copied.Count(); err != nil || count != 2 {
+		t.Errorf("Expected 2 versions in the copy, got %d %v", count, err)
+	}
+	if version, problems, _ := copied.Validate("orders", 0, []byte(`{}`)); version != 2 || len(problems) != 1 {
+		t.Errorf("Expected the copy's latest version to be 2, got %d %q", version, problems)
+	}
+	if err := copied.Import("orders", 3, []byte(`{"type": `)); err == nil {
+		t.Error("Expected a schema that doesn't compile not to be imported")
+	}
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/saem/afterme/auth"
+	"github.com/saem/afterme/data2"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// Authentication, when the config has an auth section, see the auth package. HTTP requests present a token as
+// Authorization: Bearer <token> or in an X-Api-Key header, gRPC calls in authorization metadata, appends in the
+// binary protocol in their token attribute, and RESP connections with AUTH. The credentials file is read again on
+// SIGHUP. Each message records the principal whose token it was written with.
+
+// Whether requests need a token, they can do anything they like without the auth section
+var authEnabled = false
+
+// The credentials tokens are checked against, from the file as it was last read
+var authCredentials atomic.Value // *auth.Credentials
+
+// startAuth reads the credentials file, and reads it again on SIGHUP.
+func startAuth(path string) error {
+	load := func() error {
+		credentials, err := auth.Load(path)
+		if err == nil {
+			authCredentials.Store(credentials)
+		}
+		return err
+	}
+	if err := load(); err != nil {
+		return err
+	}
+	authEnabled = true
+	reloadOnHangUp("the credentials", load)
+
+	return nil
+}
+
+// authenticate finds the principal a token belongs to, without auth there's none and that's fine.
+func authenticate(token string) (principal *auth.Principal, ok bool) {
+	if !authEnabled {
+		return nil, true
+	}
+
+	return authCredentials.Load().(*auth.Credentials).Authenticate(token)
+}
+
+// allowed reports whether principal can do operation on stream, anyone can do anything without auth.
+func allowed(principal *auth.Principal, operation string, stream string) bool {
+	return !authEnabled || principal.Can(operation, stream)
+}
+
+// allowedAny reports whether principal can do operation on any stream at all.
+func allowedAny(principal *auth.Principal, operation string) bool {
+	return !authEnabled || principal.CanAny(operation)
+}
+
+// permitted narrows matches to the messages in the streams principal can do operation on.
+func permitted(principal *auth.Principal, operation string, matches func(data2.Message) bool) func(data2.Message) bool {
+	if allowed(principal, operation, auth.AllStreams) {
+		return matches
+	}
+
+	return func(m data2.Message) bool {
+		return principal.Can(operation, m.Attributes[data2.AttrStream]) && matches(m)
+	}
+}
+
+// operationVerbs are the operations, in denied's messages.
+var operationVerbs = map[string]string{auth.Append: "append to",
+	auth.Read:      "read",
+	auth.Subscribe: "subscribe to",
+	auth.Admin:     "administer",
+	auth.Status:    "see the status of"}
+
+// denied is why principal can't do operation on stream.
+func denied(principal *auth.Principal, operation string, stream string) string {
+	switch stream {
+	case "":
+		return fmt.Sprintf("%s can't %s messages that aren't in a stream", principal.Name, operationVerbs[operation])
+	case auth.AllStreams:
+		return fmt.Sprintf("%s can't %s every stream", principal.Name, operationVerbs[operation])
+	default:
+		return fmt.Sprintf("%s can't %s stream %s", principal.Name, operationVerbs[operation], stream)
+	}
+}
+
+// principalKey is the request context key of the principal a request was authenticated as.
+type principalKey struct{}
+
+// requestPrincipal is who made a request, nil without auth.
+func requestPrincipal(r *http.Request) *auth.Principal {
+	principal, _ := r.Context().Value(principalKey{}).(*auth.Principal)
+
+	return principal
+}
+
+// requestToken is the token a request presents.
+func requestToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+
+	return r.Header.Get("X-Api-Key")
+}
+
+// authHandler authenticates requests before handing them to next, refusing those without a valid token with a 401,
+// and those for routes the principal can't use with a 403.
+func authHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authEnabled || (statusRoute(r.URL.Path) && appServer.Config.Auth.PublicStatus) {
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		principal, ok := authenticate(requestToken(r))
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="afterme"`)
+			http.Error(w, "A valid token is required, as Authorization: Bearer <token> or X-Api-Key: <token>",
+				http.StatusUnauthorized)
+
+			return
+		}
+		if !routeAllowed(principal, r) {
+			http.Error(w, fmt.Sprintf("%s can't %s %s", principal.Name, r.Method, r.URL.Path), http.StatusForbidden)
+
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+	})
+}
+
+func statusRoute(path string) bool {
+	return path == "/status" || path == "/health" || path == "/metrics"
+}
+
+// routeAllowed reports whether principal can use the route a request is for. Those for a single stream's messages
+// or schemas are left to their handlers, which know the stream, the rest need the operation on every stream.
+func routeAllowed(principal *auth.Principal, r *http.Request) bool {
+	path := r.URL.Path
+	switch {
+	case path == "/message" || strings.HasPrefix(path, "/admin/schemas"):
+		return true
+	case path == "/messages":
+		return principal.CanAny(auth.Read)
+	case path == "/subscribe":
+		return principal.CanAny(auth.Subscribe)
+	case strings.HasPrefix(path, "/consumers") || strings.HasPrefix(path, "/groups"):
+		if r.Method == "DELETE" {
+			return principal.Can(auth.Admin, auth.AllStreams)
+		}
+		return principal.CanAny(auth.Subscribe) // A lease checks its stream itself
+	case statusRoute(path):
+		return principal.Can(auth.Status, auth.AllStreams)
+	case strings.HasPrefix(path, "/subjects/") || strings.HasPrefix(path, "/admin/") || strings.HasPrefix(path, "/raft/"):
+		return principal.Can(auth.Admin, auth.AllStreams)
+	default:
+		// The audit routes and /segments, they're about every message
+		return principal.Can(auth.Read, auth.AllStreams)
+	}
+}
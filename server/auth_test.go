@@ -0,0 +1,268 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/saem/afterme/resp"
+	"github.com/saem/afterme/wire"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	grpcstatus "google.golang.org/grpc/status"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sha256Hex(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// testCredentials turns on auth, billing's token being b-token, ops' o-token and workers' w-token. As Start does,
+// it's before there's anything to serve.
+func testCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	err := ioutil.WriteFile(path, []byte(`{
+		"billing": {"tokens": ["`+sha256Hex("b-token")+`"],
+			"permissions": {"invoices": ["append", "read", "subscribe"], "orders": ["read"]}},
+		"ops": {"tokens": ["`+sha256Hex("o-token")+`"], "permissions": {"*": ["append", "read", "admin", "status"]}},
+		"workers": {"tokens": ["`+sha256Hex("w-token")+`"],
+			"permissions": {"*": ["subscribe"]}}
+	}`), 0600)
+	if err == nil {
+		err = startAuth(path)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { authEnabled = false })
+}
+
+func TestAuth(t *testing.T) {
+	startTestApp(t)
+	testCredentials(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/message", messageHandler)
+	mux.HandleFunc("/messages", messagesHandler)
+	mux.HandleFunc("/tree_head", treeHeadHandler)
+	mux.HandleFunc("/admin/schemas/", schemasHandler)
+	mux.HandleFunc("/status", statusHandler)
+	server := httptest.NewServer(authHandler(mux))
+	defer server.Close()
+
+	do := func(method string, path string, token string, stream string, body string) (*http.Response, string) {
+		t.Helper()
+		r, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		if stream != "" {
+			r.Header.Set("X-Afterme-Stream", stream)
+		}
+		response, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		contents, _ := ioutil.ReadAll(response.Body)
+		return response, string(contents)
+	}
+	expect := func(expected int, method string, path string, token string, stream string, body string) *http.Response {
+		t.Helper()
+		response, contents := do(method, path, token, stream, body)
+		if response.StatusCode != expected {
+			t.Fatalf("Expected %s %s to be a %d, got %d: %s", method, path, expected, response.StatusCode, contents)
+		}
+		return response
+	}
+
+	response := expect(http.StatusUnauthorized, "POST", "/message", "", "invoices", "i-1")
+	if response.Header.Get("WWW-Authenticate") == "" {
+		t.Fatal("Expected a 401 to say how to authenticate")
+	}
+	expect(http.StatusUnauthorized, "POST", "/message", "wrong", "invoices", "i-1")
+	expect(http.StatusOK, "POST", "/message", "b-token", "invoices", "i-1")
+	expect(http.StatusForbidden, "POST", "/message", "b-token", "orders", "o-1")
+	expect(http.StatusForbidden, "POST", "/message", "b-token", "", "none")
+	expect(http.StatusOK, "POST", "/message", "o-token", "orders", "o-1")
+	expect(http.StatusOK, "POST", "/message", "o-token", "payroll", "p-1")
+
+	response = expect(http.StatusOK, "GET", "/message?sequence=1", "b-token", "", "")
+	if principal := response.Header.Get("X-Afterme-Principal"); principal != "billing" {
+		t.Fatalf("Expected the message to record billing wrote it, got %q", principal)
+	}
+	expect(http.StatusOK, "GET", "/message?sequence=2", "b-token", "", "")
+	// A message in a stream billing can't read isn't there as far as billing's concerned
+	if response, contents := do("GET", "/message?sequence=3", "b-token", "", ""); response.StatusCode !=
+		http.StatusNotFound || strings.Contains(contents, "payroll") {
+		t.Fatalf("Expected a message billing can't read to be a 404 that doesn't name its stream, got %d: %s",
+			response.StatusCode, contents)
+	}
+	if _, contents := do("GET", "/messages", "b-token", "", ""); !strings.Contains(contents, "o-1") ||
+		strings.Contains(contents, "p-1") {
+		t.Fatalf("Expected only the streams billing can read, got %s", contents)
+	}
+
+	expect(http.StatusForbidden, "GET", "/tree_head", "b-token", "", "")
+	expect(http.StatusOK, "GET", "/tree_head", "o-token", "", "")
+	expect(http.StatusForbidden, "POST", "/admin/schemas/invoices", "b-token", "", `{"type": "object"}`)
+	expect(http.StatusForbidden, "GET", "/status", "b-token", "", "")
+	expect(http.StatusUnauthorized, "GET", "/status", "", "", "")
+	appServer.Config.Auth.PublicStatus = true
+	expect(http.StatusOK, "GET", "/status", "", "", "")
+
+	// The binary protocol's appends have their token in an attribute
+	for token, code := range map[string]uint16{"": http.StatusUnauthorized, "b-token": http.StatusForbidden} {
+		principal, _ := authenticate(token)
+		f := requestAppend(wire.Append{Id: 1, Body: []byte("o-2"), Attributes: map[string]string{"stream": "orders",
+			wire.TokenAttribute: token}}, "", principal)
+		if f.failed == nil || f.failed.Code != code {
+			t.Fatalf("Expected an append with token %q to be a %d, got %+v", token, code, f.failed)
+		}
+	}
+}
+
+func TestAppendsAuth(t *testing.T) {
+	startTestApp(t)
+	testCredentials(t)
+	client, conn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		serveAppends(conn)
+		close(done)
+	}()
+	defer func() {
+		client.Close()
+		<-done
+	}()
+
+	// The bodies of refused appends are skipped, and the appends after them carry on
+	go func() {
+		writer := bufio.NewWriter(client)
+		writer.WriteString(wire.Hello)
+		big := make([]byte, 10*1024*1024)
+		wire.WriteAppend(writer, wire.Append{Id: 1, Attributes: map[string]string{"stream": "orders"}, Body: big})
+		wire.WriteAppend(writer, wire.Append{Id: 2, Body: big, Attributes: map[string]string{"stream": "orders",
+			wire.TokenAttribute: "b-token"}})
+		wire.WriteAppend(writer, wire.Append{Id: 3, Body: []byte("o-1"), Attributes: map[string]string{
+			"stream": "orders", wire.TokenAttribute: "o-token"}})
+		writer.Flush()
+	}()
+
+	// Errors are acked along with durable appends, so they can come either side of an assigned ack
+	reader := bufio.NewReader(client)
+	acks := map[wire.Ack]bool{}
+	for i := 0; i < 4; i++ {
+		ack, err := wire.ReadAck(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		acks[ack] = true
+	}
+	expected := map[wire.Ack]bool{
+		{Kind: wire.FrameError, Id: 1, Code: http.StatusUnauthorized, Message: "A valid token is required"}:          true,
+		{Kind: wire.FrameError, Id: 2, Code: http.StatusForbidden, Message: "billing can't append to stream orders"}: true,
+		{Kind: wire.FrameAssigned, Id: 3, Sequence: 1}:                                                               true,
+		{Kind: wire.FrameDurable, Id: 3, Sequence: 1}:                                                                true,
+	}
+	if !reflect.DeepEqual(acks, expected) {
+		t.Fatalf("Expected acks %v, got %v", expected, acks)
+	}
+}
+
+func TestConsumersAndGroupsAuth(t *testing.T) {
+	testCredentials(t)
+	server := httpTestServer(t)
+	as := func(token string) http.Header { return http.Header{"Authorization": {"Bearer " + token}} }
+	for _, stream := range []string{"invoices", "orders"} {
+		header := as("o-token")
+		header.Set("X-Afterme-Stream", stream)
+		testRequest(t, http.StatusOK, "POST", server.URL+"/message", header, stream)
+	}
+
+	// Committing a consumer's offset needs subscribe on its stream, set with its first offset
+	consumer := func(expected int, token string, path string) {
+		t.Helper()
+		testRequest(t, expected, "POST", server.URL+"/consumers/"+path, as(token), "1")
+	}
+	consumer(http.StatusOK, "w-token", "all/offset")
+	consumer(http.StatusForbidden, "b-token", "all/offset")
+	consumer(http.StatusForbidden, "b-token", "all/offset?stream=invoices")
+	consumer(http.StatusForbidden, "b-token", "billing/offset")
+	consumer(http.StatusForbidden, "b-token", "billing/offset?stream=orders")
+	consumer(http.StatusOK, "b-token", "billing/offset?stream=invoices")
+	consumer(http.StatusOK, "b-token", "billing/offset")
+	consumer(http.StatusConflict, "w-token", "billing/offset?stream=orders")
+	consumer(http.StatusOK, "w-token", "billing/offset")
+	_, body := testRequest(t, http.StatusOK, "GET", server.URL+"/consumers/billing", as("w-token"), "")
+	if !strings.Contains(body, `"stream":"invoices"`) {
+		t.Fatalf("Expected billing's consumer to be for invoices, got %s", body)
+	}
+
+	// And acking or releasing a worker group's leases needs subscribe on the group's stream, as leasing does
+	group := func(expected int, token string, path string) {
+		t.Helper()
+		testRequest(t, expected, "POST", server.URL+"/groups/"+path, as(token), "")
+	}
+	group(http.StatusOK, "w-token", "all/lease?worker=w1")
+	group(http.StatusForbidden, "b-token", "all/ack?worker=w1&sequence=1")
+	group(http.StatusForbidden, "b-token", "all/release?worker=w1&sequence=1")
+	group(http.StatusOK, "w-token", "all/ack?worker=w1&sequence=1")
+	group(http.StatusOK, "b-token", "billing/lease?worker=w1&stream=invoices")
+	group(http.StatusOK, "b-token", "billing/ack?worker=w1&sequence=1")
+	group(http.StatusConflict, "b-token", "none/ack?worker=w1&sequence=1")
+}
+
+func TestRESPAuth(t *testing.T) {
+	startTestApp(t)
+	testCredentials(t)
+	dial := respTestServer(t)
+	c := dial()
+
+	c.do(resp.Error("NOAUTH Authentication required."), "XLEN", "invoices")
+	c.do(resp.Error("WRONGPASS invalid username-password pair or user is disabled."), "AUTH", "wrong")
+	c.do(resp.Error("WRONGPASS invalid username-password pair or user is disabled."), "AUTH", "ops", "b-token")
+	c.do("OK", "AUTH", "billing", "b-token")
+	c.do("1-0", "XADD", "invoices", "*", "total", "12")
+	c.do(resp.Error("NOPERM billing can't append to stream orders"), "XADD", "orders", "*", "total", "7")
+	c.do(int64(0), "XLEN", "orders")
+	c.do(resp.Error("NOPERM billing can't read stream payroll"), "XRANGE", "payroll", "-", "+")
+	c.do(resp.Error("NOPERM billing can't subscribe to stream orders"),
+		"XREAD", "BLOCK", "10", "STREAMS", "orders", "$")
+}
+
+func TestGRPCAuth(t *testing.T) {
+	startTestApp(t)
+	testCredentials(t)
+	conn := grpcTestServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	request := &appendRequest{Id: 1, Body: []byte(`{"total": 1}`), Attributes: map[string]string{"stream": "orders"}}
+	response := appendResponse{}
+	err := conn.Invoke(ctx, "/afterme.v1.Afterme/Append", request, &response)
+	if grpcstatus.Code(err) != codes.Unauthenticated {
+		t.Fatalf("Expected an append without a token to be unauthenticated, got %v", err)
+	}
+	billing := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer b-token")
+	err = conn.Invoke(billing, "/afterme.v1.Afterme/Append", request, &response)
+	if grpcstatus.Code(err) != codes.PermissionDenied {
+		t.Fatalf("Expected billing's append to orders to be denied, got %v", err)
+	}
+	ops := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer o-token")
+	if err = conn.Invoke(ops, "/afterme.v1.Afterme/Append", request, &response); err != nil {
+		t.Fatal(err)
+	}
+	err = conn.Invoke(billing, "/afterme.v1.Afterme/Status", &statusRequest{}, &statusResponse{})
+	if grpcstatus.Code(err) != codes.PermissionDenied {
+		t.Fatalf("Expected billing to be denied the status, got %v", err)
+	}
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/saem/afterme/app"
+	"github.com/saem/afterme/auth"
+	"github.com/saem/afterme/data"
+	"github.com/saem/afterme/data2"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Consumers, see app/consumers.go. A consumer subscribes with GET /subscribe?consumer=<name>, processes what it's
+// sent, and commits how far it's got with POST /consumers/<name>/offset. The next time it subscribes it carries on
+// from there. A consumer is for a stream, set with ?stream= on its first offset, every stream if it's not, and only
+// those who can subscribe to its stream can commit its offset.
+
+// subscribePoll is how often a subscription checks for newly committed messages, on top of being woken when this
+// node syncs, so cluster commits are picked up too.
+const subscribePoll = time.Second
+
+// The consumers, GET /consumers, GET or DELETE /consumers/<name>, and POST /consumers/<name>/offset with the
+// sequence of the last message processed in the body, or ?sequence=
+func consumersHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/consumers"), "/")
+	name, action := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		name, action = path[:i], path[i+1:]
+	}
+
+	switch {
+	case name == "" && r.Method == "GET":
+		writeJSON(w, appServer.Consumers())
+	case name != "" && action == "" && r.Method == "GET":
+		if offset, found := appServer.Consumer(name); found {
+			writeJSON(w, offset)
+		} else {
+			http.NotFound(w, r)
+		}
+	case name != "" && action == "" && r.Method == "DELETE":
+		found, err := appServer.DeleteConsumer(name)
+		switch {
+		case err != nil:
+			http.Error(w, fmt.Sprintf("Could not delete consumer: %s", err.Error()), http.StatusInternalServerError)
+		case !found:
+			http.NotFound(w, r)
+		default:
+			fmt.Fprintf(w, "Successfully deleted consumer: %s", name)
+		}
+	case name != "" && action == "offset" && r.Method == "POST":
+		commitOffset(w, r, name)
+	default:
+		http.Error(w, "GET /consumers[/<name>], DELETE /consumers/<name> or POST /consumers/<name>/offset",
+			http.StatusMethodNotAllowed)
+	}
+}
+
+func commitOffset(w http.ResponseWriter, r *http.Request, name string) {
+	value := r.URL.Query().Get("sequence")
+	if value == "" {
+		body, _ := ioutil.ReadAll(io.LimitReader(r.Body, 64))
+		value = strings.TrimSpace(string(body))
+	}
+	sequence, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		http.Error(w, "The sequence of the last message processed is required, in the body or ?sequence=",
+			http.StatusBadRequest)
+
+		return
+	}
+
+	stream := r.URL.Query().Get("stream")
+	principal, needed := requestPrincipal(r), consumerStream(name, stream)
+	if !allowed(principal, auth.Subscribe, needed) {
+		http.Error(w, denied(principal, auth.Subscribe, needed), http.StatusForbidden)
+
+		return
+	}
+
+	offset, err := appServer.CommitOffset(name, stream, data.Sequence(sequence))
+	switch err {
+	case nil:
+		writeJSON(w, offset)
+	case app.ErrInvalidConsumer, app.ErrUncommittedOffset:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case app.ErrConsumerStream:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, fmt.Sprintf("Could not commit offset: %s", err.Error()), http.StatusInternalServerError)
+	}
+}
+
+// consumerStream is the stream committing consumer's offset needs subscribe on, the consumer's, or stream if it's a
+// new consumer, every stream if that's empty.
+func consumerStream(consumer string, stream string) string {
+	if existing, found := appServer.Consumer(consumer); found {
+		stream = existing.Stream
+	}
+	if stream == "" {
+		stream = auth.AllStreams
+	}
+
+	return stream
+}
+
+// A subscription, GET /subscribe?consumer=<name>, streams committed messages in the log file format as they're
+// committed, until the client goes away. It starts just after the consumer's offset, from the start of the log for
+// a consumer that's yet to commit one, or from ?from= if it's given. Offsets aren't committed for the consumer, it
+// does that itself once it's processed what it's been sent.
+//
+// With ?filter= only the messages that match it are sent (see the filter package). Once the consumer has committed
+// the last message it was sent, its offset is moved on past the messages that didn't match after it, so it doesn't
+// scan them again the next time it subscribes. With ?cloudevents=structured they're structured mode CloudEvents,
+// one a line. With auth, only the messages in the streams the principal can subscribe to are sent, as if filtered.
+func subscribeHandler(w http.ResponseWriter, r *http.Request) {
+	matches, err := filterParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+	principal := requestPrincipal(r)
+	matches = permitted(principal, auth.Subscribe, matches)
+	filtered := r.URL.Query().Get("filter") != "" || !allowed(principal, auth.Subscribe, auth.AllStreams)
+	out, err := newMessageWriter(w, r, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+	from, err := sequenceParam(r, "from", 1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+	consumer := r.URL.Query().Get("consumer")
+	if offset, found := appServer.Consumer(consumer); found && r.URL.Query().Get("from") == "" {
+		from = offset.Offset + 1
+	}
+
+	out.start()
+	w.Header().Set("X-Afterme-From", strconv.FormatUint(uint64(from), 10))
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	committer := consumer // Its offset isn't moved on by those who can't commit it
+	if !allowed(principal, auth.Subscribe, consumerStream(consumer, "")) {
+		committer = ""
+	}
+	err = subscribe(r.Context(), committer, from, matches, filtered, out.write, func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+	if err != nil {
+		appServer.Logger.Printf("Subscription for %q stopped: %s", consumer, err.Error())
+	}
+}
+
+// subscribe sends committed messages that match, from from on, as they're committed, until ctx is done or sending
+// fails. sent is called after each batch of them. A filtered subscription moves consumer's offset on past messages
+// that don't match, as subscribeHandler says.
+func subscribe(ctx context.Context, consumer string, from data.Sequence, matches func(data2.Message) bool,
+	filtered bool, send func(data2.Message) error, sent func()) (err error) {
+	poll := time.NewTicker(subscribePoll)
+	defer poll.Stop()
+
+	last := from - 1 // Last message sent, or where the subscription started
+	for {
+		changed := appServer.SyncedChanged()
+		to := appServer.Committed()
+		if from <= to {
+			err = app.ReadLog(appServer.DataDir, from, func(m data2.Message) error {
+				if m.Sequence > to {
+					return app.ErrStopReading
+				}
+				m, err := app.Deliverable(appServer.Keys, m)
+				if err == nil && matches(m) {
+					err = send(m)
+					last = m.Sequence
+				}
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("reading from %d: %s", from, err.Error())
+			}
+			from = to + 1
+			sent()
+		}
+		offset, found := appServer.Consumer(consumer)
+		if found && filtered && offset.Offset >= last && offset.Offset < from-1 {
+			appServer.CommitOffset(consumer, "", from-1)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changed:
+		case <-poll.C:
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/saem/afterme/app"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConsumers(t *testing.T) {
+	server := httpTestServer(t)
+	for _, body := range []string{"a\n", "b\n", "c\n"} {
+		testRequest(t, http.StatusOK, "POST", server.URL+"/message", nil, body)
+	}
+
+	testRequest(t, http.StatusOK, "POST", server.URL+"/consumers/reader/offset", nil, "2")
+	_, body := testRequest(t, http.StatusOK, "GET", server.URL+"/consumers/reader", nil, "")
+	var offset app.ConsumerOffset
+	if err := json.Unmarshal([]byte(body), &offset); err != nil || offset.Offset != 2 || offset.Lag != 1 {
+		t.Fatalf("Expected reader at 2 with a lag of 1, got %s", body)
+	}
+	testRequest(t, http.StatusBadRequest, "POST", server.URL+"/consumers/reader/offset", nil, "4")
+	testRequest(t, http.StatusBadRequest, "POST", server.URL+"/consumers/reader/offset", nil, "")
+	testRequest(t, http.StatusNotFound, "GET", server.URL+"/consumers/other", nil, "")
+
+	// Subscribing carries on after the offset
+	if from := subscribeFrom(t, server.URL+"/subscribe?consumer=reader"); from != "3" {
+		t.Fatalf("Expected the subscription to start at 3, got %s", from)
+	}
+
+	testRequest(t, http.StatusOK, "DELETE", server.URL+"/consumers/reader", nil, "")
+	testRequest(t, http.StatusNotFound, "DELETE", server.URL+"/consumers/reader", nil, "")
+	if from := subscribeFrom(t, server.URL+"/subscribe?consumer=reader"); from != "1" {
+		t.Fatalf("Expected a deleted consumer to start from the start of the log, got %s", from)
+	}
+}
+
+// subscribeFrom subscribes, returning where the subscription started, once it's sent the first message.
+func subscribeFrom(t *testing.T, url string) string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	response, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	header, err := bufio.NewReader(response.Body).ReadString('\n')
+	if err != nil || !strings.HasPrefix(header, response.Header.Get("X-Afterme-From")+"-") {
+		t.Fatalf("Expected the first message to be %s, got %q, %v", response.Header.Get("X-Afterme-From"), header, err)
+	}
+
+	return response.Header.Get("X-Afterme-From")
+}
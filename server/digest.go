@@ -0,0 +1,72 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+// Client supplied digests, a producer can send a digest of the body in a Digest (RFC 3230) or Content-Digest
+// (RFC 9530) header and the write is refused if the body received doesn't match. That's integrity from the producer
+// onwards, the hash in the message header only covers from the handler onwards.
+
+// digestAlgorithms are those a client digest can use, by their (lowercased) HTTP names
+var digestAlgorithms = map[string]func() hash.Hash{
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+// verifyDigests checks the body against any Digest or Content-Digest headers, an error is returned if one doesn't
+// match, or if none of the digests sent use an algorithm that's supported.
+func verifyDigests(r *http.Request, body []byte) error {
+	digests := map[string]string{}
+
+	// Content-Digest: sha-256=:<base64>:, sha-512=:<base64>:
+	for _, header := range r.Header["Content-Digest"] {
+		for _, member := range strings.Split(header, ",") {
+			kv := strings.SplitN(strings.TrimSpace(member), "=", 2)
+			if len(kv) == 2 {
+				digests[strings.ToLower(kv[0])] = strings.Trim(kv[1], ":")
+			}
+		}
+	}
+
+	// Digest: SHA-256=<base64>,SHA-512=<base64>
+	for _, header := range r.Header["Digest"] {
+		for _, member := range strings.Split(header, ",") {
+			kv := strings.SplitN(strings.TrimSpace(member), "=", 2)
+			if len(kv) == 2 {
+				digests[strings.ToLower(kv[0])] = kv[1]
+			}
+		}
+	}
+
+	if len(r.Header["Content-Digest"])+len(r.Header["Digest"]) == 0 {
+		return nil
+	}
+
+	checked := 0
+	for algorithm, expected := range digests {
+		newHash, ok := digestAlgorithms[algorithm]
+		if !ok {
+			continue
+		}
+
+		h := newHash()
+		h.Write(body)
+		if actual := base64.StdEncoding.EncodeToString(h.Sum(nil)); actual != expected {
+			return fmt.Errorf("Body %s digest is %s, not %s", algorithm, actual, expected)
+		}
+		checked++
+	}
+
+	if checked == 0 {
+		return fmt.Errorf("No supported digest algorithm, use sha-256 or sha-512")
+	}
+
+	return nil
+}
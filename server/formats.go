@@ -0,0 +1,81 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/saem/afterme/cloudevents"
+	"github.com/saem/afterme/data2"
+	"io"
+	"net/http"
+)
+
+// messageWriter writes messages out the way a read asks for them, in the log file format, or as structured mode
+// CloudEvents with ?cloudevents=structured, either a batch (a JSON array) or one a line.
+type messageWriter struct {
+	w       http.ResponseWriter
+	events  bool
+	batch   bool
+	written int
+}
+
+func newMessageWriter(w http.ResponseWriter, r *http.Request, batch bool) (out *messageWriter, err error) {
+	switch events := r.URL.Query().Get("cloudevents"); events {
+	case "", cloudevents.Structured:
+		return &messageWriter{w: w, events: events != "", batch: batch}, nil
+	default:
+		return nil, fmt.Errorf("cloudevents must be structured, binary mode is for a single message")
+	}
+}
+
+// start sets the content type, and starts a batch.
+func (out *messageWriter) start() {
+	switch {
+	case !out.events:
+		out.w.Header().Set("Content-Type", "application/octet-stream")
+	case out.batch:
+		out.w.Header().Set("Content-Type", cloudevents.BatchContentType)
+		io.WriteString(out.w, "[")
+	default:
+		out.w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+}
+
+func (out *messageWriter) write(m data2.Message) (err error) {
+	if !out.events {
+		return writeMessage(out.w, m)
+	}
+
+	event, err := json.Marshal(cloudevents.Event(m))
+	if err != nil {
+		return err
+	}
+	if out.batch && out.written > 0 {
+		io.WriteString(out.w, ",")
+	}
+	if !out.batch {
+		event = append(event, '\n')
+	}
+	out.written++
+	_, err = out.w.Write(event)
+
+	return err
+}
+
+// end ends a batch.
+func (out *messageWriter) end() (err error) {
+	if out.events && out.batch {
+		_, err = io.WriteString(out.w, "]")
+	}
+
+	return err
+}
+
+// writeMessage writes a message out in the log file format.
+func writeMessage(w io.Writer, m data2.Message) (err error) {
+	header, body, _ := m.Marshal()
+	if _, err = io.WriteString(w, header); err == nil {
+		_, err = w.Write(body)
+	}
+
+	return err
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/saem/afterme/app"
+	"github.com/saem/afterme/auth"
+	"github.com/saem/afterme/data"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Worker groups, see app/groups.go. A worker leases messages with
+// POST /groups/<group>/lease?worker=<name>[&max=<n>][&visibility=<duration>][&stream=<stream>][&wait=<duration>]
+// and gets them in the log file format, each with a deliveries attribute. It acks them, or releases them to be
+// leased again, with POST /groups/<group>/ack?worker=<name> or /release, the sequences one a line in the body, or
+// ?sequence=<n>.
+
+// maxLeaseWait is the longest a lease waits for messages to be committed.
+const maxLeaseWait = time.Minute
+
+// The worker groups, GET /groups, GET or DELETE /groups/<group>, and POST /groups/<group>/lease, ack or release.
+func groupsHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/groups"), "/")
+	name, action := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		name, action = path[:i], path[i+1:]
+	}
+
+	switch {
+	case name == "" && r.Method == "GET":
+		writeJSON(w, appServer.Groups())
+	case name != "" && action == "" && r.Method == "GET":
+		if status, found := appServer.Group(name); found {
+			writeJSON(w, status)
+		} else {
+			http.NotFound(w, r)
+		}
+	case name != "" && action == "" && r.Method == "DELETE":
+		found, err := appServer.DeleteGroup(name)
+		switch {
+		case err != nil:
+			http.Error(w, fmt.Sprintf("Could not delete group: %s", err.Error()), http.StatusInternalServerError)
+		case !found:
+			http.NotFound(w, r)
+		default:
+			fmt.Fprintf(w, "Successfully deleted group: %s", name)
+		}
+	case name != "" && action == "lease" && r.Method == "POST":
+		lease(w, r, name)
+	case name != "" && (action == "ack" || action == "release") && r.Method == "POST":
+		ack(w, r, name, action)
+	default:
+		http.Error(w, "GET /groups[/<group>], DELETE /groups/<group> or POST /groups/<group>/lease, ack or release",
+			http.StatusMethodNotAllowed)
+	}
+}
+
+func lease(w http.ResponseWriter, r *http.Request, name string) {
+	query := r.URL.Query()
+	max, visibility, wait := 1, app.DefaultVisibility, time.Duration(0)
+	var err error
+	if value := query.Get("max"); value != "" {
+		if max, err = strconv.Atoi(value); err != nil || max <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid max: %s", value), http.StatusBadRequest)
+
+			return
+		}
+	}
+	for param, d := range map[string]*time.Duration{"visibility": &visibility, "wait": &wait} {
+		if value := query.Get(param); value != "" {
+			if *d, err = time.ParseDuration(value); err != nil || *d < 0 {
+				http.Error(w, fmt.Sprintf("Invalid %s: %s", param, value), http.StatusBadRequest)
+
+				return
+			}
+		}
+	}
+	if wait > maxLeaseWait {
+		wait = maxLeaseWait
+	}
+	stream := query.Get("stream")
+	if stream == "" {
+		stream = auth.AllStreams
+	}
+	if principal := requestPrincipal(r); !allowed(principal, auth.Subscribe, stream) {
+		http.Error(w, denied(principal, auth.Subscribe, stream), http.StatusForbidden)
+
+		return
+	}
+
+	deadline := time.After(wait)
+	for {
+		changed := appServer.SyncedChanged()
+		messages, err := appServer.Lease(name, query.Get("stream"), query.Get("worker"), max, visibility)
+		switch {
+		case err == app.ErrInvalidGroup:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		case err == app.ErrGroupStream:
+			http.Error(w, err.Error(), http.StatusConflict)
+
+			return
+		case err != nil:
+			http.Error(w, fmt.Sprintf("Could not lease: %s", err.Error()), http.StatusInternalServerError)
+
+			return
+		case len(messages) > 0 || wait == 0:
+			w.Header().Set("Content-Type", "application/octet-stream")
+			for _, m := range messages {
+				if err = writeMessage(w, m); err != nil {
+					return
+				}
+			}
+
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-time.After(subscribePoll):
+		case <-deadline:
+			wait = 0
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func ack(w http.ResponseWriter, r *http.Request, name string, action string) {
+	// Acking and releasing are subscribing to the group's stream, as leasing is
+	if stream, found := appServer.GroupStream(name); found {
+		if stream == "" {
+			stream = auth.AllStreams
+		}
+		if principal := requestPrincipal(r); !allowed(principal, auth.Subscribe, stream) {
+			http.Error(w, denied(principal, auth.Subscribe, stream), http.StatusForbidden)
+
+			return
+		}
+	}
+
+	var sequences []data.Sequence
+	values := r.URL.Query()["sequence"]
+	if len(values) == 0 {
+		scanner := bufio.NewScanner(io.LimitReader(r.Body, 1024*1024))
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				values = append(values, line)
+			}
+		}
+	}
+	for _, value := range values {
+		sequence, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid sequence: %s", value), http.StatusBadRequest)
+
+			return
+		}
+		sequences = append(sequences, data.Sequence(sequence))
+	}
+
+	var err error
+	worker, done := r.URL.Query().Get("worker"), "acked"
+	if action == "ack" {
+		err = appServer.Ack(name, worker, sequences)
+	} else {
+		err, done = appServer.Release(name, worker, sequences), "released"
+	}
+	switch err {
+	case nil:
+		writeJSON(w, map[string]int{done: len(sequences)})
+	case app.ErrNotLeased:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, fmt.Sprintf("Could not %s: %s", action, err.Error()), http.StatusInternalServerError)
+	}
+}
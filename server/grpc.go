@@ -0,0 +1,300 @@
+package server
+
+import (
+	"context"
+	"github.com/saem/afterme/app"
+	"github.com/saem/afterme/auth"
+	"github.com/saem/afterme/data"
+	"github.com/saem/afterme/data2"
+	"github.com/saem/afterme/filter"
+	"github.com/saem/afterme/wire"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	grpcstatus "google.golang.org/grpc/status"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// The gRPC service, afterme.proto has it. It's the HTTP API's writes, range reads, subscriptions and status, on top
+// of the same App. Appends are checked and acked as the binary protocol's are (see tcp.go), Append returns once the
+// message is durable, and AppendStream acks each message once it is, in the order they were sent, without waiting on
+// one before reading the next. With auth, calls present their token in authorization metadata, Bearer <token> as
+// HTTP's Authorization header has it.
+
+// NewGRPCServer is a gRPC server with the service registered, to Serve on a listener. It's served over TLS if the
+// other listeners are.
+func NewGRPCServer() *grpc.Server {
+	options := []grpc.ServerOption{grpc.ForceServerCodec(grpcCodec{}),
+		grpc.MaxRecvMsgSize(wire.MaxFrameSize),
+		grpc.MaxSendMsgSize(wire.MaxFrameSize)}
+	if listenerTLS != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(listenerTLS.Config())))
+	}
+	s := grpc.NewServer(options...)
+	s.RegisterService(&grpcServiceDesc, nil)
+
+	return s
+}
+
+var grpcServiceDesc = grpc.ServiceDesc{
+	ServiceName: "afterme.v1.Afterme",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Append", Handler: unary("Append", func() protoMessage { return &appendRequest{} }, grpcAppend)},
+		{MethodName: "Status", Handler: unary("Status", func() protoMessage { return &statusRequest{} }, grpcStatus)},
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "AppendStream", Handler: grpcAppendStream, ServerStreams: true, ClientStreams: true},
+		{StreamName: "Read", Handler: grpcRead, ServerStreams: true},
+		{StreamName: "Subscribe", Handler: grpcSubscribe, ServerStreams: true},
+	},
+	Metadata: "afterme.proto",
+}
+
+// unary is the handler of a unary method, decoding its request, one newRequest makes, and handling it, through the
+// server's interceptor if it has one.
+func unary(method string, newRequest func() protoMessage,
+	handle func(ctx context.Context, req interface{}) (interface{}, error)) grpc.MethodHandler {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error,
+		interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		req := newRequest()
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		if interceptor == nil {
+			return handle(ctx, req)
+		}
+		info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/afterme.v1.Afterme/" + method}
+		return interceptor(ctx, req, info, handle)
+	}
+}
+
+func grpcAppend(ctx context.Context, r interface{}) (interface{}, error) {
+	req := r.(*appendRequest)
+	principal, err := grpcPrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ack := durableAck(requestAppend(wire.Append{Id: req.Id, Attributes: req.Attributes, Body: req.Body},
+		grpcProducer(ctx), principal))
+	if ack.Kind == wire.FrameError {
+		return nil, grpcstatus.Error(grpcCode(ack.Code), ack.Message)
+	}
+
+	return &appendResponse{Id: req.Id, Sequence: ack.Sequence}, nil
+}
+
+// grpcAppendStream appends each message the client sends, one goroutine reading them and requesting they're
+// written and another acking each once it's durable.
+func grpcAppendStream(srv interface{}, stream grpc.ServerStream) error {
+	principal, err := grpcPrincipal(stream.Context())
+	if err != nil {
+		return err
+	}
+	identity := grpcProducer(stream.Context())
+	pending := make(chan inFlight, MaxInFlight)
+	acked := make(chan error)
+	go func() {
+		var err error
+		for f := range pending {
+			ack := durableAck(f)
+			// Once the client's gone there's only draining to do
+			if err == nil {
+				response := appendResponse{Id: ack.Id, Sequence: ack.Sequence}
+				if ack.Kind == wire.FrameError {
+					response.Code, response.Error = uint32(grpcCode(ack.Code)), ack.Message
+				}
+				err = stream.SendMsg(&response)
+			}
+		}
+		acked <- err
+	}()
+
+	for {
+		req := appendRequest{}
+		if err = stream.RecvMsg(&req); err != nil {
+			break
+		}
+		pending <- requestAppend(wire.Append{Id: req.Id, Attributes: req.Attributes, Body: req.Body}, identity,
+			principal)
+	}
+	close(pending)
+	ackErr := <-acked
+	if err == io.EOF {
+		err = ackErr
+	}
+
+	return err
+}
+
+// grpcRead sends committed messages from req.From to req.To, as GET /messages does.
+func grpcRead(srv interface{}, stream grpc.ServerStream) error {
+	req := readRequest{}
+	if err := stream.RecvMsg(&req); err != nil {
+		return err
+	}
+	principal, err := grpcAllowed(stream.Context(), auth.Read)
+	if err != nil {
+		return err
+	}
+	matches, err := grpcFilter(req.Filter)
+	if err != nil {
+		return err
+	}
+	matches = permitted(principal, auth.Read, matches)
+	from, to := data.Sequence(req.From), data.Sequence(req.To)
+	if from == 0 {
+		from = 1
+	}
+	if to == 0 || to > appServer.Committed() {
+		to = appServer.Committed()
+	}
+
+	err = app.ReadLog(appServer.DataDir, from, func(m data2.Message) error {
+		if m.Sequence > to {
+			return app.ErrStopReading
+		}
+		m, err := app.Deliverable(appServer.Keys, m)
+		if err == nil && matches(m) {
+			err = stream.SendMsg(newGRPCMessage(m))
+		}
+		return err
+	})
+	if err != nil {
+		appServer.Logger.Printf("Range read %d-%d failed: %s", from, to, err.Error())
+	}
+
+	return err
+}
+
+// grpcSubscribe sends committed messages as they're committed, as GET /subscribe does.
+func grpcSubscribe(srv interface{}, stream grpc.ServerStream) error {
+	req := subscribeRequest{}
+	if err := stream.RecvMsg(&req); err != nil {
+		return err
+	}
+	principal, err := grpcAllowed(stream.Context(), auth.Subscribe)
+	if err != nil {
+		return err
+	}
+	matches, err := grpcFilter(req.Filter)
+	if err != nil {
+		return err
+	}
+	matches = permitted(principal, auth.Subscribe, matches)
+	filtered := req.Filter != "" || !allowed(principal, auth.Subscribe, auth.AllStreams)
+	from := data.Sequence(req.From)
+	if offset, found := appServer.Consumer(req.Consumer); found && from == 0 {
+		from = offset.Offset + 1
+	}
+	if from == 0 {
+		from = 1
+	}
+
+	committer := req.Consumer // Its offset isn't moved on by those who can't commit it
+	if !allowed(principal, auth.Subscribe, consumerStream(req.Consumer, "")) {
+		committer = ""
+	}
+	err = subscribe(stream.Context(), committer, from, matches, filtered, func(m data2.Message) error {
+		return stream.SendMsg(newGRPCMessage(m))
+	}, func() {})
+	if err != nil {
+		appServer.Logger.Printf("Subscription for %q stopped: %s", req.Consumer, err.Error())
+	}
+
+	return err
+}
+
+func grpcStatus(ctx context.Context, _ interface{}) (interface{}, error) {
+	if !appServer.Config.Auth.PublicStatus {
+		principal, err := grpcPrincipal(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if !allowed(principal, auth.Status, auth.AllStreams) {
+			return nil, grpcstatus.Error(codes.PermissionDenied, denied(principal, auth.Status, auth.AllStreams))
+		}
+	}
+	s := currentStatus()
+
+	return &statusResponse{Version: uint64(s.Version),
+		Committed: uint64(s.Committed),
+		Epoch:     s.Epoch,
+		Leader:    s.Leader,
+		Term:      s.Term,
+		Lag:       s.Lag}, nil
+}
+
+// grpcPrincipal authenticates a call by its authorization metadata.
+func grpcPrincipal(ctx context.Context) (principal *auth.Principal, err error) {
+	if !authEnabled {
+		return nil, nil
+	}
+	var token string
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("authorization")) > 0 {
+		token, _ = strings.CutPrefix(md.Get("authorization")[0], "Bearer ")
+	}
+	principal, ok := authenticate(strings.TrimSpace(token))
+	if !ok {
+		return nil, grpcstatus.Error(codes.Unauthenticated, "A valid token is required, as authorization: Bearer <token>")
+	}
+
+	return principal, nil
+}
+
+// grpcAllowed authenticates a call, and checks the principal can do operation on a stream at least.
+func grpcAllowed(ctx context.Context, operation string) (principal *auth.Principal, err error) {
+	if principal, err = grpcPrincipal(ctx); err != nil {
+		return nil, err
+	}
+	if !allowedAny(principal, operation) {
+		return nil, grpcstatus.Errorf(codes.PermissionDenied, "%s can't %s any stream", principal.Name,
+			operationVerbs[operation])
+	}
+
+	return principal, nil
+}
+
+// grpcFilter parses a request's filter as filterParam does ?filter=.
+func grpcFilter(expression string) (matches func(data2.Message) bool, err error) {
+	if expression == "" {
+		return func(data2.Message) bool { return true }, nil
+	}
+	f, err := filter.Parse(expression)
+	if err != nil {
+		return nil, grpcstatus.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return f.Match, nil
+}
+
+func newGRPCMessage(m data2.Message) *grpcMessage {
+	return &grpcMessage{Sequence: uint64(m.Sequence),
+		Timestamp:  m.TimeStamp,
+		Hash:       m.Hash,
+		Attributes: m.Attributes,
+		Body:       m.Body}
+}
+
+// grpcCode is the gRPC status code for an ack's HTTP status.
+func grpcCode(code uint16) codes.Code {
+	switch code {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusConflict:
+		return codes.Aborted
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	default:
+		return codes.Internal
+	}
+}
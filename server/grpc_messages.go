@@ -0,0 +1,322 @@
+package server
+
+import (
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"sort"
+)
+
+// The gRPC service's messages, as afterme.proto has them, encoded in the protobuf wire format by hand so there's no
+// generated code to keep in step with the .proto. Zero values aren't encoded, as proto3 has it, and fields that
+// aren't known are skipped.
+
+// protoMessage is a message that encodes itself.
+type protoMessage interface {
+	marshal() []byte
+	unmarshal(b []byte) error
+}
+
+// grpcCodec is the service's codec, it's named proto as it's the protobuf wire format that's on the wire.
+type grpcCodec struct{}
+
+func (grpcCodec) Name() string { return "proto" }
+
+func (grpcCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(protoMessage)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a message of the gRPC service", v)
+	}
+
+	return m.marshal(), nil
+}
+
+func (grpcCodec) Unmarshal(b []byte, v interface{}) error {
+	m, ok := v.(protoMessage)
+	if !ok {
+		return fmt.Errorf("%T is not a message of the gRPC service", v)
+	}
+
+	return m.unmarshal(b)
+}
+
+type appendRequest struct {
+	Id         uint64
+	Body       []byte
+	Attributes map[string]string
+}
+
+type appendResponse struct {
+	Id       uint64
+	Sequence uint64
+	Code     uint32
+	Error    string
+}
+
+type readRequest struct {
+	From   uint64
+	To     uint64
+	Filter string
+}
+
+type subscribeRequest struct {
+	Consumer string
+	From     uint64
+	Filter   string
+}
+
+type grpcMessage struct {
+	Sequence   uint64
+	Timestamp  int64
+	Hash       string
+	Attributes map[string]string
+	Body       []byte
+}
+
+type statusRequest struct{}
+
+type statusResponse struct {
+	Version   uint64
+	Committed uint64
+	Epoch     uint64
+	Leader    string
+	Term      uint64
+	Lag       uint64
+}
+
+func (m *appendRequest) marshal() (b []byte) {
+	b = appendVarint(b, 1, m.Id)
+	b = appendBytes(b, 2, m.Body)
+	return appendMap(b, 3, m.Attributes)
+}
+
+func (m *appendRequest) unmarshal(b []byte) error {
+	return decode(b, func(number protowire.Number, v uint64, s []byte) (err error) {
+		switch number {
+		case 1:
+			m.Id = v
+		case 2:
+			m.Body = append([]byte{}, s...)
+		case 3:
+			m.Attributes, err = decodeMapEntry(m.Attributes, s)
+		}
+		return err
+	})
+}
+
+func (m *appendResponse) marshal() (b []byte) {
+	b = appendVarint(b, 1, m.Id)
+	b = appendVarint(b, 2, m.Sequence)
+	b = appendVarint(b, 3, uint64(m.Code))
+	return appendBytes(b, 4, []byte(m.Error))
+}
+
+func (m *appendResponse) unmarshal(b []byte) error {
+	return decode(b, func(number protowire.Number, v uint64, s []byte) error {
+		switch number {
+		case 1:
+			m.Id = v
+		case 2:
+			m.Sequence = v
+		case 3:
+			m.Code = uint32(v)
+		case 4:
+			m.Error = string(s)
+		}
+		return nil
+	})
+}
+
+func (m *readRequest) marshal() (b []byte) {
+	b = appendVarint(b, 1, m.From)
+	b = appendVarint(b, 2, m.To)
+	return appendBytes(b, 3, []byte(m.Filter))
+}
+
+func (m *readRequest) unmarshal(b []byte) error {
+	return decode(b, func(number protowire.Number, v uint64, s []byte) error {
+		switch number {
+		case 1:
+			m.From = v
+		case 2:
+			m.To = v
+		case 3:
+			m.Filter = string(s)
+		}
+		return nil
+	})
+}
+
+func (m *subscribeRequest) marshal() (b []byte) {
+	b = appendBytes(b, 1, []byte(m.Consumer))
+	b = appendVarint(b, 2, m.From)
+	return appendBytes(b, 3, []byte(m.Filter))
+}
+
+func (m *subscribeRequest) unmarshal(b []byte) error {
+	return decode(b, func(number protowire.Number, v uint64, s []byte) error {
+		switch number {
+		case 1:
+			m.Consumer = string(s)
+		case 2:
+			m.From = v
+		case 3:
+			m.Filter = string(s)
+		}
+		return nil
+	})
+}
+
+func (m *grpcMessage) marshal() (b []byte) {
+	b = appendVarint(b, 1, m.Sequence)
+	b = appendVarint(b, 2, uint64(m.Timestamp))
+	b = appendBytes(b, 3, []byte(m.Hash))
+	b = appendMap(b, 4, m.Attributes)
+	return appendBytes(b, 5, m.Body)
+}
+
+func (m *grpcMessage) unmarshal(b []byte) error {
+	return decode(b, func(number protowire.Number, v uint64, s []byte) (err error) {
+		switch number {
+		case 1:
+			m.Sequence = v
+		case 2:
+			m.Timestamp = int64(v)
+		case 3:
+			m.Hash = string(s)
+		case 4:
+			m.Attributes, err = decodeMapEntry(m.Attributes, s)
+		case 5:
+			m.Body = append([]byte{}, s...)
+		}
+		return err
+	})
+}
+
+func (m *statusRequest) marshal() []byte { return nil }
+
+func (m *statusRequest) unmarshal(b []byte) error {
+	return decode(b, func(protowire.Number, uint64, []byte) error { return nil })
+}
+
+func (m *statusResponse) marshal() (b []byte) {
+	b = appendVarint(b, 1, m.Version)
+	b = appendVarint(b, 2, m.Committed)
+	b = appendVarint(b, 3, m.Epoch)
+	b = appendBytes(b, 4, []byte(m.Leader))
+	b = appendVarint(b, 5, m.Term)
+	return appendVarint(b, 6, m.Lag)
+}
+
+func (m *statusResponse) unmarshal(b []byte) error {
+	return decode(b, func(number protowire.Number, v uint64, s []byte) error {
+		switch number {
+		case 1:
+			m.Version = v
+		case 2:
+			m.Committed = v
+		case 3:
+			m.Epoch = v
+		case 4:
+			m.Leader = string(s)
+		case 5:
+			m.Term = v
+		case 6:
+			m.Lag = v
+		}
+		return nil
+	})
+}
+
+func appendVarint(b []byte, number protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, number, protowire.VarintType)
+
+	return protowire.AppendVarint(b, v)
+}
+
+func appendBytes(b []byte, number protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, number, protowire.BytesType)
+
+	return protowire.AppendBytes(b, v)
+}
+
+// appendMap appends a map<string, string>, an entry at a time, in order so the same map is always the same bytes.
+func appendMap(b []byte, number protowire.Number, m map[string]string) []byte {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, key)
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendString(entry, m[key])
+		b = protowire.AppendTag(b, number, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+
+	return b
+}
+
+// decode calls field with each field in b, a varint's value is v and a length delimited one's s.
+func decode(b []byte, field func(number protowire.Number, v uint64, s []byte) error) error {
+	for len(b) > 0 {
+		number, kind, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var v uint64
+		var s []byte
+		switch kind {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			s, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(number, kind, b)
+			number = 0 // Not a field of ours, skip it
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if number != 0 {
+			if err := field(number, v, s); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// decodeMapEntry adds a map<string, string> entry to m.
+func decodeMapEntry(m map[string]string, entry []byte) (map[string]string, error) {
+	if m == nil {
+		m = map[string]string{}
+	}
+	var key, value string
+	err := decode(entry, func(number protowire.Number, v uint64, s []byte) error {
+		switch number {
+		case 1:
+			key = string(s)
+		case 2:
+			value = string(s)
+		}
+		return nil
+	})
+	m[key] = value
+
+	return m, err
+}
@@ -0,0 +1,325 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/saem/afterme/app"
+	"github.com/saem/afterme/config"
+	"github.com/saem/afterme/data2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+	grpcstatus "google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestApp starts an App in a temporary data dir, for the handlers to use.
+func startTestApp(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	os.Mkdir(dir, 0755)
+	appServer = app.CreateAppServer(dir, config.Default(), log.New(ioutil.Discard, "", 0))
+	go appServer.ProcessMessages()
+}
+
+// grpcTestServer starts an App and the gRPC service on a local listener, and is a connection to it.
+func grpcTestServer(t *testing.T) *grpc.ClientConn {
+	startTestApp(t)
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewGRPCServer()
+	go s.Serve(listener)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.NewClient(listener.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(grpcCodec{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func TestGRPC(t *testing.T) {
+	conn := grpcTestServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	response := appendResponse{}
+	err := conn.Invoke(ctx, "/afterme.v1.Afterme/Append",
+		&appendRequest{Id: 7, Body: []byte(`{"total": 1}`), Attributes: map[string]string{"stream": "orders"}},
+		&response)
+	if err != nil || response.Id != 7 || response.Sequence != 1 {
+		t.Fatalf("Expected message 1 to be appended, got %+v, %v", response, err)
+	}
+	err = conn.Invoke(ctx, "/afterme.v1.Afterme/Append", &appendRequest{Id: 8}, &response)
+	if grpcstatus.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected an empty body to be an invalid argument, got %v", err)
+	}
+
+	// A refused append is acked with an error, and the stream carries on
+	appends, err := conn.NewStream(ctx, &grpcServiceDesc.Streams[0], "/afterme.v1.Afterme/AppendStream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 4; i++ {
+		request := appendRequest{Id: uint64(i),
+			Body:       []byte(fmt.Sprintf(`{"total": %d}`, i+1)),
+			Attributes: map[string]string{"stream": "other"}}
+		switch i {
+		case 1:
+			request.Attributes["stream"] = "orders"
+		case 2:
+			request.Attributes["sequence"] = "12"
+		}
+		if err := appends.SendMsg(&request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	appends.CloseSend()
+	expected := []appendResponse{{Id: 1, Sequence: 2},
+		{Id: 2, Code: uint32(codes.InvalidArgument), Error: "The sequence attribute can't be set by a writer"},
+		{Id: 3, Sequence: 3},
+		{Id: 4, Sequence: 4}}
+	for _, e := range expected {
+		response := appendResponse{}
+		if err := appends.RecvMsg(&response); err != nil || response != e {
+			t.Fatalf("Expected %+v, got %+v, %v", e, response, err)
+		}
+	}
+	if err := appends.RecvMsg(&response); err != io.EOF {
+		t.Fatalf("Expected the stream to end, got %v", err)
+	}
+
+	read, err := conn.NewStream(ctx, &grpcServiceDesc.Streams[1], "/afterme.v1.Afterme/Read")
+	if err == nil {
+		err = read.SendMsg(&readRequest{From: 2, Filter: `attr.stream == "orders"`})
+	}
+	if err == nil {
+		err = read.CloseSend()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := grpcMessage{}
+	if err := read.RecvMsg(&m); err != nil || m.Sequence != 2 || string(m.Body) != "{\"total\": 2}\n" {
+		t.Fatalf("Expected message 2, got %+v, %v", m, err)
+	}
+	if m.Attributes[data2.AttrStream] != "orders" || m.Hash == "" || m.Timestamp == 0 {
+		t.Fatalf("Expected message 2's attributes, got %+v", m)
+	}
+	if err := read.RecvMsg(&m); err != io.EOF {
+		t.Fatalf("Expected only message 2 to match, got %+v, %v", m, err)
+	}
+
+	subscription, err := conn.NewStream(ctx, &grpcServiceDesc.Streams[2], "/afterme.v1.Afterme/Subscribe")
+	if err == nil {
+		err = subscription.SendMsg(&subscribeRequest{From: 4})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := subscription.RecvMsg(&m); err != nil || m.Sequence != 4 {
+		t.Fatalf("Expected message 4, got %+v, %v", m, err)
+	}
+	if err := conn.Invoke(ctx, "/afterme.v1.Afterme/Append", &appendRequest{Body: []byte("5")}, &response); err != nil {
+		t.Fatal(err)
+	}
+	if err := subscription.RecvMsg(&m); err != nil || m.Sequence != 5 {
+		t.Fatalf("Expected message 5 once it was committed, got %+v, %v", m, err)
+	}
+
+	s := statusResponse{}
+	if err := conn.Invoke(ctx, "/afterme.v1.Afterme/Status", &statusRequest{}, &s); err != nil || s.Committed != 5 {
+		t.Fatalf("Expected 5 committed, got %+v, %v", s, err)
+	}
+}
+
+// protoFile is afterme.proto as a descriptor, read with just enough of the language to take in its messages, so the
+// service can be checked against the protobuf runtime's encoding of them rather than grpc_messages.go's own.
+func protoFile(t *testing.T) protoreflect.FileDescriptor {
+	contents, err := ioutil.ReadFile("afterme.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	field := regexp.MustCompile(`^(map<(\w+),\s*(\w+)>|\w+)\s+(\w+)\s*=\s*(\d+);$`)
+	types := map[string]descriptorpb.FieldDescriptorProto_Type{
+		"uint64": descriptorpb.FieldDescriptorProto_TYPE_UINT64,
+		"uint32": descriptorpb.FieldDescriptorProto_TYPE_UINT32,
+		"int64":  descriptorpb.FieldDescriptorProto_TYPE_INT64,
+		"string": descriptorpb.FieldDescriptorProto_TYPE_STRING,
+		"bytes":  descriptorpb.FieldDescriptorProto_TYPE_BYTES,
+	}
+	newField := func(name string, kind string, number int32) *descriptorpb.FieldDescriptorProto {
+		if _, ok := types[kind]; !ok {
+			t.Fatalf("Field %s has type %s, the test doesn't know it", name, kind)
+		}
+		return &descriptorpb.FieldDescriptorProto{Name: proto.String(name), Number: proto.Int32(number),
+			Type: types[kind].Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			JsonName: proto.String(name)}
+	}
+
+	file := &descriptorpb.FileDescriptorProto{Name: proto.String("afterme.proto"), Package: proto.String("afterme.v1"),
+		Syntax: proto.String("proto3")}
+	var message *descriptorpb.DescriptorProto
+	for _, line := range strings.Split(string(contents), "\n") {
+		if comment := strings.Index(line, "//"); comment >= 0 {
+			line = line[:comment]
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "message "):
+			message = &descriptorpb.DescriptorProto{Name: proto.String(strings.Fields(line)[1])}
+			file.MessageType = append(file.MessageType, message)
+		case line == "}":
+			message = nil
+		case message != nil && field.MatchString(line):
+			parts := field.FindStringSubmatch(line)
+			number, _ := strconv.Atoi(parts[5])
+			if parts[2] == "" {
+				message.Field = append(message.Field, newField(parts[4], parts[1], int32(number)))
+				continue
+			}
+			// A map is a repeated entry message, of its key and value
+			entry := &descriptorpb.DescriptorProto{Name: proto.String(strings.ToUpper(parts[4][:1]) + parts[4][1:] + "Entry"),
+				Field:   []*descriptorpb.FieldDescriptorProto{newField("key", parts[2], 1), newField("value", parts[3], 2)},
+				Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)}}
+			message.NestedType = append(message.NestedType, entry)
+			message.Field = append(message.Field, &descriptorpb.FieldDescriptorProto{Name: proto.String(parts[4]),
+				Number: proto.Int32(int32(number)), Type: descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum(),
+				Label:    descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum(),
+				TypeName: proto.String(".afterme.v1." + message.GetName() + "." + entry.GetName()),
+				JsonName: proto.String(parts[4])})
+		case message != nil && line != "":
+			t.Fatalf("Could not read %q in message %s", line, message.GetName())
+		}
+	}
+
+	descriptor, err := protodesc.NewFile(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return descriptor
+}
+
+// dynamicMessage is a message of afterme.proto with the fields of v, one of grpc_messages.go's, set by name.
+func dynamicMessage(file protoreflect.FileDescriptor, name string, v interface{}) *dynamicpb.Message {
+	m := dynamicpb.NewMessage(file.Messages().ByName(protoreflect.Name(name)))
+	value := reflect.ValueOf(v).Elem()
+	fields := m.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		name := string(fd.Name())
+		f := value.FieldByName(strings.ToUpper(name[:1]) + name[1:])
+		switch {
+		case fd.IsMap():
+			entries := m.Mutable(fd).Map()
+			for key, v := range f.Interface().(map[string]string) {
+				entries.Set(protoreflect.ValueOfString(key).MapKey(), protoreflect.ValueOfString(v))
+			}
+		case !f.IsZero():
+			m.Set(fd, protoreflect.ValueOf(f.Interface()))
+		}
+	}
+
+	return m
+}
+
+func TestGRPCProtobuf(t *testing.T) {
+	file := protoFile(t)
+
+	// Each message decodes with the protobuf runtime to what it encoded, and the runtime's encoding decodes back
+	for name, m := range map[string]protoMessage{
+		"AppendRequest":    &appendRequest{Id: 1, Body: []byte("body"), Attributes: map[string]string{"a": "1", "b": ""}},
+		"AppendResponse":   &appendResponse{Id: 1, Sequence: 2, Code: 3, Error: "error"},
+		"ReadRequest":      &readRequest{From: 1, To: 1 << 63, Filter: `attr.stream == "orders"`},
+		"SubscribeRequest": &subscribeRequest{Consumer: "c", From: 2, Filter: "f"},
+		"Message": &grpcMessage{Sequence: 1, Timestamp: -1, Hash: "hash", Attributes: map[string]string{"a": "1"},
+			Body: []byte("body")},
+		"StatusRequest":  &statusRequest{},
+		"StatusResponse": &statusResponse{Version: 1, Committed: 2, Epoch: 3, Leader: "l", Term: 4, Lag: 5},
+	} {
+		decoded := dynamicpb.NewMessage(file.Messages().ByName(protoreflect.Name(name)))
+		if err := proto.Unmarshal(m.marshal(), decoded); err != nil {
+			t.Fatalf("Could not decode %s, because: %s", name, err)
+		}
+		if expected := dynamicMessage(file, name, m); !proto.Equal(decoded, expected) {
+			t.Fatalf("Expected %s to decode to %v, got %v", name, expected, decoded)
+		}
+		encoded, err := proto.Marshal(decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		back := reflect.New(reflect.TypeOf(m).Elem()).Interface().(protoMessage)
+		if err = back.unmarshal(encoded); err != nil || !reflect.DeepEqual(back, m) {
+			t.Fatalf("Expected %s to decode to %+v, got %+v, %v", name, m, back, err)
+		}
+	}
+
+	// And the service is called with the protobuf runtime's codec, as a generated client would, unknown fields and all
+	conn := grpcTestServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	message := func(name string) *dynamicpb.Message {
+		return dynamicpb.NewMessage(file.Messages().ByName(protoreflect.Name(name)))
+	}
+	// grpcTestServer's connection has the service's codec, these calls have the runtime's
+	codec := grpc.ForceCodecV2(encoding.GetCodecV2("proto"))
+	get := func(m *dynamicpb.Message, name string) protoreflect.Value {
+		return m.Get(m.Descriptor().Fields().ByName(protoreflect.Name(name)))
+	}
+
+	request := dynamicMessage(file, "AppendRequest",
+		&appendRequest{Id: 7, Body: []byte("body"), Attributes: map[string]string{"stream": "orders"}})
+	request.SetUnknown(protowire.AppendString(protowire.AppendTag(nil, 99, protowire.BytesType), "unknown"))
+	response := message("AppendResponse")
+	err := conn.Invoke(ctx, "/afterme.v1.Afterme/Append", request, response, codec)
+	if err != nil || get(response, "id").Uint() != 7 || get(response, "sequence").Uint() != 1 {
+		t.Fatalf("Expected message 1 to be appended, got %v, %v", response, err)
+	}
+
+	read, err := conn.NewStream(ctx, &grpcServiceDesc.Streams[1], "/afterme.v1.Afterme/Read", codec)
+	if err == nil {
+		err = read.SendMsg(dynamicMessage(file, "ReadRequest", &readRequest{From: 1}))
+	}
+	if err == nil {
+		err = read.CloseSend()
+	}
+	m := message("Message")
+	if err == nil {
+		err = read.RecvMsg(m)
+	}
+	attributes := get(m, "attributes").Map()
+	if err != nil || get(m, "sequence").Uint() != 1 || string(get(m, "body").Bytes()) != "body\n" ||
+		attributes.Get(protoreflect.ValueOfString(data2.AttrStream).MapKey()).String() != "orders" {
+		t.Fatalf("Expected message 1, got %v, %v", m, err)
+	}
+
+	status := message("StatusResponse")
+	err = conn.Invoke(ctx, "/afterme.v1.Afterme/Status", message("StatusRequest"), status, codec)
+	if err != nil || get(status, "committed").Uint() != 1 {
+		t.Fatalf("Expected 1 committed, got %v, %v", status, err)
+	}
+}
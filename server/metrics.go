@@ -0,0 +1,45 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Metrics, GET /metrics, in the Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	metric(w, "afterme_committed_sequence", "gauge", "Highest committed sequence.")
+	fmt.Fprintf(w, "afterme_committed_sequence %d\n", appServer.Committed())
+	metric(w, "afterme_epoch", "gauge", "Writer epoch.")
+	fmt.Fprintf(w, "afterme_epoch %d\n", appServer.Epoch())
+
+	consumers := appServer.Consumers()
+	metric(w, "afterme_consumer_offset", "gauge", "Sequence of the last message a consumer has processed.")
+	for _, consumer := range consumers {
+		fmt.Fprintf(w, "afterme_consumer_offset{consumer=%s} %d\n", strconv.Quote(consumer.Name), consumer.Offset)
+	}
+	metric(w, "afterme_consumer_lag", "gauge", "Committed messages a consumer has yet to process.")
+	for _, consumer := range consumers {
+		fmt.Fprintf(w, "afterme_consumer_lag{consumer=%s} %d\n", strconv.Quote(consumer.Name), consumer.Lag)
+	}
+
+	groups := appServer.Groups()
+	metric(w, "afterme_group_pending", "gauge", "Committed messages a worker group has yet to lease.")
+	for _, group := range groups {
+		fmt.Fprintf(w, "afterme_group_pending{group=%s} %d\n", strconv.Quote(group.Name), group.Pending)
+	}
+	metric(w, "afterme_group_leased", "gauge", "Messages leased to a worker group's workers and not yet acked.")
+	for _, group := range groups {
+		fmt.Fprintf(w, "afterme_group_leased{group=%s} %d\n", strconv.Quote(group.Name), group.Leased)
+	}
+	metric(w, "afterme_group_expired", "gauge", "Messages whose lease ran out, to be leased again.")
+	for _, group := range groups {
+		fmt.Fprintf(w, "afterme_group_expired{group=%s} %d\n", strconv.Quote(group.Name), group.Expired)
+	}
+}
+
+func metric(w http.ResponseWriter, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
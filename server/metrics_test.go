@@ -0,0 +1,34 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	server := httpTestServer(t)
+	for _, body := range []string{"a\n", "b\n", "c\n"} {
+		testRequest(t, http.StatusOK, "POST", server.URL+"/message", nil, body)
+	}
+	testRequest(t, http.StatusOK, "POST", server.URL+"/consumers/reader/offset", nil, "1")
+	testRequest(t, http.StatusOK, "POST", server.URL+"/groups/workers/lease?worker=w1&max=1", nil, "")
+
+	response, body := testRequest(t, http.StatusOK, "GET", server.URL+"/metrics", nil, "")
+	if !strings.HasPrefix(response.Header.Get("Content-Type"), "text/plain") {
+		t.Fatalf("Expected the Prometheus text format, got %s", response.Header.Get("Content-Type"))
+	}
+	for _, line := range []string{
+		"# TYPE afterme_committed_sequence gauge\n",
+		"afterme_committed_sequence 3\n",
+		`afterme_consumer_offset{consumer="reader"} 1` + "\n",
+		`afterme_consumer_lag{consumer="reader"} 2` + "\n",
+		`afterme_group_pending{group="workers"} 2` + "\n",
+		`afterme_group_leased{group="workers"} 1` + "\n",
+		`afterme_group_expired{group="workers"} 0` + "\n",
+	} {
+		if !strings.Contains(body, line) {
+			t.Fatalf("Expected %q in the metrics, got:\n%s", line, body)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"github.com/saem/afterme/app"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The leader's side of replication, see app/replication.go. Both responses carry the committed sequence in an
+// X-Afterme-Committed header, which is how a follower knows how far behind it is.
+//
+// Followers listed in the config (config.ReplicationConfig) say who they are with ?follower=<id>, and prove it
+// with their replication token in an X-Afterme-Replication-Token header. Only they are counted towards a quorum,
+// and only they are sent data keys.
+
+// replicationFollower is the id of the follower a request is from, ok is false if it's not from one, and err
+// is set if it claims to be one but isn't.
+func replicationFollower(r *http.Request) (id string, ok bool, err error) {
+	id = r.URL.Query().Get("follower")
+	if id == "" {
+		return "", false, nil
+	}
+	expected, listed := appServer.Config.Replication.Followers[id]
+	token := sha256.Sum256([]byte(r.Header.Get("X-Afterme-Replication-Token")))
+	if !listed || subtle.ConstantTimeCompare([]byte(hex.EncodeToString(token[:])), []byte(expected)) != 1 {
+		return "", false, fmt.Errorf("%s is not a follower, or that's not its replication token", id)
+	}
+
+	return id, true, nil
+}
+
+// The data files, GET /segments, as JSON
+func segmentsHandler(w http.ResponseWriter, r *http.Request) {
+	segments, err := app.ListSegments(appServer.DataDir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("X-Afterme-Committed", strconv.FormatUint(uint64(appServer.Committed()), 10))
+	writeJSON(w, segments)
+}
+
+// The committed contents of a data file, GET /segments/<name>?offset=<n>, from offset (the start of a message).
+// A follower also says how far it's got, ?follower=<id>&replicated=<sequence>, and is told, in an
+// X-Afterme-Erasures header, when subjects have been erased so it can erase them too.
+func segmentHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/segments/")
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "offset must be a byte offset into the data file", http.StatusBadRequest)
+
+		return
+	}
+	follower, isFollower, err := replicationFollower(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+
+		return
+	}
+	if isFollower {
+		replicated, err := sequenceParam(r, "replicated", 0)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+		appServer.Replicated(follower, replicated)
+		w.Header().Set("X-Afterme-Erasures", appServer.Keys.Erasures())
+		if schemas, err := appServer.Schemas.Count(); err == nil {
+			w.Header().Set("X-Afterme-Schemas", strconv.Itoa(schemas))
+		}
+	}
+
+	// Only data files are served, the name can't be used to reach anything else in the data dir
+	segments, err := app.ListSegments(appServer.DataDir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+	var segment *app.Segment
+	for i := range segments {
+		if segments[i].Name == name {
+			segment = &segments[i]
+		}
+	}
+	if segment == nil {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	committed := appServer.Committed()
+	end, err := appServer.ReplicaEnd(*segment, offset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+	file, err := os.Open(filepath.Join(appServer.DataDir, segment.Name))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(end-offset, 10))
+	w.Header().Set("X-Afterme-Committed", strconv.FormatUint(uint64(committed), 10))
+	if _, err = io.Copy(w, io.NewSectionReader(file, offset, end-offset)); err != nil {
+		appServer.Logger.Printf("Sending %s from %d failed: %s", segment.Name, offset, err.Error())
+	}
+}
+
+// Data keys, for followers only. GET /replication/keys lists the keys there are, a line of each one's name and
+// id, and GET /replication/keys/<name> is a key file, as it is.
+func keysHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok, err := replicationFollower(r); !ok {
+		if err == nil {
+			err = fmt.Errorf("Only followers are sent keys")
+		}
+		http.Error(w, err.Error(), http.StatusForbidden)
+
+		return
+	}
+
+	if name := strings.TrimPrefix(r.URL.Path, "/replication/keys/"); name != r.URL.Path {
+		contents, err := appServer.Keys.Export(name)
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(contents)
+
+		return
+	}
+
+	ids, err := appServer.Keys.List()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	for name, id := range ids {
+		fmt.Fprintln(w, name, id)
+	}
+}
+
+// Schemas, for followers only, see app/schemas.go. GET /replication/schemas lists the versions there are, a line
+// of each one's stream and version, and GET /replication/schemas/<stream>/<version> is one of them, as it was
+// registered.
+func replicationSchemasHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok, err := replicationFollower(r); !ok {
+		if err == nil {
+			err = fmt.Errorf("Only followers are sent schemas")
+		}
+		http.Error(w, err.Error(), http.StatusForbidden)
+
+		return
+	}
+
+	if path := strings.TrimPrefix(r.URL.Path, "/replication/schemas/"); path != r.URL.Path {
+		stream, version := path, ""
+		if i := strings.Index(path, "/"); i >= 0 {
+			stream, version = path[:i], path[i+1:]
+		}
+		readSchema(w, r, stream, version)
+
+		return
+	}
+
+	list, err := appServer.ListSchemas()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(list)
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/saem/afterme/app"
+	"github.com/saem/afterme/config"
+	"github.com/saem/afterme/data"
+	"github.com/saem/afterme/data2"
+	"github.com/saem/afterme/keystore"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listFollower lists a follower in the leader's config, with the replication token it's to use.
+func listFollower(id string, token string) {
+	hash := sha256.Sum256([]byte(token))
+	if appServer.Config.Replication.Followers == nil {
+		appServer.Config.Replication.Followers = map[string]string{}
+	}
+	appServer.Config.Replication.Followers[id] = hex.EncodeToString(hash[:])
+}
+
+// startFollower starts a follower of leader, the leader's base URL, in a data dir of its own. It follows until
+// the end of the test.
+func startFollower(t *testing.T, leader string, id string, token string) *app.App {
+	c := config.Default()
+	c.Replication.Id, c.Replication.Token = id, token
+	follower := app.CreateFollower(t.TempDir(), leader, c, log.New(ioutil.Discard, "", 0))
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		follower.Follow(stop)
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		close(stop)
+		<-stopped
+	})
+
+	return follower
+}
+
+// eventually fails the test if condition isn't true within a few seconds.
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !condition(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %s", what)
+		}
+	}
+}
+
+// deliverable reads a message from a node's data dir, as it would be handed to a reader.
+func deliverable(t *testing.T, node *app.App, sequence data.Sequence) (message data2.Message) {
+	t.Helper()
+	err := app.ReadLog(node.DataDir, sequence, func(m data2.Message) error {
+		message = m
+		return app.ErrStopReading
+	})
+	if err == nil {
+		message, err = app.Deliverable(node.Keys, message)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return message
+}
+
+func TestReplication(t *testing.T) {
+	server := httpTestServer(t)
+	leader := appServer
+	listFollower("b", "b-token")
+	testRequest(t, http.StatusOK, "POST", server.URL+"/message", http.Header{"X-Afterme-Subject": {"alice"}},
+		"alice's address\n")
+	testRequest(t, http.StatusOK, "POST", server.URL+"/message", nil, "b\n")
+	testRequest(t, http.StatusOK, "POST", server.URL+"/message", nil, "c\n")
+
+	follower := startFollower(t, server.URL, "b", "b-token")
+	eventually(t, "the follower to sync 3 messages", func() bool { return follower.Synced() >= 3 })
+	copied, _ := ioutil.ReadFile(filepath.Join(follower.DataDir, "2-1.log"))
+	original, _ := ioutil.ReadFile(filepath.Join(leader.DataDir, "2-1.log"))
+	if !bytes.Equal(copied, original) {
+		t.Fatal("Expected the follower's data file to be the same as the leader's")
+	}
+	eventually(t, "the follower's acks to be counted", func() bool {
+		followers := leader.Followers()
+		return len(followers) == 1 && followers[0].Id == "b" && followers[0].Replicated == 3
+	})
+
+	// The data key comes with the sealed body, so it reads the same as on the leader, until it's erased there
+	if m := deliverable(t, follower, 1); string(m.Body) != "alice's address\n" || app.Erased(m) {
+		t.Fatalf("Expected alice's body on the follower, got %q", m.Body)
+	}
+	testRequest(t, http.StatusOK, "DELETE", server.URL+"/subjects/alice", nil, "")
+	eventually(t, "the erasure to reach the follower", func() bool { return app.Erased(deliverable(t, follower, 1)) })
+
+	// A key made for alice after she's erased is a new one, it's copied but the old one stays erased
+	testRequest(t, http.StatusOK, "POST", server.URL+"/message", http.Header{"X-Afterme-Subject": {"alice"}},
+		"alice's new address\n")
+	eventually(t, "the follower to sync 4 messages", func() bool { return follower.Synced() >= 4 })
+	if m := deliverable(t, follower, 4); string(m.Body) != "alice's new address\n" {
+		t.Fatalf("Expected alice's new body on the follower, got %q", m.Body)
+	}
+	if !app.Erased(deliverable(t, follower, 1)) {
+		t.Fatal("Expected alice's old body to stay erased")
+	}
+}
+
+func TestReplicationAcks(t *testing.T) {
+	server := httpTestServer(t)
+	listFollower("b", "b-token")
+	appServer.Config.Replication.Quorum, appServer.Config.Replication.Timeout = 1, "100ms"
+
+	// Nobody has the write, so it times out, and acks from followers that aren't who they say don't count
+	testRequest(t, http.StatusGatewayTimeout, "POST", server.URL+"/message", nil, "a\n")
+	forged := []struct {
+		query  string
+		header http.Header
+	}{
+		{"follower=any&replicated=1000", nil},
+		{"follower=b&replicated=1000", nil},
+		{"follower=b&replicated=1000", http.Header{"X-Afterme-Replication-Token": {"any"}}},
+		{"follower=any&replicated=1000", http.Header{"X-Afterme-Replication-Token": {"b-token"}}},
+	}
+	for _, f := range forged {
+		testRequest(t, http.StatusForbidden, "GET", server.URL+"/segments/2-1.log?offset=0&"+f.query, f.header, "")
+	}
+	if followers := appServer.Followers(); len(followers) != 0 {
+		t.Fatalf("Expected no followers, got %+v", followers)
+	}
+	testRequest(t, http.StatusGatewayTimeout, "POST", server.URL+"/message", nil, "b\n")
+
+	// Nor are keys sent to anyone else
+	testRequest(t, http.StatusGatewayTimeout, "POST", server.URL+"/message", http.Header{"X-Afterme-Subject": {"alice"}},
+		"c\n")
+	testRequest(t, http.StatusForbidden, "GET", server.URL+"/replication/keys", nil, "")
+	testRequest(t, http.StatusForbidden, "GET", server.URL+"/replication/keys?follower=b", nil, "")
+
+	// The follower itself is counted
+	token := http.Header{"X-Afterme-Replication-Token": {"b-token"}}
+	testRequest(t, http.StatusOK, "GET", server.URL+"/segments/2-1.log?offset=0&follower=b&replicated=3", token, "")
+	if followers := appServer.Followers(); len(followers) != 1 || followers[0].Replicated != 3 {
+		t.Fatalf("Expected follower b to have 3, got %+v", followers)
+	}
+	_, listed := testRequest(t, http.StatusOK, "GET", server.URL+"/replication/keys?follower=b", token, "")
+	if fields := strings.Fields(listed); len(fields) != 2 || fields[0] != keystore.Name("alice") {
+		t.Fatalf("Expected alice's key to be listed, got %q", listed)
+	}
+	testRequest(t, http.StatusNotFound, "GET", server.URL+"/replication/keys/"+keystore.Name("bob")+"?follower=b", token,
+		"")
+	testRequest(t, http.StatusBadRequest, "GET", server.URL+"/replication/keys/x?follower=b", token, "")
+}
+
+func TestReplicationSchemas(t *testing.T) {
+	server := httpTestServer(t)
+	listFollower("b", "b-token")
+	testRequest(t, http.StatusCreated, "POST", server.URL+"/admin/schemas/orders", nil, `{"type": "object"}`)
+	testRequest(t, http.StatusOK, "POST", server.URL+"/message", nil, "a\n")
+
+	// The follower copies the leader's schemas, and those registered later
+	follower := startFollower(t, server.URL, "b", "b-token")
+	copied := func(count int) func() bool {
+		return func() bool {
+			n, _ := follower.Schemas.Count()
+			return n == count && !follower.SchemasBehind()
+		}
+	}
+	eventually(t, "the follower to copy orders' schema", copied(1))
+	testRequest(t, http.StatusCreated, "POST", server.URL+"/admin/schemas/orders", nil, `{"type": "array"}`)
+	testRequest(t, http.StatusOK, "POST", server.URL+"/message", nil, "b\n")
+	eventually(t, "the follower to copy version 2", copied(2))
+	if document, _ := follower.Schemas.Document("orders", 2); string(document) != `{"type": "array"}` {
+		t.Fatalf("Expected the follower's version 2 to be the leader's, got %s", document)
+	}
+
+	// Only followers are sent them
+	testRequest(t, http.StatusForbidden, "GET", server.URL+"/replication/schemas", nil, "")
+	token := http.Header{"X-Afterme-Replication-Token": {"b-token"}}
+	_, listed := testRequest(t, http.StatusOK, "GET", server.URL+"/replication/schemas?follower=b", token, "")
+	if lines := strings.Fields(listed); len(lines) != 4 {
+		t.Fatalf("Expected two versions listed, got %q", listed)
+	}
+	testRequest(t, http.StatusNotFound, "GET", server.URL+"/replication/schemas/orders/3?follower=b", token, "")
+}
@@ -0,0 +1,692 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/saem/afterme/app"
+	"github.com/saem/afterme/auth"
+	"github.com/saem/afterme/data"
+	"github.com/saem/afterme/data2"
+	"github.com/saem/afterme/resp"
+	"github.com/saem/afterme/wire"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The Redis Streams front end, for tooling that speaks RESP (see the resp package): XADD, XLEN, XRANGE, XREVRANGE,
+// XREAD, BLOCK and all, and XINFO STREAM. A Redis stream is an afterme stream, an entry ID is <sequence>-0, and an
+// entry's fields are its message's body, a JSON object of them. XADD writes one, replying once it's durable, as
+// POST /message does, and only takes * for the ID, afterme assigns sequences. Trimming is retention's job, so
+// there's no MAXLEN or MINID, and Redis consumer groups aren't there, they're worker groups over HTTP.
+//
+// Replies to pipelined commands are sent together, once each is done, so pipelined XADDs are written together too.
+//
+// With auth a connection sends AUTH [username] token before anything else, the username being the principal's name
+// if there is one. Reading a stream needs read on it, blocking on one with XREAD subscribe, and XADD append.
+
+// respReply writes a command's reply, it's called once the replies of the commands before it have been written.
+type respReply func(w *bufio.Writer) error
+
+// respSession is who's sending a connection's commands.
+type respSession struct {
+	producer      string          // From their TLS client certificate, see producer
+	principal     *auth.Principal // Who AUTH authenticated them as
+	authenticated bool            // Whether they have, or there's no need to
+
+	conn    net.Conn
+	reader  *bufio.Reader
+	ctx     context.Context // Cancelled when the client goes while replies are written, nil when it's not watched
+	stop    context.CancelFunc
+	watched chan struct{} // Closed once the watcher's done with reader
+}
+
+// watch is a context that's cancelled if the client goes away, for a reply that waits. Nothing reads the connection
+// while replies are written, so without it a read blocking forever would never notice. The watcher peeks at the
+// connection until unwatch, a client that's pipelined something after the command isn't watched any further.
+func (session *respSession) watch() context.Context {
+	if session.ctx != nil {
+		return session.ctx
+	}
+	session.ctx, session.stop = context.WithCancel(context.Background())
+	session.watched = make(chan struct{})
+	go func() {
+		defer close(session.watched)
+		if _, err := session.reader.Peek(1); err != nil {
+			if e, ok := err.(net.Error); !ok || !e.Timeout() {
+				session.stop()
+			}
+		}
+	}()
+
+	return session.ctx
+}
+
+// unwatch stops watch's watcher, if there is one, so the connection's commands can be read again.
+func (session *respSession) unwatch() {
+	if session.ctx == nil {
+		return
+	}
+	session.conn.SetReadDeadline(time.Now())
+	<-session.watched
+	session.conn.SetReadDeadline(time.Time{})
+	session.stop()
+	session.ctx = nil
+}
+
+func listenRESP(addr string) error {
+	listener, err := listenerTLS.listen(addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				appServer.Logger.Printf("Could not accept a RESP connection: %s", err.Error())
+				time.Sleep(time.Second)
+				continue
+			}
+			go serveRESP(conn)
+		}
+	}()
+
+	return nil
+}
+
+// serveRESP reads commands until the client's done, or quits.
+func serveRESP(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReaderSize(conn, 64*1024)
+	writer := bufio.NewWriterSize(conn, 64*1024)
+	session := &respSession{producer: connProducer(conn), authenticated: !authEnabled, conn: conn, reader: reader}
+
+	var replies []respReply
+	for {
+		args, err := resp.ReadCommand(reader)
+		if err != nil {
+			if err != io.EOF {
+				resp.WriteError(writer, "ERR Protocol error: "+err.Error())
+				writer.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := strings.ToUpper(args[0]) == "QUIT"
+		replies = append(replies, respCommand(args, session))
+		if reader.Buffered() > 0 && len(replies) < MaxInFlight && !quit {
+			continue // There's more pipelined
+		}
+
+		for _, reply := range replies {
+			reply(writer) // A bufio.Writer's errors stick, Flush has them
+		}
+		session.unwatch()
+		replies = replies[:0]
+		if err = writer.Flush(); err != nil || quit {
+			return
+		}
+	}
+}
+
+// respCommand starts on a command from a session, and is its reply.
+func respCommand(args []string, session *respSession) respReply {
+	name := strings.ToUpper(args[0])
+	wrongArgs := errorReply("ERR wrong number of arguments for '%s' command", strings.ToLower(name))
+	if !session.authenticated && name != "AUTH" && name != "QUIT" {
+		return errorReply("NOAUTH Authentication required.")
+	}
+	switch name {
+	case "AUTH":
+		if len(args) != 2 && len(args) != 3 {
+			return wrongArgs
+		}
+		return respAuth(args[1:], session)
+	case "PING":
+		if len(args) > 1 {
+			return bulkReply(args[1])
+		}
+		return simpleReply("PONG")
+	case "ECHO":
+		if len(args) != 2 {
+			return wrongArgs
+		}
+		return bulkReply(args[1])
+	case "SELECT":
+		if len(args) != 2 {
+			return wrongArgs
+		}
+		if args[1] != "0" {
+			return errorReply("ERR DB index is out of range")
+		}
+		return simpleReply("OK")
+	case "QUIT", "CLIENT":
+		return simpleReply("OK")
+	case "COMMAND":
+		// Asked for by redis-cli when it starts, there are no command docs to give it
+		return func(w *bufio.Writer) error { return resp.WriteArray(w, 0) }
+	case "XADD":
+		if len(args) < 5 || len(args)%2 != 1 {
+			return wrongArgs
+		}
+		return xadd(args[1], args[2], args[3:], session)
+	case "XLEN":
+		if len(args) != 2 {
+			return wrongArgs
+		}
+		if denial := respDenied(session.principal, auth.Read, args[1]); denial != nil {
+			return denial
+		}
+		return xlen(args[1])
+	case "XRANGE", "XREVRANGE":
+		if len(args) != 4 && len(args) != 6 {
+			return wrongArgs
+		}
+		if denial := respDenied(session.principal, auth.Read, args[1]); denial != nil {
+			return denial
+		}
+		return xrange(args[1:], name == "XREVRANGE")
+	case "XREAD":
+		return xread(args[1:], session)
+	case "XINFO":
+		if len(args) < 2 {
+			return wrongArgs
+		}
+		if len(args) > 2 {
+			if denial := respDenied(session.principal, auth.Read, args[2]); denial != nil {
+				return denial
+			}
+		}
+		return xinfo(args[1:])
+	default:
+		return errorReply("ERR unknown command '%s'", args[0])
+	}
+}
+
+// respAuth is AUTH [username] token, authenticating the session as the principal the token belongs to. A username
+// other than default has to be the principal's name.
+func respAuth(args []string, session *respSession) respReply {
+	if !authEnabled {
+		return errorReply("ERR AUTH <password> called without any password configured for the default user. " +
+			"Are you sure your configuration is correct?")
+	}
+	principal, ok := authenticate(args[len(args)-1])
+	if !ok || (len(args) == 2 && args[0] != "default" && args[0] != principal.Name) {
+		return errorReply("WRONGPASS invalid username-password pair or user is disabled.")
+	}
+	session.principal, session.authenticated = principal, true
+
+	return simpleReply("OK")
+}
+
+// respDenied is the reply when principal can't do operation on stream, nil when it can.
+func respDenied(principal *auth.Principal, operation string, stream string) respReply {
+	if allowed(principal, operation, stream) {
+		return nil
+	}
+
+	return errorReply("NOPERM %s", denied(principal, operation, stream))
+}
+
+// xadd writes an entry of fields, field value pairs, to stream, replying with its ID once it's durable.
+func xadd(stream string, id string, fields []string, session *respSession) respReply {
+	switch strings.ToUpper(id) {
+	case "*":
+	case "NOMKSTREAM", "MAXLEN", "MINID":
+		return errorReply("ERR %s isn't supported, streams are trimmed by retention", strings.ToUpper(id))
+	default:
+		return errorReply("ERR afterme assigns entry IDs, XADD only takes *")
+	}
+
+	var body bytes.Buffer
+	body.WriteByte('{')
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			body.WriteByte(',')
+		}
+		name, _ := json.Marshal(fields[i])
+		value, _ := json.Marshal(fields[i+1])
+		body.Write(name)
+		body.WriteByte(':')
+		body.Write(value)
+	}
+	body.WriteByte('}')
+
+	f := requestAppend(wire.Append{Body: body.Bytes(),
+		Attributes: map[string]string{data2.AttrStream: stream, data2.AttrContentType: "application/json"}},
+		session.producer, session.principal)
+	return func(w *bufio.Writer) error {
+		ack := durableAck(f)
+		if ack.Kind == wire.FrameError && ack.Code == http.StatusForbidden {
+			return resp.WriteError(w, "NOPERM "+ack.Message)
+		}
+		if ack.Kind == wire.FrameError {
+			return resp.WriteError(w, "ERR "+ack.Message)
+		}
+		return resp.WriteBulk(w, respID(data.Sequence(ack.Sequence)))
+	}
+}
+
+func xlen(stream string) respReply {
+	return func(w *bufio.Writer) error {
+		length, _, _, err := streamInfo(stream)
+		if err != nil {
+			return readFailed(w, err)
+		}
+		return resp.WriteInteger(w, length)
+	}
+}
+
+// xrange is XRANGE key start end [COUNT count], or XREVRANGE key end start [COUNT count] if reverse.
+func xrange(args []string, reverse bool) respReply {
+	stream, start, end := args[0], args[1], args[2]
+	if reverse {
+		start, end = end, start
+	}
+	count := -1
+	if len(args) == 5 {
+		if strings.ToUpper(args[3]) != "COUNT" {
+			return errorReply("ERR syntax error")
+		}
+		n, err := strconv.Atoi(args[4])
+		if err != nil {
+			return errorReply("ERR value is not an integer or out of range")
+		}
+		if count = n; count < 0 {
+			count = -1 // As Redis has it, a negative count is no count
+		}
+	}
+	from, to, err := respRange(start, end)
+	if err != nil {
+		return errorReply("ERR %s", err.Error())
+	}
+
+	return func(w *bufio.Writer) error {
+		if count == 0 {
+			return resp.WriteArray(w, 0)
+		}
+		if to > appServer.Committed() {
+			to = appServer.Committed()
+		}
+		var entries []data2.Message
+		var err error
+		if reverse {
+			entries, err = readStreamBackwards(stream, from, to, count)
+		} else {
+			var read [][]data2.Message
+			if read, err = readStreams([]string{stream}, []data.Sequence{from}, to, count); err == nil {
+				entries = read[0]
+			}
+		}
+		if err != nil {
+			return readFailed(w, err)
+		}
+		return writeEntries(w, entries)
+	}
+}
+
+// xread is XREAD [COUNT count] [BLOCK milliseconds] STREAMS key [key ...] id [id ...], reading the entries of each
+// stream after its id, $ being the last entry there is. If there aren't any and it blocks, it waits until there are,
+// or the time's up, 0 being no limit, or the client goes. The session's principal needs read on the streams, or
+// subscribe to block on them.
+func xread(args []string, session *respSession) respReply {
+	count, block := -1, time.Duration(-1)
+	for len(args) > 0 && strings.ToUpper(args[0]) != "STREAMS" {
+		if len(args) < 2 {
+			return errorReply("ERR syntax error")
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 {
+			return errorReply("ERR value is not an integer or out of range")
+		}
+		switch strings.ToUpper(args[0]) {
+		case "COUNT":
+			if count = n; count == 0 {
+				count = -1
+			}
+		case "BLOCK":
+			block = time.Duration(n) * time.Millisecond
+		default:
+			return errorReply("ERR syntax error")
+		}
+		args = args[2:]
+	}
+	if len(args) < 3 || len(args)%2 != 1 {
+		return errorReply("ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified.")
+	}
+
+	streams := args[1 : 1+len(args)/2]
+	operation := auth.Read
+	if block >= 0 {
+		operation = auth.Subscribe
+	}
+	for _, stream := range streams {
+		if denial := respDenied(session.principal, operation, stream); denial != nil {
+			return denial
+		}
+	}
+	froms := make([]data.Sequence, len(streams)) // 0 for $, it's after what's committed when the reply's made
+	for i, id := range args[1+len(args)/2:] {
+		if id == "$" {
+			continue
+		}
+		sequence, _, err := parseID(id)
+		if err != nil {
+			return errorReply("ERR %s", err.Error())
+		}
+		froms[i] = sequence + 1
+	}
+
+	return func(w *bufio.Writer) error {
+		for i := range froms {
+			if froms[i] == 0 {
+				froms[i] = appServer.Committed() + 1
+			}
+		}
+		var timeout <-chan time.Time
+		if block > 0 {
+			timer := time.NewTimer(block)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		poll := time.NewTicker(subscribePoll)
+		defer poll.Stop()
+
+		for {
+			changed := appServer.SyncedChanged()
+			read, err := readStreams(streams, froms, appServer.Committed(), count)
+			if err != nil {
+				return readFailed(w, err)
+			}
+			found := 0
+			for _, entries := range read {
+				if len(entries) > 0 {
+					found++
+				}
+			}
+			if found > 0 {
+				resp.WriteArray(w, found)
+				for i, entries := range read {
+					if len(entries) > 0 {
+						resp.WriteArray(w, 2)
+						resp.WriteBulk(w, streams[i])
+						writeEntries(w, entries)
+					}
+				}
+				return nil
+			}
+			if block < 0 {
+				return resp.WriteNullArray(w)
+			}
+
+			select {
+			case <-timeout:
+				return resp.WriteNullArray(w)
+			case <-session.watch().Done():
+				return nil // There's no one to reply to
+			case <-changed:
+			case <-poll.C:
+			}
+		}
+	}
+}
+
+// xinfo is XINFO STREAM key, and XINFO GROUPS key, there being no groups.
+func xinfo(args []string) respReply {
+	switch subcommand := strings.ToUpper(args[0]); {
+	case subcommand == "GROUPS" && len(args) == 2:
+		return func(w *bufio.Writer) error { return resp.WriteArray(w, 0) }
+	case subcommand == "STREAM" && len(args) == 2:
+	case subcommand == "STREAM" || subcommand == "GROUPS":
+		return errorReply("ERR syntax error")
+	default:
+		return errorReply("ERR unknown subcommand '%s'", args[0])
+	}
+
+	return func(w *bufio.Writer) error {
+		length, first, last, err := streamInfo(args[1])
+		if err == nil && length > 0 {
+			if first, err = app.Deliverable(appServer.Keys, first); err == nil {
+				last, err = app.Deliverable(appServer.Keys, last)
+			}
+		}
+		if err != nil {
+			return readFailed(w, err)
+		}
+		if length == 0 {
+			return resp.WriteError(w, "ERR no such key")
+		}
+		resp.WriteArray(w, 12)
+		resp.WriteBulk(w, "length")
+		resp.WriteInteger(w, length)
+		resp.WriteBulk(w, "last-generated-id")
+		resp.WriteBulk(w, respID(last.Sequence))
+		resp.WriteBulk(w, "entries-added")
+		resp.WriteInteger(w, length)
+		resp.WriteBulk(w, "groups")
+		resp.WriteInteger(w, 0)
+		resp.WriteBulk(w, "first-entry")
+		writeEntry(w, first)
+		resp.WriteBulk(w, "last-entry")
+		return writeEntry(w, last)
+	}
+}
+
+// streamInfo is how many committed messages stream has, and its first and last, as they're stored, they're only
+// made deliverable by those that want them so counting doesn't mean decrypting every one.
+func streamInfo(stream string) (length int64, first data2.Message, last data2.Message, err error) {
+	to := appServer.Committed()
+	err = app.ReadLog(appServer.DataDir, 1, func(m data2.Message) error {
+		if m.Sequence > to {
+			return app.ErrStopReading
+		}
+		if m.Attributes[data2.AttrStream] != stream {
+			return nil
+		}
+		if length == 0 {
+			first = m
+		}
+		length++
+		last = m
+		return nil
+	})
+
+	return length, first, last, err
+}
+
+// readStreamBackwards reads the committed messages of stream from to back to from, last first, no more than count
+// unless count is -1, only reading as far back through the log as it takes to find them.
+func readStreamBackwards(stream string, from data.Sequence, to data.Sequence, count int) (read []data2.Message,
+	err error) {
+	err = app.ReadLogBackwards(appServer.DataDir, from, to, func(m data2.Message) bool {
+		return m.Attributes[data2.AttrStream] == stream
+	}, func(m data2.Message) error {
+		m, err := app.Deliverable(appServer.Keys, m)
+		if err != nil {
+			return err
+		}
+		read = append(read, m)
+		if len(read) == count {
+			return app.ErrStopReading
+		}
+		return nil
+	})
+
+	return read, err
+}
+
+// readStreams reads the committed messages of each of streams, from its from up to to, no more than count of each
+// unless count is -1.
+func readStreams(streams []string, froms []data.Sequence, to data.Sequence, count int) (read [][]data2.Message,
+	err error) {
+	read = make([][]data2.Message, len(streams))
+	from, wanted := to+1, 0
+	for _, f := range froms {
+		if f < from {
+			from = f
+		}
+	}
+	for _, f := range froms {
+		if f <= to {
+			wanted++
+		}
+	}
+	if wanted == 0 {
+		return read, nil
+	}
+
+	err = app.ReadLog(appServer.DataDir, from, func(m data2.Message) error {
+		if m.Sequence > to {
+			return app.ErrStopReading
+		}
+		for i, stream := range streams {
+			if m.Attributes[data2.AttrStream] != stream || m.Sequence < froms[i] || len(read[i]) == count {
+				continue
+			}
+			m, err := app.Deliverable(appServer.Keys, m)
+			if err != nil {
+				return err
+			}
+			read[i] = append(read[i], m)
+			if len(read[i]) == count {
+				if wanted--; wanted == 0 {
+					return app.ErrStopReading
+				}
+			}
+		}
+		return nil
+	})
+
+	return read, err
+}
+
+// respRange parses XRANGE's start and end, - and + being the first and last entries, and ( before an ID making it
+// exclusive. + is as far as there could be, what's committed is up to the reply.
+func respRange(start string, end string) (from data.Sequence, to data.Sequence, err error) {
+	from, to = 1, math.MaxUint64
+	if start != "-" {
+		sequence, after, err := parseID(strings.TrimPrefix(start, "("))
+		if err != nil {
+			return 0, 0, err
+		}
+		if from = sequence; after || strings.HasPrefix(start, "(") {
+			from++
+		}
+	}
+	if end != "+" {
+		sequence, after, err := parseID(strings.TrimPrefix(end, "("))
+		if err != nil {
+			return 0, 0, err
+		}
+		if sequence < to {
+			to = sequence
+			if !after && strings.HasPrefix(end, "(") && to > 0 {
+				to--
+			}
+		}
+	}
+
+	return from, to, nil
+}
+
+// parseID parses an entry ID, <sequence>-<n> or <sequence>, after is whether n isn't 0, so the ID falls between
+// sequence's entry and the next.
+func parseID(id string) (sequence data.Sequence, after bool, err error) {
+	s, n, found := strings.Cut(id, "-")
+	parsed, err := strconv.ParseUint(s, 10, 64)
+	if err == nil && found {
+		var m uint64
+		m, err = strconv.ParseUint(n, 10, 64)
+		after = m > 0
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("Invalid stream ID specified as stream command argument")
+	}
+
+	return data.Sequence(parsed), after, nil
+}
+
+// respID is a sequence's entry ID.
+func respID(sequence data.Sequence) string {
+	return strconv.FormatUint(uint64(sequence), 10) + "-0"
+}
+
+// respFields are a message's fields as an entry's: those of its body if it's a JSON object, in order, with string
+// values as they are and others as JSON, otherwise a body field of the whole of it.
+func respFields(body []byte) (fields []string) {
+	body = bytes.TrimSuffix(body, []byte("\n"))
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return []string{"body", string(body)}
+	}
+	for decoder.More() {
+		name, err := decoder.Token()
+		var value json.RawMessage
+		if err == nil {
+			err = decoder.Decode(&value)
+		}
+		if err != nil {
+			return []string{"body", string(body)}
+		}
+		var s string
+		if json.Unmarshal(value, &s) != nil {
+			s = string(value)
+		}
+		fields = append(fields, name.(string), s)
+	}
+	if _, err := decoder.Token(); err != nil || decoder.More() {
+		return []string{"body", string(body)}
+	}
+
+	return fields
+}
+
+func writeEntries(w *bufio.Writer, entries []data2.Message) (err error) {
+	err = resp.WriteArray(w, len(entries))
+	for _, m := range entries {
+		err = writeEntry(w, m)
+	}
+
+	return err
+}
+
+// writeEntry writes a message as an entry, its ID and its fields.
+func writeEntry(w *bufio.Writer, m data2.Message) (err error) {
+	fields := respFields(m.Body)
+	resp.WriteArray(w, 2)
+	resp.WriteBulk(w, respID(m.Sequence))
+	err = resp.WriteArray(w, len(fields))
+	for _, field := range fields {
+		err = resp.WriteBulk(w, field)
+	}
+
+	return err
+}
+
+func readFailed(w *bufio.Writer, err error) error {
+	appServer.Logger.Printf("RESP read failed: %s", err.Error())
+	return resp.WriteError(w, "ERR Something went wrong reading")
+}
+
+func simpleReply(s string) respReply {
+	return func(w *bufio.Writer) error { return resp.WriteSimple(w, s) }
+}
+
+func bulkReply(s string) respReply {
+	return func(w *bufio.Writer) error { return resp.WriteBulk(w, s) }
+}
+
+func errorReply(format string, args ...interface{}) respReply {
+	message := fmt.Sprintf(format, args...)
+	return func(w *bufio.Writer) error { return resp.WriteError(w, message) }
+}
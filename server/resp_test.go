@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bufio"
+	"github.com/saem/afterme/resp"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// respClient is a connection to the Redis Streams front end.
+type respClient struct {
+	t      *testing.T
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+// respTestServer starts an App and the Redis Streams front end on a local listener, and dials it.
+func respTestServer(t *testing.T) (dial func() *respClient) {
+	startTestApp(t)
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveRESP(conn)
+		}
+	}()
+
+	return func() *respClient {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return &respClient{t: t, reader: bufio.NewReader(conn), writer: bufio.NewWriter(conn)}
+	}
+}
+
+func (c *respClient) send(args ...string) {
+	resp.WriteCommand(c.writer, args...)
+	if err := c.writer.Flush(); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *respClient) expect(expected interface{}) {
+	c.t.Helper()
+	reply, err := resp.ReadReply(c.reader)
+	if err != nil || !reflect.DeepEqual(reply, expected) {
+		c.t.Fatalf("Expected %#v, got %#v, %v", expected, reply, err)
+	}
+}
+
+func (c *respClient) do(expected interface{}, args ...string) {
+	c.t.Helper()
+	c.send(args...)
+	c.expect(expected)
+}
+
+// respEntry is an entry as a reply has it.
+func respEntry(id string, fields ...interface{}) []interface{} {
+	return []interface{}{id, fields}
+}
+
+func TestRESP(t *testing.T) {
+	dial := respTestServer(t)
+	c := dial()
+
+	c.do("PONG", "PING")
+	c.do("1-0", "XADD", "orders", "*", "total", "12", "customer", "c1")
+	// Pipelined
+	c.send("XADD", "other", "*", "n", "1")
+	c.send("XADD", "orders", "*", "total", "7")
+	c.send("XADD", "orders", "5-0", "total", "7")
+	c.send("XLEN", "other")
+	c.expect("2-0")
+	c.expect("3-0")
+	c.expect(resp.Error("ERR afterme assigns entry IDs, XADD only takes *"))
+	c.expect(int64(1))
+	c.do(resp.Error("ERR MAXLEN isn't supported, streams are trimmed by retention"),
+		"XADD", "orders", "MAXLEN", "10", "*", "a", "b")
+
+	c.do(int64(2), "XLEN", "orders")
+	c.do(int64(0), "XLEN", "nothing")
+	c.do([]interface{}{respEntry("1-0", "total", "12", "customer", "c1"), respEntry("3-0", "total", "7")},
+		"XRANGE", "orders", "-", "+")
+	c.do([]interface{}{respEntry("3-0", "total", "7")}, "XRANGE", "orders", "(1-0", "+")
+	c.do([]interface{}{respEntry("3-0", "total", "7")}, "XREVRANGE", "orders", "+", "-", "COUNT", "1")
+	c.do([]interface{}{respEntry("3-0", "total", "7"), respEntry("1-0", "total", "12", "customer", "c1")},
+		"XREVRANGE", "orders", "+", "-")
+	c.do([]interface{}{respEntry("1-0", "total", "12", "customer", "c1")}, "XREVRANGE", "orders", "(3-0", "-")
+	c.do([]interface{}{}, "XREVRANGE", "orders", "+", "-", "COUNT", "0")
+	c.do([]interface{}{}, "XRANGE", "orders", "4", "+")
+	c.do(resp.Error("ERR Invalid stream ID specified as stream command argument"), "XRANGE", "orders", "x", "+")
+
+	c.do([]interface{}{[]interface{}{"orders", []interface{}{respEntry("3-0", "total", "7")}},
+		[]interface{}{"other", []interface{}{respEntry("2-0", "n", "1")}}},
+		"XREAD", "COUNT", "5", "STREAMS", "orders", "other", "1-0", "0")
+	c.do(nil, "XREAD", "STREAMS", "orders", "$")
+	c.do(nil, "XREAD", "BLOCK", "10", "STREAMS", "orders", "$")
+
+	// A blocked read gets the next entry once it's committed
+	c.send("XREAD", "BLOCK", "0", "STREAMS", "orders", "$")
+	time.Sleep(50 * time.Millisecond)
+	dial().do("4-0", "XADD", "orders", "*", "total", "3")
+	c.expect([]interface{}{[]interface{}{"orders", []interface{}{respEntry("4-0", "total", "3")}}})
+
+	c.do([]interface{}{"length", int64(3),
+		"last-generated-id", "4-0",
+		"entries-added", int64(3),
+		"groups", int64(0),
+		"first-entry", respEntry("1-0", "total", "12", "customer", "c1"),
+		"last-entry", respEntry("4-0", "total", "3")},
+		"XINFO", "STREAM", "orders")
+	c.do(resp.Error("ERR no such key"), "XINFO", "STREAM", "nothing")
+	c.do(resp.Error("ERR unknown command 'SET'"), "SET", "a", "b")
+}
+
+func TestRESPBlockDisconnect(t *testing.T) {
+	startTestApp(t)
+	conn, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		serveRESP(conn)
+		close(done)
+	}()
+
+	// A client that goes while its read's blocked forever doesn't leave the connection being served
+	c := &respClient{t: t, reader: bufio.NewReader(client), writer: bufio.NewWriter(client)}
+	c.do("PONG", "PING")
+	c.send("XREAD", "BLOCK", "0", "STREAMS", "orders", "$")
+	time.Sleep(50 * time.Millisecond)
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the connection to be done with once the client went")
+	}
+}
+
+func TestRESPFields(t *testing.T) {
+	tests := map[string][]string{
+		"{\"total\": 12, \"customer\": {\"id\": \"c1\"}, \"note\": \"hi\"}\n": {"total", "12", "customer", `{"id": "c1"}`,
+			"note", "hi"},
+		"[1, 2]\n":      {"body", "[1, 2]"},
+		"not json\n":    {"body", "not json"},
+		"{\"a\": 1} {}": {"body", "{\"a\": 1} {}"},
+	}
+	for body, expected := range tests {
+		if fields := respFields([]byte(body)); !reflect.DeepEqual(fields, expected) {
+			t.Fatalf("Expected %q's fields to be %q, got %q", body, expected, fields)
+		}
+	}
+}
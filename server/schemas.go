@@ -0,0 +1,163 @@
+package server
+
+import (
+	"fmt"
+	"github.com/saem/afterme/app"
+	"github.com/saem/afterme/auth"
+	"github.com/saem/afterme/schema"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Schemas, see the schema package. Writes to a stream with a schema are validated against it, and refused with a 422
+// if they don't match.
+
+// MaxSchemaSize is the biggest schema that can be registered.
+const MaxSchemaSize = 1024 * 1024
+
+// The schema registry, GET /admin/schemas for every stream's versions, GET /admin/schemas/<stream> for one's,
+// GET /admin/schemas/<stream>/<version> or /latest for a schema, and POST /admin/schemas/<stream> with a JSON Schema
+// in the body to register it as the stream's next version. With auth, reading a stream's schemas needs read on it, and
+// registering one admin.
+func schemasHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/schemas"), "/")
+	stream, version := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		stream, version = path[:i], path[i+1:]
+	}
+
+	principal := requestPrincipal(r)
+	operation := auth.Read
+	if r.Method != "GET" {
+		operation = auth.Admin
+	}
+	if stream != "" && !allowed(principal, operation, stream) {
+		http.Error(w, denied(principal, operation, stream), http.StatusForbidden)
+
+		return
+	}
+
+	switch {
+	case stream == "" && r.Method == "GET":
+		streams, err := appServer.Schemas.Streams()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Could not list schemas: %s", err.Error()), http.StatusInternalServerError)
+
+			return
+		}
+		for stream := range streams {
+			if !allowed(principal, auth.Read, stream) {
+				delete(streams, stream)
+			}
+		}
+		writeJSON(w, streams)
+	case stream != "" && version == "" && r.Method == "GET":
+		versions, err := appServer.Schemas.Versions(stream)
+		if err == nil && len(versions) == 0 {
+			http.NotFound(w, r)
+
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+		writeJSON(w, struct {
+			Stream   string `json:"stream"`
+			Versions []int  `json:"versions"`
+		}{stream, versions})
+	case stream != "" && version != "" && r.Method == "GET":
+		readSchema(w, r, stream, version)
+	case stream != "" && version == "" && r.Method == "POST":
+		registerSchema(w, r, stream)
+	default:
+		http.Error(w, "GET /admin/schemas[/<stream>[/<version>]] or POST /admin/schemas/<stream>",
+			http.StatusMethodNotAllowed)
+	}
+}
+
+func readSchema(w http.ResponseWriter, r *http.Request, stream string, value string) {
+	version, err := strconv.Atoi(value)
+	if value == "latest" {
+		version, err = 0, nil
+	}
+	if err != nil || version < 0 {
+		http.Error(w, "The version is a number, or latest", http.StatusBadRequest)
+
+		return
+	}
+
+	document, err := appServer.Schemas.Document(stream, version)
+	switch err {
+	case nil:
+		w.Header().Set("Content-Type", "application/schema+json")
+		w.Write(document)
+	case schema.ErrUnknownVersion:
+		http.NotFound(w, r)
+	case schema.ErrInvalidStream:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, fmt.Sprintf("Could not read schema: %s", err.Error()), http.StatusInternalServerError)
+	}
+}
+
+func registerSchema(w http.ResponseWriter, r *http.Request, stream string) {
+	// Only the node taking writes registers schemas, the others copy them from it
+	if appServer.Leader != "" {
+		http.Error(w, fmt.Sprintf("This is a read only follower, register schemas with the leader: %s",
+			appServer.Leader), http.StatusServiceUnavailable)
+
+		return
+	}
+	if leader, leading := appServer.WriteLeader(); !leading {
+		if leader == "" {
+			http.Error(w, "There's no cluster leader right now, try again shortly", http.StatusServiceUnavailable)
+
+			return
+		}
+		http.Redirect(w, r, leader+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+
+		return
+	}
+	if appServer.SchemasBehind() {
+		http.Error(w, app.ErrSchemasBehind.Error(), http.StatusServiceUnavailable)
+
+		return
+	}
+	document, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxSchemaSize+1))
+	if err != nil || len(document) > MaxSchemaSize {
+		http.Error(w, fmt.Sprintf("A schema no bigger than %db is required", MaxSchemaSize), http.StatusBadRequest)
+
+		return
+	}
+
+	if _, err = schema.Compile(document); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	version, added, err := appServer.Schemas.Register(stream, document)
+	if err == schema.ErrInvalidStream {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not register schema: %s", err.Error()), http.StatusInternalServerError)
+
+		return
+	}
+
+	if added {
+		w.WriteHeader(http.StatusCreated)
+	}
+	writeJSON(w, struct {
+		Stream  string `json:"stream"`
+		Version int    `json:"version"`
+	}{stream, version})
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSchemaValidation(t *testing.T) {
+	server := httpTestServer(t)
+	testRequest(t, http.StatusCreated, "POST", server.URL+"/admin/schemas/orders", nil,
+		`{"type": "object", "required": ["id"]}`)
+	testRequest(t, http.StatusCreated, "POST", server.URL+"/admin/schemas/orders", nil, `{"type": "object"}`)
+	// A schema that would have validation go round in circles is turned away
+	_, body := testRequest(t, http.StatusBadRequest, "POST", server.URL+"/admin/schemas/orders", nil, `{"$ref": "#"}`)
+	if !strings.Contains(body, "leads back to itself") {
+		t.Fatalf("Expected the $ref cycle in the error, got %s", body)
+	}
+	orders := http.Header{"X-Afterme-Stream": {"orders"}}
+
+	// A body that doesn't match the latest version is a 422, with what's wrong with it
+	_, body = testRequest(t, http.StatusUnprocessableEntity, "POST", server.URL+"/message", orders, "[1, 2]\n")
+	if !strings.Contains(body, "version 2 of stream orders") {
+		t.Fatalf("Expected the version and stream in the error, got %s", body)
+	}
+	testRequest(t, http.StatusOK, "POST", server.URL+"/message", orders, `{"total": 1}`+"\n")
+	response, _ := testRequest(t, http.StatusOK, "GET", server.URL+"/message?sequence=1", nil, "")
+	if version := response.Header.Get("X-Afterme-Schema-Version"); version != "2" {
+		t.Fatalf("Expected the message to record version 2, got %q", version)
+	}
+
+	// As is one that doesn't match the version it asks for
+	orders.Set("X-Afterme-Schema-Version", "1")
+	testRequest(t, http.StatusUnprocessableEntity, "POST", server.URL+"/message", orders, `{"total": 1}`+"\n")
+	testRequest(t, http.StatusOK, "POST", server.URL+"/message", orders, `{"id": "o-1"}`+"\n")
+	orders.Set("X-Afterme-Schema-Version", "3")
+	testRequest(t, http.StatusBadRequest, "POST", server.URL+"/message", orders, `{"id": "o-1"}`+"\n")
+
+	// Streams without a schema aren't validated
+	testRequest(t, http.StatusOK, "POST", server.URL+"/message", http.Header{"X-Afterme-Stream": {"other"}}, "[1, 2]\n")
+
+	// A node that's missing schemas the last leader had turns away writes to streams, and new schemas
+	appServer.WantSchemas(3)
+	orders.Del("X-Afterme-Schema-Version")
+	testRequest(t, http.StatusServiceUnavailable, "POST", server.URL+"/message", orders, `{"id": "o-2"}`+"\n")
+	testRequest(t, http.StatusServiceUnavailable, "POST", server.URL+"/admin/schemas/orders", nil, `{}`)
+	testRequest(t, http.StatusOK, "POST", server.URL+"/message", nil, "no stream\n")
+}
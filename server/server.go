@@ -1,11 +1,27 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/saem/afterme/app"
+	"github.com/saem/afterme/auth"
+	"github.com/saem/afterme/cloudevents"
+	"github.com/saem/afterme/data"
+	"github.com/saem/afterme/data2"
+	"github.com/saem/afterme/filter"
+	"github.com/saem/afterme/merkle"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 const (
@@ -15,20 +31,203 @@ const (
 // Package private instance that the handler methods use
 var appServer *app.App = nil
 
+// The TLS the TCP listeners are served with, nil if they're plain, see tls.go
+var listenerTLS *serverTLS = nil
+
+// Addrs are the addresses the server listens on, those that are empty aren't listened on, and how.
+type Addrs struct {
+	HTTP       []string    // host:port, or unix:<path> for a Unix domain socket
+	TCP        string      // Appends in the binary protocol, see tcp.go
+	GRPC       string      // The gRPC service, see grpc.go
+	RESP       string      // The Redis Streams front end, see resp.go
+	SocketMode os.FileMode // Permissions of HTTP's Unix domain sockets
+	H2C        bool        // Serve HTTP/2 without TLS on HTTP's listeners, as well as HTTP/1.1
+}
+
 // Starts a server listening, handling requests and forwarding them to the App as needed
-func Start(addr string, a *app.App) (err error) {
-	http.HandleFunc("/message", messageHandler)
-	http.HandleFunc("/status", statusHandler)
-	http.HandleFunc("/health", healthHandler)
-	http.HandleFunc("/", http.NotFound)
+func Start(addrs Addrs, a *app.App) (err error) {
+	handle(http.DefaultServeMux)
 
 	appServer = a
+	if a.Config.Auth.Enabled() {
+		if err = startAuth(a.Config.Auth.Credentials); err != nil {
+			return err
+		}
+	}
+	if a.Config.TLS.Enabled() {
+		if listenerTLS, err = newServerTLS(a.Config.TLS); err != nil {
+			return err
+		}
+	}
+	if addrs.TCP != "" {
+		if err = listenTCP(addrs.TCP); err != nil {
+			return err
+		}
+	}
+	if addrs.GRPC != "" {
+		listener, err := net.Listen("tcp", addrs.GRPC)
+		if err != nil {
+			return err
+		}
+		go NewGRPCServer().Serve(listener)
+	}
+	if addrs.RESP != "" {
+		if err = listenRESP(addrs.RESP); err != nil {
+			return err
+		}
+	}
+
+	listeners := make([]net.Listener, 0, len(addrs.HTTP))
+	for _, addr := range addrs.HTTP {
+		listener, err := listenHTTP(addr, addrs.SocketMode)
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, listener)
+	}
+	httpServer := newHTTPServer(authHandler(http.DefaultServeMux), addrs.H2C)
+	served := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			served <- httpServer.Serve(listener)
+		}(listener)
+	}
+
+	return <-served
+}
+
+// newHTTPServer is the server for HTTP's listeners, with h2c it serves HTTP/2 without TLS as well as HTTP/1.1.
+func newHTTPServer(handler http.Handler, h2c bool) *http.Server {
+	httpServer := &http.Server{Handler: handler}
+	if h2c {
+		httpServer.Protocols = new(http.Protocols)
+		httpServer.Protocols.SetHTTP1(true)
+		httpServer.Protocols.SetHTTP2(true)
+		httpServer.Protocols.SetUnencryptedHTTP2(true)
+	}
+
+	return httpServer
+}
+
+// handle registers the HTTP API's handlers on mux.
+func handle(mux *http.ServeMux) {
+	mux.HandleFunc("/message", messageHandler)
+	mux.HandleFunc("/messages", messagesHandler)
+	mux.HandleFunc("/subjects/", subjectHandler)
+	mux.HandleFunc("/tree_head", treeHeadHandler)
+	mux.HandleFunc("/proof/", proofHandler)
+	mux.HandleFunc("/consistency", consistencyHandler)
+	mux.HandleFunc("/segments", segmentsHandler)
+	mux.HandleFunc("/segments/", segmentHandler)
+	mux.HandleFunc("/replication/keys", keysHandler)
+	mux.HandleFunc("/replication/keys/", keysHandler)
+	mux.HandleFunc("/replication/schemas", replicationSchemasHandler)
+	mux.HandleFunc("/replication/schemas/", replicationSchemasHandler)
+	mux.HandleFunc("/consumers", consumersHandler)
+	mux.HandleFunc("/consumers/", consumersHandler)
+	mux.HandleFunc("/subscribe", subscribeHandler)
+	mux.HandleFunc("/groups", groupsHandler)
+	mux.HandleFunc("/groups/", groupsHandler)
+	mux.HandleFunc("/admin/schemas", schemasHandler)
+	mux.HandleFunc("/admin/schemas/", schemasHandler)
+	mux.HandleFunc("/status", statusHandler)
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/health", healthHandler)
+	mux.HandleFunc("/", http.NotFound)
+}
+
+// listenHTTP listens on an HTTP address, a Unix domain socket's is unix:<path>. A socket left behind by a server
+// that's gone is replaced, one that's still being served isn't. A socket's made in a directory of its own, that only
+// the server can get into, given mode there and then moved into place, so it's never more open than mode.
+func listenHTTP(addr string, mode os.FileMode) (listener net.Listener, err error) {
+	path, unix := strings.CutPrefix(addr, "unix:")
+	if !unix {
+		return listenerTLS.listen(addr)
+	}
+
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another server", path)
+		}
+		os.Remove(path)
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".afterme-socket-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	made := filepath.Join(dir, "socket")
+	if listener, err = net.Listen("unix", made); err != nil {
+		return nil, err
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false) // It's not there by the time it's closed
+	if err = os.Chmod(made, mode); err == nil {
+		err = os.Rename(made, path)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return &socketListener{Listener: listener, path: path}, nil
+}
 
-	return http.ListenAndServe(addr, nil)
+// socketListener is a Unix domain socket's listener, the socket's removed when it's closed, as net's listeners do
+// with those they made where they are.
+type socketListener struct {
+	net.Listener
+	path   string
+	remove sync.Once
 }
 
-// A write
+func (l *socketListener) Close() error {
+	err := l.Listener.Close()
+	l.remove.Do(func() { os.Remove(l.path) })
+
+	return err
+}
+
+// reloadOnHangUp calls load on every SIGHUP, what is what it loads, for the log.
+func reloadOnHangUp(what string, load func() error) {
+	logger := appServer.Logger
+	hangUps := make(chan os.Signal, 1)
+	signal.Notify(hangUps, syscall.SIGHUP)
+	go func() {
+		for range hangUps {
+			if err := load(); err != nil {
+				logger.Printf("Could not reload %s, still using the old ones: %s", what, err.Error())
+				continue
+			}
+			logger.Printf("Reloaded %s", what)
+		}
+	}()
+}
+
+// A write, or with a GET a read of a single message
 func messageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		readMessageHandler(w, r)
+
+		return
+	}
+	if appServer.Leader != "" {
+		http.Error(w, fmt.Sprintf("This is a read only follower, write to the leader: %s", appServer.Leader),
+			http.StatusServiceUnavailable)
+
+		return
+	}
+	if leader, leading := appServer.WriteLeader(); !leading {
+		if leader == "" {
+			http.Error(w, "There's no cluster leader right now, try again shortly", http.StatusServiceUnavailable)
+
+			return
+		}
+		http.Redirect(w, r, leader+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+
+		return
+	}
+
 	if r.ContentLength < 0 || r.ContentLength > app.MaxMessageSize {
 		msg := fmt.Sprintf("Content-Length header required, and no bigger than: %db", app.MaxMessageSize)
 		http.Error(w, msg, http.StatusLengthRequired)
@@ -51,25 +250,586 @@ func messageHandler(w http.ResponseWriter, r *http.Request) {
 
 		return
 	}
-	if bytesRead == 0 {
+	if bytesRead == 0 && !cloudevents.IsEvent(r.Header) {
 		http.Error(w, "Empty body", http.StatusPreconditionFailed)
 
 		return
 	}
+	if err = verifyDigests(r, body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+	if epoch := r.Header.Get("X-Afterme-Epoch"); epoch != "" && epoch != strconv.FormatUint(appServer.Epoch(), 10) {
+		// The client's fencing token, it's writing for an epoch that's over (or yet to start)
+		msg := fmt.Sprintf("X-Afterme-Epoch %s is not the current epoch, %d", epoch, appServer.Epoch())
+		http.Error(w, msg, http.StatusConflict)
+
+		return
+	}
+
+	attributes, err := requestAttributes(r)
+	if err == nil && cloudevents.IsEvent(r.Header) {
+		body, err = eventAttributes(r, body, attributes)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+	principal := requestPrincipal(r)
+	if stream := attributes[data2.AttrStream]; !allowed(principal, auth.Append, stream) {
+		http.Error(w, denied(principal, auth.Append, stream), http.StatusForbidden)
+
+		return
+	}
+	problems, err := validateBody(r.Header.Get("X-Afterme-Schema-Version"), body, attributes)
+	if err == app.ErrSchemasBehind {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 
-	notifier := appServer.RequestWrite(body)
+		return
+	}
+	if len(problems) > 0 {
+		http.Error(w, invalidBody(attributes, problems), http.StatusUnprocessableEntity)
+
+		return
+	}
+
+	notifier := appServer.RequestWrite(body, attributes)
 	wr := <-notifier
-	if wr.Err != nil {
+	if wr.Err == app.ErrNotLeader {
+		http.Error(w, "No longer the cluster leader, try again shortly", http.StatusServiceUnavailable)
+	} else if wr.Err == app.ErrStaleEpoch {
+		http.Error(w, "This writer has been taken over by one with a later epoch", http.StatusConflict)
+	} else if wr.Err != nil {
 		fmt.Fprintf(w, "Something went wrong when writing")
+	} else if err = appServer.WaitForQuorum(wr.Sequence); err != nil {
+		msg := fmt.Sprintf("Written, sequence: %d, but not acknowledged by a quorum of followers: %s",
+			wr.Sequence,
+			err.Error())
+		http.Error(w, msg, http.StatusGatewayTimeout)
 	} else {
-		fmt.Fprintf(w, "Successfully written, sequence: %s, sha1: %s", wr.Sequence, wr.Hash)
+		fmt.Fprintf(w, "Successfully written, sequence: %d, %s: %s", wr.Sequence, wr.HashAlgorithm, wr.Hash)
+	}
+}
+
+// MaxMetadataSize is the most client supplied metadata, X-Afterme-Meta-* keys and values, a message can have.
+const MaxMetadataSize = 8 * 1024
+
+// envelopeHeaders are the request headers a write's envelope attributes are taken from, and the response headers
+// they're returned in for a single message read, as they were given.
+var envelopeHeaders = map[string]string{
+	data2.AttrSubject:     "X-Afterme-Subject",
+	data2.AttrStream:      "X-Afterme-Stream",
+	data2.AttrType:        "X-Afterme-Event-Type",
+	data2.AttrCorrelation: "X-Afterme-Correlation-Id",
+	data2.AttrCausation:   "X-Afterme-Causation-Id",
+	data2.AttrContentType: "Content-Type",
+}
+
+// attributeHeaders are the response headers message attributes are returned in for a single message read
+var attributeHeaders = map[string]string{
+	data2.AttrHash:      "X-Afterme-Hash-Algorithm",
+	data2.AttrTime:      "X-Afterme-Time",
+	data2.AttrZone:      "X-Afterme-Zone",
+	data2.AttrClock:     "X-Afterme-Clock",
+	data2.AttrSchema:    "X-Afterme-Schema-Version",
+	data2.AttrProducer:  "X-Afterme-Producer",
+	data2.AttrPrincipal: "X-Afterme-Principal",
+}
+
+func init() {
+	for attribute, header := range envelopeHeaders {
+		attributeHeaders[attribute] = header
+	}
+}
+
+// requestAttributes are the attributes a write's headers give its message: the envelope headers, the event time,
+// and metadata, each X-Afterme-Meta-<key> header is a meta.<key> attribute. Over TLS with a client certificate, its
+// subject is the producer, and with auth the principal the request was authenticated as is recorded.
+func requestAttributes(r *http.Request) (attributes data2.Attributes, err error) {
+	attributes = data2.Attributes{}
+	for attribute, header := range envelopeHeaders {
+		if len(r.Header.Values(header)) > 1 {
+			return nil, fmt.Errorf("%s can only be given once", header)
+		}
+		if value := r.Header.Get(header); value != "" {
+			attributes[attribute] = value
+		}
+	}
+	if eventTime := r.Header.Get("X-Afterme-Event-Time"); eventTime != "" {
+		t, err := time.Parse(time.RFC3339Nano, eventTime)
+		if err != nil {
+			return nil, fmt.Errorf("X-Afterme-Event-Time must be an RFC 3339 time")
+		}
+		attributes[data2.AttrEvent] = strconv.FormatInt(t.UnixNano(), 10)
+	}
+
+	if p := producer(r.TLS); p != "" {
+		attributes[data2.AttrProducer] = p
+	}
+	if p := requestPrincipal(r); p != nil {
+		attributes[data2.AttrPrincipal] = p.Name
+	}
+
+	size := 0
+	for header, values := range r.Header {
+		if !strings.HasPrefix(header, "X-Afterme-Meta-") || len(header) == len("X-Afterme-Meta-") {
+			continue
+		}
+		if len(values) > 1 {
+			return nil, fmt.Errorf("%s can only be given once", header)
+		}
+		key := data2.AttrMeta + strings.ToLower(strings.TrimPrefix(header, "X-Afterme-Meta-"))
+		attributes[key] = values[0]
+		if size += len(key) + len(values[0]); size > MaxMetadataSize {
+			return nil, fmt.Errorf("No more than %db of X-Afterme-Meta-* headers", MaxMetadataSize)
+		}
+	}
+
+	return attributes, nil
+}
+
+// eventAttributes adds the envelope of the CloudEvent in a request to its attributes, and returns the event's data
+// as the message body, an empty line if it has none.
+func eventAttributes(r *http.Request, body []byte, attributes data2.Attributes) (data []byte, err error) {
+	data, event, err := cloudevents.Decode(r.Header, body)
+	if err != nil {
+		return nil, err
+	}
+	// Content-Type is the event's, in structured mode it's the data's type from the event
+	delete(attributes, data2.AttrContentType)
+	for attribute, value := range event {
+		attributes[attribute] = value
+	}
+	if len(data) == 0 {
+		data = []byte("\n")
+	}
+
+	return data, nil
+}
+
+// validateBody validates a body against its stream's schema, the latest version or the one asked for, and records
+// the version in its attributes. It returns what's wrong with the body, nothing if it's valid or the stream has no
+// schema. It's app.ErrSchemasBehind for a named stream while this node is missing schemas the last leader had.
+func validateBody(askedFor string, body []byte, attributes data2.Attributes) (problems []string, err error) {
+	if attributes[data2.AttrStream] != "" && appServer.SchemasBehind() {
+		return nil, app.ErrSchemasBehind
 	}
+	version := 0
+	if askedFor != "" {
+		if version, err = strconv.Atoi(askedFor); err != nil || version <= 0 {
+			return nil, fmt.Errorf("The schema version must be a version number")
+		}
+	}
+
+	version, problems, err = appServer.Schemas.Validate(attributes[data2.AttrStream], version, body)
+	if err != nil {
+		return nil, fmt.Errorf("Could not validate body: %s", err.Error())
+	}
+	if version > 0 {
+		attributes[data2.AttrSchema] = strconv.Itoa(version)
+	}
+
+	return problems, nil
+}
+
+// invalidBody is the error for a body that doesn't match its schema.
+func invalidBody(attributes data2.Attributes, problems []string) string {
+	return fmt.Sprintf("Body does not match schema version %s of stream %s:\n%s",
+		attributes[data2.AttrSchema],
+		attributes[data2.AttrStream],
+		strings.Join(problems, "\n"))
+}
+
+// A read of a single message (?sequence=), the body is returned as is with the header in X-Afterme-* headers,
+// erased messages are a 410 Gone. With ?cloudevents=binary it's a CloudEvent in binary mode as well, the event
+// attributes in ce-* headers, and with ?cloudevents=structured it's a structured mode CloudEvent instead.
+func readMessageHandler(w http.ResponseWriter, r *http.Request) {
+	sequence, err := sequenceParam(r, "sequence", 0)
+	if err != nil || sequence == 0 {
+		http.Error(w, "A valid sequence parameter is required", http.StatusBadRequest)
+
+		return
+	}
+	events := r.URL.Query().Get("cloudevents")
+	if events != "" && events != cloudevents.Binary && events != cloudevents.Structured {
+		http.Error(w, "cloudevents must be binary or structured", http.StatusBadRequest)
+
+		return
+	}
+	if sequence > appServer.Committed() {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	var message *data2.Message
+	err = app.ReadLog(appServer.DataDir, sequence, func(m data2.Message) error {
+		if m.Sequence == sequence {
+			message = &m
+		}
+		return app.ErrStopReading
+	})
+	if err == nil && message != nil {
+		*message, err = app.Deliverable(appServer.Keys, *message)
+	}
+	principal := requestPrincipal(r)
+	switch {
+	case err != nil:
+		msg := fmt.Sprintf("Could not read message %d: %s", sequence, err.Error())
+		http.Error(w, msg, http.StatusInternalServerError)
+	case message == nil:
+		http.NotFound(w, r)
+	case !allowed(principal, auth.Read, message.Attributes[data2.AttrStream]):
+		// As good as not there, a 403 would say which stream it's in
+		http.NotFound(w, r)
+	case app.Erased(*message):
+		http.Error(w, fmt.Sprintf("Message %d erased", sequence), http.StatusGone)
+	default:
+		w.Header().Set("X-Afterme-Sequence", strconv.FormatUint(uint64(message.Sequence), 10))
+		w.Header().Set("X-Afterme-Timestamp", strconv.FormatInt(message.TimeStamp, 10))
+		w.Header().Set("X-Afterme-Hash", message.Hash)
+		for attribute, header := range attributeHeaders {
+			if value, ok := message.Attributes[attribute]; ok {
+				w.Header().Set(header, value)
+			}
+		}
+		for attribute, value := range message.Attributes {
+			if strings.HasPrefix(attribute, data2.AttrMeta) {
+				w.Header().Set("X-Afterme-Meta-"+strings.TrimPrefix(attribute, data2.AttrMeta), value)
+			}
+		}
+		if event, err := strconv.ParseInt(message.Attributes[data2.AttrEvent], 10, 64); err == nil {
+			w.Header().Set("X-Afterme-Event-Time", time.Unix(0, event).UTC().Format(time.RFC3339Nano))
+		}
+		switch events {
+		case cloudevents.Binary:
+			cloudevents.SetHeaders(w.Header(), *message)
+		case cloudevents.Structured:
+			w.Header().Set("Content-Type", cloudevents.ContentType)
+			json.NewEncoder(w).Encode(cloudevents.Event(*message))
+
+			return
+		}
+		w.Write(message.Body)
+	}
+}
+
+// A read of a range of messages (?from=&to=, inclusive), written out in the log file format. The range can be
+// narrowed by time with ?since=&until=, RFC3339 times, since is inclusive and until exclusive. Erased messages
+// have their body replaced with an empty line, and an erased=true attribute. With ?filter= only the messages that
+// match it are written out (see the filter package), and an X-Afterme-Next trailer has the sequence to read on from.
+// With ?cloudevents=structured they're a CloudEvents batch instead. With auth, only the messages in the streams the
+// principal can read are written out.
+func messagesHandler(w http.ResponseWriter, r *http.Request) {
+	matches, err := filterParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+	matches = permitted(requestPrincipal(r), auth.Read, matches)
+	out, err := newMessageWriter(w, r, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+	from, err := sequenceParam(r, "from", 1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+	to, err := sequenceParam(r, "to", appServer.Committed())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+	if to > appServer.Committed() {
+		to = appServer.Committed()
+	}
+	from, to, err = app.TimeRange(appServer.DataDir, from, to, r.URL.Query().Get("since"), r.URL.Query().Get("until"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	// The trailer's declared before anything's written, structured CloudEvents start writing in start
+	if r.URL.Query().Get("filter") != "" {
+		w.Header().Set("Trailer", "X-Afterme-Next")
+	}
+	out.start()
+	next := from
+	err = app.ReadLog(appServer.DataDir, from, func(m data2.Message) error {
+		if m.Sequence > to {
+			return app.ErrStopReading
+		}
+		m, err := app.Deliverable(appServer.Keys, m)
+		if err == nil && matches(m) {
+			err = out.write(m)
+		}
+		next = m.Sequence + 1
+		return err
+	})
+	if err == nil {
+		err = out.end()
+	}
+	if err != nil {
+		appServer.Logger.Printf("Range read %d-%d failed: %s", from, to, err.Error())
+	}
+	if r.URL.Query().Get("filter") != "" {
+		w.Header().Set("X-Afterme-Next", strconv.FormatUint(uint64(next), 10))
+	}
+}
+
+// filterParam parses ?filter=, the filter matches everything if there isn't one.
+func filterParam(r *http.Request) (matches func(data2.Message) bool, err error) {
+	expression := r.URL.Query().Get("filter")
+	if expression == "" {
+		return func(data2.Message) bool { return true }, nil
+	}
+	f, err := filter.Parse(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.Match, nil
+}
+
+// Erase a subject with a DELETE /subjects/<subject>, deleting its data key so every message sealed for it is
+// unreadable
+func subjectHandler(w http.ResponseWriter, r *http.Request) {
+	subject := strings.TrimPrefix(r.URL.Path, "/subjects/")
+	if r.Method != "DELETE" || subject == "" {
+		http.Error(w, "DELETE /subjects/<subject> to erase a subject", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	err := appServer.Keys.Erase(subject)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not erase subject: %s", err.Error()), http.StatusInternalServerError)
+
+		return
+	}
+
+	fmt.Fprintf(w, "Successfully erased subject: %s", subject)
+}
+
+// The signed tree head, for all committed messages or ?tree_size=
+func treeHeadHandler(w http.ResponseWriter, r *http.Request) {
+	size, err := sizeParam(r, "tree_size", appServer.TreeSize())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	th, err := appServer.TreeHead(size)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	writeJSON(w, th)
+}
+
+// inclusionProof is the response to GET /proof/<sequence>
+type inclusionProof struct {
+	Sequence  data.Sequence   `json:"sequence"`
+	LeafIndex uint64          `json:"leaf_index"`
+	Header    string          `json:"header"` // The leaf data, the message header as written
+	LeafHash  []byte          `json:"leaf_hash"`
+	AuditPath [][]byte        `json:"audit_path"`
+	TreeHead  merkle.TreeHead `json:"tree_head"`
+}
+
+// An inclusion proof for a message, against the signed tree head for all committed messages or ?tree_size=
+func proofHandler(w http.ResponseWriter, r *http.Request) {
+	parsed, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/proof/"), 10, 64)
+	if err != nil {
+		http.Error(w, "GET /proof/<sequence> requires a valid sequence", http.StatusBadRequest)
+
+		return
+	}
+	sequence := data.Sequence(parsed)
+
+	size, err := sizeParam(r, "tree_size", appServer.TreeSize())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+	th, err := appServer.TreeHead(size)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+	index, err := appServer.LeafIndex(sequence)
+	if err != nil || index >= th.TreeSize {
+		http.NotFound(w, r)
+
+		return
+	}
+	path, err := appServer.InclusionProof(sequence, th.TreeSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	var header []byte
+	err = app.ReadLog(appServer.DataDir, sequence, func(m data2.Message) error {
+		header = app.LeafData(m)
+		return app.ErrStopReading
+	})
+	if err != nil || header == nil {
+		http.Error(w, fmt.Sprintf("Could not read message %d", sequence), http.StatusInternalServerError)
+
+		return
+	}
+
+	writeJSON(w, inclusionProof{Sequence: sequence,
+		LeafIndex: index,
+		Header:    string(header),
+		LeafHash:  merkle.LeafHash(header),
+		AuditPath: path,
+		TreeHead:  th})
+}
+
+// consistencyProof is the response to GET /consistency
+type consistencyProof struct {
+	From     uint64          `json:"from"`
+	To       uint64          `json:"to"`
+	Proof    [][]byte        `json:"proof"`
+	TreeHead merkle.TreeHead `json:"tree_head"` // Signed tree head for the to tree size
+}
+
+// A consistency proof between two tree sizes, ?from=&to=, to defaults to all committed messages
+func consistencyHandler(w http.ResponseWriter, r *http.Request) {
+	from, err := sizeParam(r, "from", 0)
+	if err == nil && from == 0 {
+		err = fmt.Errorf("GET /consistency requires from, the smaller tree size")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+	to, err := sizeParam(r, "to", appServer.TreeSize())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+	th, err := appServer.TreeHead(to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+	proof, err := appServer.ConsistencyProof(from, th.TreeSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	writeJSON(w, consistencyProof{From: from, To: th.TreeSize, Proof: proof, TreeHead: th})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		appServer.Logger.Printf("Could not write response: %s", err.Error())
+	}
+}
+
+// sizeParam parses a tree size out of the query string, using def if it's absent. A size of 0 is an empty tree,
+// there's nothing to ask about one, so it's refused rather than taken to mean something else.
+func sizeParam(r *http.Request, name string, def uint64) (size uint64, err error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, nil
+	}
+
+	size, err = strconv.ParseUint(value, 10, 64)
+	if err != nil || size == 0 {
+		return 0, fmt.Errorf("Invalid %s: %s, tree sizes start at 1", name, value)
+	}
+
+	return size, nil
+}
+
+// sequenceParam parses a sequence out of the query string, using def if it's absent.
+func sequenceParam(r *http.Request, name string, def data.Sequence) (sequence data.Sequence, err error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, nil
+	}
+
+	parsed, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s: %s", name, value)
+	}
+
+	return data.Sequence(parsed), nil
+}
+
+// status is the response to GET /status
+type status struct {
+	Version   data.Version         `json:"version"`
+	Committed data.Sequence        `json:"committed"`
+	Epoch     uint64               `json:"epoch"`            // Writer epoch, a follower has its last message's
+	Leader    string               `json:"leader,omitempty"` // Only on a follower, or a cluster node that's not leading
+	Term      uint64               `json:"term,omitempty"`   // Only in a cluster
+	Lag       uint64               `json:"lag"`              // Messages committed on the leader, not yet here
+	TreeStart data.Sequence        `json:"tree_start"`       // Sequence of the Merkle tree's first leaf
+	Followers []app.FollowerStatus `json:"followers,omitempty"`
+	Consumers []app.ConsumerOffset `json:"consumers,omitempty"`
+	Groups    []app.GroupStatus    `json:"groups,omitempty"`
 }
 
 // Check the current status (sequence, version, configs, etc...)
 func statusHandler(w http.ResponseWriter, r *http.Request) {
-	// TODO: Finish implementing me
-	fmt.Fprintf(w, "Return the current status.")
+	writeJSON(w, currentStatus())
+}
+
+func currentStatus() (s status) {
+	s = status{Version: appServer.Version,
+		Committed: appServer.Committed(),
+		Epoch:     appServer.Epoch(),
+		Leader:    appServer.Leader,
+		TreeStart: appServer.TreeStart(),
+		Consumers: appServer.Consumers(),
+		Groups:    appServer.Groups()}
+	if appServer.Coordinator != nil {
+		s.Term = appServer.Coordinator.Term()
+		if leader, leading := appServer.Coordinator.Leader(); !leading {
+			s.Leader = leader
+		}
+		s.Followers = appServer.Followers()
+	} else if s.Leader != "" {
+		if leaderCommitted := appServer.LeaderCommitted(); leaderCommitted > s.Committed {
+			s.Lag = uint64(leaderCommitted - s.Committed)
+		}
+	} else {
+		s.Followers = appServer.Followers()
+	}
+
+	return s
 }
 
 // Check the health (failed writes, latencies, blah),
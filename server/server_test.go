@@ -0,0 +1,308 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/saem/afterme/app"
+	"github.com/saem/afterme/data2"
+	"github.com/saem/afterme/hashes"
+	"github.com/saem/afterme/merkle"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// httpTestServer starts an App and the HTTP API on a local listener.
+func httpTestServer(t *testing.T) *httptest.Server {
+	startTestApp(t)
+	mux := http.NewServeMux()
+	handle(mux)
+	server := httptest.NewServer(authHandler(mux))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// testRequest makes a request, failing the test if the response isn't expected, and returns the response and its
+// body.
+func testRequest(t *testing.T, expected int, method string, url string, header http.Header,
+	body string) (*http.Response, string) {
+	t.Helper()
+	r, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	response, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	contents, _ := ioutil.ReadAll(response.Body)
+	if response.StatusCode != expected {
+		t.Fatalf("Expected %s %s to be a %d, got %d: %s", method, url, expected, response.StatusCode, contents)
+	}
+
+	return response, string(contents)
+}
+
+func TestErasure(t *testing.T) {
+	server := httpTestServer(t)
+	alice := http.Header{"X-Afterme-Subject": {"alice"}}
+	testRequest(t, http.StatusOK, "POST", server.URL+"/message", alice, "alice's address\n")
+	testRequest(t, http.StatusOK, "POST", server.URL+"/message", http.Header{"X-Afterme-Subject": {"bob"}}, "bob's\n")
+
+	_, body := testRequest(t, http.StatusOK, "GET", server.URL+"/message?sequence=1", nil, "")
+	if body != "alice's address\n" {
+		t.Fatalf("Expected alice's body before she's erased, got %q", body)
+	}
+	onDisk, err := ioutil.ReadFile(filepath.Join(appServer.DataDir, "2-1.log"))
+	if err != nil || strings.Contains(string(onDisk), "alice's address") {
+		t.Fatal("Expected the body to be sealed on disk")
+	}
+
+	testRequest(t, http.StatusMethodNotAllowed, "GET", server.URL+"/subjects/alice", nil, "")
+	testRequest(t, http.StatusOK, "DELETE", server.URL+"/subjects/alice", nil, "")
+	testRequest(t, http.StatusGone, "GET", server.URL+"/message?sequence=1", nil, "")
+	_, body = testRequest(t, http.StatusOK, "GET", server.URL+"/messages", nil, "")
+	lines := strings.Split(body, "\n")
+	if !strings.Contains(lines[0], "erased=true") || strings.Contains(body, "alice's address") ||
+		!strings.Contains(body, "bob's") {
+		t.Fatalf("Expected alice's message to be erased and bob's not, got %q", body)
+	}
+}
+
+func TestAuditProofs(t *testing.T) {
+	server := httpTestServer(t)
+	for _, body := range []string{"a", "b", "c"} {
+		testRequest(t, http.StatusOK, "POST", server.URL+"/message", nil, body)
+	}
+
+	var th merkle.TreeHead
+	_, body := testRequest(t, http.StatusOK, "GET", server.URL+"/tree_head", nil, "")
+	if err := json.Unmarshal([]byte(body), &th); err != nil || th.TreeSize != 3 ||
+		!th.Verify(appServer.Key.Public().(ed25519.PublicKey)) {
+		t.Fatalf("Expected a signed tree head for 3 messages, got %s", body)
+	}
+
+	var proof inclusionProof
+	_, body = testRequest(t, http.StatusOK, "GET", server.URL+"/proof/2?tree_size=2", nil, "")
+	if err := json.Unmarshal([]byte(body), &proof); err != nil || proof.LeafIndex != 1 ||
+		!merkle.VerifyInclusion(1, 2, proof.LeafHash, proof.AuditPath, proof.TreeHead.Root) {
+		t.Fatalf("Expected an inclusion proof for leaf 1, got %s", body)
+	}
+	testRequest(t, http.StatusNotFound, "GET", server.URL+"/proof/3?tree_size=2", nil, "")
+
+	var consistency consistencyProof
+	_, body = testRequest(t, http.StatusOK, "GET", server.URL+"/consistency?from=1", nil, "")
+	if err := json.Unmarshal([]byte(body), &consistency); err != nil || consistency.To != 3 {
+		t.Fatalf("Expected a consistency proof from 1 to 3, got %s", body)
+	}
+
+	// A size of 0 isn't all of them
+	for _, path := range []string{"/tree_head?tree_size=0", "/proof/1?tree_size=0", "/consistency?from=1&to=0",
+		"/consistency?from=0&to=2", "/consistency", "/tree_head?tree_size=4"} {
+		testRequest(t, http.StatusBadRequest, "GET", server.URL+path, nil, "")
+	}
+}
+
+func TestDigests(t *testing.T) {
+	server := httpTestServer(t)
+	body := "total: 12\n"
+	sha256Sum := sha256.Sum256([]byte(body))
+	sha512Sum := sha512.Sum512([]byte(body))
+	good := base64.StdEncoding.EncodeToString(sha256Sum[:])
+	bad := base64.StdEncoding.EncodeToString(sha512Sum[:32])
+
+	tests := []struct {
+		header   http.Header
+		expected int
+	}{
+		{http.Header{"Digest": {"SHA-256=" + good}}, http.StatusOK},
+		{http.Header{"Content-Digest": {"sha-512=:" + base64.StdEncoding.EncodeToString(sha512Sum[:]) + ":"}},
+			http.StatusOK},
+		{http.Header{"Digest": {"SHA-256=" + bad}}, http.StatusBadRequest},
+		{http.Header{"Content-Digest": {"sha-256=:" + bad + ":"}}, http.StatusBadRequest},
+		{http.Header{"Digest": {"MD5=" + good}}, http.StatusBadRequest},
+		{http.Header{"Digest": {"MD5=x, SHA-256=" + good}}, http.StatusOK},
+	}
+	for _, test := range tests {
+		testRequest(t, test.expected, "POST", server.URL+"/message", test.header, body)
+	}
+	if committed := appServer.Committed(); committed != 3 {
+		t.Fatalf("Expected only the writes with good digests to be written, got up to %d", committed)
+	}
+
+	// Without a config saying otherwise bodies are hashed with SHA256
+	response, _ := testRequest(t, http.StatusOK, "GET", server.URL+"/message?sequence=1", nil, "")
+	if algorithm := response.Header.Get("X-Afterme-Hash-Algorithm"); algorithm != hashes.SHA256 {
+		t.Fatalf("Expected the body to be hashed with SHA256, got %q", algorithm)
+	}
+}
+
+func TestRangeReadTimes(t *testing.T) {
+	server := httpTestServer(t)
+	for _, body := range []string{"a", "b", "c", "d"} {
+		testRequest(t, http.StatusOK, "POST", server.URL+"/message", nil, body)
+		time.Sleep(time.Millisecond)
+	}
+	var times []string
+	app.ReadLog(appServer.DataDir, 0, func(m data2.Message) error {
+		times = append(times, url.QueryEscape(time.Unix(0, data2.MessageTime(m)).Format(time.RFC3339Nano)))
+		return nil
+	})
+
+	tests := map[string]string{
+		"?since=" + times[1]:                        "b c d",
+		"?until=" + times[2]:                        "a b",
+		"?since=" + times[1] + "&until=" + times[3]: "b c",
+		"?from=3&since=" + times[1]:                 "c d",
+		"?since=2200-01-01T00:00:00Z":               "",
+	}
+	for query, expected := range tests {
+		_, body := testRequest(t, http.StatusOK, "GET", server.URL+"/messages"+query, nil, "")
+		var bodies []string
+		for i, line := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+			if i%2 == 1 {
+				bodies = append(bodies, line)
+			}
+		}
+		if strings.Join(bodies, " ") != expected {
+			t.Fatalf("Expected %s to read %q, got %q", query, expected, body)
+		}
+	}
+	testRequest(t, http.StatusBadRequest, "GET", server.URL+"/messages?since=yesterday", nil, "")
+}
+
+func TestFilteredReads(t *testing.T) {
+	server := httpTestServer(t)
+	for _, stream := range []string{"orders", "other", "orders", "other"} {
+		header := http.Header{"X-Afterme-Stream": {stream}, "Content-Type": {"application/json"}}
+		testRequest(t, http.StatusOK, "POST", server.URL+"/message", header, `{"stream": "`+stream+`"}`+"\n")
+	}
+
+	// The trailer has the sequence to read on from, in the log file format or as structured CloudEvents
+	filter := "?filter=" + url.QueryEscape(`attr.stream == "orders"`) + "&to=3"
+	response, body := testRequest(t, http.StatusOK, "GET", server.URL+"/messages"+filter, nil, "")
+	if strings.Count(body, `{"stream": "orders"}`) != 2 || strings.Contains(body, "other") {
+		t.Fatalf("Expected messages 1 and 3, got %q", body)
+	}
+	if next := response.Trailer.Get("X-Afterme-Next"); next != "4" {
+		t.Fatalf("Expected to read on from 4, got %q", next)
+	}
+	response, body = testRequest(t, http.StatusOK, "GET", server.URL+"/messages"+filter+"&cloudevents=structured", nil,
+		"")
+	var events []map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &events); err != nil || len(events) != 2 {
+		t.Fatalf("Expected a batch of 2 events, got %q, %v", body, err)
+	}
+	if next := response.Trailer.Get("X-Afterme-Next"); next != "4" {
+		t.Fatalf("Expected structured CloudEvents to read on from 4, got %q", next)
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	server := httpTestServer(t)
+	envelope := http.Header{"Content-Type": {"application/json"},
+		"X-Afterme-Event-Type":     {"order.placed"},
+		"X-Afterme-Correlation-Id": {"c-1"},
+		"X-Afterme-Causation-Id":   {"c-0"},
+		"X-Afterme-Meta-Region":    {"eu-west"},
+		"X-Afterme-Meta-Tenant":    {"acme"}}
+	testRequest(t, http.StatusOK, "POST", server.URL+"/message", envelope, `{"order": 1}`+"\n")
+
+	response, body := testRequest(t, http.StatusOK, "GET", server.URL+"/message?sequence=1", nil, "")
+	if body != `{"order": 1}`+"\n" {
+		t.Fatalf("Expected the body back, got %q", body)
+	}
+	for header, values := range envelope {
+		if got := response.Header.Get(header); got != values[0] {
+			t.Errorf("Expected %s to be %q, got %q", header, values[0], got)
+		}
+	}
+
+	// A header given twice is turned away, rather than keeping one and dropping the other
+	for _, header := range []string{"X-Afterme-Meta-Region", "X-Afterme-Correlation-Id"} {
+		testRequest(t, http.StatusBadRequest, "POST", server.URL+"/message", http.Header{header: {"a", "b"}}, "x\n")
+	}
+}
+
+func TestListenHTTP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "afterme.sock")
+	listener, err := listenHTTP("unix:"+path, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Lstat(path); err != nil || info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0660 {
+		t.Fatalf("Expected a socket with permissions 0660, got %v, %v", info.Mode(), err)
+	}
+	// It's made somewhere else then moved into place, with nothing left behind
+	if entries, err := os.ReadDir(filepath.Dir(path)); err != nil || len(entries) != 1 {
+		t.Fatalf("Expected only the socket in its directory, got %v, %v", entries, err)
+	}
+	server := newHTTPServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}), true)
+	go server.Serve(listener)
+	defer server.Close()
+
+	if _, err = listenHTTP("unix:"+path, 0660); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("Expected a socket that's being served not to be replaced, got %v", err)
+	}
+
+	// With h2c, HTTP/2 is served without TLS to clients that know it is, as well as HTTP/1.1
+	for _, unencryptedHTTP2 := range []bool{false, true} {
+		transport := &http.Transport{DialContext: func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		}}
+		expected := "HTTP/1.1"
+		if unencryptedHTTP2 {
+			transport.Protocols = new(http.Protocols)
+			transport.Protocols.SetUnencryptedHTTP2(true)
+			expected = "HTTP/2.0"
+		}
+		client := &http.Client{Transport: transport}
+		response, err := client.Get("http://afterme/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if string(body) != expected || response.Proto != expected {
+			t.Fatalf("Expected %s, got %s, served as %s", expected, response.Proto, body)
+		}
+		transport.CloseIdleConnections()
+	}
+
+	// A socket left behind is replaced, with the permissions asked for
+	stale := filepath.Join(t.TempDir(), "stale.sock")
+	left, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	left.(*net.UnixListener).SetUnlinkOnClose(false)
+	left.Close()
+	if listener, err = listenHTTP("unix:"+stale, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Lstat(stale); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("Expected the stale socket to be replaced with one with permissions 0600, got %v, %v", info, err)
+	}
+	listener.Close()
+	if _, err := os.Lstat(stale); !os.IsNotExist(err) {
+		t.Fatalf("Expected the socket to be removed once it's closed, got %v", err)
+	}
+}
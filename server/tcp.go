@@ -0,0 +1,266 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/saem/afterme/app"
+	"github.com/saem/afterme/auth"
+	"github.com/saem/afterme/data2"
+	"github.com/saem/afterme/wire"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Appends in the binary protocol, see the wire package. They go to the same DataWriter as POST /message, with the
+// same checks. A connection has a goroutine reading appends and handing them to the App without waiting, one acking
+// each with its sequence once it's assigned one, and one acking it again once it's durable, so the only thing an
+// append waits on is there being room for it.
+
+// MaxInFlight is how many appends a connection can have waiting on acks, reading more waits until there's room.
+const MaxInFlight = 10000
+
+// inFlight is an append waiting to be acked.
+type inFlight struct {
+	id       uint64
+	assigned chan app.WriteResponse
+	notifier chan app.WriteResponse
+	failed   *wire.Ack          // Set when the append was refused, it's acked with this
+	response *app.WriteResponse // Set once notifier's been received from
+}
+
+func listenTCP(addr string) error {
+	listener, err := listenerTLS.listen(addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				appServer.Logger.Printf("Could not accept a binary protocol connection: %s", err.Error())
+				time.Sleep(time.Second)
+				continue
+			}
+			go serveAppends(conn)
+		}
+	}()
+
+	return nil
+}
+
+// serveAppends reads appends until the client's done, the acks of those still in flight are sent before the
+// connection's closed.
+func serveAppends(conn net.Conn) {
+	reader := bufio.NewReaderSize(conn, 64*1024)
+	hello := make([]byte, len(wire.Hello))
+	if _, err := io.ReadFull(reader, hello); err != nil || string(hello) != wire.Hello {
+		conn.Close()
+		return
+	}
+	identity := connProducer(conn)
+
+	pending := make(chan inFlight, MaxInFlight)
+	assigned := make(chan inFlight, MaxInFlight)
+	acks := make(chan wire.Ack, MaxInFlight)
+	go ackAssigned(pending, assigned, acks)
+	go ackDurable(assigned, acks)
+	go writeAcks(conn, acks)
+	defer close(pending)
+
+	for {
+		// The body's only read once the token's checked, someone who can't append to the stream can't have the
+		// server hold up to wire.MaxFrameSize for them, it's skipped as it arrives and the append refused
+		a, size, err := wire.ReadAppendHeader(reader)
+		principal, _ := authenticate(a.Attributes[wire.TokenAttribute])
+		refused := authEnabled && principal == nil || !allowed(principal, auth.Append, a.Attributes[data2.AttrStream])
+		if err == nil && refused {
+			err = wire.DiscardBody(reader, size)
+		} else if err == nil {
+			a.Body, err = wire.ReadBody(reader, size)
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			// The frames are out of step, there's no carrying on
+			failed := wire.Ack{Kind: wire.FrameError, Code: http.StatusBadRequest, Message: err.Error()}
+			pending <- inFlight{failed: &failed}
+			return
+		}
+		pending <- requestAppend(a, identity, principal)
+	}
+}
+
+// requestAppend checks an append as messageHandler does a write, and requests it's written. producer is who's
+// appending, from their TLS client certificate, if they had one, and principal who they authenticated as, if they
+// did.
+func requestAppend(a wire.Append, producer string, principal *auth.Principal) (f inFlight) {
+	f.id = a.Id
+	refuse := func(code int, format string, args ...interface{}) inFlight {
+		f.failed = &wire.Ack{Kind: wire.FrameError, Id: a.Id, Code: uint16(code), Message: fmt.Sprintf(format, args...)}
+		return f
+	}
+
+	if authEnabled && principal == nil {
+		return refuse(http.StatusUnauthorized, "A valid token is required")
+	}
+	if stream := a.Attributes[data2.AttrStream]; !allowed(principal, auth.Append, stream) {
+		return refuse(http.StatusForbidden, "%s", denied(principal, auth.Append, stream))
+	}
+
+	if leader, leading := appServer.WriteLeader(); !leading {
+		if leader == "" {
+			return refuse(http.StatusServiceUnavailable, "There's no cluster leader right now, try again shortly")
+		}
+		return refuse(http.StatusServiceUnavailable, "Not the leader, write to the leader: %s", leader)
+	}
+	if len(a.Body) == 0 {
+		return refuse(http.StatusBadRequest, "Empty body")
+	}
+	if len(a.Body) > app.MaxMessageSize {
+		return refuse(http.StatusBadRequest, "Body is bigger than %db", app.MaxMessageSize)
+	}
+	if epoch := a.Attributes[data2.AttrEpoch]; epoch != "" && epoch != strconv.FormatUint(appServer.Epoch(), 10) {
+		return refuse(http.StatusConflict, "Epoch %s is not the current epoch, %d", epoch, appServer.Epoch())
+	}
+
+	attributes, err := appendAttributes(a.Attributes)
+	var problems []string
+	if err == nil && producer != "" {
+		attributes[data2.AttrProducer] = producer
+	}
+	if err == nil && principal != nil {
+		attributes[data2.AttrPrincipal] = principal.Name
+	}
+	if err == nil {
+		problems, err = validateBody(a.Attributes[data2.AttrSchema], a.Body, attributes)
+	}
+	if err == app.ErrSchemasBehind {
+		return refuse(http.StatusServiceUnavailable, "%s", err.Error())
+	}
+	if err != nil {
+		return refuse(http.StatusBadRequest, "%s", err.Error())
+	}
+	if len(problems) > 0 {
+		return refuse(http.StatusUnprocessableEntity, "%s", invalidBody(attributes, problems))
+	}
+
+	f.assigned, f.notifier = appServer.RequestWriteAssigned(a.Body, attributes)
+
+	return f
+}
+
+// appendAttributes are the attributes an append gives its message, those the headers of a write would give it.
+func appendAttributes(given map[string]string) (attributes data2.Attributes, err error) {
+	attributes = data2.Attributes{}
+	size := 0
+	for name, value := range given {
+		_, envelope := envelopeHeaders[name]
+		switch {
+		case value == "" || name == data2.AttrSchema || name == data2.AttrEpoch || name == wire.TokenAttribute:
+			continue // Not recorded as they are
+		case name == data2.AttrEvent:
+			if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+				return nil, fmt.Errorf("The event time must be nanoseconds since the epoch")
+			}
+		case strings.HasPrefix(name, data2.AttrMeta) && len(name) > len(data2.AttrMeta):
+			name = strings.ToLower(name)
+			if size += len(name) + len(value); size > MaxMetadataSize {
+				return nil, fmt.Errorf("No more than %db of meta.* attributes", MaxMetadataSize)
+			}
+		case !envelope:
+			return nil, fmt.Errorf("The %s attribute can't be set by a writer", name)
+		}
+		attributes[name] = value
+	}
+
+	return attributes, nil
+}
+
+// ackAssigned acks appends with their sequence once they're assigned one.
+func ackAssigned(pending chan inFlight, assigned chan inFlight, acks chan wire.Ack) {
+	defer close(assigned)
+
+	for f := range pending {
+		if f.failed == nil {
+			// A write that fails is only ever sent to notifier, a quick one can be there too by now
+			select {
+			case response := <-f.assigned:
+				acks <- wire.Ack{Kind: wire.FrameAssigned, Id: f.id, Sequence: uint64(response.Sequence)}
+			case response := <-f.notifier:
+				f.response = &response
+				if response.Err == nil {
+					acks <- wire.Ack{Kind: wire.FrameAssigned, Id: f.id, Sequence: uint64(response.Sequence)}
+				}
+			}
+		}
+		assigned <- f
+	}
+}
+
+// ackDurable acks appends again once they're durable, as a write to POST /message is acknowledged.
+func ackDurable(assigned chan inFlight, acks chan wire.Ack) {
+	defer close(acks)
+
+	for f := range assigned {
+		acks <- durableAck(f)
+	}
+}
+
+// durableAck waits until an append's durable, or has failed, and is its ack.
+func durableAck(f inFlight) (ack wire.Ack) {
+	if f.failed != nil {
+		return *f.failed
+	}
+	response := f.response
+	if response == nil {
+		r := <-f.notifier
+		response = &r
+	}
+
+	ack = wire.Ack{Kind: wire.FrameError, Id: f.id, Code: http.StatusInternalServerError}
+	switch {
+	case response.Err == app.ErrNotLeader:
+		ack.Code, ack.Message = http.StatusServiceUnavailable, "No longer the cluster leader, try again shortly"
+	case response.Err == app.ErrStaleEpoch:
+		ack.Code, ack.Message = http.StatusConflict, "This writer has been taken over by one with a later epoch"
+	case response.Err != nil:
+		ack.Message = "Something went wrong when writing"
+	default:
+		if err := appServer.WaitForQuorum(response.Sequence); err != nil {
+			ack.Code = http.StatusGatewayTimeout
+			ack.Message = fmt.Sprintf("Written, sequence: %d, but not acknowledged by a quorum of followers: %s",
+				response.Sequence,
+				err.Error())
+		} else {
+			ack = wire.Ack{Kind: wire.FrameDurable, Id: f.id, Sequence: uint64(response.Sequence)}
+		}
+	}
+
+	return ack
+}
+
+// writeAcks writes acks to the connection, flushing whenever it's caught up, and closes it once they're all sent.
+func writeAcks(conn net.Conn, acks chan wire.Ack) {
+	defer conn.Close()
+	writer := bufio.NewWriterSize(conn, 64*1024)
+
+	var err error
+	for ack := range acks {
+		// Once the client's gone there's only draining to do
+		if err == nil {
+			err = wire.WriteAck(writer, ack)
+		}
+		if err == nil && len(acks) == 0 {
+			err = writer.Flush()
+		}
+	}
+	if err == nil {
+		writer.Flush()
+	}
+}
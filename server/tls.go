@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/saem/afterme/config"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+)
+
+// TLS for every TCP listener, HTTP's, the binary protocol's, gRPC's and RESP's, when the config has a tls section.
+// Unix domain sockets stay plain, their permissions are what guard them. The certificate and client CAs are read
+// again on SIGHUP, connections from then on use the new ones. A verified client certificate's subject is recorded
+// in each message written over the connection as its producer.
+
+// serverTLS is the TLS the listeners are served with.
+type serverTLS struct {
+	config  config.TLSConfig
+	current atomic.Value // *tls.Config, from the files as they were last read
+}
+
+// newServerTLS reads the certificate and client CAs, and reads them again on SIGHUP.
+func newServerTLS(c config.TLSConfig) (s *serverTLS, err error) {
+	s = &serverTLS{config: c}
+	if err = s.load(); err != nil {
+		return nil, err
+	}
+	reloadOnHangUp("the TLS certificates", s.load)
+
+	return s, nil
+}
+
+func (s *serverTLS) load() error {
+	certificate, err := tls.LoadX509KeyPair(s.config.Cert, s.config.Key)
+	if err != nil {
+		return err
+	}
+	loaded := &tls.Config{Certificates: []tls.Certificate{certificate},
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"}}
+
+	if s.config.ClientCA != "" {
+		pem, err := ioutil.ReadFile(s.config.ClientCA)
+		if err != nil {
+			return err
+		}
+		loaded.ClientCAs = x509.NewCertPool()
+		if !loaded.ClientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("No certificates in %s", s.config.ClientCA)
+		}
+		loaded.ClientAuth = tls.VerifyClientCertIfGiven
+		if s.config.RequireClientCert {
+			loaded.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	s.current.Store(loaded)
+
+	return nil
+}
+
+// Config is the config to serve TLS with, each connection gets the one current when it connects.
+func (s *serverTLS) Config() *tls.Config {
+	return &tls.Config{GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		return s.current.Load().(*tls.Config), nil
+	}}
+}
+
+// listen listens on a TCP address, with TLS if there's any.
+func (s *serverTLS) listen(addr string) (listener net.Listener, err error) {
+	if listener, err = net.Listen("tcp", addr); err != nil || s == nil {
+		return listener, err
+	}
+
+	return tls.NewListener(listener, s.Config()), nil
+}
+
+// producer is who's producing over a TLS connection, its client certificate's subject, empty if it has none.
+func producer(state *tls.ConnectionState) string {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+
+	return state.PeerCertificates[0].Subject.String()
+}
+
+// connProducer is producer for a connection, which is only TLS if the listener's is.
+func connProducer(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok || tlsConn.Handshake() != nil {
+		return ""
+	}
+	state := tlsConn.ConnectionState()
+
+	return producer(&state)
+}
+
+// grpcProducer is producer for a gRPC call.
+func grpcProducer(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			return producer(&info.State)
+		}
+	}
+
+	return ""
+}
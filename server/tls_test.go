@@ -0,0 +1,136 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/saem/afterme/config"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testCertificate makes a certificate for name, signed by ca, or self signed if ca is nil.
+func testCertificate(t *testing.T, name string, ca *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{SerialNumber: serial,
+		Subject:     pkix.Name{CommonName: name, Organization: []string{"Afterme Test"}},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(time.Hour),
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}}
+	parent, signer := template, interface{}(key)
+	if ca == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		parent, signer = ca.Leaf, ca.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// writePEM writes a certificate, and its key if keyPath isn't empty.
+func writePEM(t *testing.T, certificate tls.Certificate, certPath string, keyPath string) {
+	block := &pem.Block{Type: "CERTIFICATE", Bytes: certificate.Certificate[0]}
+	err := ioutil.WriteFile(certPath, pem.EncodeToMemory(block), 0600)
+	if err == nil && keyPath != "" {
+		der, _ := x509.MarshalECPrivateKey(certificate.PrivateKey.(*ecdsa.PrivateKey))
+		err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	startTestApp(t)
+	dir := t.TempDir()
+	ca := testCertificate(t, "Afterme Test CA", nil)
+	c := config.TLSConfig{Cert: filepath.Join(dir, "server.pem"),
+		Key:               filepath.Join(dir, "server.key"),
+		ClientCA:          filepath.Join(dir, "ca.pem"),
+		RequireClientCert: true}
+	writePEM(t, ca, c.ClientCA, "")
+	writePEM(t, testCertificate(t, "server one", &ca), c.Cert, c.Key)
+
+	s, err := newServerTLS(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := s.listen("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go http.Serve(listener, http.HandlerFunc(messageHandler))
+	url := "https://" + listener.Addr().String() + "/message"
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots,
+		Certificates: []tls.Certificate{testCertificate(t, "orders-service", &ca)}}}}
+	response, err := client.Post(url, "application/json", strings.NewReader(`{"total": 12}`))
+	if err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the write to succeed, got %v, %v", response, err)
+	}
+	response.Body.Close()
+	if server := response.TLS.PeerCertificates[0].Subject.CommonName; server != "server one" {
+		t.Fatalf("Expected the server's certificate, got %s's", server)
+	}
+	response, err = client.Get(url + "?sequence=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if p := response.Header.Get("X-Afterme-Producer"); p != "CN=orders-service,O=Afterme Test" {
+		t.Fatalf("Expected the client certificate's subject to be the producer, got %q", p)
+	}
+
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	if response, err := anonymous.Post(url, "application/json", strings.NewReader(`{"total": 1}`)); err == nil {
+		response.Body.Close()
+		t.Fatal("Expected a client without a certificate to be refused")
+	}
+
+	// The certificate's replaced, and reloaded on SIGHUP
+	writePEM(t, testCertificate(t, "server two", &ca), c.Cert, c.Key)
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		client.CloseIdleConnections()
+		response, err := client.Get(url + "?sequence=1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.TLS.PeerCertificates[0].Subject.CommonName == "server two" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the new certificate after SIGHUP")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,120 @@
+package tools
+
+import (
+	"flag"
+	"fmt"
+	"github.com/saem/afterme/app"
+	"github.com/saem/afterme/data"
+	"github.com/saem/afterme/data2"
+	"github.com/saem/afterme/dirlock"
+	"io"
+	"sort"
+)
+
+// Epochs lists the sequences written in each writer epoch, and flags any sequence written under two epochs, as
+// happens when a writer that's been taken over carries on writing. Any sequence written twice is reported and an
+// error returned.
+func Epochs(args []string, out io.Writer) (err error) {
+	flags := flag.NewFlagSet("epochs", flag.ContinueOnError)
+	dataDir := flags.String("datadir", app.DefaultDataDir, "Data dir to check")
+	if err = flags.Parse(args); err != nil {
+		return err
+	}
+
+	lock, err := dirlock.Shared(*dataDir)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	segments, err := app.ListSegments(*dataDir)
+	if err != nil {
+		return err
+	}
+
+	// Each data file is a run of sequences, a writer that's been taken over carries on with its own data file while
+	// the new one starts another, so sequences written twice are where data files overlap. What's kept is each
+	// file's runs of messages in the same epoch, not the messages.
+	type span struct {
+		first, last data.Sequence
+		count       uint64
+	}
+	type run struct {
+		epoch       uint64
+		first, last data.Sequence
+	}
+	spans := map[uint64]*span{}
+	runs := make([][]run, len(segments))
+	for i, segment := range segments {
+		err = app.ReadSegment(*dataDir, segment, 0, func(m data2.Message) error {
+			epoch := app.MessageEpoch(m)
+			if n := len(runs[i]); n > 0 && runs[i][n-1].epoch == epoch && runs[i][n-1].last+1 == m.Sequence {
+				runs[i][n-1].last = m.Sequence
+			} else {
+				runs[i] = append(runs[i], run{epoch: epoch, first: m.Sequence, last: m.Sequence})
+			}
+
+			s, ok := spans[epoch]
+			if !ok {
+				s = &span{first: m.Sequence, last: m.Sequence}
+				spans[epoch] = s
+			}
+			if m.Sequence < s.first {
+				s.first = m.Sequence
+			}
+			if m.Sequence > s.last {
+				s.last = m.Sequence
+			}
+			s.count++
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("%s: could not be read: %s", segment.Name, err.Error())
+		}
+	}
+
+	duplicates := 0
+	for j := range segments {
+		for _, later := range runs[j] {
+			for i := 0; i < j; i++ {
+				for _, earlier := range runs[i] {
+					from, to := earlier.first, earlier.last
+					if later.first > from {
+						from = later.first
+					}
+					if later.last < to {
+						to = later.last
+					}
+					for sequence := from; sequence <= to; sequence++ {
+						fmt.Fprintf(out, "sequence %d: written in epoch %d (%s) and epoch %d (%s)\n",
+							sequence,
+							earlier.epoch,
+							segments[i].Name,
+							later.epoch,
+							segments[j].Name)
+						duplicates++
+					}
+				}
+			}
+		}
+	}
+
+	epochs := make([]uint64, 0, len(spans))
+	for epoch := range spans {
+		epochs = append(epochs, epoch)
+	}
+	sort.Slice(epochs, func(i, j int) bool { return epochs[i] < epochs[j] })
+	for _, epoch := range epochs {
+		s := spans[epoch]
+		fmt.Fprintf(out, "epoch %d: %d messages, sequences %d to %d\n", epoch, s.count, s.first, s.last)
+	}
+	if current, err := app.ReadEpoch(*dataDir); err == nil {
+		fmt.Fprintf(out, "current epoch: %d\n", current)
+	}
+
+	if duplicates > 0 {
+		return fmt.Errorf("%d sequences written more than once", duplicates)
+	}
+
+	return nil
+}
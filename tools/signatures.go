@@ -0,0 +1,120 @@
+package tools
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"github.com/saem/afterme/app"
+	"github.com/saem/afterme/data"
+	"github.com/saem/afterme/data2"
+	"github.com/saem/afterme/dirlock"
+	"github.com/saem/afterme/merkle"
+	"github.com/saem/afterme/nodekey"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// VerifySignatures checks the seal of every data file in a directory, a data dir or an archive copy of one: the seal
+// is signed by the node key, the file's digest matches, and it holds the messages the seal says it does.
+func VerifySignatures(args []string, out io.Writer) (err error) {
+	flags := flag.NewFlagSet("verify-signatures", flag.ContinueOnError)
+	dataDir := flags.String("datadir", app.DefaultDataDir, "Directory of data files, and their seals, to check")
+	publicKey := flags.String("pubkey", "", "Node public key, defaults to <datadir>/"+nodekey.PublicFileName)
+	if err = flags.Parse(args); err != nil {
+		return err
+	}
+	if *publicKey == "" {
+		*publicKey = filepath.Join(*dataDir, nodekey.PublicFileName)
+	}
+
+	key, err := nodekey.LoadPublic(*publicKey)
+	if err != nil {
+		return err
+	}
+	lock, err := dirlock.Shared(*dataDir)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	segments, err := app.ListSegments(*dataDir)
+	if err != nil {
+		return err
+	}
+
+	problems, sealed := 0, 0
+	problem := func(format string, args ...interface{}) {
+		problems++
+		fmt.Fprintf(out, format+"\n", args...)
+	}
+
+	for i, segment := range segments {
+		if segment.Version != data.Version(2) {
+			continue
+		}
+
+		seal, err := data2.ReadSeal(*dataDir, segment.Name)
+		if os.IsNotExist(err) && i == len(segments)-1 {
+			// The latest file is only sealed once it's no longer being written to
+			fmt.Fprintf(out, "%s: not sealed, it's the latest\n", segment.Name)
+			continue
+		}
+		if os.IsNotExist(err) {
+			// Every other file is sealed, taking its seal away mustn't hide what's been done to it
+			problem("%s: is not sealed", segment.Name)
+			continue
+		}
+		if err != nil {
+			problem("%s: seal could not be read: %s", segment.Name, err.Error())
+			continue
+		}
+		sealed++
+
+		if seal.Segment != segment.Name {
+			problem("%s: seal is for %s", segment.Name, seal.Segment)
+		}
+		if !seal.Verify(key) {
+			problem("%s: seal signature is not valid", segment.Name)
+		}
+		digest, err := data2.FileDigest(*dataDir, segment.Name)
+		if err != nil {
+			problem("%s: could not be read: %s", segment.Name, err.Error())
+		} else if digest != seal.Digest {
+			problem("%s: digest is %s, sealed with %s", segment.Name, digest, seal.Digest)
+		}
+
+		var first, last data.Sequence
+		var count uint64
+		tree := merkle.NewTree()
+		err = app.ReadSegment(*dataDir, segment, 0, func(m data2.Message) error {
+			if count == 0 {
+				first = m.Sequence
+			}
+			last = m.Sequence
+			count++
+			tree.Append(merkle.LeafHash(app.LeafData(m)))
+			return nil
+		})
+		if err != nil {
+			problem("%s: could not be read: %s", segment.Name, err.Error())
+			continue
+		}
+		if first != seal.First || last != seal.Last || count != seal.Count {
+			problem("%s: holds %d messages, %d to %d, sealed with %d, %d to %d",
+				segment.Name, count, first, last, seal.Count, seal.First, seal.Last)
+		}
+		root, _ := tree.Root(count)
+		if merkleRoot := base64.StdEncoding.EncodeToString(root); merkleRoot != seal.Merkle {
+			problem("%s: Merkle root is %s, sealed with %s", segment.Name, merkleRoot, seal.Merkle)
+		}
+	}
+
+	fmt.Fprintf(out, "%d sealed data files checked\n", sealed)
+
+	if problems > 0 {
+		return fmt.Errorf("%d problems found", problems)
+	}
+
+	return nil
+}
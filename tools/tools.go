@@ -0,0 +1,99 @@
+package tools
+
+import (
+	"flag"
+	"fmt"
+	"github.com/saem/afterme/app"
+	"github.com/saem/afterme/data"
+	"github.com/saem/afterme/data2"
+	"github.com/saem/afterme/dirlock"
+	"github.com/saem/afterme/keystore"
+	"io"
+	"math"
+	"path/filepath"
+)
+
+// Tools work directly against a data dir, rather than through a running server, they're run as:
+//
+//	afterme <tool> [flags]
+
+// Tool runs with the arguments following its name, writing any output to out.
+type Tool func(args []string, out io.Writer) error
+
+// Tools by name
+var Tools = map[string]Tool{
+	"cat":               Cat,
+	"epochs":            Epochs,
+	"erase":             Erase,
+	"verify":            Verify,
+	"verify-signatures": VerifySignatures,
+}
+
+// Cat writes out messages, in the log file format, with sealed bodies opened or marked as erased.
+func Cat(args []string, out io.Writer) (err error) {
+	flags := flag.NewFlagSet("cat", flag.ContinueOnError)
+	dataDir := flags.String("datadir", app.DefaultDataDir, "Data dir to read")
+	from := flags.Uint64("from", 1, "First sequence to write out")
+	to := flags.Uint64("to", math.MaxUint64, "Last sequence to write out")
+	since := flags.String("since", "", "Only write out messages at or after this RFC3339 time")
+	until := flags.String("until", "", "Only write out messages before this RFC3339 time")
+	if err = flags.Parse(args); err != nil {
+		return err
+	}
+
+	lock, err := dirlock.Shared(*dataDir)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	first, last, err := app.TimeRange(*dataDir, data.Sequence(*from), data.Sequence(*to), *since, *until)
+	if err != nil {
+		return err
+	}
+
+	keys := keystore.New(filepath.Join(*dataDir, "keys"))
+
+	return app.ReadLog(*dataDir, first, func(m data2.Message) error {
+		if m.Sequence > last {
+			return app.ErrStopReading
+		}
+		m, err := app.Deliverable(keys, m)
+		if err != nil {
+			return err
+		}
+		header, body, _ := m.Marshal()
+		if _, err = io.WriteString(out, header); err == nil {
+			_, err = out.Write(body)
+		}
+		return err
+	})
+}
+
+// Erase deletes a subject's data key, making every message sealed for it unreadable.
+func Erase(args []string, out io.Writer) (err error) {
+	flags := flag.NewFlagSet("erase", flag.ContinueOnError)
+	dataDir := flags.String("datadir", app.DefaultDataDir, "Data dir holding the key store")
+	subject := flags.String("subject", "", "Subject to erase")
+	if err = flags.Parse(args); err != nil {
+		return err
+	}
+	if *subject == "" {
+		return fmt.Errorf("-subject is required")
+	}
+
+	// A running server erases with DELETE /subjects/<subject>
+	lock, err := dirlock.Exclusive(*dataDir)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	if err = keystore.New(filepath.Join(*dataDir, "keys")).Erase(*subject); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Erased subject: %s\n", *subject)
+
+	return nil
+}
@@ -0,0 +1,213 @@
+package tools
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/saem/afterme/app"
+	"github.com/saem/afterme/data"
+	"github.com/saem/afterme/data2"
+	"github.com/saem/afterme/hashes"
+	"github.com/saem/afterme/merkle"
+	"github.com/saem/afterme/nodekey"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeLog writes a data dir as the server would, a data file of chained messages per segment, each sealed with
+// the node key except the last, which is still being written to. Segments are the bodies of their messages.
+func writeLog(t *testing.T, segments ...[]string) (dir string) {
+	dir = t.TempDir()
+	key, err := nodekey.LoadOrCreate(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sequence, chain := data.Sequence(1), ""
+	for i, bodies := range segments {
+		df := data2.NewDataFile(sequence, dir)
+		if err = df.CreateForWrite(); err != nil {
+			t.Fatal(err)
+		}
+		tree := merkle.NewTree()
+		first := sequence
+		for _, body := range bodies {
+			m := data2.Message{Sequence: sequence, TimeStamp: int64(sequence), MessageSize: uint32(len(body) + 1),
+				Attributes: data2.Attributes{data2.AttrHash: hashes.SHA256}, Body: []byte(body + "\n")}
+			m.Hash, _ = hashes.Sum(hashes.SHA256, m.Body)
+			if chain, err = data2.ChainHash(chain, m); err != nil {
+				t.Fatal(err)
+			}
+			m.Attributes[data2.AttrChain] = chain
+			if err = df.Write(&m); err != nil {
+				t.Fatal(err)
+			}
+			tree.Append(merkle.LeafHash(app.LeafData(m)))
+			sequence++
+		}
+		df.Close()
+
+		if i == len(segments)-1 {
+			break
+		}
+		root, _ := tree.Root(tree.Size())
+		seal := data2.Seal{Segment: df.Name(), First: first, Last: sequence - 1, Count: uint64(sequence - first),
+			Chain: chain, Merkle: base64.StdEncoding.EncodeToString(root)}
+		if seal.Digest, err = data2.FileDigest(dir, df.Name()); err != nil {
+			t.Fatal(err)
+		}
+		seal.Sign(key)
+		if err = data2.WriteSeal(dir, seal); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+// tamper replaces old with new in a data file.
+func tamper(t *testing.T, dir string, segment string, old string, new string) {
+	path := filepath.Join(dir, segment)
+	contents, err := ioutil.ReadFile(path)
+	if err == nil && !bytes.Contains(contents, []byte(old)) {
+		err = fmt.Errorf("%s is not in %s", old, segment)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(path, bytes.Replace(contents, []byte(old), []byte(new), 1), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// runTool runs a tool against dir, returning its output.
+func runTool(t *testing.T, tool Tool, dir string, args ...string) (output string, err error) {
+	var out bytes.Buffer
+	err = tool(append([]string{"-datadir", dir}, args...), &out)
+
+	return out.String(), err
+}
+
+func TestVerify(t *testing.T) {
+	dir := writeLog(t, []string{"a", "b", "c"}, []string{"d", "e"})
+	output, err := runTool(t, Verify, dir)
+	if err != nil || !strings.HasPrefix(output, "5 messages, 5 chained, last sequence: 5") {
+		t.Fatalf("Expected the log to verify, got %v: %s", err, output)
+	}
+}
+
+func TestVerifyTampering(t *testing.T) {
+	// Rewriting a message, hash and all, only shows up in the chain
+	dir := writeLog(t, []string{"a", "b", "c"}, []string{"d", "e"})
+	hash, _ := hashes.Sum(hashes.SHA256, []byte("b\n"))
+	forged, _ := hashes.Sum(hashes.SHA256, []byte("x\n"))
+	tamper(t, dir, "2-1.log", hash+" ", forged+" ")
+	tamper(t, dir, "2-1.log", "\nb\n", "\nx\n")
+
+	output, err := runTool(t, Verify, dir)
+	if err == nil || !strings.Contains(output, "2: chain hash is") {
+		t.Fatalf("Expected the broken chain to be reported, got %v: %s", err, output)
+	}
+	if strings.Contains(output, "3: chain hash is") {
+		t.Fatalf("Expected only the rewritten message to be reported, got %s", output)
+	}
+
+	// Changing the body alone breaks its hash too
+	dir = writeLog(t, []string{"a", "b", "c"}, []string{"d", "e"})
+	tamper(t, dir, "2-4.log", "\ne\n", "\nf\n")
+	output, err = runTool(t, Verify, dir)
+	if err == nil || !strings.Contains(output, "5: body hashes to") || !strings.Contains(output, "5: chain hash is") {
+		t.Fatalf("Expected the changed body to be reported, got %v: %s", err, output)
+	}
+
+	// So does removing a message from a sealed file, even one that leaves the chain intact
+	dir = writeLog(t, []string{"a", "b", "c"}, []string{"d", "e"})
+	contents, _ := ioutil.ReadFile(filepath.Join(dir, "2-1.log"))
+	lines := strings.SplitAfter(string(contents), "\n")
+	ioutil.WriteFile(filepath.Join(dir, "2-1.log"), []byte(strings.Join(lines[:4], "")), 0644)
+	output, err = runTool(t, Verify, dir)
+	if err == nil || !strings.Contains(output, "2-1.log: sealed with chain") ||
+		!strings.Contains(output, "4: follows 2") {
+		t.Fatalf("Expected the missing message to be reported, got %v: %s", err, output)
+	}
+}
+
+func TestVerifySignatures(t *testing.T) {
+	dir := writeLog(t, []string{"a", "b"}, []string{"c"}, []string{"d"})
+	output, err := runTool(t, VerifySignatures, dir)
+	if err != nil || !strings.Contains(output, "2 sealed data files checked") {
+		t.Fatalf("Expected the seals to verify, got %v: %s", err, output)
+	}
+
+	tamper(t, dir, "2-3.log", "\nc\n", "\nx\n")
+	output, err = runTool(t, VerifySignatures, dir)
+	if err == nil || !strings.Contains(output, "2-3.log: digest is") {
+		t.Fatalf("Expected the changed file to be reported, got %v: %s", err, output)
+	}
+
+	// Taking the seal away doesn't hide it
+	os.Remove(filepath.Join(dir, data2.SealFileName("2-3.log")))
+	output, err = runTool(t, VerifySignatures, dir)
+	if err == nil || !strings.Contains(output, "2-3.log: is not sealed") {
+		t.Fatalf("Expected the missing seal to be reported, got %v: %s", err, output)
+	}
+
+	// A seal signed by another node's key doesn't verify
+	dir = writeLog(t, []string{"a", "b"}, []string{"c"})
+	other := writeLog(t, []string{"a"})
+	output, err = runTool(t, VerifySignatures, dir, "-pubkey", filepath.Join(other, nodekey.PublicFileName))
+	if err == nil || !strings.Contains(output, "2-1.log: seal signature is not valid") {
+		t.Fatalf("Expected the signature not to verify, got %v: %s", err, output)
+	}
+}
+
+// writeEpoch writes a data file of messages from first to last, written in epoch.
+func writeEpoch(t *testing.T, dir string, epoch int, first data.Sequence, last data.Sequence) {
+	df := data2.NewDataFile(first, dir)
+	if err := df.CreateForWrite(); err != nil {
+		t.Fatal(err)
+	}
+	defer df.Close()
+	for sequence := first; sequence <= last; sequence++ {
+		m := data2.Message{Sequence: sequence, TimeStamp: int64(sequence), MessageSize: 2,
+			Attributes: data2.Attributes{data2.AttrHash: hashes.SHA256, data2.AttrEpoch: fmt.Sprint(epoch)},
+			Body:       []byte("m\n")}
+		m.Hash, _ = hashes.Sum(hashes.SHA256, m.Body)
+		if err := df.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestEpochs(t *testing.T) {
+	dir := t.TempDir()
+	writeEpoch(t, dir, 1, 1, 3)
+	writeEpoch(t, dir, 2, 4, 6)
+	output, err := runTool(t, Epochs, dir)
+	if err != nil || !strings.Contains(output, "epoch 1: 3 messages, sequences 1 to 3\n") ||
+		!strings.Contains(output, "epoch 2: 3 messages, sequences 4 to 6\n") {
+		t.Fatalf("Expected two epochs, got %v: %s", err, output)
+	}
+
+	// Epoch 3 took over at 5, while epoch 2 carried on to 8
+	dir = t.TempDir()
+	writeEpoch(t, dir, 1, 1, 3)
+	writeEpoch(t, dir, 2, 4, 8)
+	writeEpoch(t, dir, 3, 5, 9)
+	output, err = runTool(t, Epochs, dir)
+	if err == nil || err.Error() != "4 sequences written more than once" {
+		t.Fatalf("Expected 4 sequences written twice, got %v: %s", err, output)
+	}
+	for sequence := 5; sequence <= 8; sequence++ {
+		line := fmt.Sprintf("sequence %d: written in epoch 2 (2-4.log) and epoch 3 (2-5.log)\n", sequence)
+		if !strings.Contains(output, line) {
+			t.Fatalf("Expected %q, got %s", line, output)
+		}
+	}
+	if strings.Contains(output, "sequence 4:") || strings.Contains(output, "sequence 9:") {
+		t.Fatalf("Expected only 5 to 8 to be reported, got %s", output)
+	}
+}
@@ -0,0 +1,148 @@
+package tools
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"github.com/saem/afterme/app"
+	"github.com/saem/afterme/data"
+	"github.com/saem/afterme/data2"
+	"github.com/saem/afterme/dirlock"
+	"github.com/saem/afterme/hashes"
+	"github.com/saem/afterme/merkle"
+	"io"
+	"os"
+)
+
+// Verify checks the whole history in a data dir: sequences are contiguous, bodies match their hashes, the hash chain is
+// unbroken and seals (chain head and Merkle root) agree with the data files they seal. Any problem is reported and an
+// error returned.
+//
+// The chain head is printed at the end, recording it elsewhere (or comparing it with one recorded earlier) is
+// what catches messages being removed from the end of the log.
+func Verify(args []string, out io.Writer) (err error) {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	dataDir := flags.String("datadir", app.DefaultDataDir, "Data dir to verify")
+	if err = flags.Parse(args); err != nil {
+		return err
+	}
+
+	lock, err := dirlock.Shared(*dataDir)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	segments, err := app.ListSegments(*dataDir)
+	if err != nil {
+		return err
+	}
+
+	var v verifier
+	v.out = out
+	v.tree = merkle.NewTree()
+	for i, segment := range segments {
+		first := true
+		leaves := v.tree.Size()
+		err = app.ReadSegment(*dataDir, segment, 0, func(m data2.Message) error {
+			if first && m.Sequence != segment.StartingSequence {
+				v.problem("%s: starts at sequence %d, not %d", segment.Name, m.Sequence, segment.StartingSequence)
+			}
+			first = false
+			v.message(m)
+			return nil
+		})
+		if err != nil {
+			v.problem("%s: could not be read: %s", segment.Name, err.Error())
+		}
+
+		if segment.Version != data.Version(2) || first {
+			continue
+		}
+		seal, err := data2.ReadSeal(*dataDir, segment.Name)
+		switch {
+		case os.IsNotExist(err) && i == len(segments)-1:
+			// The latest file is only sealed once it's no longer being written to
+		case os.IsNotExist(err):
+			v.problem("%s: is not sealed", segment.Name)
+		case err != nil:
+			v.problem("%s: seal could not be read: %s", segment.Name, err.Error())
+		case seal.Chain != v.chain:
+			v.problem("%s: sealed with chain %s, but the data file ends with %s", segment.Name, seal.Chain, v.chain)
+		default:
+			root, _ := v.tree.RangeRoot(leaves, v.tree.Size())
+			if merkleRoot := base64.StdEncoding.EncodeToString(root); seal.Merkle != merkleRoot {
+				v.problem("%s: sealed with Merkle root %s, but its messages give %s", segment.Name, seal.Merkle, merkleRoot)
+			}
+		}
+	}
+
+	fmt.Fprintf(out, "%d messages, %d chained, last sequence: %d, chain head: %s\n",
+		v.messages,
+		v.chainedMessages,
+		v.last,
+		v.chain)
+
+	if v.problems > 0 {
+		return fmt.Errorf("%d problems found", v.problems)
+	}
+
+	return nil
+}
+
+// verifier accumulates state while walking the log.
+type verifier struct {
+	out             io.Writer
+	tree            *merkle.Tree
+	last            data.Sequence
+	chain           string
+	chained         bool
+	messages        int
+	chainedMessages int
+	problems        int
+}
+
+func (v *verifier) problem(format string, args ...interface{}) {
+	v.problems++
+	fmt.Fprintf(v.out, format+"\n", args...)
+}
+
+// message checks a message against those that came before it.
+func (v *verifier) message(m data2.Message) {
+	if v.messages > 0 && m.Sequence != v.last+1 {
+		v.problem("%d: follows %d, the sequence is not contiguous", m.Sequence, v.last)
+	}
+	v.messages++
+	v.last = m.Sequence
+	v.tree.Append(merkle.LeafHash(app.LeafData(m)))
+
+	hash, err := hashes.Sum(m.Attributes[data2.AttrHash], m.Body)
+	switch {
+	case err != nil:
+		v.problem("%d: %s", m.Sequence, err.Error())
+	case hash != m.Hash:
+		v.problem("%d: body hashes to %s, not %s", m.Sequence, hash, m.Hash)
+	}
+
+	recorded, ok := m.Attributes[data2.AttrChain]
+	switch {
+	case !ok && v.chained:
+		v.problem("%d: has no chain hash, but follows chained messages", m.Sequence)
+	case ok && v.messages == 1 && m.Sequence > 1:
+		// Retention deleted the messages before it, its chain hash can only be taken as it is
+		v.chained = true
+		v.chainedMessages++
+		v.chain = recorded
+	case ok:
+		v.chained = true
+		v.chainedMessages++
+		chain, err := data2.ChainHash(v.chain, m)
+		if err != nil {
+			v.problem("%d: %s", m.Sequence, err.Error())
+		} else if chain != recorded {
+			v.problem("%d: chain hash is %s, expected %s", m.Sequence, recorded, chain)
+		}
+		// Carry on with what's recorded, so one bad message is reported once rather than for the rest of the log
+		v.chain = recorded
+	}
+}
@@ -0,0 +1,297 @@
+package wire
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// The binary append protocol, for producers writing more than HTTP keeps up with. A client connects, sends Hello,
+// then as many appends as it likes without waiting for their acks. Each append carries an id the client picks, and
+// is acked twice, first with the sequence it was assigned, once it's in the write buffer, then again once it's
+// durable, synced and, if replication has a quorum, on enough followers. That's when an HTTP write would return.
+// Each kind of ack comes back in the order the appends were sent, a failed append gets an error instead and the
+// connection carries on.
+//
+// Everything is big endian. A frame is a uint32 length, of what follows it, then a byte for its type:
+//
+//	Append:   id uint64, attribute count uint16, count × (key length uint16, key, value length uint16, value), body
+//	Assigned: id uint64, sequence uint64
+//	Durable:  id uint64, sequence uint64
+//	Error:    id uint64, code uint16 (an HTTP status: 400, 401, 403, 409, 422, 500, 503 or 504), message
+//
+// Attributes are those HTTP headers set: stream, subject, type, correlation, causation, content-type, event (the
+// event time in nanoseconds since the epoch) and meta.<key>, plus schema for the schema version to validate against,
+// epoch for the writer epoch, as X-Afterme-Epoch, and token for the token to authenticate with, when the server
+// wants one. They take up no more than MaxAttributesSize, and come before the body so the server can check the token
+// before reading it, the body of an append that's refused is skipped.
+
+// TokenAttribute is the attribute an append's token is in, it's not recorded in the message.
+const TokenAttribute = "token"
+
+// Hello is sent by the client when it connects, the protocol's name and version.
+const Hello = "AFTM\x01"
+
+// Frame types
+const (
+	FrameAppend   byte = 1
+	FrameAssigned byte = 2
+	FrameDurable  byte = 3
+	FrameError    byte = 4
+)
+
+// MaxFrameSize is the biggest frame there can be, a body of the most a message can be along with its attributes.
+const MaxFrameSize = 50*1024*1024 + MaxAttributesSize
+
+// MaxAttributesSize is the most an append's attributes can take up, lengths included.
+const MaxAttributesSize = 64 * 1024
+
+// ErrFrameTooBig is returned reading a frame bigger than MaxFrameSize, the connection can't carry on after it.
+var ErrFrameTooBig = errors.New("frame is bigger than the maximum frame size")
+
+var errTruncated = fmt.Errorf("Truncated attribute in append frame, or attributes bigger than %db", MaxAttributesSize)
+
+// Append asks for a message to be written.
+type Append struct {
+	Id         uint64
+	Attributes map[string]string
+	Body       []byte
+}
+
+// Ack is the server's answer to an Append, Kind is FrameAssigned, FrameDurable or FrameError.
+type Ack struct {
+	Kind     byte
+	Id       uint64
+	Sequence uint64 // Assigned and Durable
+	Code     uint16 // Error
+	Message  string // Error
+}
+
+func (ack Ack) Error() string {
+	return fmt.Sprintf("%d %s", ack.Code, ack.Message)
+}
+
+// WriteAppend writes an append frame.
+func WriteAppend(w *bufio.Writer, a Append) error {
+	names := make([]string, 0, len(a.Attributes))
+	size := 1 + 8 + 2 + len(a.Body)
+	for name, value := range a.Attributes {
+		if len(name) > 0xffff || len(value) > 0xffff {
+			return fmt.Errorf("Attribute %.20s is too big", name)
+		}
+		names = append(names, name)
+		size += 4 + len(name) + len(value)
+	}
+	if len(names) > 0xffff {
+		return fmt.Errorf("Too many attributes")
+	}
+	if size-len(a.Body)-11 > MaxAttributesSize {
+		return fmt.Errorf("Attributes are bigger than %db", MaxAttributesSize)
+	}
+	if size > MaxFrameSize {
+		return ErrFrameTooBig
+	}
+	sort.Strings(names)
+
+	var header [15]byte
+	binary.BigEndian.PutUint32(header[0:], uint32(size))
+	header[4] = FrameAppend
+	binary.BigEndian.PutUint64(header[5:], a.Id)
+	binary.BigEndian.PutUint16(header[13:], uint16(len(names)))
+	w.Write(header[:])
+	for _, name := range names {
+		writeString(w, name)
+		writeString(w, a.Attributes[name])
+	}
+	_, err := w.Write(a.Body)
+
+	return err
+}
+
+// WriteAck writes an ack frame.
+func WriteAck(w *bufio.Writer, ack Ack) error {
+	var frame [23]byte
+	size := 1 + 8 + 8
+	if ack.Kind == FrameError {
+		size = 1 + 8 + 2 + len(ack.Message)
+	}
+	binary.BigEndian.PutUint32(frame[0:], uint32(size))
+	frame[4] = ack.Kind
+	binary.BigEndian.PutUint64(frame[5:], ack.Id)
+	if ack.Kind != FrameError {
+		binary.BigEndian.PutUint64(frame[13:], ack.Sequence)
+		_, err := w.Write(frame[:21])
+		return err
+	}
+
+	binary.BigEndian.PutUint16(frame[13:], ack.Code)
+	w.Write(frame[:15])
+	_, err := w.WriteString(ack.Message)
+
+	return err
+}
+
+// ReadAppend reads an append frame.
+func ReadAppend(r *bufio.Reader) (a Append, err error) {
+	a, size, err := ReadAppendHeader(r)
+	if err == nil {
+		a.Body, err = ReadBody(r, size)
+	}
+
+	return a, err
+}
+
+// ReadAppendHeader reads an append frame up to its body, its id and attributes, and returns the size of the body
+// still to be read, with ReadBody, or skipped, with DiscardBody. It's so the server can check an append's token
+// before taking in a body of up to MaxFrameSize from whoever sent it.
+func ReadAppendHeader(r *bufio.Reader) (a Append, size uint32, err error) {
+	var header [15]byte
+	if _, err = io.ReadFull(r, header[:4]); err != nil {
+		return a, 0, err
+	}
+	size = binary.BigEndian.Uint32(header[:4])
+	if size > MaxFrameSize {
+		return a, 0, ErrFrameTooBig
+	}
+	if size < 11 {
+		return a, 0, fmt.Errorf("Expected an append frame")
+	}
+	if _, err = io.ReadFull(r, header[4:]); err != nil {
+		return a, 0, unexpectedEOF(err)
+	}
+	if header[4] != FrameAppend {
+		return a, 0, fmt.Errorf("Expected an append frame, got a frame of type %d", header[4])
+	}
+
+	a.Id = binary.BigEndian.Uint64(header[5:])
+	count := int(binary.BigEndian.Uint16(header[13:]))
+	size -= 11
+	// The attributes can't take up more than MaxAttributesSize, whatever the frame's length says
+	limit := uint32(MaxAttributesSize)
+	if size < limit {
+		limit = size
+	}
+	left := limit
+	a.Attributes = make(map[string]string, count)
+	for i := 0; i < count; i++ {
+		var name, value string
+		if name, err = readString(r, &left); err == nil {
+			value, err = readString(r, &left)
+		}
+		if err != nil {
+			return a, 0, err
+		}
+		a.Attributes[name] = value
+	}
+
+	return a, size - (limit - left), nil
+}
+
+// ReadBody reads the body of an append, size bytes, as it arrives, so there's never more held than was sent.
+func ReadBody(r *bufio.Reader, size uint32) ([]byte, error) {
+	return readAll(r, size)
+}
+
+// DiscardBody skips the body of an append, size bytes, so the next frame can be read.
+func DiscardBody(r *bufio.Reader, size uint32) error {
+	_, err := r.Discard(int(size))
+
+	return unexpectedEOF(err)
+}
+
+// ReadAck reads an ack frame.
+func ReadAck(r *bufio.Reader) (ack Ack, err error) {
+	kind, frame, err := readFrame(r)
+	if err != nil {
+		return ack, err
+	}
+
+	ack.Kind = kind
+	switch {
+	case (kind == FrameAssigned || kind == FrameDurable) && len(frame) == 16:
+		ack.Id = binary.BigEndian.Uint64(frame)
+		ack.Sequence = binary.BigEndian.Uint64(frame[8:])
+	case kind == FrameError && len(frame) >= 10:
+		ack.Id = binary.BigEndian.Uint64(frame)
+		ack.Code = binary.BigEndian.Uint16(frame[8:])
+		ack.Message = string(frame[10:])
+	default:
+		return ack, fmt.Errorf("Expected an ack frame, got a frame of type %d", kind)
+	}
+
+	return ack, nil
+}
+
+// readFrame reads a frame's type and what follows it.
+func readFrame(r *bufio.Reader) (kind byte, frame []byte, err error) {
+	var length [4]byte
+	if _, err = io.ReadFull(r, length[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if size > MaxFrameSize {
+		return 0, nil, ErrFrameTooBig
+	}
+	if size == 0 {
+		return 0, nil, fmt.Errorf("Empty frame")
+	}
+
+	if frame, err = readAll(r, size); err != nil {
+		return 0, nil, err
+	}
+
+	return frame[0], frame[1:], nil
+}
+
+// readAll reads size bytes into a buffer that grows as they arrive, rather than trusting a length prefix with
+// allocating all of them up front.
+func readAll(r *bufio.Reader, size uint32) ([]byte, error) {
+	var b bytes.Buffer
+	n, err := b.ReadFrom(io.LimitReader(r, int64(size)))
+	if err == nil && n < int64(size) {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return b.Bytes(), err
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+func writeString(w *bufio.Writer, s string) {
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], uint16(len(s)))
+	w.Write(length[:])
+	w.WriteString(s)
+}
+
+// readString reads a length and string, of no more than left bytes in all, and takes them off left.
+func readString(r *bufio.Reader, left *uint32) (string, error) {
+	var length [2]byte
+	if *left < 2 {
+		return "", errTruncated
+	}
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return "", unexpectedEOF(err)
+	}
+	size := uint32(binary.BigEndian.Uint16(length[:]))
+	if *left < 2+size {
+		return "", errTruncated
+	}
+	s := make([]byte, size)
+	if _, err := io.ReadFull(r, s); err != nil {
+		return "", unexpectedEOF(err)
+	}
+	*left -= 2 + size
+
+	return string(s), nil
+}
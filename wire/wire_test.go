@@ -0,0 +1,136 @@
+package wire
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// frame is a length prefix and what follows it, length being what the prefix says however much follows.
+func frame(length uint32, rest ...[]byte) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, length)
+	for _, r := range rest {
+		b = append(b, r...)
+	}
+	return b
+}
+
+func TestAppends(t *testing.T) {
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	appends := []Append{
+		{Id: 1, Attributes: map[string]string{"stream": "orders", "meta.k": "v", TokenAttribute: "t"},
+			Body: []byte("one")},
+		{Id: 2, Attributes: map[string]string{}, Body: []byte("two")},
+		{Id: 1<<64 - 1, Attributes: map[string]string{"": ""}, Body: []byte{}},
+		{Id: 4, Attributes: map[string]string{"skipped": "yes"}, Body: bytes.Repeat([]byte("x"), 100*1024)},
+		{Id: 5, Attributes: map[string]string{"type": "last"}, Body: []byte("five")},
+	}
+	for _, a := range appends {
+		if err := WriteAppend(w, a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Flush()
+
+	r := bufio.NewReader(&b)
+	for _, expected := range appends[:3] {
+		a, err := ReadAppend(r)
+		if err != nil || !reflect.DeepEqual(a, expected) {
+			t.Fatalf("Expected %+v, got %+v, %v", expected, a, err)
+		}
+	}
+	// A body that's skipped leaves the next frame to be read
+	a, size, err := ReadAppendHeader(r)
+	if err != nil || a.Id != 4 || a.Attributes["skipped"] != "yes" || a.Body != nil || size != 100*1024 {
+		t.Fatalf("Expected the header of append 4, got %+v, %d, %v", a, size, err)
+	}
+	if err = DiscardBody(r, size); err != nil {
+		t.Fatal(err)
+	}
+	if a, err = ReadAppend(r); err != nil || !reflect.DeepEqual(a, appends[4]) {
+		t.Fatalf("Expected %+v, got %+v, %v", appends[4], a, err)
+	}
+	if _, err = ReadAppend(r); err != io.EOF {
+		t.Fatalf("Expected EOF at the end, got %v", err)
+	}
+
+	if err = WriteAppend(w, Append{Attributes: map[string]string{"a": strings.Repeat("a", MaxAttributesSize/2),
+		"b": strings.Repeat("b", MaxAttributesSize/2)}}); err == nil {
+		t.Fatal("Expected attributes bigger than MaxAttributesSize to be refused")
+	}
+	if err = WriteAppend(w, Append{Body: make([]byte, MaxFrameSize)}); err != ErrFrameTooBig {
+		t.Fatalf("Expected ErrFrameTooBig, got %v", err)
+	}
+}
+
+func TestAcks(t *testing.T) {
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	acks := []Ack{
+		{Kind: FrameAssigned, Id: 1, Sequence: 10},
+		{Kind: FrameDurable, Id: 1, Sequence: 10},
+		{Kind: FrameError, Id: 2, Code: 422, Message: "bad body"},
+		{Kind: FrameError, Id: 3, Code: 500},
+	}
+	for _, ack := range acks {
+		WriteAck(w, ack)
+	}
+	w.Flush()
+
+	r := bufio.NewReader(&b)
+	for _, expected := range acks {
+		ack, err := ReadAck(r)
+		if err != nil || ack != expected {
+			t.Fatalf("Expected %+v, got %+v, %v", expected, ack, err)
+		}
+	}
+	if _, err := ReadAck(r); err != io.EOF {
+		t.Fatalf("Expected EOF at the end, got %v", err)
+	}
+}
+
+func TestBadFrames(t *testing.T) {
+	header := []byte{FrameAppend, 0, 0, 0, 0, 0, 0, 0, 1}
+	for _, test := range []struct {
+		name  string
+		frame []byte
+		err   error
+	}{
+		{"too big", frame(MaxFrameSize + 1), ErrFrameTooBig},
+		{"empty", frame(0), nil},
+		{"not an append", frame(17, []byte{FrameAssigned}, make([]byte, 16)), nil},
+		{"truncated header", frame(11, header), io.ErrUnexpectedEOF},
+		{"truncated attribute", frame(13, header, []byte{0, 1, 0, 5}), errTruncated},
+		{"attribute past the frame", frame(20, header, []byte{0, 1, 0, 20}, make([]byte, 20)), errTruncated},
+		{"attributes too big", frame(MaxFrameSize, header, []byte{0, 2, 0xff, 0xff}, make([]byte, 0xffff),
+			[]byte{0xff, 0xff}, make([]byte, 0xffff)), errTruncated},
+		{"truncated body", frame(MaxFrameSize, header, []byte{0, 0}, []byte("body")), io.ErrUnexpectedEOF},
+	} {
+		// A frame's length is taken as no more than the most it could be, what's held is what's been sent
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, err := ReadAppend(bufio.NewReader(bytes.NewReader(test.frame)))
+		runtime.ReadMemStats(&after)
+		if err == nil || test.err != nil && err != test.err {
+			t.Fatalf("Expected %s to be %v, got %v", test.name, test.err, err)
+		}
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 4*1024*1024 {
+			t.Fatalf("Expected %s to allocate what was sent, it allocated %db", test.name, allocated)
+		}
+	}
+
+	truncated := frame(MaxFrameSize, []byte{FrameError})
+	if _, err := ReadAck(bufio.NewReader(bytes.NewReader(truncated))); err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected a truncated ack to be io.ErrUnexpectedEOF, got %v", err)
+	}
+	if err := DiscardBody(bufio.NewReader(strings.NewReader("abc")), 4); err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected a truncated body to be io.ErrUnexpectedEOF, got %v", err)
+	}
+}